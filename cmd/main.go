@@ -4,10 +4,10 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"github.com/SystemBuilders/KeyValueStore/internal/indexer/art"
 	"github.com/SystemBuilders/KeyValueStore/internal/indexer/map"
 	"github.com/SystemBuilders/KeyValueStore/internal/indexer/sst"
 	"log"
-	"time"
 
 	"github.com/SystemBuilders/KeyValueStore/internal/indexer"
 
@@ -19,8 +19,11 @@ func main() {
 	var (
 		appendOnlyStorageFlag = flag.Bool("appendOnlyStorage",false, "--appendOnlyStorage=true")
 		sstStorageFlag = flag.Bool("sstStorage", false, "--sstStorage=true")
+		btreeStorageFlag = flag.Bool("btreeStorage", false, "--btreeStorage=true")
+		memoryStorageFlag = flag.Bool("memoryStorage", false, "--memoryStorage=true")
 		mapIndexerFlag = flag.Bool("map", false, "--map=true")
 		sstIndexerFlag = flag.Bool("sst", false, "--sst=true")
+		artIndexerFlag = flag.Bool("art", false, "--art=true")
 	)
 
 	flag.Parse()
@@ -28,122 +31,130 @@ func main() {
 
 	ctx := context.Background()
 
-	if *appendOnlyStorageFlag {
+	// The append-only storage is used unless another one
+	// is asked for.
+	switch {
+	case *appendOnlyStorageFlag:
 		ctx = context.WithValue(ctx,"storage","append")
-	} else if *sstStorageFlag {
+	case *sstStorageFlag:
 		ctx = context.WithValue(ctx,"storage","sst")
+	case *btreeStorageFlag:
+		ctx = context.WithValue(ctx,"storage","btree")
+	case *memoryStorageFlag:
+		ctx = context.WithValue(ctx,"storage","memory")
+	default:
+		ctx = context.WithValue(ctx,"storage","append")
 	}
 
-	var idxr indexer.Indexer
+	var idxrGntr indexer.IndexerGenerator = _map.NewMapIndexerGenerator()
 
 	if *mapIndexerFlag {
-		idxr = _map.NewMapIndexer()
+		idxrGntr = _map.NewMapIndexerGenerator()
 	} else if *sstIndexerFlag {
-		idxr = sst.NewSSTableIndexer()
+		idxrGntr = sst.NewSSTableIndexerGenerator()
+	} else if *artIndexerFlag {
+		idxrGntr = art.NewARTIndexerGenerator()
 	}
 
-	idxr = sst.NewSSTableIndexer()
-
-	kv, err := database.NewKeyValueStore(ctx, idxr)
+	kv, err := database.NewKeyValueStore(ctx, idxrGntr)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer kv.Close()
 
-	err = kv.Insert("key", "value")
+	err = kv.Insert([]byte("key"), "value")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = kv.Insert("key", "value1")
+	err = kv.Insert([]byte("key"), "value1")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = kv.Insert("key", "value2")
+	err = kv.Insert([]byte("key"), "value2")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = kv.Insert("key", "value")
+	err = kv.Insert([]byte("key"), "value")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = kv.Insert("key", "value1")
+	err = kv.Insert([]byte("key"), "value1")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = kv.Insert("key", "value2")
+	err = kv.Insert([]byte("key"), "value2")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = kv.Insert("key", "valuenew")
+	err = kv.Insert([]byte("key"), "valuenew")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = kv.Insert("key", "value1new")
+	err = kv.Insert([]byte("key"), "value1new")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = kv.Insert("key", "value2new")
+	err = kv.Insert([]byte("key"), "value2new")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = kv.Insert("key", "valuenew")
+	err = kv.Insert([]byte("key"), "valuenew")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = kv.Insert("key", "value1new")
+	err = kv.Insert([]byte("key"), "value1new")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = kv.Insert("key0", "value2new")
+	err = kv.Insert([]byte("key0"), "value2new")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = kv.Insert("key", "valuenewer")
+	err = kv.Insert([]byte("key"), "valuenewer")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = kv.Insert("key", "value1newer")
+	err = kv.Insert([]byte("key"), "value1newer")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = kv.Insert("key", "value2newer")
+	err = kv.Insert([]byte("key"), "value2newer")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = kv.Insert("key", "valuenewer")
+	err = kv.Insert([]byte("key"), "valuenewer")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = kv.Insert("key", "value1newer")
+	err = kv.Insert([]byte("key"), "value1newer")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = kv.Insert("key", "value2newer")
+	err = kv.Insert([]byte("key"), "value2newer")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	data, err := kv.Query("key5")
+	data, err := kv.Query([]byte("key"))
 	if err != nil {
 		log.Fatal(err)
 	}
-	// TODO: Merging same keys issue to be solved.
-	time.Sleep(50000 * time.Second)
 	fmt.Println(data)
 }
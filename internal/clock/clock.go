@@ -0,0 +1,79 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a source of time, which the storage engines and
+// the filesystems read the time from and wait on, so that a
+// simulation can decide how time passes.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// Sleep blocks for the duration.
+	Sleep(d time.Duration)
+	// After returns a channel which receives the current
+	// time once the duration has passed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// Real is the clock of the operating system.
+var Real Clock = realClock{}
+
+// realClock passes everything through to package time.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Sim is a simulated clock, whose time only passes when
+// it's advanced or waited on. Waiting on it doesn't block
+// but moves its time forward by the duration waited for,
+// as if nothing else happened meanwhile.
+//
+// This is a race-safe type.
+type Sim struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+var _ (Clock) = (*Sim)(nil)
+
+// NewSim returns a simulated clock set to the time.
+func NewSim(start time.Time) *Sim {
+	return &Sim{now: start}
+}
+
+// Now returns the time of the clock.
+func (c *Sim) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Sleep advances the clock by the duration.
+func (c *Sim) Sleep(d time.Duration) {
+	c.Advance(d)
+}
+
+// After advances the clock by the duration and returns a
+// channel holding the time it's advanced to.
+func (c *Sim) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	ch <- c.Advance(d)
+	return ch
+}
+
+// Advance moves the clock forward by the duration, if it's
+// positive, and returns the time it's moved to.
+func (c *Sim) Advance(d time.Duration) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if d > 0 {
+		c.now = c.now.Add(d)
+	}
+	return c.now
+}
@@ -0,0 +1,31 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSim(t *testing.T) {
+	start := time.Unix(0, 0)
+	c := NewSim(start)
+	assert.Equal(t, start, c.Now())
+
+	c.Sleep(time.Second)
+	assert.Equal(t, start.Add(time.Second), c.Now())
+
+	got := <-c.After(time.Minute)
+	assert.Equal(t, start.Add(time.Second+time.Minute), got)
+	assert.Equal(t, got, c.Now())
+
+	// The clock never goes back.
+	assert.Equal(t, got, c.Advance(-time.Hour))
+}
+
+func TestReal(t *testing.T) {
+	before := time.Now()
+	Real.Sleep(time.Millisecond)
+	assert.True(t, Real.Now().Sub(before) >= time.Millisecond)
+	assert.False(t, (<-Real.After(time.Millisecond)).Before(before))
+}
@@ -0,0 +1,332 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	_map "github.com/SystemBuilders/KeyValueStore/internal/indexer/map"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/scheduler"
+	"github.com/SystemBuilders/KeyValueStore/internal/vfs"
+)
+
+const (
+	// crashKeys is the number of keys the crash workload
+	// writes to.
+	crashKeys = 16
+	// crashWorkloadOps is the largest number of writes and
+	// syncs the crash workload makes before a crash.
+	crashWorkloadOps = 60
+	// crashRecoveryOps is the largest number of operations
+	// of the filesystem a recovery is cut short after.
+	crashRecoveryOps = 100
+)
+
+// errInjected is the error of the operations the crash
+// harness makes fail.
+var errInjected = errors.New("injected fault")
+
+// crashHarness runs a workload on a store kept on a
+// FaultFS, which crashes at random points of it, and
+// checks what the store recovers after every crash.
+//
+// A write is known to be durable once a Sync after it
+// returns, and then it must survive every crash. Writes
+// made since the last Sync may or may not survive, along
+// with the write the crash failed.
+//
+// The recovery of the store may crash too, in which case
+// it's recovered again. With faults set, a write, sync or
+// rename of the filesystem fails at a random point of every
+// workload as well, and the call of the store it was made
+// for must fail. The store is then written to until the
+// crash as before.
+type crashHarness struct {
+	t           *testing.T
+	storageType string
+	seed        int64
+	opts        storage.Options
+	fs          *vfs.FaultFS
+	rand        *rand.Rand
+	faults      bool
+	// injected is the number of operations made to fail
+	// so far, counted atomically.
+	injected int64
+	// durable holds the value of every key as of the last
+	// Sync which returned. Keys without a value are left
+	// out.
+	durable map[string]string
+	// current holds the value of every key as of the last
+	// write which returned.
+	current map[string]string
+	// unsynced hold the values written to every key since
+	// the last Sync, with a nil value for a delete. These
+	// include the write the crash failed.
+	unsynced map[string][]*string
+}
+
+// newCrashHarness returns a harness for a store of the
+// storage type kept on a FaultFS with the options, whose
+// crashes are driven by the seed of the options.
+//
+// With faults set, the background work of the store is
+// only done by the calls the harness makes, which run it
+// on a manual scheduler once writes are held back, so that
+// every operation of the filesystem is made for one of the
+// calls.
+func newCrashHarness(t *testing.T, storageType string, fsOpts vfs.FaultOptions, faults bool) *crashHarness {
+	seed := fsOpts.Seed
+	fs := vfs.NewFaultFS(fsOpts)
+	opts := storage.DefaultOptions()
+	opts.Dir = "store"
+	opts.FS = fs
+	opts.MemtableSize = 512
+	opts.ValueThreshold = 64
+	if faults {
+		opts.NewScheduler = func(ctx context.Context, _ int) *scheduler.Scheduler {
+			return scheduler.NewManualScheduler(ctx)
+		}
+	}
+
+	return &crashHarness{
+		t:           t,
+		storageType: storageType,
+		seed:        seed,
+		opts:        opts,
+		fs:          fs,
+		rand:        rand.New(rand.NewSource(seed)),
+		faults:      faults,
+		durable:     make(map[string]string),
+		current:     make(map[string]string),
+		unsynced:    make(map[string][]*string),
+	}
+}
+
+// open creates the store on the filesystem of the harness.
+// Every other time, the filesystem crashes at a random
+// point of the recovery first, and the store is recovered
+// again until a recovery isn't cut short.
+func (h *crashHarness) open() *KeyValueStore {
+	ctx := context.WithValue(context.Background(), "storage", h.storageType)
+	for {
+		crash := h.rand.Intn(2) == 0
+		if crash {
+			h.fs.CrashAfter(1 + h.rand.Int63n(crashRecoveryOps))
+		}
+		kv, err := NewKeyValueStoreWithOptions(ctx, _map.NewMapIndexerGenerator(), h.opts)
+		h.fs.CrashAfter(0)
+		if !h.fs.Crashed() {
+			if err != nil {
+				h.t.Fatalf("seed %d: opening the store: %v", h.seed, err)
+			}
+			return kv
+		}
+
+		if err == nil {
+			kv.Close()
+		}
+		h.fs.Restart()
+	}
+}
+
+// run crashes the store the number of times, checking what
+// it recovers every time.
+func (h *crashHarness) run(crashes int) {
+	for i := 0; i < crashes; i++ {
+		kv := h.open()
+		h.check(kv, i)
+
+		if h.faults {
+			h.inject()
+		}
+		h.fs.CrashAfter(1 + h.rand.Int63n(20*crashWorkloadOps))
+		h.workload(kv, i)
+		if !h.fs.Crashed() {
+			h.fs.Crash()
+		}
+		h.fs.Inject(nil)
+
+		kv.Close()
+		h.fs.Restart()
+	}
+}
+
+// inject makes a write, sync or rename of the filesystem
+// at a random point of the workload fail.
+func (h *crashHarness) inject() {
+	left := 1 + h.rand.Intn(4*crashWorkloadOps)
+	h.fs.Inject(func(op vfs.Op, path string) error {
+		if op != vfs.OpWrite && op != vfs.OpSync && op != vfs.OpRename {
+			return nil
+		}
+		left--
+		if left != 0 {
+			return nil
+		}
+		atomic.AddInt64(&h.injected, 1)
+		return &os.PathError{Op: op.String(), Path: path, Err: errInjected}
+	})
+}
+
+// workload writes to the store and syncs it until the
+// filesystem crashes or enough is done. A call of the store
+// which an operation was made to fail for must fail.
+func (h *crashHarness) workload(kv *KeyValueStore, crash int) {
+	for i := 0; i < crashWorkloadOps; i++ {
+		injected := atomic.LoadInt64(&h.injected)
+		op, err := h.write(kv)
+		if err == nil && atomic.LoadInt64(&h.injected) > injected {
+			h.t.Fatalf("seed %d, crash %d: %s succeeded despite a failed operation", h.seed, crash, op)
+		}
+		if err != nil && h.fs.Crashed() {
+			return
+		}
+	}
+}
+
+// write makes a random write to the store, or syncs it,
+// and returns what it did.
+func (h *crashHarness) write(kv *KeyValueStore) (string, error) {
+	key := "key" + strconv.Itoa(h.rand.Intn(crashKeys))
+
+	switch n := h.rand.Intn(10); {
+	case n < 6:
+		// Some of the values are large enough to be kept
+		// in the value log.
+		value := strconv.Itoa(h.rand.Int()) + strings.Repeat("v", h.rand.Intn(2)*100)
+		h.unsynced[key] = append(h.unsynced[key], &value)
+		err := kv.Insert([]byte(key), value)
+		if err == nil {
+			h.current[key] = value
+		}
+		return "insert " + key + " " + describe(&value), err
+	case n < 8:
+		h.unsynced[key] = append(h.unsynced[key], nil)
+		err := kv.Delete([]byte(key))
+		if err == nil {
+			delete(h.current, key)
+		}
+		return "delete " + key, err
+	default:
+		err := kv.Sync()
+		if err == nil {
+			h.durable = copyValues(h.current)
+			h.unsynced = make(map[string][]*string)
+		}
+		return "sync", err
+	}
+}
+
+// check checks that the store recovered from the crash
+// holds every durable write, or a write made after it,
+// and returns nothing corrupt. What the store holds is
+// durable from then on.
+func (h *crashHarness) check(kv *KeyValueStore, crash int) {
+	recovered := make(map[string]string)
+	for i := 0; i < crashKeys; i++ {
+		key := "key" + strconv.Itoa(i)
+
+		var got *string
+		value, err := kv.Query([]byte(key))
+		if err == nil {
+			s, ok := value.(string)
+			if !ok {
+				h.t.Fatalf("seed %d, crash %d: %s holds %#v", h.seed, crash, key, value)
+			}
+			got = &s
+			recovered[key] = s
+		} else if err != storage.ErrDataNotFound {
+			h.t.Fatalf("seed %d, crash %d: querying %s: %v", h.seed, crash, key, err)
+		}
+
+		if !h.allowed(key, got) {
+			h.t.Fatalf("seed %d, crash %d: %s holds %s, expected %s or one of %s",
+				h.seed, crash, key, describe(got), describe(valueOf(h.durable, key)), describeAll(h.unsynced[key]))
+		}
+	}
+
+	h.durable = recovered
+	h.current = copyValues(recovered)
+	h.unsynced = make(map[string][]*string)
+}
+
+// allowed reports whether the key may hold the value after
+// a crash.
+func (h *crashHarness) allowed(key string, got *string) bool {
+	candidates := append([]*string{valueOf(h.durable, key)}, h.unsynced[key]...)
+	for _, c := range candidates {
+		if (c == nil && got == nil) || (c != nil && got != nil && *c == *got) {
+			return true
+		}
+	}
+	return false
+}
+
+// valueOf returns the value of the key, or nil.
+func valueOf(values map[string]string, key string) *string {
+	if value, ok := values[key]; ok {
+		return &value
+	}
+	return nil
+}
+
+// copyValues returns a copy of the values.
+func copyValues(values map[string]string) map[string]string {
+	c := make(map[string]string, len(values))
+	for key, value := range values {
+		c[key] = value
+	}
+	return c
+}
+
+// describe describes a value in a failure.
+func describe(value *string) string {
+	if value == nil {
+		return "nothing"
+	}
+	return strconv.Quote(*value)
+}
+
+// describeAll describes the values in a failure.
+func describeAll(values []*string) string {
+	var s []string
+	for _, value := range values {
+		s = append(s, describe(value))
+	}
+	return "[" + strings.Join(s, ", ") + "]"
+}
+
+func TestCrashConsistency(t *testing.T) {
+	for _, storageType := range []string{"append", "sst", "btree"} {
+		for _, tearWrites := range []bool{false, true} {
+			name := storageType + "/drop"
+			if tearWrites {
+				name = storageType + "/tear"
+			}
+
+			t.Run(name, func(t *testing.T) {
+				for seed := int64(0); seed < 10; seed++ {
+					fsOpts := vfs.FaultOptions{Seed: seed, TearWrites: tearWrites}
+					newCrashHarness(t, storageType, fsOpts, false).run(20)
+				}
+			})
+		}
+	}
+}
+
+func TestCrashConsistency_Faults(t *testing.T) {
+	for _, storageType := range []string{"append", "sst", "btree"} {
+		t.Run(storageType, func(t *testing.T) {
+			for seed := int64(0); seed < 10; seed++ {
+				fsOpts := vfs.FaultOptions{Seed: seed}
+				newCrashHarness(t, storageType, fsOpts, true).run(20)
+			}
+		})
+	}
+}
@@ -2,22 +2,28 @@ package database
 
 import (
 	"context"
-	"fmt"
 	"log"
+	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 
 	_map "github.com/SystemBuilders/KeyValueStore/internal/indexer/map"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage"
+	"github.com/SystemBuilders/KeyValueStore/internal/vfs"
 )
 
 func TestAppend(t *testing.T) {
 	ctx := context.Background()
 	ctx = context.WithValue(ctx, "storage", "append")
 	idxrGntr := _map.NewMapIndexerGenerator()
-	kv, err := NewKeyValueStore(ctx, idxrGntr)
+	opts := storage.DefaultOptions()
+	opts.Dir = t.TempDir()
+	kv, err := NewKeyValueStoreWithOptions(ctx, idxrGntr, opts)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer kv.Close()
 
 	insertCount := 0
 	for {
@@ -37,8 +43,9 @@ func TestAppend(t *testing.T) {
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	fmt.Println(data)
+	if data != "value929" {
+		t.Fatalf("expected %v, got %v", "value929", data)
+	}
 }
 
 // func BenchmarkMapIndexer(b *testing.B) {
@@ -128,3 +135,195 @@ func TestAppend(t *testing.T) {
 // 		b.Fatal(err)
 // 	}
 // }
+
+func TestDelete(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "storage", "append")
+	opts := storage.DefaultOptions()
+	opts.Dir = t.TempDir()
+	kv, err := NewKeyValueStoreWithOptions(ctx, _map.NewMapIndexerGenerator(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	err = kv.Insert([]byte("key"), "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = kv.Delete([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = kv.Query([]byte("key"))
+	if err != storage.ErrDataNotFound {
+		t.Fatalf("expected %v, got %v", storage.ErrDataNotFound, err)
+	}
+}
+
+// TestDefaultStorage ensures that a store whose context
+// names no storage engine is backed by a StorageV1, which
+// it's written to like any other engine.
+func TestDefaultStorage(t *testing.T) {
+	opts := storage.DefaultOptions()
+	opts.Dir = t.TempDir()
+	kv, err := NewKeyValueStoreWithOptions(context.Background(), _map.NewMapIndexerGenerator(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	if _, ok := kv.s.(*storage.StorageV1); !ok {
+		t.Fatalf("expected a StorageV1, got %T", kv.s)
+	}
+
+	err = kv.Insert([]byte("key"), "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := kv.Query([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "value" {
+		t.Fatalf("expected %v, got %v", "value", value)
+	}
+
+	err = kv.Delete([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = kv.Query([]byte("key"))
+	if err != storage.ErrDataNotFound {
+		t.Fatalf("expected %v, got %v", storage.ErrDataNotFound, err)
+	}
+}
+
+func TestBTreeStorage(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "storage", "btree")
+	opts := storage.DefaultOptions()
+	opts.Dir = t.TempDir()
+	kv, err := NewKeyValueStoreWithOptions(ctx, _map.NewMapIndexerGenerator(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	err = kv.Insert([]byte("key"), "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.Insert([]byte("key"), "value1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := kv.Query([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "value1" {
+		t.Fatalf("expected %v, got %v", "value1", value)
+	}
+
+	err = kv.Delete([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = kv.Query([]byte("key"))
+	if err != storage.ErrDataNotFound {
+		t.Fatalf("expected %v, got %v", storage.ErrDataNotFound, err)
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "storage", "memory")
+	opts := storage.DefaultOptions()
+	opts.MemoryCapacity = 64
+	kv, err := NewKeyValueStoreWithOptions(ctx, _map.NewMapIndexerGenerator(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	for i := 0; i < 10; i++ {
+		err = kv.Insert([]byte("key"+strconv.Itoa(i)), "value")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	value, err := kv.Query([]byte("key9"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "value" {
+		t.Fatalf("expected %v, got %v", "value", value)
+	}
+
+	// Only the most recently written key fits.
+	_, err = kv.Query([]byte("key0"))
+	if err != storage.ErrDataNotFound {
+		t.Fatalf("expected %v, got %v", storage.ErrDataNotFound, err)
+	}
+	if kv.Stats().Evictions != 9 {
+		t.Fatalf("expected %v evictions, got %v", 9, kv.Stats().Evictions)
+	}
+}
+
+func TestMemFS(t *testing.T) {
+	for _, storageType := range []string{"append", "sst", "btree"} {
+		t.Run(storageType, func(t *testing.T) {
+			ctx := context.WithValue(context.Background(), "storage", storageType)
+			opts := storage.DefaultOptions()
+			opts.Dir = filepath.Join(t.TempDir(), "store")
+			opts.FS = vfs.NewMemFS()
+			kv, err := NewKeyValueStoreWithOptions(ctx, _map.NewMapIndexerGenerator(), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 20; i++ {
+				err = kv.Insert([]byte("key"+strconv.Itoa(i)), "value"+strconv.Itoa(i))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = kv.Delete([]byte("key0"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = kv.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The store is created again from what it wrote
+			// to the filesystem, which is all in memory.
+			kv, err = NewKeyValueStoreWithOptions(ctx, _map.NewMapIndexerGenerator(), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer kv.Close()
+
+			value, err := kv.Query([]byte("key19"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value != "value19" {
+				t.Fatalf("expected %v, got %v", "value19", value)
+			}
+			_, err = kv.Query([]byte("key0"))
+			if err != storage.ErrDataNotFound {
+				t.Fatalf("expected %v, got %v", storage.ErrDataNotFound, err)
+			}
+
+			_, err = os.Stat(opts.Dir)
+			if !os.IsNotExist(err) {
+				t.Fatalf("the store was written to disk: %v", err)
+			}
+		})
+	}
+}
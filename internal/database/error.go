@@ -10,4 +10,21 @@ const (
 	// storage engine type.
 	ErrBadIndexerForEngine Error = "unsupported indexer for the storage engine type"
 	ErrUnsupported         Error = "unsupported feature for database"
+	// ErrNotStream indicates that the value of a key read with GetStream
+	// wasn't written with PutStream.
+	ErrNotStream Error = "the value wasn't written as a stream"
+	// ErrStreamValue indicates that the value of a key read with Query
+	// was written with PutStream, and must be read with GetStream.
+	ErrStreamValue Error = "the value was written as a stream"
+	// ErrStreamCorrupt indicates that a streamed value failed its
+	// integrity checks while it was read.
+	ErrStreamCorrupt Error = "the streamed value is corrupt"
+	// ErrStreamReplaced indicates that a streamed value was replaced or
+	// deleted while it was read.
+	ErrStreamReplaced Error = "the streamed value was replaced while it was read"
+	// ErrStreamClosed indicates a read from a closed stream.
+	ErrStreamClosed Error = "the stream is closed"
+	// ErrReservedKey indicates a write of a key starting with the prefix
+	// reserved for the chunks of streamed values.
+	ErrReservedKey Error = "the key is reserved for the chunks of streamed values"
 )
@@ -3,7 +3,7 @@ package database
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"strings"
 	"sync"
 
 	"github.com/SystemBuilders/KeyValueStore/internal/dataobject"
@@ -26,28 +26,77 @@ type KeyValueStore struct {
 	// create new indexers per segment on the fly instead
 	// of a global indexer per key value store.
 	idxrGntr indexer.IndexerGenerator
-	mu       *sync.Mutex
+	// mu serialises the writes which replace or delete a
+	// streamed value along with its chunks. The writes of
+	// the other keys only hold it for reading.
+	mu *sync.RWMutex
+	// pending holds the streams whose chunks are being put
+	// or deleted, by id, with the key each stream was put
+	// for. It's guarded by mu.
+	pending map[string][]byte
+	// streamed holds the keys whose values are streamed,
+	// with the streams describing them. It's guarded by mu.
+	streamed map[string]dataobject.StreamInfo
+	// chunkSize is the size of the chunks the values
+	// written with PutStream are split into.
+	chunkSize int
 }
 
 var _ Database = (*KeyValueStore)(nil)
 
-// NewKeyValueStore returns a new instance of a KV store.
+// NewKeyValueStore returns a new instance of a KV store
+// using the default storage options.
 func NewKeyValueStore(
 	ctx context.Context,
 	idxrGntr indexer.IndexerGenerator,
 ) (*KeyValueStore, error) {
+	return NewKeyValueStoreWithOptions(ctx, idxrGntr, storage.DefaultOptions())
+}
 
-	mu := sync.Mutex{}
-	s, err := storage.NewStorageV1(ctx, idxrGntr)
+// NewKeyValueStoreWithOptions returns a new instance of a
+// KV store whose storage is configured with the given
+// options.
+func NewKeyValueStoreWithOptions(
+	ctx context.Context,
+	idxrGntr indexer.IndexerGenerator,
+	opts storage.Options,
+) (*KeyValueStore, error) {
+
+	mu := sync.RWMutex{}
+	var (
+		s   storage.Storage
+		err error
+	)
+	switch ctx.Value("storage") {
+	case "sst":
+		s, err = storage.NewSSTStorage(ctx, idxrGntr, opts)
+	case "btree":
+		s, err = storage.NewBTreeStorage(ctx, opts)
+	case "memory":
+		s = storage.NewMemoryStorage(ctx, opts)
+	default:
+		s, err = storage.NewStorageV1(ctx, idxrGntr, opts)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	kvStore := &KeyValueStore{
-		ctx:      ctx,
-		s:        s,
-		idxrGntr: idxrGntr,
-		mu:       &mu,
+		ctx:       ctx,
+		s:         s,
+		idxrGntr:  idxrGntr,
+		mu:        &mu,
+		pending:   make(map[string][]byte),
+		streamed:  make(map[string]dataobject.StreamInfo),
+		chunkSize: defaultStreamChunkSize,
+	}
+
+	// The chunks a crash left behind are swept before the
+	// store is used.
+	err = kvStore.sweepStreams()
+	if err != nil {
+		s.Close()
+		return nil, err
 	}
 
 	return kvStore, nil
@@ -57,7 +106,16 @@ func NewKeyValueStore(
 //
 // Insert writes the data to the file, gets the location of the object
 // and finally indexes it into the provided indexer.
+//
+// A value of the key written with PutStream is replaced along with its
+// chunks. ErrReservedKey is returned for a key starting with the prefix
+// reserved for the chunks of streamed values.
 func (kv *KeyValueStore) Insert(key []byte, value interface{}) error {
+	err := checkKey(key)
+	if err != nil {
+		return err
+	}
+
 	// We append both the key and the value together as a
 	// dataObject type.
 	obj := dataobject.NewObject(key, value)
@@ -66,13 +124,18 @@ func (kv *KeyValueStore) Insert(key []byte, value interface{}) error {
 		return err
 	}
 
-	return kv.insert(key, data)
+	return kv.overwrite(key, func() error {
+		return kv.insert(key, data)
+	})
 }
 
 // Query returns the last appended Object type from the file, or
 // the encountered error.
 // Query uses the indexed value to get the object location and
 // uses the file API to query the data.
+//
+// ErrStreamValue is returned for a value written with PutStream,
+// which must be read with GetStream.
 func (kv *KeyValueStore) Query(key []byte) (interface{}, error) {
 	data, err := kv.s.Query(key)
 	if err != nil {
@@ -86,36 +149,104 @@ func (kv *KeyValueStore) Query(key []byte) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
+	if dbObj.Stream != nil {
+		return nil, ErrStreamValue
+	}
 
 	return dbObj.Value, nil
 }
 
-// Delete deletes all entries of the
+// Scan calls fn with the keys from start up to but not including
+// end and their values, in the order of the keys, until fn returns
+// false. A nil start scans from the first key and a nil end up to
+// the last one.
+//
+// Values written with PutStream are left out, and must be read with
+// GetStream. ErrUnsupported is returned if the backing storage can't
+// scan its keys in order, see storage.Scanner. The store mustn't be
+// written to from fn.
+func (kv *KeyValueStore) Scan(start, end []byte, fn func(key []byte, value interface{}) bool) error {
+	scanner, ok := kv.s.(storage.Scanner)
+	if !ok {
+		return ErrUnsupported
+	}
+
+	var decodeErr error
+	err := scanner.Scan(start, end, func(key []byte, data string) bool {
+		if strings.HasPrefix(string(key), streamKeyPrefix) {
+			return true
+		}
+
+		var dbObj dataobject.Object
+		decodeErr = json.Unmarshal([]byte(data), &dbObj)
+		if decodeErr != nil {
+			return false
+		}
+		if dbObj.Stream != nil {
+			return true
+		}
+		return fn(key, dbObj.Value)
+	})
+	if err != nil {
+		return err
+	}
+	return decodeErr
+}
+
+// Delete deletes all entries of the key from the store.
+//
+// Deleting a key which doesn't exist is not an error. The chunks of a
+// value written with PutStream are deleted along with it. Keys starting
+// with the prefix reserved for the chunks can't be deleted, and
+// ErrReservedKey is returned for them.
 func (kv *KeyValueStore) Delete(key []byte) error {
-	return ErrUnsupported
+	err := checkKey(key)
+	if err != nil {
+		return err
+	}
+
+	return kv.overwrite(key, func() error {
+		return kv.s.Delete(key)
+	})
 }
 
-// insert is a storage and indexer aware inserting method that
-// stores the key, value pair in the storage engine and indexes
-// into the appropriate indexer.
-func (kv *KeyValueStore) insert(key, data []byte) error {
+// Sync commits everything written to the store so far
+// to disk. Writes are only known to survive a crash of
+// the machine once a Sync after them returns.
+func (kv *KeyValueStore) Sync() error {
+	return kv.s.Sync()
+}
 
-	switch kv.ctx.Value("storage") {
-	case "append":
-		// TODO: Need a wrapper function here that'll append based
-		// on the ctx of the KV Store.
+// Stats returns the statistics of the backing storage
+// of the store.
+func (kv *KeyValueStore) Stats() storage.Stats {
+	return kv.s.Stats()
+}
 
-		err := kv.s.Append(key, data)
-		if err != nil {
-			return err
-		}
-	case "sst":
-	default:
-		fmt.Println(kv.ctx.Value("storage"))
-		return ErrBadIndexerForEngine
-	}
+// PauseBackgroundWork stops the backing storage from
+// starting any more flushes or compactions until
+// ResumeBackgroundWork is called.
+func (kv *KeyValueStore) PauseBackgroundWork() {
+	kv.s.PauseBackgroundWork()
+}
 
-	return nil
+// ResumeBackgroundWork lets the backing storage start
+// background work again.
+func (kv *KeyValueStore) ResumeBackgroundWork() {
+	kv.s.ResumeBackgroundWork()
+}
+
+// Close stops the background work of the store and
+// closes its backing storage.
+func (kv *KeyValueStore) Close() error {
+	return kv.s.Close()
+}
+
+// insert stores the key, value pair in the backing storage
+// of the store, whichever engine it is, which indexes it
+// into the appropriate indexer.
+func (kv *KeyValueStore) insert(key, data []byte) error {
+	return kv.s.Append(key, data)
 }
 
 /*
@@ -0,0 +1,92 @@
+package database
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+
+	_map "github.com/SystemBuilders/KeyValueStore/internal/indexer/map"
+	"github.com/SystemBuilders/KeyValueStore/internal/linearizability"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage"
+	"github.com/SystemBuilders/KeyValueStore/internal/vfs"
+)
+
+const (
+	// linearizabilityClients is the number of clients
+	// using the store at once.
+	linearizabilityClients = 6
+	// linearizabilityKeys is the number of keys the
+	// clients share.
+	linearizabilityKeys = 4
+	// linearizabilityOps is the number of operations every
+	// client makes.
+	linearizabilityOps = 150
+)
+
+// TestLinearizability runs clients inserting, deleting and
+// querying a few shared keys of every storage at once, while
+// it flushes, merges and compacts in the background, and
+// checks that what the queries read is linearizable.
+func TestLinearizability(t *testing.T) {
+	for _, storageType := range []string{"append", "sst", "btree", "memory"} {
+		t.Run(storageType, func(t *testing.T) {
+			opts := storage.DefaultOptions()
+			opts.Dir = "store"
+			opts.FS = vfs.NewMemFS()
+			opts.MemtableSize = 256
+			opts.ValueThreshold = 64
+			opts.GarbageRatioThreshold = 0.3
+
+			ctx := context.WithValue(context.Background(), "storage", storageType)
+			kv, err := NewKeyValueStoreWithOptions(ctx, _map.NewMapIndexerGenerator(), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer kv.Close()
+
+			r := linearizability.NewRecorder(kv)
+			var wg sync.WaitGroup
+			for c := 0; c < linearizabilityClients; c++ {
+				wg.Add(1)
+				go func(c int) {
+					defer wg.Done()
+					rnd := rand.New(rand.NewSource(int64(c)))
+					for i := 0; i < linearizabilityOps; i++ {
+						key := []byte("key" + strconv.Itoa(rnd.Intn(linearizabilityKeys)))
+
+						var err error
+						switch n := rnd.Intn(10); {
+						case n < 4:
+							// Some of the values are large enough to be
+							// kept in the value log.
+							value := strconv.Itoa(c) + "-" + strconv.Itoa(i)
+							if rnd.Intn(2) == 0 {
+								value += strconv.Itoa(rnd.Int()) + strconv.Itoa(rnd.Int()) + strconv.Itoa(rnd.Int())
+							}
+							err = r.Insert(c, key, value)
+						case n < 5:
+							err = r.Delete(c, key)
+						default:
+							_, err = r.Query(c, key)
+							if err == storage.ErrDataNotFound {
+								err = nil
+							}
+						}
+						if err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}(c)
+			}
+			wg.Wait()
+
+			err = linearizability.Check(r.History())
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,377 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/clock"
+	_map "github.com/SystemBuilders/KeyValueStore/internal/indexer/map"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/scheduler"
+	"github.com/SystemBuilders/KeyValueStore/internal/vfs"
+)
+
+const (
+	// modelKeys is the number of keys the model workload
+	// uses.
+	modelKeys = 12
+	// modelOps is the number of operations of a model
+	// workload.
+	modelOps = 300
+)
+
+// modelOpKind is the kind of an operation of a model
+// workload.
+type modelOpKind int
+
+const (
+	modelInsert modelOpKind = iota
+	modelDelete
+	modelQuery
+	modelScan
+	// modelBackground runs the flushes, merges and
+	// compactions queued so far.
+	modelBackground
+	// modelReopen closes the store and opens it again.
+	modelReopen
+)
+
+// modelOp is an operation of a model workload.
+type modelOp struct {
+	kind  modelOpKind
+	key   string
+	value string
+	// start and end bound a scan, where an empty string
+	// leaves it unbounded.
+	start, end string
+}
+
+func (op modelOp) String() string {
+	switch op.kind {
+	case modelInsert:
+		return "insert " + op.key + " " + strconv.Quote(op.value)
+	case modelDelete:
+		return "delete " + op.key
+	case modelQuery:
+		return "query " + op.key
+	case modelScan:
+		return "scan [" + op.start + ", " + op.end + ")"
+	case modelBackground:
+		return "run background work"
+	default:
+		return "reopen"
+	}
+}
+
+// modelKey returns a random key of the model workload.
+func modelKey(rnd *rand.Rand) string {
+	return "key" + strconv.Itoa(rnd.Intn(modelKeys))
+}
+
+// generateModelOps returns n random operations. Some of
+// the values are large enough to be kept in the value log.
+func generateModelOps(rnd *rand.Rand, n int) []modelOp {
+	ops := make([]modelOp, n)
+	for i := range ops {
+		switch k := rnd.Intn(100); {
+		case k < 40:
+			value := strconv.Itoa(rnd.Intn(1000)) + strings.Repeat("v", rnd.Intn(2)*100)
+			ops[i] = modelOp{kind: modelInsert, key: modelKey(rnd), value: value}
+		case k < 55:
+			ops[i] = modelOp{kind: modelDelete, key: modelKey(rnd)}
+		case k < 75:
+			ops[i] = modelOp{kind: modelQuery, key: modelKey(rnd)}
+		case k < 85:
+			op := modelOp{kind: modelScan}
+			if rnd.Intn(2) == 0 {
+				op.start = modelKey(rnd)
+			}
+			if rnd.Intn(2) == 0 {
+				op.end = modelKey(rnd)
+			}
+			ops[i] = op
+		case k < 97:
+			ops[i] = modelOp{kind: modelBackground}
+		default:
+			ops[i] = modelOp{kind: modelReopen}
+		}
+	}
+	return ops
+}
+
+// modelStore is a store run alongside a map holding what
+// it's expected to hold.
+type modelStore struct {
+	storageType string
+	opts        storage.Options
+	kv          *KeyValueStore
+	// scheduler is the scheduler of the store last opened,
+	// which only runs background work when asked to.
+	scheduler *scheduler.Scheduler
+	// model holds the value of every key in the store.
+	model map[string]string
+}
+
+// newModelStore returns a store of the storage type, kept
+// in memory with segments and memtables small enough for
+// a workload to fill many of them.
+func newModelStore(storageType string) (*modelStore, error) {
+	c := clock.NewSim(time.Unix(0, 0))
+	ms := &modelStore{
+		storageType: storageType,
+		opts:        storage.DefaultOptions(),
+		model:       make(map[string]string),
+	}
+	ms.opts.Dir = "store"
+	ms.opts.FS = vfs.NewMemFSWithClock(c)
+	ms.opts.Clock = c
+	ms.opts.MemtableSize = 256
+	ms.opts.ValueThreshold = 64
+	ms.opts.GarbageRatioThreshold = 0.3
+	ms.opts.Seed = 1
+	ms.opts.NewScheduler = func(ctx context.Context, _ int) *scheduler.Scheduler {
+		ms.scheduler = scheduler.NewManualScheduler(ctx)
+		return ms.scheduler
+	}
+	return ms, ms.open()
+}
+
+// open opens the store.
+func (ms *modelStore) open() error {
+	ctx := context.WithValue(context.Background(), "storage", ms.storageType)
+	kv, err := NewKeyValueStoreWithOptions(ctx, _map.NewMapIndexerGenerator(), ms.opts)
+	ms.kv = kv
+	return err
+}
+
+// apply applies the operation to the store and the model,
+// and returns an error if the store doesn't do what the
+// model does.
+func (ms *modelStore) apply(op modelOp) error {
+	switch op.kind {
+	case modelInsert:
+		ms.model[op.key] = op.value
+		return ms.kv.Insert([]byte(op.key), op.value)
+	case modelDelete:
+		delete(ms.model, op.key)
+		return ms.kv.Delete([]byte(op.key))
+	case modelQuery:
+		return ms.query(op.key)
+	case modelScan:
+		return ms.scan(op.start, op.end)
+	case modelBackground:
+		if ms.scheduler != nil {
+			ms.scheduler.Wait()
+			return ms.scheduler.Err()
+		}
+		return nil
+	default:
+		// A MemoryStorage loses its data once it's closed.
+		if ms.storageType == "memory" {
+			return nil
+		}
+		err := ms.kv.Close()
+		if err != nil {
+			return err
+		}
+		return ms.open()
+	}
+}
+
+// query checks that the key holds the value of the model.
+func (ms *modelStore) query(key string) error {
+	value, err := ms.kv.Query([]byte(key))
+	want, ok := ms.model[key]
+	if !ok {
+		if err != storage.ErrDataNotFound {
+			return fmt.Errorf("expected %v, got %v, %v", storage.ErrDataNotFound, value, err)
+		}
+		return nil
+	}
+	if err != nil || value != want {
+		return fmt.Errorf("expected %q, got %v, %v", want, value, err)
+	}
+	return nil
+}
+
+// scan checks that scanning the keys within the bounds
+// finds the keys and values of the model in order.
+func (ms *modelStore) scan(start, end string) error {
+	var from, to []byte
+	if start != "" {
+		from = []byte(start)
+	}
+	if end != "" {
+		to = []byte(end)
+	}
+
+	var got []string
+	err := ms.kv.Scan(from, to, func(key []byte, value interface{}) bool {
+		got = append(got, fmt.Sprintf("%s=%v", key, value))
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	for key := range ms.model {
+		if (start == "" || key >= start) && (end == "" || key < end) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var want []string
+	for _, key := range keys {
+		want = append(want, key+"="+ms.model[key])
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		return fmt.Errorf("expected %v, got %v", want, got)
+	}
+	return nil
+}
+
+// runModelOps runs the operations on a new store of the
+// storage type and returns an error describing the first
+// one the store and the model disagree on.
+func runModelOps(storageType string, ops []modelOp) error {
+	ms, err := newModelStore(storageType)
+	if err != nil {
+		return fmt.Errorf("opening the store: %v", err)
+	}
+	defer func() {
+		if ms.kv != nil {
+			ms.kv.Close()
+		}
+	}()
+
+	for i, op := range ops {
+		err := ms.apply(op)
+		if err != nil {
+			return fmt.Errorf("operation %d, %s: %v", i, op, err)
+		}
+	}
+	return nil
+}
+
+// shrinkModelOps returns a smallest sequence of the
+// operations, found by removing ever smaller runs of them,
+// for which fails still reports a failure. Removing any
+// single operation from it makes the failure go away.
+func shrinkModelOps(ops []modelOp, fails func([]modelOp) bool) []modelOp {
+	for size := len(ops) / 2; size >= 1; {
+		removed := false
+		for i := 0; i+size <= len(ops); {
+			candidate := append(append([]modelOp(nil), ops[:i]...), ops[i+size:]...)
+			if fails(candidate) {
+				ops = candidate
+				removed = true
+			} else {
+				i += size
+			}
+		}
+
+		// Removing an operation may let one before it go
+		// too, so single operations are tried again until
+		// none of them can be removed.
+		if size > 1 || !removed {
+			size /= 2
+		}
+	}
+	return ops
+}
+
+// describeModelOps lists the operations, one per line.
+func describeModelOps(ops []modelOp) string {
+	var s strings.Builder
+	for _, op := range ops {
+		s.WriteString("\t" + op.String() + "\n")
+	}
+	return s.String()
+}
+
+// TestModel runs random operations on every storage and on
+// a map alongside it, across many segment rollovers, flushes,
+// merges and compactions, and checks that they agree. A
+// failing sequence is shrunk to a minimal reproduction.
+func TestModel(t *testing.T) {
+	for _, storageType := range []string{"append", "sst", "btree", "memory"} {
+		t.Run(storageType, func(t *testing.T) {
+			for seed := int64(0); seed < 20; seed++ {
+				ops := generateModelOps(rand.New(rand.NewSource(seed)), modelOps)
+				err := runModelOps(storageType, ops)
+				if err == nil {
+					continue
+				}
+
+				minimal := shrinkModelOps(ops, func(ops []modelOp) bool {
+					return runModelOps(storageType, ops) != nil
+				})
+				t.Fatalf("seed %d: %v\nminimal reproduction, %d of %d operations:\n%sfailing with: %v",
+					seed, err, len(minimal), len(ops), describeModelOps(minimal), runModelOps(storageType, minimal))
+			}
+		})
+	}
+}
+
+// TestShrinkModelOps ensures that shrinking keeps only the
+// operations the failure depends on.
+func TestShrinkModelOps(t *testing.T) {
+	ops := generateModelOps(rand.New(rand.NewSource(1)), modelOps)
+	ops = append(ops, modelOp{kind: modelInsert, key: "key0", value: "bad"})
+	ops = append(ops, generateModelOps(rand.New(rand.NewSource(2)), modelOps)...)
+
+	// The failure is an insert of a bad value followed by
+	// any scan.
+	fails := func(ops []modelOp) bool {
+		inserted := false
+		for _, op := range ops {
+			if op.kind == modelInsert && op.value == "bad" {
+				inserted = true
+			}
+			if inserted && op.kind == modelScan {
+				return true
+			}
+		}
+		return false
+	}
+
+	minimal := shrinkModelOps(ops, fails)
+	if len(minimal) != 2 || minimal[0].value != "bad" || minimal[1].kind != modelScan {
+		t.Fatalf("expected the bad insert and a scan, got:\n%s", describeModelOps(minimal))
+	}
+
+	// The query of key0 can only be removed once the
+	// delete after it is, which a single pass over the
+	// operations misses.
+	ops = []modelOp{
+		{kind: modelQuery, key: "key0"},
+		{kind: modelDelete, key: "key0"},
+		{kind: modelInsert, key: "key0", value: "bad"},
+	}
+	fails = func(ops []modelOp) bool {
+		var queried, deleted, inserted bool
+		for _, op := range ops {
+			switch op.kind {
+			case modelQuery:
+				queried = true
+			case modelDelete:
+				deleted = true
+			case modelInsert:
+				inserted = true
+			}
+		}
+		return inserted && (queried || !deleted)
+	}
+
+	minimal = shrinkModelOps(ops, fails)
+	if len(minimal) != 1 || minimal[0].value != "bad" {
+		t.Fatalf("expected only the bad insert, got:\n%s", describeModelOps(minimal))
+	}
+}
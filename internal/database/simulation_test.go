@@ -0,0 +1,222 @@
+package database
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/clock"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/scheduler"
+	"github.com/SystemBuilders/KeyValueStore/internal/vfs"
+)
+
+// simSeed replays a single seed of the simulation, as
+// reported by a failure.
+var simSeed = flag.Int64("sim.seed", -1, "run the simulation with this seed only")
+
+// simSteps is the number of steps of a simulation.
+const simSteps = 400
+
+// simStart is the time the clock of a simulation starts at.
+var simStart = time.Unix(0, 0)
+
+// simulation runs a store with everything it depends on
+// under the control of a seed: its files are kept on a
+// FaultFS, time is kept by a simulated clock and its
+// background work is run by a manual scheduler, which the
+// simulation runs the jobs of itself. The same seed thus
+// makes the store go through the same writes, flushes,
+// compactions and crashes, and end up with the same files.
+//
+// What the store holds is checked as in the crash harness
+// after every crash, and against the writes made so far
+// by every query in between.
+type simulation struct {
+	*crashHarness
+	clock *clock.Sim
+	// scheduler is the scheduler of the store last opened.
+	scheduler *scheduler.Scheduler
+	// trace records every step and its outcome.
+	trace []string
+}
+
+// newSimulation returns a simulation of a store of the
+// storage type driven by the seed.
+func newSimulation(t *testing.T, storageType string, seed int64) *simulation {
+	c := clock.NewSim(simStart)
+	sim := &simulation{
+		crashHarness: newCrashHarness(t, storageType, vfs.FaultOptions{
+			Seed:       seed,
+			TearWrites: seed%2 == 1,
+			Clock:      c,
+		}, false),
+		clock: c,
+	}
+	sim.opts.Clock = c
+	sim.opts.Seed = seed + 1
+	sim.opts.SoftSegmentLimit = 4
+	sim.opts.HardSegmentLimit = 8
+	sim.opts.CompactionRateLimit = 1 << 16
+	sim.opts.NewScheduler = func(ctx context.Context, _ int) *scheduler.Scheduler {
+		sim.scheduler = scheduler.NewManualScheduler(ctx)
+		return sim.scheduler
+	}
+	return sim
+}
+
+// run runs the simulation for the number of steps and
+// returns its trace.
+func (sim *simulation) run(steps int) []string {
+	kv := sim.open()
+	crashes := 0
+	for i := 0; i < steps; i++ {
+		var (
+			step string
+			err  error
+		)
+		switch n := sim.rand.Intn(100); {
+		case n < 50:
+			step, err = sim.write(kv)
+		case n < 65:
+			step, err = sim.query(kv)
+		case n < 85:
+			queued := sim.scheduler.Queued()
+			if len(queued) == 0 {
+				continue
+			}
+			name := queued[sim.rand.Intn(len(queued))]
+			sim.scheduler.Run(name)
+			step, err = "run "+name, sim.scheduler.Err()
+		case n < 95:
+			d := time.Duration(sim.rand.Intn(100)) * time.Millisecond
+			sim.clock.Advance(d)
+			step = "advance " + d.String()
+		default:
+			// The crash lands in one of the next operations
+			// on the files, possibly one of the background
+			// work.
+			ops := 1 + sim.rand.Int63n(100)
+			sim.fs.CrashAfter(ops)
+			step = "crash after " + strconv.FormatInt(ops, 10)
+		}
+		sim.trace = append(sim.trace, fmt.Sprintf("%s: %v (at %v)", step, err, sim.clock.Now().Sub(simStart)))
+
+		if sim.fs.Crashed() {
+			kv.Close()
+			sim.fs.Restart()
+			kv = sim.open()
+			sim.check(kv, crashes)
+			crashes++
+			sim.trace = append(sim.trace, "recovered")
+		}
+	}
+
+	sim.fs.CrashAfter(0)
+	err := kv.Close()
+	if err != nil && !sim.fs.Crashed() {
+		sim.t.Fatalf("seed %d: closing the store: %v", sim.seed, err)
+	}
+	return append(sim.trace, sim.files("store")...)
+}
+
+// query queries a random key of the store and checks that
+// it holds the value last written to it, unless the FS
+// crashed meanwhile.
+func (sim *simulation) query(kv *KeyValueStore) (string, error) {
+	key := "key" + strconv.Itoa(sim.rand.Intn(crashKeys))
+	step := "query " + key
+
+	var got *string
+	value, err := kv.Query([]byte(key))
+	if sim.fs.Crashed() {
+		return step, err
+	}
+	if err == nil {
+		s, ok := value.(string)
+		if !ok {
+			sim.t.Fatalf("seed %d: %s holds %#v", sim.seed, key, value)
+		}
+		got = &s
+	} else if err != storage.ErrDataNotFound {
+		sim.t.Fatalf("seed %d: querying %s: %v", sim.seed, key, err)
+	}
+
+	want := valueOf(sim.current, key)
+	if describe(got) != describe(want) {
+		sim.t.Fatalf("seed %d: %s holds %s, expected %s", sim.seed, key, describe(got), describe(want))
+	}
+	return step + " " + describe(got), nil
+}
+
+// files lists the files under the directory along with
+// their sizes and times.
+func (sim *simulation) files(dir string) []string {
+	infos, err := sim.fs.ReadDir(dir)
+	if err != nil {
+		sim.t.Fatalf("seed %d: listing %s: %v", sim.seed, dir, err)
+	}
+
+	var files []string
+	for _, info := range infos {
+		name := path.Join(dir, info.Name())
+		if info.IsDir() {
+			files = append(files, sim.files(name)...)
+			continue
+		}
+		files = append(files, fmt.Sprintf("%s %d %d", name, info.Size(), info.ModTime().UnixNano()))
+	}
+	return files
+}
+
+// simulationSeeds returns the seeds to simulate, which
+// are those up to n unless -sim.seed is set.
+func simulationSeeds(n int64) []int64 {
+	if *simSeed >= 0 {
+		return []int64{*simSeed}
+	}
+	seeds := make([]int64, n)
+	for i := range seeds {
+		seeds[i] = int64(i)
+	}
+	return seeds
+}
+
+// TestSimulation runs the simulation on every storage with
+// background work. A failing seed is reported and can be
+// replayed alone with -sim.seed.
+func TestSimulation(t *testing.T) {
+	for _, storageType := range []string{"append", "sst"} {
+		t.Run(storageType, func(t *testing.T) {
+			for _, seed := range simulationSeeds(20) {
+				newSimulation(t, storageType, seed).run(simSteps)
+			}
+		})
+	}
+}
+
+// TestSimulation_Deterministic ensures that a simulation
+// run twice with the same seed goes through the same steps
+// and leaves the same files behind.
+func TestSimulation_Deterministic(t *testing.T) {
+	for _, storageType := range []string{"append", "sst"} {
+		t.Run(storageType, func(t *testing.T) {
+			for _, seed := range simulationSeeds(5) {
+				first := newSimulation(t, storageType, seed).run(simSteps)
+				second := newSimulation(t, storageType, seed).run(simSteps)
+				for i := 0; i < len(first) && i < len(second); i++ {
+					if first[i] != second[i] {
+						t.Fatalf("seed %d: the runs differ at step %d: %s, then %s", seed, i, first[i], second[i])
+					}
+				}
+				if len(first) != len(second) {
+					t.Fatalf("seed %d: the runs took %d and %d steps", seed, len(first), len(second))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,514 @@
+package database
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/dataobject"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage"
+)
+
+const (
+	// defaultStreamChunkSize is the size of the chunks the
+	// values written with PutStream are split into.
+	defaultStreamChunkSize = 1 << 20
+	// streamKeyPrefix starts the keys of the chunks of
+	// streamed values. Keys starting with it are reserved.
+	streamKeyPrefix = "\x00stream\x00"
+	// pendingStreamsKey is the key of the object listing
+	// the pending streams.
+	pendingStreamsKey = streamKeyPrefix + "pending"
+	// streamedKeysKey is the key of the object listing the
+	// keys whose values are streamed.
+	streamedKeysKey = streamKeyPrefix + "keys"
+)
+
+// streamChunkHeaderSize is the size of the header of a
+// chunk of a streamed value, which holds the CRC-32 of
+// the data of the chunk.
+const streamChunkHeaderSize = 4
+
+// PutStream stores the value read from r for the key
+// without holding all of it in memory.
+//
+// The value is split into chunks, which are stored as raw
+// objects of their own along with their checksums. Then
+// an object describing the stream, with the size and the
+// SHA-256 of the whole value, is stored for the key. This
+// is what replaces the previous value of the key, so a
+// failure to read from r or to store a chunk leaves the
+// key as it was.
+//
+// The stream is pending until the object describing it is
+// stored, and so is the previous value of the key until
+// its chunks are deleted. The chunks of the pending
+// streams which a crash left behind are swept when the
+// store is opened again.
+//
+// If the chunks of a stream which failed to be put can't
+// be deleted, the error deleting them is returned and the
+// stream stays pending, so that they're swept once the
+// store is opened again.
+//
+// The value is read back with GetStream. ErrReservedKey is
+// returned for a key starting with streamKeyPrefix.
+func (kv *KeyValueStore) PutStream(key []byte, r io.Reader) error {
+	err := checkKey(key)
+	if err != nil {
+		return err
+	}
+
+	id, err := newStreamID()
+	if err != nil {
+		return err
+	}
+	err = kv.addPending(id, key)
+	if err != nil {
+		return err
+	}
+
+	var (
+		info = dataobject.StreamInfo{ID: id}
+		sum  = sha256.New()
+		buf  = make([]byte, kv.chunkSize)
+	)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sum.Write(buf[:n])
+			putErr := kv.putChunk(info.ID, info.Chunks, buf[:n])
+			if putErr != nil {
+				return kv.dropStream(info, putErr)
+			}
+			info.Chunks++
+			info.Size += int64(n)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return kv.dropStream(info, err)
+		}
+	}
+	info.Checksum = hex.EncodeToString(sum.Sum(nil))
+
+	data, err := json.Marshal(dataobject.NewStream(key, info))
+	if err != nil {
+		return kv.dropStream(info, err)
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	return kv.replaceStream(key, &info, func() error {
+		return kv.insert(key, data)
+	})
+}
+
+// GetStream returns a reader of the value stored for the
+// key with PutStream, which reads the value a chunk at a
+// time.
+//
+// The reader verifies the checksum of every chunk and the
+// size and SHA-256 of the whole value, and returns
+// ErrStreamCorrupt if any of them don't match. It returns
+// ErrStreamReplaced if the value of the key is replaced
+// before all of it is read.
+func (kv *KeyValueStore) GetStream(key []byte) (io.ReadCloser, error) {
+	data, err := kv.s.Query(key)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := dataobject.StreamOf([]byte(data))
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, ErrNotStream
+	}
+
+	return &streamReader{
+		kv:   kv,
+		info: *info,
+		sum:  sha256.New(),
+	}, nil
+}
+
+// streamReader reads a streamed value chunk by chunk.
+type streamReader struct {
+	kv   *KeyValueStore
+	info dataobject.StreamInfo
+	// next is the index of the next chunk to read.
+	next int64
+	// buf holds what's left to be read of the current
+	// chunk.
+	buf []byte
+	// sum and size are the SHA-256 and the size of the
+	// chunks read so far.
+	sum  hash.Hash
+	size int64
+	// err is the error every read returns once set.
+	err error
+}
+
+// Read reads the value into p, reading the next chunk
+// once the current one is read.
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.readChunk()
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Close stops the reader, after which reads return
+// ErrStreamClosed.
+func (r *streamReader) Close() error {
+	r.buf = nil
+	r.err = ErrStreamClosed
+	return nil
+}
+
+// readChunk reads the next chunk into buf, or verifies
+// the value and returns io.EOF once all the chunks are
+// read.
+func (r *streamReader) readChunk() error {
+	if r.next == r.info.Chunks {
+		if r.size != r.info.Size || hex.EncodeToString(r.sum.Sum(nil)) != r.info.Checksum {
+			return ErrStreamCorrupt
+		}
+		return io.EOF
+	}
+
+	data, err := r.kv.s.Query(streamChunkKey(r.info.ID, r.next))
+	if err == storage.ErrDataNotFound {
+		return ErrStreamReplaced
+	}
+	if err != nil {
+		return err
+	}
+
+	chunk, ok := dataobject.RawOf([]byte(data))
+	if !ok || len(chunk) < streamChunkHeaderSize {
+		return ErrStreamCorrupt
+	}
+	chunkData := chunk[streamChunkHeaderSize:]
+	if crc32.ChecksumIEEE(chunkData) != binary.BigEndian.Uint32(chunk) {
+		return ErrStreamCorrupt
+	}
+
+	r.sum.Write(chunkData)
+	r.size += int64(len(chunkData))
+	r.buf = chunkData
+	r.next++
+	return nil
+}
+
+// putChunk stores a chunk of the stream as a raw object,
+// the data of the chunk following its header.
+func (kv *KeyValueStore) putChunk(id string, index int64, data []byte) error {
+	chunk := make([]byte, streamChunkHeaderSize, streamChunkHeaderSize+len(data))
+	binary.BigEndian.PutUint32(chunk, crc32.ChecksumIEEE(data))
+	chunk = append(chunk, data...)
+	return kv.insert(streamChunkKey(id, index), dataobject.NewRaw(chunk))
+}
+
+// removeChunks deletes the chunks of the stream, from the
+// last to the first. The chunks are put from the first to
+// the last, so the chunks a crash leaves behind are always
+// the first ones of the stream either way.
+func (kv *KeyValueStore) removeChunks(info dataobject.StreamInfo) error {
+	for i := info.Chunks - 1; i >= 0; i-- {
+		err := kv.s.Delete(streamChunkKey(info.ID, i))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropStream deletes the chunks of a stream which failed
+// to be put with err, and stops it from being pending once
+// they're deleted. It returns err, or the error deleting
+// the chunks, in which case the stream stays pending.
+func (kv *KeyValueStore) dropStream(info dataobject.StreamInfo, err error) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	dropErr := kv.removeChunks(info)
+	if dropErr != nil {
+		return dropErr
+	}
+	delete(kv.pending, info.ID)
+	dropErr = kv.writePending()
+	if dropErr != nil {
+		return dropErr
+	}
+	return err
+}
+
+// overwrite replaces or deletes the value of the key with
+// write, deleting the chunks of the previous value of the
+// key along with it if it was streamed.
+//
+// Whether it was is looked up in the streamed keys, so the
+// values of the keys which aren't streamed are written
+// without being read first, alongside each other.
+func (kv *KeyValueStore) overwrite(key []byte, write func() error) error {
+	kv.mu.RLock()
+	_, streamed := kv.streamed[string(key)]
+	if !streamed {
+		defer kv.mu.RUnlock()
+		return write()
+	}
+	kv.mu.RUnlock()
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.replaceStream(key, nil, write)
+}
+
+// replaceStream replaces or deletes the value of the key
+// with write, then deletes the chunks of the previous value
+// of the key if it was streamed. next describes the stream
+// write puts for the key, if any, which stops being pending
+// once it's stored.
+//
+// The previous stream is made pending before it's
+// overwritten, so that its chunks are swept if a crash
+// cuts the deletion short, and so that the streamed keys
+// are worked out again for the key.
+//
+// It must be called with mu held.
+func (kv *KeyValueStore) replaceStream(key []byte, next *dataobject.StreamInfo, write func() error) error {
+	prev, streamed := kv.streamed[string(key)]
+	if streamed {
+		kv.pending[prev.ID] = key
+		err := kv.writePending()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := write()
+	if err != nil {
+		return err
+	}
+	if !streamed && next == nil {
+		return nil
+	}
+
+	if next != nil {
+		kv.streamed[string(key)] = *next
+	} else {
+		delete(kv.streamed, string(key))
+	}
+	err = kv.writeStreamed()
+	if err != nil {
+		return err
+	}
+
+	if streamed {
+		err = kv.removeChunks(prev)
+		if err != nil {
+			return err
+		}
+		delete(kv.pending, prev.ID)
+	}
+	if next != nil {
+		delete(kv.pending, next.ID)
+	}
+	return kv.writePending()
+}
+
+// addPending makes the stream being put for the key
+// pending.
+func (kv *KeyValueStore) addPending(id string, key []byte) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.pending[id] = key
+	return kv.writePending()
+}
+
+// writePending stores the pending streams, along with the
+// keys they were put for, and must be called with mu held.
+func (kv *KeyValueStore) writePending() error {
+	data, err := json.Marshal(dataobject.NewObject([]byte(pendingStreamsKey), kv.pending))
+	if err != nil {
+		return err
+	}
+	return kv.insert([]byte(pendingStreamsKey), data)
+}
+
+// writeStreamed stores the streamed keys, as the objects
+// describing their streams, and must be called with mu
+// held.
+func (kv *KeyValueStore) writeStreamed() error {
+	objs := make([]dataobject.Object, 0, len(kv.streamed))
+	for key, info := range kv.streamed {
+		objs = append(objs, dataobject.NewStream([]byte(key), info))
+	}
+
+	data, err := json.Marshal(dataobject.NewObject([]byte(streamedKeysKey), objs))
+	if err != nil {
+		return err
+	}
+	return kv.insert([]byte(streamedKeysKey), data)
+}
+
+// readStreamed loads the streamed keys stored by
+// writeStreamed.
+func (kv *KeyValueStore) readStreamed() error {
+	data, err := kv.s.Query([]byte(streamedKeysKey))
+	if err == storage.ErrDataNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var obj struct {
+		Value []struct {
+			Key    []byte
+			Stream dataobject.StreamInfo
+		}
+	}
+	err = json.Unmarshal([]byte(data), &obj)
+	if err != nil {
+		return err
+	}
+	for _, o := range obj.Value {
+		kv.streamed[string(o.Key)] = o.Stream
+	}
+	return nil
+}
+
+// sweepStreams loads the streamed keys once the store is
+// opened, and deletes the chunks of the pending streams
+// which aren't the value of the key they were put for,
+// which a crash left behind.
+//
+// The streamed keys may be out of date for the keys of the
+// pending streams, so the values of those keys are read to
+// tell whether they're streamed.
+//
+// The number of chunks left of a stream isn't known, so
+// they're counted from the first one until one is missing.
+func (kv *KeyValueStore) sweepStreams() error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	err := kv.readStreamed()
+	if err != nil {
+		return err
+	}
+
+	data, err := kv.s.Query([]byte(pendingStreamsKey))
+	if err == storage.ErrDataNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var obj struct {
+		Value map[string][]byte
+	}
+	err = json.Unmarshal([]byte(data), &obj)
+	if err != nil {
+		return err
+	}
+
+	for id, key := range obj.Value {
+		info, err := kv.streamOfKey(key)
+		if err != nil {
+			return err
+		}
+		if info != nil {
+			kv.streamed[string(key)] = *info
+		} else {
+			delete(kv.streamed, string(key))
+		}
+		if info != nil && info.ID == id {
+			continue
+		}
+
+		orphaned := dataobject.StreamInfo{ID: id}
+		for {
+			_, err := kv.s.Query(streamChunkKey(id, orphaned.Chunks))
+			if err == storage.ErrDataNotFound {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			orphaned.Chunks++
+		}
+		err = kv.removeChunks(orphaned)
+		if err != nil {
+			return err
+		}
+	}
+	if len(obj.Value) == 0 {
+		return nil
+	}
+
+	err = kv.writeStreamed()
+	if err != nil {
+		return err
+	}
+	return kv.writePending()
+}
+
+// streamOfKey returns the description of the value stored
+// for the key if it was streamed, or nil.
+func (kv *KeyValueStore) streamOfKey(key []byte) (*dataobject.StreamInfo, error) {
+	data, err := kv.s.Query(key)
+	if err == storage.ErrDataNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return dataobject.StreamOf([]byte(data))
+}
+
+// checkKey returns ErrReservedKey if the key can't be
+// written to, as it starts with streamKeyPrefix.
+func checkKey(key []byte) error {
+	if strings.HasPrefix(string(key), streamKeyPrefix) {
+		return ErrReservedKey
+	}
+	return nil
+}
+
+// streamChunkKey returns the key of a chunk of a stream.
+func streamChunkKey(id string, index int64) []byte {
+	return []byte(streamKeyPrefix + id + "/" + strconv.FormatInt(index, 10))
+}
+
+// newStreamID returns a random id for a stream.
+func newStreamID() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
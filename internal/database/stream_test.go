@@ -0,0 +1,480 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/dataobject"
+	_map "github.com/SystemBuilders/KeyValueStore/internal/indexer/map"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage"
+)
+
+// newStreamTestStore returns a store of the storage type
+// whose streamed values are split into small chunks.
+func newStreamTestStore(t *testing.T, storageType string) *KeyValueStore {
+	ctx := context.WithValue(context.Background(), "storage", storageType)
+	opts := storage.DefaultOptions()
+	opts.Dir = t.TempDir()
+	kv, err := NewKeyValueStoreWithOptions(ctx, _map.NewMapIndexerGenerator(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { kv.Close() })
+
+	kv.chunkSize = 1000
+	return kv
+}
+
+// streamValue returns random bytes to be streamed.
+func streamValue(size int) []byte {
+	value := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(value)
+	return value
+}
+
+// readStream reads the whole value streamed for the key.
+func readStream(kv *KeyValueStore, key string) ([]byte, error) {
+	r, err := kv.GetStream([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func TestStream(t *testing.T) {
+	for _, storageType := range []string{"append", "sst", "btree", "memory"} {
+		t.Run(storageType, func(t *testing.T) {
+			kv := newStreamTestStore(t, storageType)
+
+			for _, size := range []int{0, 999, 1000, 10500} {
+				value := streamValue(size)
+				err := kv.PutStream([]byte("blob"), bytes.NewReader(value))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				got, err := readStream(kv, "blob")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(value, got) {
+					t.Fatalf("read %d bytes back, expected %d", len(got), size)
+				}
+			}
+
+			// The chunks hold the data of the value as it is.
+			info := streamInfo(t, kv, "blob")
+			data, err := kv.s.Query(streamChunkKey(info.ID, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			chunk, ok := dataobject.RawOf([]byte(data))
+			if !ok || !bytes.Equal(streamValue(10500)[:1000], chunk[streamChunkHeaderSize:]) {
+				t.Fatal("the chunk isn't stored as raw data")
+			}
+
+			_, err = kv.Query([]byte("blob"))
+			if err != ErrStreamValue {
+				t.Fatalf("expected %v, got %v", ErrStreamValue, err)
+			}
+
+			err = kv.Insert([]byte("plain"), "value")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = kv.GetStream([]byte("plain"))
+			if err != ErrNotStream {
+				t.Fatalf("expected %v, got %v", ErrNotStream, err)
+			}
+
+			// Replacing or deleting a streamed value deletes
+			// its chunks.
+			err = kv.Insert([]byte("blob"), "value")
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertChunksRemoved(t, kv, info)
+
+			err = kv.PutStream([]byte("blob"), bytes.NewReader(streamValue(2500)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			info = streamInfo(t, kv, "blob")
+			err = kv.Delete([]byte("blob"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertChunksRemoved(t, kv, info)
+		})
+	}
+}
+
+// failingReader returns err once its data is read.
+type failingReader struct {
+	data io.Reader
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		return n, r.err
+	}
+	return n, err
+}
+
+func TestStream_FailedPut(t *testing.T) {
+	kv := newStreamTestStore(t, "append")
+
+	value := streamValue(1500)
+	err := kv.PutStream([]byte("blob"), bytes.NewReader(value))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readErr := errors.New("read failed")
+	err = kv.PutStream([]byte("blob"), &failingReader{bytes.NewReader(streamValue(5000)), readErr})
+	if err != readErr {
+		t.Fatalf("expected %v, got %v", readErr, err)
+	}
+
+	got, err := readStream(kv, "blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, got) {
+		t.Fatal("the failed stream replaced the value")
+	}
+}
+
+func TestStream_Integrity(t *testing.T) {
+	kv := newStreamTestStore(t, "append")
+
+	err := kv.PutStream([]byte("blob"), bytes.NewReader(streamValue(3000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := streamInfo(t, kv, "blob")
+
+	// A chunk whose data doesn't match its checksum.
+	key := streamChunkKey(info.ID, 1)
+	err = kv.s.Append(key, dataobject.NewRaw([]byte("\x00\x00\x00\x01corrupt")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = readStream(kv, "blob")
+	if err != ErrStreamCorrupt {
+		t.Fatalf("expected %v, got %v", ErrStreamCorrupt, err)
+	}
+
+	// A chunk which matches its checksum but not the value.
+	err = kv.putChunk(info.ID, 1, []byte("replaced"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readStream(kv, "blob")
+	if err != ErrStreamCorrupt {
+		t.Fatalf("expected %v, got %v", ErrStreamCorrupt, err)
+	}
+
+	// A value replaced while it's read.
+	r, err := kv.GetStream([]byte("blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.PutStream([]byte("blob"), bytes.NewReader(streamValue(10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(r)
+	if err != ErrStreamReplaced {
+		t.Fatalf("expected %v, got %v", ErrStreamReplaced, err)
+	}
+
+	r.Close()
+	_, err = r.Read(make([]byte, 1))
+	if err != ErrStreamClosed {
+		t.Fatalf("expected %v, got %v", ErrStreamClosed, err)
+	}
+}
+
+func TestStream_ReservedKeys(t *testing.T) {
+	kv := newStreamTestStore(t, "append")
+
+	err := kv.PutStream([]byte("blob"), bytes.NewReader(streamValue(1500)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := streamInfo(t, kv, "blob")
+	chunk := streamChunkKey(info.ID, 0)
+
+	err = kv.Insert(chunk, "value")
+	if err != ErrReservedKey {
+		t.Fatalf("insert: expected %v, got %v", ErrReservedKey, err)
+	}
+	err = kv.Delete(chunk)
+	if err != ErrReservedKey {
+		t.Fatalf("delete: expected %v, got %v", ErrReservedKey, err)
+	}
+	err = kv.PutStream([]byte(streamKeyPrefix+"blob"), bytes.NewReader(streamValue(10)))
+	if err != ErrReservedKey {
+		t.Fatalf("put stream: expected %v, got %v", ErrReservedKey, err)
+	}
+
+	value := streamValue(1500)
+	got, err := readStream(kv, "blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, got) {
+		t.Fatal("the chunks of the value were written to")
+	}
+}
+
+func TestStream_Sweep(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "storage", "append")
+	opts := storage.DefaultOptions()
+	opts.Dir = t.TempDir()
+	kv, err := NewKeyValueStoreWithOptions(ctx, _map.NewMapIndexerGenerator(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.chunkSize = 1000
+
+	value := streamValue(2500)
+	err = kv.PutStream([]byte("kept"), bytes.NewReader(value))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A stream cut short before the object describing it
+	// was stored.
+	cut := dataobject.StreamInfo{ID: "cut", Chunks: 3}
+	err = kv.addPending(cut.ID, []byte("cut"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < cut.Chunks; i++ {
+		err = kv.putChunk(cut.ID, i, streamValue(1000))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A stream replaced by a value, cut short after its
+	// last chunk was deleted.
+	err = kv.PutStream([]byte("replaced"), bytes.NewReader(streamValue(2500)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaced := streamInfo(t, kv, "replaced")
+	data, err := json.Marshal(dataobject.NewObject([]byte("replaced"), "value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash := errors.New("crash")
+	kv.mu.Lock()
+	err = kv.replaceStream([]byte("replaced"), nil, func() error {
+		err := kv.insert([]byte("replaced"), data)
+		if err != nil {
+			return err
+		}
+		err = kv.s.Delete(streamChunkKey(replaced.ID, replaced.Chunks-1))
+		if err != nil {
+			return err
+		}
+		return crash
+	})
+	kv.mu.Unlock()
+	if err != crash {
+		t.Fatalf("expected %v, got %v", crash, err)
+	}
+
+	err = kv.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv, err = NewKeyValueStoreWithOptions(ctx, _map.NewMapIndexerGenerator(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	assertChunksRemoved(t, kv, cut)
+	assertChunksRemoved(t, kv, replaced)
+	got, err := readStream(kv, "kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, got) {
+		t.Fatal("the chunks of a stored stream were swept")
+	}
+	if len(kv.pending) != 0 {
+		t.Fatalf("expected no pending streams, got %d", len(kv.pending))
+	}
+	if _, ok := kv.streamed["replaced"]; ok || len(kv.streamed) != 1 {
+		t.Fatalf("expected only kept to be streamed, got %v", kv.streamed)
+	}
+}
+
+// queryCounter counts the queries of a storage.
+type queryCounter struct {
+	storage.Storage
+	queries int
+}
+
+func (s *queryCounter) Query(key []byte) (string, error) {
+	s.queries++
+	return s.Storage.Query(key)
+}
+
+func TestStream_StreamedKeys(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "storage", "append")
+	opts := storage.DefaultOptions()
+	opts.Dir = t.TempDir()
+	kv, err := NewKeyValueStoreWithOptions(ctx, _map.NewMapIndexerGenerator(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.chunkSize = 1000
+
+	for _, key := range []string{"first", "second"} {
+		err = kv.PutStream([]byte(key), bytes.NewReader(streamValue(2500)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := streamInfo(t, kv, "first")
+
+	err = kv.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv, err = NewKeyValueStoreWithOptions(ctx, _map.NewMapIndexerGenerator(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	if kv.streamed["first"] != first || len(kv.streamed) != 2 {
+		t.Fatalf("expected first and second to be streamed, got %v", kv.streamed)
+	}
+
+	// The values of the keys which aren't streamed are
+	// written without being read.
+	counter := &queryCounter{Storage: kv.s}
+	kv.s = counter
+	err = kv.Insert([]byte("plain"), "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.Delete([]byte("plain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counter.queries != 0 {
+		t.Fatalf("expected no queries, got %d", counter.queries)
+	}
+
+	// The streamed keys loaded are overwritten along with
+	// their chunks.
+	err = kv.Insert([]byte("first"), "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertChunksRemoved(t, kv, first)
+	value, err := kv.Query([]byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "value" {
+		t.Fatalf("expected value, got %v", value)
+	}
+	if _, ok := kv.streamed["first"]; ok {
+		t.Fatal("first is still streamed")
+	}
+}
+
+// closingReader closes the storage of the store once its
+// data is read, so that the stream being put fails.
+type closingReader struct {
+	data io.Reader
+	kv   *KeyValueStore
+}
+
+func (r *closingReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		r.kv.s.Close()
+		return n, errors.New("read failed")
+	}
+	return n, err
+}
+
+func TestStream_FailedDrop(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "storage", "append")
+	opts := storage.DefaultOptions()
+	opts.Dir = t.TempDir()
+	kv, err := NewKeyValueStoreWithOptions(ctx, _map.NewMapIndexerGenerator(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.chunkSize = 1000
+
+	// The chunks of the failed stream can't be deleted
+	// from the closed storage.
+	err = kv.PutStream([]byte("blob"), &closingReader{bytes.NewReader(streamValue(2500)), kv})
+	if err != storage.ErrStorageClosed {
+		t.Fatalf("expected %v, got %v", storage.ErrStorageClosed, err)
+	}
+	if len(kv.pending) != 1 {
+		t.Fatalf("expected the stream to stay pending, got %d pending", len(kv.pending))
+	}
+	var failed dataobject.StreamInfo
+	for id := range kv.pending {
+		failed = dataobject.StreamInfo{ID: id, Chunks: 2}
+	}
+
+	kv, err = NewKeyValueStoreWithOptions(ctx, _map.NewMapIndexerGenerator(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	assertChunksRemoved(t, kv, failed)
+	if len(kv.pending) != 0 {
+		t.Fatalf("expected no pending streams, got %d", len(kv.pending))
+	}
+}
+
+// streamInfo returns the description of the value
+// streamed for the key.
+func streamInfo(t *testing.T, kv *KeyValueStore, key string) dataobject.StreamInfo {
+	info, err := kv.streamOfKey([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info == nil {
+		t.Fatalf("%s isn't streamed", key)
+	}
+	return *info
+}
+
+// assertChunksRemoved fails the test if any chunk of the
+// stream is still stored.
+func assertChunksRemoved(t *testing.T, kv *KeyValueStore, info dataobject.StreamInfo) {
+	for i := int64(0); i < info.Chunks; i++ {
+		_, err := kv.s.Query(streamChunkKey(info.ID, i))
+		if err != storage.ErrDataNotFound {
+			t.Fatalf("chunk %d: expected %v, got %v", i, storage.ErrDataNotFound, err)
+		}
+	}
+}
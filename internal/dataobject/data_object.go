@@ -1,6 +1,7 @@
 package dataobject
 
 import (
+	"bytes"
 	"encoding/json"
 )
 
@@ -8,6 +9,41 @@ import (
 type Object struct {
 	Key   interface{}
 	Value interface{}
+	// Tombstone marks an object which records the
+	// deletion of its key rather than a value.
+	Tombstone bool `json:",omitempty"`
+	// Pointer, if set, locates the object holding the
+	// value of the key in a value log, and the object
+	// carries no value itself.
+	Pointer *ValuePointer `json:",omitempty"`
+	// Stream, if set, describes the chunks the value of
+	// the key was streamed into, and the object carries
+	// no value itself.
+	Stream *StreamInfo `json:",omitempty"`
+}
+
+// ValuePointer locates an object written to a value log.
+type ValuePointer struct {
+	// File is the id of the value log file.
+	File int64
+	// Offset and Size locate the entry of the object in
+	// the file.
+	Offset int64
+	Size   int64
+}
+
+// StreamInfo describes a value stored as a stream of
+// chunks, each of them stored as an object of its own.
+type StreamInfo struct {
+	// ID tells the chunks of the stream apart from those
+	// of any other stream.
+	ID string
+	// Chunks is the number of chunks of the stream.
+	Chunks int64
+	// Size is the total size of the value.
+	Size int64
+	// Checksum is the hex encoded SHA-256 of the value.
+	Checksum string
 }
 
 // NewObject returns a new instance of an object.
@@ -18,6 +54,108 @@ func NewObject(key []byte, value interface{}) Object {
 	}
 }
 
+// NewTombstone returns a new object recording the
+// deletion of the key.
+func NewTombstone(key []byte) Object {
+	return Object{
+		Key:       key,
+		Tombstone: true,
+	}
+}
+
+// NewPointer returns a new object pointing at the object
+// holding the value of the key in a value log.
+func NewPointer(key []byte, p ValuePointer) Object {
+	return Object{
+		Key:     key,
+		Pointer: &p,
+	}
+}
+
+// NewStream returns a new object describing the value of
+// the key stored as a stream of chunks.
+func NewStream(key []byte, info StreamInfo) Object {
+	return Object{
+		Key:    key,
+		Stream: &info,
+	}
+}
+
+// RawMarker starts the data of a raw object, which holds
+// its bytes as they are rather than as a marshalled
+// Object. A marshalled Object never starts with it.
+const RawMarker = "\x00"
+
+// NewRaw returns the data of a raw object holding the
+// bytes, which spares binary values being encoded to
+// fit in a marshalled Object.
+//
+// The storages holding records in segments or tables
+// keep raw objects in their value log, and only a
+// pointer to them in the segments and tables.
+func NewRaw(data []byte) []byte {
+	raw := make([]byte, 0, len(RawMarker)+len(data))
+	raw = append(raw, RawMarker...)
+	return append(raw, data...)
+}
+
+// RawOf returns the bytes held by the data of a raw
+// object, or false if the data is a marshalled Object.
+func RawOf(data []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(data, []byte(RawMarker)) {
+		return nil, false
+	}
+	return data[len(RawMarker):], true
+}
+
+// PointerOf returns the value pointer of an Object from
+// its marshalled form, or nil if it carries its value.
+func PointerOf(data []byte) (*ValuePointer, error) {
+	var obj struct {
+		Pointer *ValuePointer
+	}
+	err := json.Unmarshal(data, &obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return obj.Pointer, nil
+}
+
+// StreamOf returns the stream description of an Object
+// from its marshalled form, or nil if it carries its
+// value.
+func StreamOf(data []byte) (*StreamInfo, error) {
+	var obj struct {
+		Stream *StreamInfo
+	}
+	err := json.Unmarshal(data, &obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return obj.Stream, nil
+}
+
+// KeyOf returns the key of an Object from its
+// marshalled form and whether it is a tombstone.
+//
+// This lets the storage layers recover the key of
+// a stored record without knowing anything about
+// the value it carries.
+func KeyOf(data []byte) ([]byte, bool, error) {
+	var obj struct {
+		Key       []byte
+		Tombstone bool
+	}
+	err := json.Unmarshal(data, &obj)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return obj.Key, obj.Tombstone, nil
+}
+
 // LeastCmpFnc converts the strings as a DB object
 // and returns the smaller object of the two as a
 // string.
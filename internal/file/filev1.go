@@ -9,14 +9,18 @@ import (
 	"time"
 
 	"github.com/SystemBuilders/KeyValueStore/internal/indexer"
+	"github.com/SystemBuilders/KeyValueStore/internal/vfs"
 )
 
 // FileV1 implements File.
 //
-// FileV1 is an abstraction over the os.File package.
+// FileV1 is an abstraction over the files of a vfs.FS.
 // This enables handling multiple files that may be carrying the
 // data of the KV store using a single struct.
 type FileV1 struct {
+	// fsys is the filesystem holding the files used
+	// as segments.
+	fsys vfs.FS
 	// fName has all the names of the files used
 	// as segments.
 	fName []string
@@ -24,7 +28,7 @@ type FileV1 struct {
 	//
 	// fs is the handle to the actual files
 	// that hold the data.
-	fs []*os.File
+	fs []vfs.File
 
 	// prevObjLength specifies the length of the last
 	// appended object. This is used to index the next
@@ -49,16 +53,18 @@ type FileV1 struct {
 
 var _ (File) = (*FileV1)(nil)
 
-// NewFileV1 returns a new instance of File.
+// NewFileV1 returns a new instance of File, whose
+// files are kept on the given filesystem.
 //
 // This is deprecated now in view of the new
 // design of File for merging and compaction.
-func NewFileV1(ctx context.Context, mu *sync.Mutex, index indexer.Indexer,
+func NewFileV1(ctx context.Context, fsys vfs.FS, mu *sync.Mutex, index indexer.Indexer,
 ) (*FileV1, error) {
 
 	file := &FileV1{
+		fsys:          fsys,
 		fName:         []string{},
-		fs:            []*os.File{},
+		fs:            []vfs.File{},
 		prevObjLength: 0,
 		currSegment:   0,
 		MergeNeeded:   false,
@@ -101,11 +107,11 @@ func (f *FileV1) ReadAt(loc indexer.ObjectLocation) (string, error) {
 
 	// If the file to be read is not the active segment,
 	// it must be opened before it is read.
-	var file *os.File
+	var file vfs.File
 	f.fileLock.Lock()
 	if loc.Segment != f.currSegment {
 		var err error
-		file, err = os.OpenFile(f.fName[loc.Segment], os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+		file, err = f.fsys.OpenFile(f.fName[loc.Segment], os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 		if err != nil {
 			f.fileLock.Unlock()
 			return "", err
@@ -142,7 +148,7 @@ func (f *FileV1) ReadAt(loc indexer.ObjectLocation) (string, error) {
 // This function needs to be able to acquire a lock on "fileLock".
 func (f *FileV1) createNewFileSegment() error {
 	fName := time.Now().String()
-	file, err := os.OpenFile(fName, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	file, err := f.fsys.OpenFile(fName, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return err
 	}
@@ -169,7 +175,7 @@ func (f *FileV1) seekToActiveFileSegment() int {
 func (f *FileV1) appendAtSegment(s string, segment int,
 ) (indexer.ObjectLocation, error) {
 
-	info, err := os.Stat(f.fName[segment])
+	info, err := f.fsys.Stat(f.fName[segment])
 	if err != nil {
 		return indexer.ObjectLocation{}, err
 	}
@@ -238,11 +244,11 @@ func (f *FileV1) appendAtSegment(s string, segment int,
 func (f *FileV1) deleteFilesTillIndex(index int) {
 
 	f.fileLock.Lock()
-	files := make([]*os.File, len(f.fs)-index-1)
+	files := make([]vfs.File, len(f.fs)-index-1)
 	fileNames := make([]string, len(f.fName)-index-1)
 
 	for i := 0; i < index; i++ {
-		os.Remove(f.fName[i])
+		f.fsys.Remove(f.fName[i])
 	}
 
 	copy(files, f.fs[index:])
@@ -264,7 +270,7 @@ func (f *FileV1) closeFileOfSegment(segment int) error {
 	// Futher reading: https://stackoverflow.com/questions/64744802/safely-close-a-file-descriptor-in-golang
 	var err error
 	f.fileLock.Lock()
-	if _, err = os.Stat(f.fName[segment]); err == nil {
+	if _, err = f.fsys.Stat(f.fName[segment]); err == nil {
 		defer f.fileLock.Unlock()
 		return f.fs[segment].Close()
 	}
@@ -282,7 +288,7 @@ func (f *FileV1) closeActiveFile() error {
 	return f.closeFileOfSegment(currSegment)
 }
 
-func releaseFile(f string) {
+func releaseFile(fsys vfs.FS, f string) {
 	fmt.Printf("deleting: %s\n", f)
-	os.Remove(f)
+	fsys.Remove(f)
 }
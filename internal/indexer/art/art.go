@@ -0,0 +1,671 @@
+package art
+
+import (
+	"strings"
+	"unsafe"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/indexer"
+)
+
+// nodeKind is the capacity class of an inner node.
+type nodeKind uint8
+
+const (
+	node4 nodeKind = iota
+	node16
+	node48
+	node256
+)
+
+// capacity returns the number of children an inner node
+// of the kind can hold.
+func (k nodeKind) capacity() int {
+	switch k {
+	case node4:
+		return 4
+	case node16:
+		return 16
+	case node48:
+		return 48
+	default:
+		return 256
+	}
+}
+
+const (
+	// leafSize and innerSize are the number of bytes taken
+	// by a leaf and an inner node, besides the suffix of
+	// the leaf and the prefix, edges and children of the
+	// inner node.
+	leafSize  = int64(unsafe.Sizeof(leaf{}))
+	innerSize = int64(unsafe.Sizeof(inner{}))
+	// childSize is the number of bytes taken by every child
+	// slot of an inner node.
+	childSize = int64(unsafe.Sizeof(node(nil)))
+)
+
+// node is either a *leaf or an *inner.
+type node interface{}
+
+// leaf holds a key of the tree along with its location.
+// Only the rest of the key after the bytes that led to the
+// leaf is kept in it, which is all that tells it apart
+// from the other keys below the same node.
+type leaf struct {
+	suffix string
+	loc    indexer.ObjectLocation
+}
+
+// inner is an inner node of the tree.
+//
+// The keys below an inner node all share its prefix,
+// following the bytes that led to the node, and part on
+// the byte after it, each edge byte leading to a child.
+// A key which ends right after the prefix is held by the
+// node itself, as a key may be the prefix of others.
+//
+// How the edges are kept depends on the kind of the node,
+// which grows and shrinks with the number of children so
+// that sparse nodes stay small and dense nodes are looked
+// up directly.
+//
+//   - node4 and node16 keep up to 4 and 16 children, with
+//     their edges sorted in the first count bytes of edges
+//     and the children at the same positions.
+//   - node48 keeps up to 48 children in any order, with
+//     edges holding, for every byte, the position of its
+//     child plus one or zero if there is none.
+//   - node256 keeps a child for every byte, without edges.
+type inner struct {
+	prefix   string
+	leaf     *leaf
+	kind     nodeKind
+	count    int
+	edges    []byte
+	children []node
+}
+
+// tree is an adaptive radix tree mapping keys to their
+// locations in the order of their bytes.
+//
+// Keys sharing a prefix share the inner nodes on the path
+// of the prefix, and runs of inner nodes with a single
+// child are collapsed into the prefix of the node below
+// them. The bytes of a prefix are thus kept only once for
+// all the keys sharing it. The work of a lookup is bound
+// by the length of the key rather than by the number of
+// keys, and all the keys starting with a prefix lie below
+// a single node.
+//
+// A tree isn't safe for concurrent use.
+type tree struct {
+	root node
+	size int
+	// bytes is the approximate number of bytes taken by
+	// the nodes of the tree.
+	bytes int64
+}
+
+// newLeaf returns a leaf holding the suffix of a key,
+// which is copied so that the rest of the key isn't kept
+// in memory along with it.
+func newLeaf(suffix string, loc indexer.ObjectLocation) *leaf {
+	return &leaf{suffix: clone(suffix), loc: loc}
+}
+
+// newInner returns an empty inner node of the given kind
+// and prefix, which is copied so that the rest of the key
+// it's taken from isn't kept in memory along with it.
+func newInner(kind nodeKind, prefix string) *inner {
+	n := &inner{
+		prefix:   clone(prefix),
+		kind:     kind,
+		children: make([]node, kind.capacity()),
+	}
+	switch kind {
+	case node4, node16:
+		n.edges = make([]byte, kind.capacity())
+	case node48:
+		n.edges = make([]byte, 256)
+	}
+	return n
+}
+
+// innerBytes returns the number of bytes taken by the
+// inner node.
+func innerBytes(n *inner) int64 {
+	return innerSize + int64(len(n.prefix)+len(n.edges)) + int64(len(n.children))*childSize
+}
+
+// leafBytes returns the number of bytes taken by the leaf.
+func leafBytes(l *leaf) int64 {
+	return leafSize + int64(len(l.suffix))
+}
+
+// get returns the location of the key and whether the
+// key is in the tree.
+func (t *tree) get(key string) (indexer.ObjectLocation, bool) {
+	n, depth := t.root, 0
+	for n != nil {
+		switch curr := n.(type) {
+		case *leaf:
+			if curr.suffix == key[depth:] {
+				return curr.loc, true
+			}
+			return indexer.ObjectLocation{}, false
+		case *inner:
+			if !strings.HasPrefix(key[depth:], curr.prefix) {
+				return indexer.ObjectLocation{}, false
+			}
+			depth += len(curr.prefix)
+			if depth == len(key) {
+				if curr.leaf == nil {
+					return indexer.ObjectLocation{}, false
+				}
+				return curr.leaf.loc, true
+			}
+
+			child := curr.findChild(key[depth])
+			if child == nil {
+				return indexer.ObjectLocation{}, false
+			}
+			n, depth = *child, depth+1
+		}
+	}
+	return indexer.ObjectLocation{}, false
+}
+
+// put stores the location of the key, replacing the one
+// it was stored with before.
+func (t *tree) put(key string, loc indexer.ObjectLocation) {
+	if t.insert(&t.root, key, loc, 0) {
+		t.size++
+	}
+}
+
+// insert inserts the key below the node in the slot, whose
+// keys share the first depth bytes of the key. It reports
+// whether the key wasn't there yet.
+func (t *tree) insert(slot *node, key string, loc indexer.ObjectLocation, depth int) bool {
+	for {
+		rest := key[depth:]
+		switch curr := (*slot).(type) {
+		case nil:
+			t.hang(slot, rest, loc)
+			return true
+
+		case *leaf:
+			if curr.suffix == rest {
+				curr.loc = loc
+				return false
+			}
+
+			// The keys part after their common prefix, so a
+			// node is put in place of the old leaf to hold
+			// both of them.
+			common := commonPrefixLen(curr.suffix, rest)
+			n := newInner(node4, rest[:common])
+			t.bytes += innerBytes(n) - leafBytes(curr)
+			t.add(n, curr.suffix[common:], curr.loc)
+			t.add(n, rest[common:], loc)
+			*slot = n
+			return true
+
+		case *inner:
+			common := commonPrefixLen(curr.prefix, rest)
+			if common < len(curr.prefix) {
+				// The key parts from the prefix of the node, so
+				// a node holding what they share is put above
+				// it, with the rest of the prefix of the node
+				// below the byte it parts on.
+				n := newInner(node4, curr.prefix[:common])
+				t.bytes += innerBytes(n) - innerBytes(curr)
+
+				edge := curr.prefix[common]
+				curr.prefix = clone(curr.prefix[common+1:])
+				t.bytes += innerBytes(curr)
+
+				t.addChild(n, edge, curr)
+				t.add(n, rest[common:], loc)
+				*slot = n
+				return true
+			}
+
+			depth += len(curr.prefix)
+			if depth == len(key) {
+				if curr.leaf != nil {
+					curr.leaf.loc = loc
+					return false
+				}
+				t.add(curr, "", loc)
+				return true
+			}
+
+			child := curr.findChild(key[depth])
+			if child == nil {
+				t.add(curr, key[depth:], loc)
+				return true
+			}
+			slot, depth = child, depth+1
+		}
+	}
+}
+
+// hang puts a leaf holding the suffix in the empty slot.
+func (t *tree) hang(slot *node, suffix string, loc indexer.ObjectLocation) {
+	l := newLeaf(suffix, loc)
+	t.bytes += leafBytes(l)
+	*slot = l
+}
+
+// add adds a leaf to the node for the key which goes on
+// with the suffix after the prefix of the node, either in
+// the node itself if the key ends there or as a child. The
+// node must hold no key going on with the suffix yet.
+func (t *tree) add(n *inner, suffix string, loc indexer.ObjectLocation) {
+	if suffix == "" {
+		l := newLeaf("", loc)
+		t.bytes += leafBytes(l)
+		n.leaf = l
+		return
+	}
+
+	var child node
+	t.hang(&child, suffix[1:], loc)
+	t.addChild(n, suffix[0], child)
+}
+
+// delete removes the key from the tree and reports
+// whether it was there.
+func (t *tree) delete(key string) bool {
+	if t.remove(&t.root, key, 0) {
+		t.size--
+		return true
+	}
+	return false
+}
+
+// remove removes the key from below the node in the slot,
+// whose keys share the first depth bytes of the key, and
+// reports whether it was there.
+func (t *tree) remove(slot *node, key string, depth int) bool {
+	switch curr := (*slot).(type) {
+	case *leaf:
+		if curr.suffix != key[depth:] {
+			return false
+		}
+		*slot = nil
+		t.bytes -= leafBytes(curr)
+		return true
+
+	case *inner:
+		if !strings.HasPrefix(key[depth:], curr.prefix) {
+			return false
+		}
+		depth += len(curr.prefix)
+
+		if depth == len(key) {
+			if curr.leaf == nil {
+				return false
+			}
+			t.bytes -= leafBytes(curr.leaf)
+			curr.leaf = nil
+		} else {
+			child := curr.findChild(key[depth])
+			if child == nil || !t.remove(child, key, depth+1) {
+				return false
+			}
+			if *child == nil {
+				t.removeChild(curr, key[depth])
+			}
+		}
+
+		t.collapse(slot, curr)
+		return true
+	}
+	return false
+}
+
+// collapse replaces the inner node in the slot with what
+// it holds if it's left with a single key or child, and
+// otherwise shrinks it to fit its children.
+func (t *tree) collapse(slot *node, n *inner) {
+	switch {
+	case n.count == 0:
+		t.bytes -= innerBytes(n)
+		if n.leaf != nil {
+			t.extend(n.leaf, n.prefix)
+			*slot = n.leaf
+		} else {
+			*slot = nil
+		}
+
+	case n.count == 1 && n.leaf == nil:
+		t.bytes -= innerBytes(n)
+		edge, child := n.firstChild()
+		switch c := child.(type) {
+		case *leaf:
+			t.extend(c, n.prefix+string(edge))
+		case *inner:
+			t.bytes -= innerBytes(c)
+			c.prefix = n.prefix + string(edge) + c.prefix
+			t.bytes += innerBytes(c)
+		}
+		*slot = child
+
+	default:
+		t.shrink(n)
+	}
+}
+
+// extend puts the bytes in front of the suffix of the
+// leaf, as it's moved up to where they lead from.
+func (t *tree) extend(l *leaf, bytes string) {
+	t.bytes -= leafBytes(l)
+	l.suffix = bytes + l.suffix
+	t.bytes += leafBytes(l)
+}
+
+// findChild returns the slot of the child of the node at
+// the edge, or nil if there is no such child.
+func (n *inner) findChild(edge byte) *node {
+	switch n.kind {
+	case node4, node16:
+		for i := 0; i < n.count; i++ {
+			if n.edges[i] == edge {
+				return &n.children[i]
+			}
+		}
+	case node48:
+		if pos := n.edges[edge]; pos != 0 {
+			return &n.children[pos-1]
+		}
+	case node256:
+		if n.children[edge] != nil {
+			return &n.children[edge]
+		}
+	}
+	return nil
+}
+
+// addChild adds the child to the node at the edge, which
+// the node has no child at, growing the node if it's full.
+func (t *tree) addChild(n *inner, edge byte, child node) {
+	if n.count == n.kind.capacity() {
+		t.grow(n)
+	}
+
+	switch n.kind {
+	case node4, node16:
+		i := 0
+		for i < n.count && n.edges[i] < edge {
+			i++
+		}
+		copy(n.edges[i+1:n.count+1], n.edges[i:n.count])
+		copy(n.children[i+1:n.count+1], n.children[i:n.count])
+		n.edges[i], n.children[i] = edge, child
+	case node48:
+		pos := 0
+		for n.children[pos] != nil {
+			pos++
+		}
+		n.children[pos] = child
+		n.edges[edge] = byte(pos + 1)
+	case node256:
+		n.children[edge] = child
+	}
+	n.count++
+}
+
+// removeChild removes the child of the node at the edge.
+func (t *tree) removeChild(n *inner, edge byte) {
+	switch n.kind {
+	case node4, node16:
+		i := 0
+		for n.edges[i] != edge {
+			i++
+		}
+		copy(n.edges[i:], n.edges[i+1:n.count])
+		copy(n.children[i:], n.children[i+1:n.count])
+		n.children[n.count-1] = nil
+	case node48:
+		n.children[n.edges[edge]-1] = nil
+		n.edges[edge] = 0
+	case node256:
+		n.children[edge] = nil
+	}
+	n.count--
+}
+
+// grow turns the node into the next larger kind.
+func (t *tree) grow(n *inner) {
+	t.resize(n, n.kind+1)
+}
+
+// shrink turns the node into the next smaller kind once
+// it holds few enough children. The thresholds are lower
+// than the capacity of the smaller kind, so that a node
+// isn't turned back and forth by a key added and removed
+// over and over.
+func (t *tree) shrink(n *inner) {
+	switch {
+	case n.kind == node256 && n.count <= 40:
+		t.resize(n, node48)
+	case n.kind == node48 && n.count <= 12:
+		t.resize(n, node16)
+	case n.kind == node16 && n.count <= 3:
+		t.resize(n, node4)
+	}
+}
+
+// resize moves the children of the node into a node of
+// the given kind, which must fit them all.
+func (t *tree) resize(n *inner, kind nodeKind) {
+	resized := newInner(kind, n.prefix)
+	resized.leaf = n.leaf
+	n.ascendChildren(func(edge byte, child node) bool {
+		t.addChild(resized, edge, child)
+		return true
+	})
+
+	t.bytes += innerBytes(resized) - innerBytes(n)
+	*n = *resized
+}
+
+// firstChild returns the child of the node at the lowest
+// edge, which the node must have.
+func (n *inner) firstChild() (byte, node) {
+	var (
+		edge  byte
+		child node
+	)
+	n.ascendChildren(func(e byte, c node) bool {
+		edge, child = e, c
+		return false
+	})
+	return edge, child
+}
+
+// lastChild returns the child of the node at the highest
+// edge, which the node must have.
+func (n *inner) lastChild() (byte, node) {
+	switch n.kind {
+	case node4, node16:
+		return n.edges[n.count-1], n.children[n.count-1]
+	case node48:
+		for b := 255; b >= 0; b-- {
+			if pos := n.edges[b]; pos != 0 {
+				return byte(b), n.children[pos-1]
+			}
+		}
+	case node256:
+		for b := 255; b >= 0; b-- {
+			if n.children[b] != nil {
+				return byte(b), n.children[b]
+			}
+		}
+	}
+	return 0, nil
+}
+
+// ascendChildren calls fn with the children of the node
+// in the order of their edges, until fn returns false.
+// It reports whether fn never returned false.
+func (n *inner) ascendChildren(fn func(edge byte, child node) bool) bool {
+	switch n.kind {
+	case node4, node16:
+		for i := 0; i < n.count; i++ {
+			if !fn(n.edges[i], n.children[i]) {
+				return false
+			}
+		}
+	case node48:
+		for b := 0; b < 256; b++ {
+			if pos := n.edges[b]; pos != 0 && !fn(byte(b), n.children[pos-1]) {
+				return false
+			}
+		}
+	case node256:
+		for b := 0; b < 256; b++ {
+			if child := n.children[b]; child != nil && !fn(byte(b), child) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ascend calls fn with the keys below the node and their
+// locations in order, until fn returns false. path holds
+// the bytes that led to the node, which start every key
+// below it. It reports whether fn never returned false.
+func ascend(n node, path []byte, fn func(key string, loc indexer.ObjectLocation) bool) bool {
+	switch curr := n.(type) {
+	case *leaf:
+		return fn(string(path)+curr.suffix, curr.loc)
+	case *inner:
+		path = append(path, curr.prefix...)
+
+		// The key held by the node is a prefix of all the
+		// others below it, so it comes first.
+		if curr.leaf != nil && !fn(string(path), curr.leaf.loc) {
+			return false
+		}
+		return curr.ascendChildren(func(edge byte, child node) bool {
+			return ascend(child, append(path, edge), fn)
+		})
+	}
+	return true
+}
+
+// ascendPrefix calls fn with the keys of the tree which
+// start with the prefix and their locations in order,
+// until fn returns false.
+//
+// The node below which all those keys lie is found first,
+// so only the keys starting with the prefix are visited.
+func (t *tree) ascendPrefix(prefix string, fn func(key string, loc indexer.ObjectLocation) bool) {
+	n, depth := t.root, 0
+	for n != nil {
+		rest := prefix[depth:]
+		switch curr := n.(type) {
+		case *leaf:
+			if strings.HasPrefix(curr.suffix, rest) {
+				fn(prefix[:depth]+curr.suffix, curr.loc)
+			}
+			return
+
+		case *inner:
+			if len(rest) <= len(curr.prefix) {
+				if strings.HasPrefix(curr.prefix, rest) {
+					ascend(curr, []byte(prefix[:depth]), fn)
+				}
+				return
+			}
+			if !strings.HasPrefix(rest, curr.prefix) {
+				return
+			}
+
+			depth += len(curr.prefix)
+			child := curr.findChild(prefix[depth])
+			if child == nil {
+				return
+			}
+			n, depth = *child, depth+1
+		}
+	}
+}
+
+// min returns the smallest key of the tree along with its
+// location, or false if the tree is empty.
+func (t *tree) min() (string, indexer.ObjectLocation, bool) {
+	var (
+		path []byte
+		n    = t.root
+	)
+	for {
+		switch curr := n.(type) {
+		case *leaf:
+			return string(path) + curr.suffix, curr.loc, true
+		case *inner:
+			path = append(path, curr.prefix...)
+			if curr.leaf != nil {
+				return string(path), curr.leaf.loc, true
+			}
+
+			var edge byte
+			edge, n = curr.firstChild()
+			path = append(path, edge)
+		default:
+			return "", indexer.ObjectLocation{}, false
+		}
+	}
+}
+
+// max returns the largest key of the tree along with its
+// location, or false if the tree is empty.
+func (t *tree) max() (string, indexer.ObjectLocation, bool) {
+	var (
+		path []byte
+		n    = t.root
+	)
+	for {
+		switch curr := n.(type) {
+		case *leaf:
+			return string(path) + curr.suffix, curr.loc, true
+		case *inner:
+			path = append(path, curr.prefix...)
+			if curr.count == 0 {
+				return string(path), curr.leaf.loc, true
+			}
+
+			var edge byte
+			edge, n = curr.lastChild()
+			path = append(path, edge)
+		default:
+			return "", indexer.ObjectLocation{}, false
+		}
+	}
+}
+
+// commonPrefixLen returns the length of the longest
+// common prefix of a and b.
+func commonPrefixLen(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// clone returns a copy of the string which doesn't share
+// its bytes.
+func clone(s string) string {
+	if s == "" {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString(s)
+	return b.String()
+}
@@ -0,0 +1,183 @@
+package art
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/indexer"
+)
+
+// ART stands for Adaptive Radix Tree.
+// The ART indexer keeps the keys of a segment in an
+// adaptive radix tree, along with the location of the
+// most recent object of every key in the segment.
+//
+// Keys sharing a prefix share the nodes of the tree on
+// the path of the prefix, which suits hierarchical keys
+// such as paths, and storing and querying a key take time
+// bound by the length of the key. The keys are kept in
+// the order of their bytes, so the least and highest keys
+// can be queried and all the keys starting with a prefix
+// can be iterated without visiting any other key.
+//
+// Keys are indexed by their bytes. Strings and byte slices
+// are taken as they are, and keys of any other type by
+// their default format as given by fmt. Keys are given
+// back as strings.
+//
+// The ART indexer is race-safe, queries only wait for
+// stores and not for each other.
+type ART struct {
+	tree tree
+	l    sync.RWMutex
+}
+
+var _ (indexer.OrderedIndexer) = (*ART)(nil)
+
+// NewARTIndexer creates a new ART indexer.
+func NewARTIndexer() *ART {
+	return &ART{}
+}
+
+// Type returns the type of the indexer.
+func (art *ART) Type() string {
+	return "art"
+}
+
+// Store indexes the location of the key, replacing the
+// location it was indexed with before, if any.
+//
+// This is a race-safe method.
+func (art *ART) Store(key interface{}, loc indexer.ObjectLocation) {
+	art.l.Lock()
+	defer art.l.Unlock()
+	art.tree.put(keyOf(key), loc)
+}
+
+// Query returns the ObjectLocation for the given key.
+//
+// This is a race-safe method.
+func (art *ART) Query(key interface{}) (indexer.ObjectLocation, error) {
+	_, objLoc, err := art.QueryWith(indexer.QueryRandom, key)
+	return objLoc, err
+}
+
+// QueryWith queries the indexer as described by the
+// query type. The key is ignored when querying the least
+// or highest key.
+//
+// This is a race-safe method.
+func (art *ART) QueryWith(qt indexer.QueryType, key interface{}) (interface{}, indexer.ObjectLocation, error) {
+	art.l.RLock()
+	defer art.l.RUnlock()
+
+	var (
+		k   string
+		loc indexer.ObjectLocation
+		ok  bool
+	)
+	switch qt {
+	case indexer.QueryRandom:
+		k = keyOf(key)
+		loc, ok = art.tree.get(k)
+	case indexer.QueryLeast:
+		k, loc, ok = art.tree.min()
+	case indexer.QueryHighest:
+		k, loc, ok = art.tree.max()
+	default:
+		return nil, indexer.ObjectLocation{}, indexer.ErrUnknownQueryType
+	}
+
+	if !ok {
+		return nil, indexer.ObjectLocation{}, indexer.ErrDataDoesntExistInIndexer
+	}
+	return k, loc, nil
+}
+
+// Delete removes the key from the ART.
+//
+// This is a race-safe method.
+func (art *ART) Delete(key interface{}) error {
+	art.l.Lock()
+	defer art.l.Unlock()
+
+	if !art.tree.delete(keyOf(key)) {
+		return indexer.ErrDataDoesntExistInIndexer
+	}
+	return nil
+}
+
+// Len returns the number of keys in the ART.
+//
+// This is a race-safe method.
+func (art *ART) Len() int {
+	art.l.RLock()
+	defer art.l.RUnlock()
+	return art.tree.size
+}
+
+// Iterate calls fn with the keys of the ART in order.
+// The ART can't be stored into until the iteration is
+// done.
+//
+// This is a race-safe method.
+func (art *ART) Iterate(fn func(interface{}, indexer.ObjectLocation) bool) {
+	art.l.RLock()
+	defer art.l.RUnlock()
+
+	ascend(art.tree.root, nil, func(key string, loc indexer.ObjectLocation) bool {
+		return fn(key, loc)
+	})
+}
+
+// IteratePrefix calls fn with the keys of the ART which
+// start with the prefix in order, until fn returns false.
+// Only the part of the tree below the prefix is visited.
+// The ART can't be stored into until the iteration is
+// done.
+//
+// This is a race-safe method.
+func (art *ART) IteratePrefix(prefix interface{}, fn func(interface{}, indexer.ObjectLocation) bool) {
+	art.l.RLock()
+	defer art.l.RUnlock()
+
+	art.tree.ascendPrefix(keyOf(prefix), func(key string, loc indexer.ObjectLocation) bool {
+		return fn(key, loc)
+	})
+}
+
+// ApproximateMemoryUsage returns the approximate number of
+// bytes taken by the nodes of the ART, including the keys
+// and locations.
+//
+// This is a race-safe method.
+func (art *ART) ApproximateMemoryUsage() int64 {
+	art.l.RLock()
+	defer art.l.RUnlock()
+	return art.tree.bytes
+}
+
+// Print prints the keys of the ART in order, along with
+// their locations.
+func (art *ART) Print() {
+	art.l.RLock()
+	defer art.l.RUnlock()
+
+	ascend(art.tree.root, nil, func(key string, loc indexer.ObjectLocation) bool {
+		fmt.Print(key, ":", loc, " ")
+		return true
+	})
+	fmt.Println("")
+}
+
+// keyOf returns the bytes the key is indexed by.
+func keyOf(key interface{}) string {
+	switch key := key.(type) {
+	case string:
+		return key
+	case []byte:
+		return string(key)
+	default:
+		return fmt.Sprint(key)
+	}
+}
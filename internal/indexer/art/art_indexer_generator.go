@@ -0,0 +1,22 @@
+package art
+
+import "github.com/SystemBuilders/KeyValueStore/internal/indexer"
+
+// ARTIndexerGenerator implements IndexerGenerator.
+type ARTIndexerGenerator struct {
+}
+
+var _ (indexer.IndexerGenerator) = (*ARTIndexerGenerator)(nil)
+
+// NewARTIndexerGenerator creates a new instance of an
+// ARTIndexerGenerator.
+func NewARTIndexerGenerator() *ARTIndexerGenerator {
+	return &ARTIndexerGenerator{}
+}
+
+// Generate generates a new ART indexer instance.
+// This instance is independent of any other existing
+// indexers.
+func (aig *ARTIndexerGenerator) Generate() indexer.Indexer {
+	return NewARTIndexer()
+}
@@ -0,0 +1,159 @@
+package art
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/indexer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestART_StoreAndQuery(t *testing.T) {
+	art := NewARTIndexer()
+
+	_, err := art.Query("key")
+	assert.Equal(t, indexer.ErrDataDoesntExistInIndexer, err)
+
+	art.Store("key", indexer.ObjectLocation{Offset: 0, Size: 10})
+	art.Store([]byte("key"), indexer.ObjectLocation{Offset: 10, Size: 12})
+
+	objLoc, err := art.Query("key")
+	assert.Nil(t, err)
+	assert.Equal(t, indexer.ObjectLocation{Offset: 10, Size: 12}, objLoc)
+	assert.Equal(t, 1, art.Len())
+
+	art.Store(42, indexer.ObjectLocation{Size: 2})
+	objLoc, err = art.Query("42")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, objLoc.Size)
+}
+
+func TestART_QueryWith(t *testing.T) {
+	art := NewARTIndexer()
+
+	_, _, err := art.QueryWith(indexer.QueryLeast, nil)
+	assert.Equal(t, indexer.ErrDataDoesntExistInIndexer, err)
+
+	for i, key := range []string{"m", "c", "x", "a", "q", "xy"} {
+		art.Store(key, indexer.ObjectLocation{Offset: int64(i)})
+	}
+
+	key, objLoc, err := art.QueryWith(indexer.QueryLeast, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "a", key)
+	assert.Equal(t, int64(3), objLoc.Offset)
+
+	key, objLoc, err = art.QueryWith(indexer.QueryHighest, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "xy", key)
+	assert.Equal(t, int64(5), objLoc.Offset)
+
+	key, objLoc, err = art.QueryWith(indexer.QueryRandom, "q")
+	assert.Nil(t, err)
+	assert.Equal(t, "q", key)
+	assert.Equal(t, int64(4), objLoc.Offset)
+
+	_, _, err = art.QueryWith(indexer.QueryType(-1), "q")
+	assert.Equal(t, indexer.ErrUnknownQueryType, err)
+}
+
+func TestARTIndexerGenerator(t *testing.T) {
+	gen := NewARTIndexerGenerator()
+	first, second := gen.Generate(), gen.Generate()
+
+	first.Store("key", indexer.ObjectLocation{Size: 1})
+	_, err := second.Query("key")
+	assert.Equal(t, indexer.ErrDataDoesntExistInIndexer, err)
+	assert.Equal(t, "art", first.Type())
+}
+
+func TestART_DeleteAndIterate(t *testing.T) {
+	art := NewARTIndexer()
+	for i, key := range []string{"d", "b", "a", "c", "ab"} {
+		art.Store(key, indexer.ObjectLocation{Offset: int64(i)})
+	}
+	assert.Equal(t, 5, art.Len())
+
+	assert.Nil(t, art.Delete("b"))
+	assert.Equal(t, indexer.ErrDataDoesntExistInIndexer, art.Delete("b"))
+	assert.Equal(t, 4, art.Len())
+
+	var keys []interface{}
+	art.Iterate(func(key interface{}, _ indexer.ObjectLocation) bool {
+		keys = append(keys, key)
+		return len(keys) < 3
+	})
+	assert.Equal(t, []interface{}{"a", "ab", "c"}, keys)
+}
+
+// TestART_IteratePrefix ensures that exactly the keys
+// below a path are iterated, in order.
+func TestART_IteratePrefix(t *testing.T) {
+	art := NewARTIndexer()
+	paths := []string{
+		"/usr/bin/go",
+		"/usr/bin/gofmt",
+		"/usr/lib/go",
+		"/usr",
+		"/var/log",
+		"/usr/bin",
+	}
+	for i, path := range paths {
+		art.Store(path, indexer.ObjectLocation{Offset: int64(i)})
+	}
+
+	prefixed := func(prefix string) []interface{} {
+		var keys []interface{}
+		art.IteratePrefix(prefix, func(key interface{}, _ indexer.ObjectLocation) bool {
+			keys = append(keys, key)
+			return true
+		})
+		return keys
+	}
+
+	assert.Equal(t, []interface{}{"/usr/bin", "/usr/bin/go", "/usr/bin/gofmt"}, prefixed("/usr/bin"))
+	assert.Equal(t, []interface{}{"/usr/bin/go", "/usr/bin/gofmt"}, prefixed("/usr/bin/go"))
+	assert.Equal(t, []interface{}{"/usr/lib/go"}, prefixed("/usr/l"))
+	assert.Len(t, prefixed("/"), len(paths))
+	assert.Len(t, prefixed(""), len(paths))
+	assert.Empty(t, prefixed("/usr/bin/x"))
+	assert.Empty(t, prefixed("/opt"))
+}
+
+func TestART_ApproximateMemoryUsage(t *testing.T) {
+	art := NewARTIndexer()
+	assert.Zero(t, art.ApproximateMemoryUsage())
+
+	art.Store("key", indexer.ObjectLocation{})
+	usage := art.ApproximateMemoryUsage()
+	assert.True(t, usage > int64(len("key")))
+
+	art.Store("key", indexer.ObjectLocation{Offset: 10})
+	assert.Equal(t, usage, art.ApproximateMemoryUsage())
+
+	art.Store("key2", indexer.ObjectLocation{})
+	assert.True(t, art.ApproximateMemoryUsage() > usage)
+
+	assert.Nil(t, art.Delete("key2"))
+	assert.Equal(t, usage, art.ApproximateMemoryUsage())
+
+	assert.Nil(t, art.Delete("key"))
+	assert.Zero(t, art.ApproximateMemoryUsage())
+}
+
+// BenchmarkART_Query measures querying hierarchical keys,
+// which share long prefixes.
+func BenchmarkART_Query(b *testing.B) {
+	art := NewARTIndexer()
+	keys := make([]string, 0, 1<<14)
+	for i := 0; i < cap(keys); i++ {
+		key := "/data/" + strconv.Itoa(i%16) + "/segment/" + strconv.Itoa(i)
+		art.Store(key, indexer.ObjectLocation{Offset: int64(i)})
+		keys = append(keys, key)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		art.Query(keys[i%len(keys)])
+	}
+}
@@ -0,0 +1,155 @@
+package art
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/indexer"
+	"github.com/stretchr/testify/assert"
+)
+
+// checkNode ensures that the node and every node below it
+// are well formed, and returns the number of keys below
+// the node.
+func checkNode(t *testing.T, n node) int {
+	switch curr := n.(type) {
+	case *leaf:
+		return 1
+	case *inner:
+		assert.True(t, curr.count <= curr.kind.capacity())
+		assert.False(t, curr.count == 0, "node without children")
+		assert.False(t, curr.count == 1 && curr.leaf == nil, "node with a single child")
+
+		keys, children := 0, 0
+		last := -1
+		curr.ascendChildren(func(edge byte, child node) bool {
+			assert.True(t, int(edge) > last, "edges out of order")
+			last = int(edge)
+			children++
+			keys += checkNode(t, child)
+			return true
+		})
+		assert.Equal(t, curr.count, children)
+		if curr.leaf != nil {
+			keys++
+		}
+		return keys
+	}
+	return 0
+}
+
+// keysOf returns the keys the tree ascends through.
+func keysOf(n node) []string {
+	var keys []string
+	ascend(n, nil, func(key string, _ indexer.ObjectLocation) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// TestTree_GrowAndShrink ensures that an inner node grows
+// through every kind as children are added to it and
+// shrinks back as they're removed, keeping its children.
+func TestTree_GrowAndShrink(t *testing.T) {
+	var tr tree
+	tr.put("path/", indexer.ObjectLocation{})
+
+	kinds := map[int]nodeKind{2: node4, 5: node16, 17: node48, 49: node256}
+	for b := 0; b < 256; b++ {
+		tr.put("path/"+string([]byte{byte(b)}), indexer.ObjectLocation{Offset: int64(b)})
+		if kind, ok := kinds[b+1]; ok {
+			assert.Equal(t, kind, tr.root.(*inner).kind, "%d children", b+1)
+		}
+	}
+	assert.Equal(t, 257, tr.size)
+	assert.Equal(t, 257, checkNode(t, tr.root))
+
+	for b := 255; b >= 0; b-- {
+		assert.True(t, tr.delete("path/"+string([]byte{byte(b)})))
+		if b > 0 {
+			loc, ok := tr.get("path/" + string([]byte{byte(b - 1)}))
+			assert.True(t, ok)
+			assert.Equal(t, int64(b-1), loc.Offset)
+		}
+	}
+	assert.Equal(t, 1, tr.size)
+	assert.IsType(t, &leaf{}, tr.root)
+}
+
+// TestTree_Random ensures that the tree behaves like a map
+// whose keys are kept in order, across random puts and
+// deletes of keys sharing prefixes, and that its memory is
+// accounted for until all its keys are gone.
+func TestTree_Random(t *testing.T) {
+	var (
+		tr   tree
+		want = make(map[string]int64)
+		rnd  = rand.New(rand.NewSource(1))
+	)
+
+	randomKey := func() string {
+		parts := make([]string, rnd.Intn(4))
+		for i := range parts {
+			parts[i] = string("abc"[rnd.Intn(3)]) + strings.Repeat("x", rnd.Intn(3))
+		}
+		return strings.Join(parts, "/")
+	}
+
+	for i := 0; i < 5000; i++ {
+		key := randomKey()
+		if rnd.Intn(3) == 0 {
+			_, ok := want[key]
+			assert.Equal(t, ok, tr.delete(key), "delete %q", key)
+			delete(want, key)
+		} else {
+			tr.put(key, indexer.ObjectLocation{Offset: int64(i)})
+			want[key] = int64(i)
+		}
+
+		if i%100 != 0 {
+			continue
+		}
+
+		assert.Equal(t, len(want), tr.size)
+		assert.Equal(t, len(want), checkNode(t, tr.root))
+
+		var keys []string
+		for key, offset := range want {
+			loc, ok := tr.get(key)
+			assert.True(t, ok, "get %q", key)
+			assert.Equal(t, offset, loc.Offset)
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if len(keys) > 0 {
+			assert.Equal(t, keys, keysOf(tr.root))
+			least, _, _ := tr.min()
+			highest, _, _ := tr.max()
+			assert.Equal(t, keys[0], least)
+			assert.Equal(t, keys[len(keys)-1], highest)
+		}
+
+		prefix := randomKey()
+		var withPrefix, found []string
+		for _, key := range keys {
+			if strings.HasPrefix(key, prefix) {
+				withPrefix = append(withPrefix, key)
+			}
+		}
+		tr.ascendPrefix(prefix, func(key string, _ indexer.ObjectLocation) bool {
+			found = append(found, key)
+			return true
+		})
+		assert.Equal(t, withPrefix, found, "prefix %q", prefix)
+	}
+
+	for key := range want {
+		assert.True(t, tr.delete(key))
+	}
+	assert.Nil(t, tr.root)
+	assert.Zero(t, tr.size)
+	assert.Zero(t, tr.bytes)
+}
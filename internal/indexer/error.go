@@ -7,4 +7,7 @@ func (e Error) Error() string { return string(e) }
 
 const (
 	ErrDataDoesntExistInIndexer Error = "the queried key is not indexed in the indexer"
+	// ErrUnknownQueryType indicates that an indexer was queried
+	// with a QueryType it doesn't know of.
+	ErrUnknownQueryType Error = "the query type is unknown to the indexer"
 )
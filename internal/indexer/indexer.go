@@ -15,10 +15,35 @@ type Indexer interface {
 	// Based on the QueryType parameter, data can be
 	// queried in multiple ways.
 	Query(interface{}) (ObjectLocation, error)
+	// Delete removes the key from the indexer. It returns
+	// ErrDataDoesntExistInIndexer if the key isn't indexed.
+	Delete(interface{}) error
+	// Len returns the number of keys indexed.
+	Len() int
+	// Iterate calls the given function with every key
+	// indexed and its ObjectLocation until it returns
+	// false. An OrderedIndexer iterates in the order of
+	// the keys, any other indexer in no particular order.
+	Iterate(func(interface{}, ObjectLocation) bool)
+	// ApproximateMemoryUsage returns the approximate number
+	// of bytes taken by the indexer.
+	ApproximateMemoryUsage() int64
 	// Print prints the indexer in an explicit manner.
 	Print()
 }
 
+// OrderedIndexer is an Indexer which keeps its keys
+// in order, which lets it be queried by any QueryType.
+type OrderedIndexer interface {
+	Indexer
+	// QueryWith queries the indexer as described by the
+	// QueryType. QueryRandom looks up the given key like
+	// Query does, while QueryLeast and QueryHighest ignore
+	// it and look up the least or highest key indexed. The
+	// key found is returned along with its ObjectLocation.
+	QueryWith(QueryType, interface{}) (interface{}, ObjectLocation, error)
+}
+
 // ObjectLocation describes the precise location of an Object
 // in the database file.
 type ObjectLocation struct {
@@ -29,6 +54,9 @@ type ObjectLocation struct {
 	Offset int64
 	// Size describes the size of this particular object.
 	Size int
+	// Tombstone signifies that the object records the
+	// deletion of its key rather than a value.
+	Tombstone bool
 }
 
 // QueryType allows to query the indexer in a desired manner.
@@ -3,17 +3,26 @@ package _map
 import (
 	"fmt"
 	"sync"
+	"unsafe"
 
 	"github.com/SystemBuilders/KeyValueStore/internal/indexer"
 )
 
+// mapEntryOverhead is the approximate number of bytes a
+// Go map takes for every entry besides its key and value,
+// for its buckets and their spare slots.
+const mapEntryOverhead = int64(unsafe.Sizeof(uintptr(0)))
+
 // Map implements Indexer.
 // The map indexer is a race-safe indexer out of the box
 // and uses a single Go map to maintain the indexes of
 // a key-value store.
 type Map struct {
 	index map[interface{}]indexer.ObjectLocation
-	l     sync.Mutex
+	// bytes is the approximate number of bytes taken by
+	// the entries of the map.
+	bytes int64
+	l     sync.RWMutex
 }
 
 var _ (indexer.Indexer) = (*Map)(nil)
@@ -38,6 +47,9 @@ func (m *Map) Type() string {
 func (m *Map) Store(key interface{}, loc indexer.ObjectLocation) {
 	m.l.Lock()
 	keyString := key.(string)
+	if _, ok := m.index[keyString]; !ok {
+		m.bytes += entrySize(keyString)
+	}
 	m.index[keyString] = loc
 	m.l.Unlock()
 }
@@ -46,18 +58,74 @@ func (m *Map) Store(key interface{}, loc indexer.ObjectLocation) {
 //
 // This is a race-safe method.
 func (m *Map) Query(key interface{}) (indexer.ObjectLocation, error) {
-	m.l.Lock()
+	m.l.RLock()
 	if objLoc, ok := m.index[key]; ok {
-		m.l.Unlock()
+		m.l.RUnlock()
 		return objLoc, nil
 	}
-	m.l.Unlock()
+	m.l.RUnlock()
 	return indexer.ObjectLocation{}, indexer.ErrDataDoesntExistInIndexer
 }
 
+// Delete removes the key from the map.
+//
+// This is a race-safe method.
+func (m *Map) Delete(key interface{}) error {
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	if _, ok := m.index[key]; !ok {
+		return indexer.ErrDataDoesntExistInIndexer
+	}
+	delete(m.index, key)
+	m.bytes -= entrySize(key)
+	return nil
+}
+
+// Len returns the number of keys in the map.
+//
+// This is a race-safe method.
+func (m *Map) Len() int {
+	m.l.RLock()
+	defer m.l.RUnlock()
+	return len(m.index)
+}
+
+// Iterate calls fn with the keys of the map in no
+// particular order. The map can't be stored into until
+// the iteration is done.
+//
+// This is a race-safe method.
+func (m *Map) Iterate(fn func(interface{}, indexer.ObjectLocation) bool) {
+	m.l.RLock()
+	defer m.l.RUnlock()
+
+	for key, objLoc := range m.index {
+		if !fn(key, objLoc) {
+			return
+		}
+	}
+}
+
+// ApproximateMemoryUsage returns the approximate number of
+// bytes taken by the keys and locations in the map.
+//
+// This is a race-safe method.
+func (m *Map) ApproximateMemoryUsage() int64 {
+	m.l.RLock()
+	defer m.l.RUnlock()
+	return m.bytes
+}
+
 // Print prints the indexer map.
 func (m *Map) Print() {
-	m.l.Lock()
+	m.l.RLock()
 	fmt.Print(m.index)
-	m.l.Unlock()
+	m.l.RUnlock()
+}
+
+// entrySize returns the approximate number of bytes taken
+// by the entry of the key in the map.
+func entrySize(key interface{}) int64 {
+	return indexer.ApproximateKeySize(key) + indexer.ObjectLocationSize + mapEntryOverhead
 }
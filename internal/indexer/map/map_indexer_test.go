@@ -1 +1,64 @@
 package _map
+
+import (
+	"testing"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/indexer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMap_DeleteAndLen(t *testing.T) {
+	m := NewMapIndexer()
+	m.Store("a", indexer.ObjectLocation{Offset: 1})
+	m.Store("b", indexer.ObjectLocation{Offset: 2})
+	m.Store("a", indexer.ObjectLocation{Offset: 3})
+	assert.Equal(t, 2, m.Len())
+
+	assert.Nil(t, m.Delete("a"))
+	assert.Equal(t, indexer.ErrDataDoesntExistInIndexer, m.Delete("a"))
+	assert.Equal(t, 1, m.Len())
+
+	_, err := m.Query("a")
+	assert.Equal(t, indexer.ErrDataDoesntExistInIndexer, err)
+}
+
+func TestMap_Iterate(t *testing.T) {
+	m := NewMapIndexer()
+	for i, key := range []string{"a", "b", "c"} {
+		m.Store(key, indexer.ObjectLocation{Offset: int64(i)})
+	}
+
+	seen := make(map[interface{}]int64)
+	m.Iterate(func(key interface{}, objLoc indexer.ObjectLocation) bool {
+		seen[key] = objLoc.Offset
+		return true
+	})
+	assert.Equal(t, map[interface{}]int64{"a": 0, "b": 1, "c": 2}, seen)
+
+	var count int
+	m.Iterate(func(interface{}, indexer.ObjectLocation) bool {
+		count++
+		return false
+	})
+	assert.Equal(t, 1, count)
+}
+
+func TestMap_ApproximateMemoryUsage(t *testing.T) {
+	m := NewMapIndexer()
+	assert.Zero(t, m.ApproximateMemoryUsage())
+
+	m.Store("key", indexer.ObjectLocation{})
+	usage := m.ApproximateMemoryUsage()
+	assert.True(t, usage > int64(len("key")))
+
+	// Storing the key again doesn't take more memory.
+	m.Store("key", indexer.ObjectLocation{Offset: 10})
+	assert.Equal(t, usage, m.ApproximateMemoryUsage())
+
+	m.Store("longer key", indexer.ObjectLocation{})
+	assert.Equal(t, 2*usage+int64(len("longer key")-len("key")), m.ApproximateMemoryUsage())
+
+	assert.Nil(t, m.Delete("key"))
+	assert.Nil(t, m.Delete("longer key"))
+	assert.Zero(t, m.ApproximateMemoryUsage())
+}
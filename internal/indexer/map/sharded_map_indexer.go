@@ -0,0 +1,197 @@
+package _map
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/indexer"
+)
+
+const (
+	// defaultShards is the number of shards of a ShardedMap
+	// if none is given.
+	defaultShards = 16
+	// fnvOffset and fnvPrime are the parameters of the
+	// 32-bit FNV-1a hash spreading the keys over the shards.
+	fnvOffset = 2166136261
+	fnvPrime  = 16777619
+)
+
+// ShardedMap implements Indexer.
+// The sharded map indexer spreads the keys over a number
+// of independent maps, the shards, by the hash of the key.
+// Every shard has a lock of its own, so stores and queries
+// of keys in different shards don't wait for each other,
+// and queries don't wait for each other at all.
+type ShardedMap struct {
+	shards []*shard
+}
+
+// shard is one of the maps of a ShardedMap.
+type shard struct {
+	index map[string]indexer.ObjectLocation
+	// bytes is the approximate number of bytes taken by
+	// the entries of the shard.
+	bytes int64
+	l     sync.RWMutex
+	// _ pads the shard so that the locks of different
+	// shards don't share a cache line.
+	_ [64]byte
+}
+
+var _ (indexer.Indexer) = (*ShardedMap)(nil)
+
+// NewShardedMapIndexer returns a new sharded map indexer
+// with the given number of shards. A number of shards
+// below one means defaultShards.
+func NewShardedMapIndexer(shards int) *ShardedMap {
+	if shards < 1 {
+		shards = defaultShards
+	}
+
+	m := &ShardedMap{
+		shards: make([]*shard, shards),
+	}
+	for i := range m.shards {
+		m.shards[i] = &shard{
+			index: make(map[string]indexer.ObjectLocation),
+		}
+	}
+	return m
+}
+
+// Type returns the type of this indexer.
+func (m *ShardedMap) Type() string {
+	return "sharded-map"
+}
+
+// Store indexes the location of the key in the shard
+// of the key.
+//
+// This is a race-safe method.
+func (m *ShardedMap) Store(key interface{}, loc indexer.ObjectLocation) {
+	keyString := key.(string)
+	s := m.shardOf(keyString)
+
+	s.l.Lock()
+	if _, ok := s.index[keyString]; !ok {
+		s.bytes += entrySize(keyString)
+	}
+	s.index[keyString] = loc
+	s.l.Unlock()
+}
+
+// Query returns the ObjectLocation for the given key.
+//
+// This is a race-safe method.
+func (m *ShardedMap) Query(key interface{}) (indexer.ObjectLocation, error) {
+	keyString, ok := key.(string)
+	if !ok {
+		return indexer.ObjectLocation{}, indexer.ErrDataDoesntExistInIndexer
+	}
+	s := m.shardOf(keyString)
+
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	if objLoc, ok := s.index[keyString]; ok {
+		return objLoc, nil
+	}
+	return indexer.ObjectLocation{}, indexer.ErrDataDoesntExistInIndexer
+}
+
+// Delete removes the key from its shard.
+//
+// This is a race-safe method.
+func (m *ShardedMap) Delete(key interface{}) error {
+	keyString, ok := key.(string)
+	if !ok {
+		return indexer.ErrDataDoesntExistInIndexer
+	}
+	s := m.shardOf(keyString)
+
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if _, ok := s.index[keyString]; !ok {
+		return indexer.ErrDataDoesntExistInIndexer
+	}
+	delete(s.index, keyString)
+	s.bytes -= entrySize(keyString)
+	return nil
+}
+
+// Len returns the number of keys in all the shards.
+//
+// This is a race-safe method, but keys stored meanwhile
+// may or may not be counted.
+func (m *ShardedMap) Len() int {
+	var n int
+	for _, s := range m.shards {
+		s.l.RLock()
+		n += len(s.index)
+		s.l.RUnlock()
+	}
+	return n
+}
+
+// Iterate calls fn with the keys of every shard in no
+// particular order. A shard can't be stored into while its
+// keys are being iterated.
+//
+// This is a race-safe method.
+func (m *ShardedMap) Iterate(fn func(interface{}, indexer.ObjectLocation) bool) {
+	for _, s := range m.shards {
+		if !s.iterate(fn) {
+			return
+		}
+	}
+}
+
+// ApproximateMemoryUsage returns the approximate number of
+// bytes taken by the keys and locations in all the shards.
+//
+// This is a race-safe method.
+func (m *ShardedMap) ApproximateMemoryUsage() int64 {
+	var bytes int64
+	for _, s := range m.shards {
+		s.l.RLock()
+		bytes += s.bytes
+		s.l.RUnlock()
+	}
+	return bytes
+}
+
+// Print prints the shards of the indexer.
+func (m *ShardedMap) Print() {
+	for _, s := range m.shards {
+		s.l.RLock()
+		fmt.Print(s.index)
+		s.l.RUnlock()
+	}
+}
+
+// shardOf returns the shard holding the key, which is
+// picked by the FNV-1a hash of the key.
+func (m *ShardedMap) shardOf(key string) *shard {
+	h := uint32(fnvOffset)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= fnvPrime
+	}
+	return m.shards[h%uint32(len(m.shards))]
+}
+
+// iterate calls fn with the keys of the shard, and returns
+// false once fn does.
+func (s *shard) iterate(fn func(interface{}, indexer.ObjectLocation) bool) bool {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	for key, objLoc := range s.index {
+		if !fn(key, objLoc) {
+			return false
+		}
+	}
+	return true
+}
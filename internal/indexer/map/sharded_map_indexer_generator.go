@@ -0,0 +1,27 @@
+package _map
+
+import "github.com/SystemBuilders/KeyValueStore/internal/indexer"
+
+// ShardedMapIndexerGenerator implements IndexerGenerator.
+type ShardedMapIndexerGenerator struct {
+	shards int
+}
+
+var _ (indexer.IndexerGenerator) = (*ShardedMapIndexerGenerator)(nil)
+
+// NewShardedMapIndexerGenerator creates a new instance of a
+// ShardedMapIndexerGenerator generating indexers with the
+// given number of shards. A number of shards below one
+// means the default number of shards.
+func NewShardedMapIndexerGenerator(shards int) *ShardedMapIndexerGenerator {
+	return &ShardedMapIndexerGenerator{
+		shards: shards,
+	}
+}
+
+// Generate generates a new ShardedMap instance.
+// This instance is independent of any other existing
+// indexers.
+func (smig *ShardedMapIndexerGenerator) Generate() indexer.Indexer {
+	return NewShardedMapIndexer(smig.shards)
+}
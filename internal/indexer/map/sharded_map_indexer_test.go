@@ -0,0 +1,116 @@
+package _map
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/indexer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardedMap_StoreAndQuery(t *testing.T) {
+	m := NewShardedMapIndexer(4)
+	for i := 0; i < 100; i++ {
+		m.Store("key"+strconv.Itoa(i), indexer.ObjectLocation{Offset: int64(i)})
+	}
+	m.Store("key0", indexer.ObjectLocation{Offset: 100})
+	assert.Equal(t, 100, m.Len())
+
+	objLoc, err := m.Query("key0")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), objLoc.Offset)
+	objLoc, err = m.Query("key42")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(42), objLoc.Offset)
+
+	_, err = m.Query("key100")
+	assert.Equal(t, indexer.ErrDataDoesntExistInIndexer, err)
+	_, err = m.Query(42)
+	assert.Equal(t, indexer.ErrDataDoesntExistInIndexer, err)
+
+	assert.Nil(t, m.Delete("key42"))
+	assert.Equal(t, indexer.ErrDataDoesntExistInIndexer, m.Delete("key42"))
+	assert.Equal(t, 99, m.Len())
+
+	var count int
+	m.Iterate(func(interface{}, indexer.ObjectLocation) bool {
+		count++
+		return true
+	})
+	assert.Equal(t, 99, count)
+}
+
+// TestShardedMap_ApproximateMemoryUsage ensures that the
+// sharded map accounts for its keys like the map does.
+func TestShardedMap_ApproximateMemoryUsage(t *testing.T) {
+	m, sharded := NewMapIndexer(), NewShardedMapIndexer(0)
+	for i := 0; i < 50; i++ {
+		key := "key" + strconv.Itoa(i)
+		m.Store(key, indexer.ObjectLocation{})
+		sharded.Store(key, indexer.ObjectLocation{})
+	}
+	assert.Equal(t, m.ApproximateMemoryUsage(), sharded.ApproximateMemoryUsage())
+	assert.Len(t, sharded.shards, defaultShards)
+}
+
+// TestShardedMap_Concurrent ensures that the sharded map
+// can be stored into and queried at once, which is meant
+// to be run with -race.
+func TestShardedMap_Concurrent(t *testing.T) {
+	m := NewShardedMapIndexerGenerator(8).Generate()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := "key" + strconv.Itoa(i)
+				m.Store(key, indexer.ObjectLocation{Offset: int64(w)})
+				_, err := m.Query(key)
+				assert.Nil(t, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 200, m.Len())
+}
+
+// benchmarkParallel stores and queries keys of the indexer
+// from parallel goroutines, querying nine times out of ten.
+func benchmarkParallel(b *testing.B, idxr indexer.Indexer) {
+	const keys = 1024
+	names := make([]string, keys)
+	for i := range names {
+		names[i] = "key" + strconv.Itoa(i)
+		idxr.Store(names[i], indexer.ObjectLocation{Offset: int64(i)})
+	}
+
+	// Every goroutine starts at a different key, so they
+	// don't all go after the same keys at once.
+	var start uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint32(&start, 7919))
+		for pb.Next() {
+			key := names[i%keys]
+			if i%10 == 0 {
+				idxr.Store(key, indexer.ObjectLocation{Offset: int64(i)})
+			} else {
+				idxr.Query(key)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkMap_Parallel(b *testing.B) {
+	benchmarkParallel(b, NewMapIndexer())
+}
+
+func BenchmarkShardedMap_Parallel(b *testing.B) {
+	benchmarkParallel(b, NewShardedMapIndexer(defaultShards))
+}
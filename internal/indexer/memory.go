@@ -0,0 +1,22 @@
+package indexer
+
+import "unsafe"
+
+// ObjectLocationSize is the number of bytes taken by an
+// ObjectLocation.
+const ObjectLocationSize = int64(unsafe.Sizeof(ObjectLocation{}))
+
+// ApproximateKeySize returns the approximate number of
+// bytes taken by a key of an indexer, which is the size of
+// the interface holding it along with the bytes of a
+// string or byte slice key.
+func ApproximateKeySize(key interface{}) int64 {
+	size := int64(unsafe.Sizeof(key))
+	switch key := key.(type) {
+	case string:
+		size += int64(unsafe.Sizeof(key)) + int64(len(key))
+	case []byte:
+		size += int64(unsafe.Sizeof(key)) + int64(len(key))
+	}
+	return size
+}
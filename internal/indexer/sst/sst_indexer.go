@@ -2,34 +2,63 @@ package sst
 
 import (
 	"fmt"
+	"sync"
+	"unsafe"
+
 	"github.com/SystemBuilders/KeyValueStore/internal/indexer"
-	tree2 "github.com/SystemBuilders/KeyValueStore/internal/indexer/sst/tree"
+	"github.com/SystemBuilders/KeyValueStore/internal/indexer/sst/tree"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/comparator"
 )
 
+// nodeSize is the number of bytes taken by a node of the
+// tree besides its key, including the ObjectLocation it
+// holds.
+const nodeSize = int64(unsafe.Sizeof(tree.AVLNode{})) + indexer.ObjectLocationSize
+
 // SSTable stands for Sorted Segment Table.
-// An SSTable is a collection of a number of file
-// segments where each segment has the objects
-// in sorted order by the key of the object.
+// The SSTable indexer keeps the keys of a segment
+// in sorted order, along with the location of the
+// most recent object of every key in the segment.
+//
+// The keys are held in a balanced tree, so storing
+// and querying a key are logarithmic in the number of
+// keys, and the least and highest keys can be queried
+// as well.
+//
+// The SSTable indexer is race-safe, queries only wait
+// for stores and not for each other.
 type SSTable struct {
-	list        [][]SSTableObject
-
-	tree        tree2.Tree
-	currSegment int
+	tree *tree.AVLTree
+	// bytes is the approximate number of bytes taken by
+	// the nodes of the tree.
+	bytes int64
+	l     sync.RWMutex
 }
 
-// SSTableObject is the complex struct of a key
-// to be indexed and the object location in the segment.
-type SSTableObject struct {
-	key interface{}
-	loc indexer.ObjectLocation
-}
-
-var _ (indexer.Indexer) = (*SSTable)(nil)
+var _ (indexer.OrderedIndexer) = (*SSTable)(nil)
 
 // NewSSTableIndexer creates a new SSTable indexer.
 func NewSSTableIndexer() *SSTable {
+	return NewSSTableIndexerWithComparator(comparator.Bytewise)
+}
+
+// NewSSTableIndexerWithComparator creates a new SSTable
+// indexer which keeps the keys of the segment in the order
+// of the given comparator, as the storage the segment
+// belongs to does.
+//
+// Keys other than strings aren't ordered by a comparator,
+// they keep the order of tree.Compare.
+func NewSSTableIndexerWithComparator(cmp comparator.Comparator) *SSTable {
 	return &SSTable{
-		currSegment: -1,
+		tree: tree.NewAVLTreeWithCompare(func(a, b interface{}) int {
+			as, aok := a.(string)
+			bs, bok := b.(string)
+			if aok && bok {
+				return cmp.Compare(as, bs)
+			}
+			return tree.Compare(a, b)
+		}),
 	}
 }
 
@@ -38,123 +67,114 @@ func (sst *SSTable) Type() string {
 	return "sst"
 }
 
-// Store inserts into the sorted list of objects.
+// Store indexes the location of the key, replacing the
+// location it was indexed with before, if any.
 //
-// Iterate over the list until the first object bigger than the
-// inserting element is found and insert at that position.
+// This is a race-safe method.
 func (sst *SSTable) Store(key interface{}, loc indexer.ObjectLocation) {
-	sstObject := SSTableObject{key, loc}
-	if sst.currSegment < loc.Segment {
-		var segmentList []SSTableObject
-		sst.list = append(sst.list, segmentList)
-		sst.currSegment++
+	sst.l.Lock()
+	keys := sst.tree.Len()
+	sst.tree.Put(key, loc)
+	if sst.tree.Len() > keys {
+		sst.bytes += nodeSize + indexer.ApproximateKeySize(key)
 	}
+	sst.l.Unlock()
+}
 
-	if len(sst.list[sst.currSegment]) == 0 {
-		sst.list[sst.currSegment] = append(sst.list[sst.currSegment], sstObject)
-		return
-	}
-	if len(sst.list[sst.currSegment]) == 1 {
-		if sst.list[sst.currSegment][0].key.(string) > key.(string) {
-			sst.list[sst.currSegment] = append(
-				[]SSTableObject{sstObject}, sst.list[sst.currSegment]...,
-			)
-		} else {
-			sst.list[sst.currSegment] = append(sst.list[sst.currSegment], sstObject)
-		}
-		return
-	}
+// Query returns the ObjectLocation for the given key.
+//
+// This is a race-safe method.
+func (sst *SSTable) Query(key interface{}) (indexer.ObjectLocation, error) {
+	_, objLoc, err := sst.QueryWith(indexer.QueryRandom, key)
+	return objLoc, err
+}
 
-	for i, v := range sst.list[sst.currSegment] {
-		if key.(string) < v.key.(string) {
-			if i == 0 {
-				sst.list[sst.currSegment] = append([]SSTableObject{sstObject}, sst.list[sst.currSegment]...)
-				break
-			}
-			sst.list[sst.currSegment] = insertAt(i, SSTableObject{key, loc}, sst.list[sst.currSegment])
-			break
-		}
+// QueryWith queries the indexer as described by the
+// query type. The key is ignored when querying the least
+// or highest key.
+//
+// This is a race-safe method.
+func (sst *SSTable) QueryWith(qt indexer.QueryType, key interface{}) (interface{}, indexer.ObjectLocation, error) {
+	sst.l.RLock()
+	defer sst.l.RUnlock()
+
+	var (
+		value interface{}
+		ok    bool
+	)
+	switch qt {
+	case indexer.QueryRandom:
+		value, ok = sst.tree.Get(key)
+	case indexer.QueryLeast:
+		key, value, ok = sst.tree.Min()
+	case indexer.QueryHighest:
+		key, value, ok = sst.tree.Max()
+	default:
+		return nil, indexer.ObjectLocation{}, indexer.ErrUnknownQueryType
 	}
-	if key.(string) >= sst.list[sst.currSegment][len(sst.list[sst.currSegment])-1].key.(string) {
-		sst.list[sst.currSegment] = append(sst.list[sst.currSegment], SSTableObject{key, loc})
+
+	if !ok {
+		return nil, indexer.ObjectLocation{}, indexer.ErrDataDoesntExistInIndexer
 	}
+	return key, value.(indexer.ObjectLocation), nil
 }
 
-// Query is a simple binary search over the sorted list of
-// objects in the SSTable.
-// It searches backwards in the segments to find the most recently
-// appended value in the store.
-func (sst *SSTable) Query(key interface{}) (objLoc indexer.ObjectLocation) {
-	currSegment := sst.currSegment
-	for {
-		val, ok := binarySearch(sst.list[currSegment], key)
-		if !ok {
-			if currSegment != 0 {
-				currSegment--
-			} else {
-				// Object not found.
-				objLoc = indexer.ObjectLocation{}
-				return
-			}
-		} else {
-			objLoc = val
-			return
-		}
+// Delete removes the key from the SSTable.
+//
+// This is a race-safe method.
+func (sst *SSTable) Delete(key interface{}) error {
+	sst.l.Lock()
+	defer sst.l.Unlock()
+
+	if sst.tree.Delete(key) != nil {
+		return indexer.ErrDataDoesntExistInIndexer
 	}
+	sst.bytes -= nodeSize + indexer.ApproximateKeySize(key)
+	return nil
 }
 
-// Print prints the SSTable.
-func (sst *SSTable) Print() {
-	fmt.Println(sst.list)
+// Len returns the number of keys in the SSTable.
+//
+// This is a race-safe method.
+func (sst *SSTable) Len() int {
+	sst.l.RLock()
+	defer sst.l.RUnlock()
+	return sst.tree.Len()
 }
 
-// insertAt inserts at the provided index of the list.
-// insertAt is 0 - indexed.
-//
-// Example:
-// Initial slice: a = [1,2,3,4,5,6,7]
-// insertAt(3,9,a) returns [1,2,3,9,4,5,6,7]
+// Iterate calls fn with the keys of the SSTable in order.
+// The SSTable can't be stored into until the iteration is
+// done.
 //
-// insertAt DOES NOT CHECK FOR END OF LIST, PLEASE TAKE
-// CARE TO PASS APPROPRIATE ARGUMENTS.
-func insertAt(i int, key SSTableObject, list []SSTableObject) []SSTableObject {
-	rightSlice := list[i:]
-	copyOfRightSlice := make([]SSTableObject, len(rightSlice))
-	copy(copyOfRightSlice, rightSlice)
-	list = append(list[:i], key)
-	list = append(list[:i+1], copyOfRightSlice...)
-	return list
+// This is a race-safe method.
+func (sst *SSTable) Iterate(fn func(interface{}, indexer.ObjectLocation) bool) {
+	sst.l.RLock()
+	defer sst.l.RUnlock()
+
+	sst.tree.Ascend(func(key, value interface{}) bool {
+		return fn(key, value.(indexer.ObjectLocation))
+	})
 }
 
-// binarySearch does a simple binary search of the key in
-// the list. The second argument returns false if the object
-// was not found in the list.
-func binarySearch(list []SSTableObject, key interface{}) (indexer.ObjectLocation, bool) {
-	lenList := len(list)
-	if lenList == 0 {
-		return indexer.ObjectLocation{}, false
-	}
-	if lenList == 1 {
-		if key.(string) != list[0].key.(string) {
-			return indexer.ObjectLocation{}, false
-		}
-		return list[0].loc, true
-	}
-
-	low := 0
-	high := lenList - 1
-	for high >= low {
-		pivot := low + (high-low)/2
-
-		if list[pivot].key.(string) == key.(string) {
-			return list[pivot].loc, true
-		}
+// ApproximateMemoryUsage returns the approximate number of
+// bytes taken by the keys and locations in the SSTable.
+//
+// This is a race-safe method.
+func (sst *SSTable) ApproximateMemoryUsage() int64 {
+	sst.l.RLock()
+	defer sst.l.RUnlock()
+	return sst.bytes
+}
 
-		if list[pivot].key.(string) < key.(string) {
-			low = pivot + 1
-		} else {
-			high = pivot - 1
-		}
-	}
-	return indexer.ObjectLocation{}, false
+// Print prints the keys of the SSTable in order,
+// along with their locations.
+func (sst *SSTable) Print() {
+	sst.l.RLock()
+	defer sst.l.RUnlock()
+
+	sst.tree.Ascend(func(key, value interface{}) bool {
+		fmt.Print(key, ":", value, " ")
+		return true
+	})
+	fmt.Println("")
 }
@@ -0,0 +1,42 @@
+package sst
+
+import (
+	"github.com/SystemBuilders/KeyValueStore/internal/indexer"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/comparator"
+)
+
+// SSTableIndexerGenerator implements IndexerGenerator.
+type SSTableIndexerGenerator struct {
+	// cmp orders the keys of the indexers generated.
+	cmp comparator.Comparator
+}
+
+var _ (indexer.IndexerGenerator) = (*SSTableIndexerGenerator)(nil)
+
+// NewSSTableIndexerGenerator creates a new instance of a
+// SSTableIndexerGenerator.
+func NewSSTableIndexerGenerator() *SSTableIndexerGenerator {
+	return NewSSTableIndexerGeneratorWithComparator(comparator.Bytewise)
+}
+
+// NewSSTableIndexerGeneratorWithComparator creates a new
+// instance of a SSTableIndexerGenerator whose indexers
+// order their keys with the given comparator.
+func NewSSTableIndexerGeneratorWithComparator(cmp comparator.Comparator) *SSTableIndexerGenerator {
+	return &SSTableIndexerGenerator{
+		cmp: cmp,
+	}
+}
+
+// Generate generates a new SSTable indexer instance.
+// This instance is independent of any other existing
+// indexers.
+func (sig *SSTableIndexerGenerator) Generate() indexer.Indexer {
+	return NewSSTableIndexerWithComparator(sig.cmp)
+}
+
+// WithComparator returns a generator of SSTable indexers
+// ordering their keys with the given comparator.
+func (sig *SSTableIndexerGenerator) WithComparator(cmp comparator.Comparator) indexer.IndexerGenerator {
+	return NewSSTableIndexerGeneratorWithComparator(cmp)
+}
@@ -0,0 +1,116 @@
+package sst
+
+import (
+	"testing"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/indexer"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/comparator"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSTable_StoreAndQuery(t *testing.T) {
+	sst := NewSSTableIndexer()
+
+	_, err := sst.Query("key")
+	assert.Equal(t, indexer.ErrDataDoesntExistInIndexer, err)
+
+	sst.Store("key", indexer.ObjectLocation{Offset: 0, Size: 10})
+	sst.Store("key", indexer.ObjectLocation{Offset: 10, Size: 12})
+
+	objLoc, err := sst.Query("key")
+	assert.Nil(t, err)
+	assert.Equal(t, indexer.ObjectLocation{Offset: 10, Size: 12}, objLoc)
+}
+
+func TestSSTable_QueryWith(t *testing.T) {
+	sst := NewSSTableIndexer()
+
+	_, _, err := sst.QueryWith(indexer.QueryLeast, nil)
+	assert.Equal(t, indexer.ErrDataDoesntExistInIndexer, err)
+
+	for i, key := range []string{"m", "c", "x", "a", "q"} {
+		sst.Store(key, indexer.ObjectLocation{Offset: int64(i)})
+	}
+
+	key, objLoc, err := sst.QueryWith(indexer.QueryLeast, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "a", key)
+	assert.Equal(t, int64(3), objLoc.Offset)
+
+	key, objLoc, err = sst.QueryWith(indexer.QueryHighest, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "x", key)
+	assert.Equal(t, int64(2), objLoc.Offset)
+
+	key, objLoc, err = sst.QueryWith(indexer.QueryRandom, "q")
+	assert.Nil(t, err)
+	assert.Equal(t, "q", key)
+	assert.Equal(t, int64(4), objLoc.Offset)
+
+	_, _, err = sst.QueryWith(indexer.QueryType(-1), "q")
+	assert.Equal(t, indexer.ErrUnknownQueryType, err)
+}
+
+func TestSSTableIndexerGenerator(t *testing.T) {
+	gen := NewSSTableIndexerGenerator()
+	first, second := gen.Generate(), gen.Generate()
+
+	first.Store("key", indexer.ObjectLocation{Size: 1})
+	_, err := second.Query("key")
+	assert.Equal(t, indexer.ErrDataDoesntExistInIndexer, err)
+	assert.Equal(t, "sst", first.Type())
+}
+
+func TestSSTable_Comparator(t *testing.T) {
+	gen := NewSSTableIndexerGenerator().WithComparator(comparator.Reverse(comparator.Bytewise))
+	sst := gen.Generate().(*SSTable)
+	for i, key := range []string{"b", "a", "c"} {
+		sst.Store(key, indexer.ObjectLocation{Offset: int64(i)})
+	}
+
+	var keys []interface{}
+	sst.Iterate(func(key interface{}, _ indexer.ObjectLocation) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.Equal(t, []interface{}{"c", "b", "a"}, keys)
+
+	least, loc, err := sst.QueryWith(indexer.QueryLeast, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "c", least)
+	assert.Equal(t, int64(2), loc.Offset)
+}
+
+func TestSSTable_DeleteAndIterate(t *testing.T) {
+	sst := NewSSTableIndexer()
+	for i, key := range []string{"d", "b", "a", "c"} {
+		sst.Store(key, indexer.ObjectLocation{Offset: int64(i)})
+	}
+	assert.Equal(t, 4, sst.Len())
+
+	assert.Nil(t, sst.Delete("b"))
+	assert.Equal(t, indexer.ErrDataDoesntExistInIndexer, sst.Delete("b"))
+	assert.Equal(t, 3, sst.Len())
+
+	var keys []interface{}
+	sst.Iterate(func(key interface{}, _ indexer.ObjectLocation) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.Equal(t, []interface{}{"a", "c", "d"}, keys)
+}
+
+func TestSSTable_ApproximateMemoryUsage(t *testing.T) {
+	sst := NewSSTableIndexer()
+	assert.Zero(t, sst.ApproximateMemoryUsage())
+
+	sst.Store("key", indexer.ObjectLocation{})
+	usage := sst.ApproximateMemoryUsage()
+	assert.True(t, usage > int64(len("key")))
+
+	sst.Store("key", indexer.ObjectLocation{Offset: 10})
+	assert.Equal(t, usage, sst.ApproximateMemoryUsage())
+
+	assert.Nil(t, sst.Delete("key"))
+	assert.Zero(t, sst.ApproximateMemoryUsage())
+}
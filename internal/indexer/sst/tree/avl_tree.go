@@ -1,21 +1,20 @@
 package tree
 
 import (
-	"bytes"
 	"fmt"
-	"github.com/SystemBuilders/KeyValueStore/internal/database"
 )
 
 // AVLNode represents a single node of the
 // AVL Tree. It has the left and right branches
-// as links its successors and parent, its own value and
-// the height of the node from the root of the tree,
-// assuming the root is at height zero.
+// as links to its successors, its own key and the
+// value stored with it, and the height of the
+// subtree rooted at the node, a leaf being at
+// height one.
 type AVLNode struct {
-	Value []byte
-	InterfaceValue interface{}
-	Left, Right, Parent *AVLNode
-	Height int
+	Key         interface{}
+	Value       interface{}
+	Left, Right *AVLNode
+	Height      int
 }
 
 // AVLTree implements Tree.
@@ -23,134 +22,422 @@ type AVLNode struct {
 // This can be searched similarly to a binary tree,
 // all the while having a logarithmic complexity for
 // the search.
+//
+// The heights of the two subtrees of every node differ
+// by at most one, which is restored by rotating the
+// nodes after every insertion and deletion.
+//
+// Every node holds a key, which orders the nodes, along
+// with a value stored with it. The keys are ordered by
+// the compare function of the tree.
+//
+// The AVL tree isn't safe for concurrent use.
 type AVLTree struct {
 	headNode *AVLNode
-
-	printQueue []*AVLNode
-	printItr int
+	compare  CompareFunc
+	size     int
 }
 
 var _ Tree = (*AVLTree)(nil)
 
-// newAVLNode returns a new AVLNode with the
-// given value and a zero height. It's left and
-// right node are nil.
-func newAVLNode(val interface{}) *AVLNode {
-
-	byteData := database.GetBytesFromInterface(val)
-
+// newAVLNode returns a new leaf AVLNode with the
+// given key and value. It's left and right node
+// are nil.
+func newAVLNode(key, value interface{}) *AVLNode {
 	return &AVLNode{
-		Value: byteData,
-		InterfaceValue: val,
-		Left: nil,
-		Right: nil,
-		Parent: nil,
-		Height: 0,
+		Key:    key,
+		Value:  value,
+		Height: 1,
 	}
 }
 
 // NewAVLTree returns a ready to use instance
-// of an AVL Tree. This always returns a nil
-// head-node.
+// of an AVL Tree, ordering its keys with Compare.
+// This always returns a nil head-node.
 func NewAVLTree() *AVLTree {
+	return NewAVLTreeWithCompare(Compare)
+}
+
+// NewAVLTreeWithCompare returns an empty AVL Tree
+// ordering its keys with the given compare function.
+func NewAVLTreeWithCompare(compare CompareFunc) *AVLTree {
 	return &AVLTree{
-		headNode: nil,
-		printItr: 0,
+		compare: compare,
 	}
 }
 
-func (avl *AVLTree) Insert(val interface{}) error {
-
-	if avl.headNode == nil {
-		avl.headNode = newAVLNode(val)
-		avl.headNode.Height = 0
+// Insert inserts the key into the tree with a nil
+// value. Inserting a key which is already in the tree
+// leaves it as it is.
+func (avl *AVLTree) Insert(key interface{}) error {
+	if _, ok := avl.Get(key); ok {
 		return nil
 	}
 
-	node := avl.headNode
-	newNode := newAVLNode(val)
-	node.insert(newNode)
+	avl.Put(key, nil)
 	return nil
 }
 
-func (avl *AVLTree) Delete(val interface{}) error {
+// Put stores the value with the key, replacing the
+// value stored with it before if the key is already
+// in the tree.
+func (avl *AVLTree) Put(key, value interface{}) {
+	var inserted bool
+	avl.headNode = avl.insert(avl.headNode, key, value, &inserted)
+	if inserted {
+		avl.size++
+	}
+}
+
+// Get returns the value stored with the key and whether
+// the key is in the tree.
+func (avl *AVLTree) Get(key interface{}) (interface{}, bool) {
+	node := avl.query(key)
+	if node == nil {
+		return nil, false
+	}
+	return node.Value, true
+}
+
+// Delete deletes the key from the tree. It returns
+// ErrNodeDoesntExist if the key isn't in the tree.
+func (avl *AVLTree) Delete(key interface{}) error {
+	var deleted bool
+	avl.headNode = avl.delete(avl.headNode, key, &deleted)
+	if !deleted {
+		return ErrNodeDoesntExist
+	}
+
+	avl.size--
 	return nil
 }
 
-func (avl *AVLTree) Query(val interface{}) (bool,error) {
+// Query returns true if the key is in the tree, and
+// false along with ErrNodeDoesntExist otherwise.
+func (avl *AVLTree) Query(key interface{}) (bool, error) {
+	if avl.query(key) == nil {
+		return false, ErrNodeDoesntExist
+	}
 	return true, nil
 }
 
-// Print prints the tree in a level order manner.
-func (avl *AVLTree) Print() {
-	avl.printQueue = append(avl.printQueue,avl.headNode)
-	curLevel := 0
-	for avl.printItr < len(avl.printQueue) {
-		// The "dequeue" operation.
-		node := avl.printQueue[avl.printItr]
-		avl.printItr++
-
-		// If the node is in the next level, print a
-		// new line before printing the node.
-		if node.Height > curLevel {
-			fmt.Println("")
-			curLevel = node.Height
+// Len returns the number of keys in the tree.
+func (avl *AVLTree) Len() int {
+	return avl.size
+}
+
+// Height returns the height of the tree, which is zero
+// for an empty tree.
+func (avl *AVLTree) Height() int {
+	return avl.headNode.height()
+}
+
+// Ascend calls fn with every key in the tree and its
+// value in ascending order of the keys, until fn returns
+// false.
+func (avl *AVLTree) Ascend(fn func(key, value interface{}) bool) {
+	avl.ascend(avl.headNode, nil, nil, fn)
+}
+
+// AscendRange calls fn with every key in the tree from
+// the start key up to but not including the end key, in
+// ascending order, until fn returns false. A nil start
+// or end leaves the range open on that side.
+func (avl *AVLTree) AscendRange(start, end interface{}, fn func(key, value interface{}) bool) {
+	avl.ascend(avl.headNode, start, end, fn)
+}
+
+// Min returns the smallest key in the tree and its value,
+// and false if the tree is empty.
+func (avl *AVLTree) Min() (interface{}, interface{}, bool) {
+	if avl.headNode == nil {
+		return nil, nil, false
+	}
+
+	node := avl.headNode.min()
+	return node.Key, node.Value, true
+}
+
+// Max returns the largest key in the tree and its value,
+// and false if the tree is empty.
+func (avl *AVLTree) Max() (interface{}, interface{}, bool) {
+	node := avl.headNode
+	if node == nil {
+		return nil, nil, false
+	}
+
+	for node.Right != nil {
+		node = node.Right
+	}
+	return node.Key, node.Value, true
+}
+
+// Floor returns the largest key in the tree which is
+// smaller than or equal to the given key, along with its
+// value, and false if there is no such key.
+func (avl *AVLTree) Floor(key interface{}) (interface{}, interface{}, bool) {
+	var floor *AVLNode
+	for node := avl.headNode; node != nil; {
+		cmp := avl.compare(key, node.Key)
+		if cmp == 0 {
+			return node.Key, node.Value, true
 		}
 
-		// Print the node.
-		fmt.Printf("%d", node.InterfaceValue)
-		fmt.Printf(", ")
+		if cmp < 0 {
+			node = node.Left
+		} else {
+			floor = node
+			node = node.Right
+		}
+	}
+
+	if floor == nil {
+		return nil, nil, false
+	}
+	return floor.Key, floor.Value, true
+}
+
+// Ceiling returns the smallest key in the tree which is
+// larger than or equal to the given key, along with its
+// value, and false if there is no such key.
+func (avl *AVLTree) Ceiling(key interface{}) (interface{}, interface{}, bool) {
+	var ceiling *AVLNode
+	for node := avl.headNode; node != nil; {
+		cmp := avl.compare(key, node.Key)
+		if cmp == 0 {
+			return node.Key, node.Value, true
+		}
 
-		// Append the successors if they exist.
-		if node.Left != nil {
-			avl.printQueue = append(avl.printQueue, node.Left)
+		if cmp > 0 {
+			node = node.Right
+		} else {
+			ceiling = node
+			node = node.Left
 		}
-		if node.Right != nil {
-			avl.printQueue = append(avl.printQueue, node.Right)
+	}
+
+	if ceiling == nil {
+		return nil, nil, false
+	}
+	return ceiling.Key, ceiling.Value, true
+}
+
+// Print prints the tree in a level order manner,
+// one level per line.
+func (avl *AVLTree) Print() {
+	if avl.headNode == nil {
+		fmt.Println("")
+		return
+	}
+
+	level := []*AVLNode{avl.headNode}
+	for len(level) > 0 {
+		var next []*AVLNode
+		for _, node := range level {
+			fmt.Printf("%v, ", node.Key)
+
+			// Append the successors if they exist.
+			if node.Left != nil {
+				next = append(next, node.Left)
+			}
+			if node.Right != nil {
+				next = append(next, node.Right)
+			}
 		}
+		fmt.Println("")
+		level = next
 	}
-	fmt.Println("")
 }
 
-// insert has lesser control than Insert and can only insert on
-// an existing tree.
+// insert stores the key and value in the subtree rooted
+// at the node and returns the new root of the subtree.
 //
 // Inserting is a simple compare and insert mechanism that obeys
-// the binary tree insertion style. This also computes the height
-// of the node inserted.
-// The second part of inserting is the balancing of the tree based
-// on the AVL tree rules. In-depth documentation exists in the
-// respective balancing functions.
-func (node *AVLNode) insert(currNode *AVLNode) (*AVLNode, error) {
+// the binary tree insertion style. On the way back up, the
+// height of every node on the path is recomputed and the
+// node is rebalanced based on the AVL tree rules. In-depth
+// documentation exists in the respective balancing functions.
+func (avl *AVLTree) insert(node *AVLNode, key, value interface{}, inserted *bool) *AVLNode {
+	if node == nil {
+		*inserted = true
+		return newAVLNode(key, value)
+	}
+
+	cmp := avl.compare(key, node.Key)
+	switch {
+	case cmp < 0:
+		node.Left = avl.insert(node.Left, key, value, inserted)
+	case cmp > 0:
+		node.Right = avl.insert(node.Right, key, value, inserted)
+	default:
+		node.Value = value
+		return node
+	}
+
+	return node.rebalance()
+}
+
+// delete removes the key from the subtree rooted at the
+// node and returns the new root of the subtree.
+//
+// A node with two successors is replaced by the smallest
+// node of its right subtree, which is removed from there
+// instead.
+func (avl *AVLTree) delete(node *AVLNode, key interface{}, deleted *bool) *AVLNode {
 	if node == nil {
-		node = currNode
-		return node, nil
+		return nil
 	}
 
-	// If incoming value greater than current
-	// node value.
-	if bytes.Compare(node.Value, currNode.Value) < 0 {
-		newNode, err := node.Right.insert(currNode)
+	cmp := avl.compare(key, node.Key)
+	switch {
+	case cmp < 0:
+		node.Left = avl.delete(node.Left, key, deleted)
+	case cmp > 0:
+		node.Right = avl.delete(node.Right, key, deleted)
+	default:
+		*deleted = true
+		if node.Left == nil {
+			return node.Right
+		}
 		if node.Right == nil {
-			node.Right = newNode
-			newNode.Parent = node
-			newNode.Height = newNode.Parent.Height + 1
-			return newNode, err
+			return node.Left
+		}
+
+		successor := node.Right.min()
+		node.Key, node.Value = successor.Key, successor.Value
+		node.Right = avl.delete(node.Right, successor.Key, new(bool))
+	}
+
+	return node.rebalance()
+}
+
+// query returns the node holding the key, or nil if
+// the key isn't in the tree.
+func (avl *AVLTree) query(key interface{}) *AVLNode {
+	node := avl.headNode
+	for node != nil {
+		cmp := avl.compare(key, node.Key)
+		switch {
+		case cmp < 0:
+			node = node.Left
+		case cmp > 0:
+			node = node.Right
+		default:
+			return node
 		}
-		return node, nil
+	}
+	return nil
+}
+
+// ascend walks the subtree rooted at the node in order,
+// calling fn with the keys between start and end. It
+// returns false once fn does.
+func (avl *AVLTree) ascend(node *AVLNode, start, end interface{}, fn func(key, value interface{}) bool) bool {
+	if node == nil {
+		return true
+	}
+
+	afterStart := start == nil || avl.compare(node.Key, start) >= 0
+	beforeEnd := end == nil || avl.compare(node.Key, end) < 0
+
+	// The left subtree only holds keys in the range if
+	// this node's key is past the start, and likewise for
+	// the right subtree and the end.
+	if afterStart && !avl.ascend(node.Left, start, end, fn) {
+		return false
+	}
+	if afterStart && beforeEnd && !fn(node.Key, node.Value) {
+		return false
+	}
+	if beforeEnd {
+		return avl.ascend(node.Right, start, end, fn)
+	}
+	return true
+}
+
+// height returns the height of the subtree rooted at
+// the node, which is zero for a nil node.
+func (node *AVLNode) height() int {
+	if node == nil {
+		return 0
+	}
+	return node.Height
+}
+
+// balance returns the difference between the heights
+// of the left and the right subtrees of the node.
+func (node *AVLNode) balance() int {
+	return node.Left.height() - node.Right.height()
+}
+
+// updateHeight recomputes the height of the node from
+// the heights of its successors.
+func (node *AVLNode) updateHeight() {
+	left, right := node.Left.height(), node.Right.height()
+	if left > right {
+		node.Height = left + 1
 	} else {
-		newNode, err := node.Left.insert(currNode)
-		if node.Left == nil {
-			node.Left = newNode
-			newNode.Parent = node
-			newNode.Height = newNode.Parent.Height + 1
-			return newNode, err
+		node.Height = right + 1
+	}
+}
+
+// min returns the node with the smallest key in the
+// subtree rooted at the node.
+func (node *AVLNode) min() *AVLNode {
+	for node.Left != nil {
+		node = node.Left
+	}
+	return node
+}
+
+// rebalance restores the AVL property of the node, whose
+// subtrees are balanced and differ in height by at most
+// two, and returns the new root of its subtree.
+//
+// A subtree leaning to the left is rotated right, after
+// rotating its left successor left if that one leans to
+// the right, which is the left-right case. A subtree
+// leaning to the right is handled the other way round.
+func (node *AVLNode) rebalance() *AVLNode {
+	node.updateHeight()
+
+	switch balance := node.balance(); {
+	case balance > 1:
+		if node.Left.balance() < 0 {
+			node.Left = node.Left.rotateLeft()
+		}
+		return node.rotateRight()
+	case balance < -1:
+		if node.Right.balance() > 0 {
+			node.Right = node.Right.rotateRight()
 		}
-		return node, nil
+		return node.rotateLeft()
 	}
+	return node
+}
+
+// rotateLeft makes the right successor of the node the
+// root of its subtree, with the node as its left successor,
+// and returns the new root.
+func (node *AVLNode) rotateLeft() *AVLNode {
+	root := node.Right
+	node.Right = root.Left
+	root.Left = node
+
+	node.updateHeight()
+	root.updateHeight()
+	return root
 }
 
+// rotateRight makes the left successor of the node the
+// root of its subtree, with the node as its right successor,
+// and returns the new root.
+func (node *AVLNode) rotateRight() *AVLNode {
+	root := node.Left
+	node.Left = root.Right
+	root.Right = node
 
-func (avl *AVLTree) query(val interface{}) (*AVLNode, error) {
-	return nil, nil
-}
\ No newline at end of file
+	node.updateHeight()
+	root.updateHeight()
+	return root
+}
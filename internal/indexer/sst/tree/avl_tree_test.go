@@ -1,8 +1,11 @@
 package tree
 
 import (
-	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"sort"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestAVLTree_Insert(t *testing.T) {
@@ -35,4 +38,213 @@ func TestAVLTree_Insert(t *testing.T) {
 	assert.Nil(err)
 
 	avlTree.Print()
+	// Printing doesn't change the tree, so it can be
+	// printed again.
+	avlTree.Print()
+
+	assert.Equal(7, avlTree.Len())
+	assert.Equal(4, avlTree.Height())
+	assert.True(checkAVL(t, avlTree))
+	assert.Equal([]interface{}{-2, -1, 0, 1, 2, 3, 4}, keys(avlTree))
+}
+
+func TestAVLTree_Delete(t *testing.T) {
+	assert := assert.New(t)
+	avlTree := NewAVLTree()
+	for i := 0; i < 10; i++ {
+		avlTree.Put(i, i*i)
+	}
+
+	assert.Nil(avlTree.Delete(3))
+	assert.Equal(ErrNodeDoesntExist, avlTree.Delete(3))
+	assert.Equal(ErrNodeDoesntExist, avlTree.Delete(10))
+
+	ok, err := avlTree.Query(3)
+	assert.False(ok)
+	assert.Equal(ErrNodeDoesntExist, err)
+
+	value, ok := avlTree.Get(4)
+	assert.True(ok)
+	assert.Equal(16, value)
+
+	assert.Equal(9, avlTree.Len())
+	assert.Equal([]interface{}{0, 1, 2, 4, 5, 6, 7, 8, 9}, keys(avlTree))
+}
+
+func TestAVLTree_Put(t *testing.T) {
+	assert := assert.New(t)
+	avlTree := NewAVLTree()
+
+	avlTree.Put("key", "first")
+	avlTree.Put("key", "second")
+	assert.Nil(avlTree.Insert("key"))
+
+	value, ok := avlTree.Get("key")
+	assert.True(ok)
+	assert.Equal("second", value)
+	assert.Equal(1, avlTree.Len())
+}
+
+func TestAVLTree_FloorAndCeiling(t *testing.T) {
+	assert := assert.New(t)
+	avlTree := NewAVLTree()
+	for _, key := range []string{"b", "d", "f"} {
+		avlTree.Put(key, key+"-value")
+	}
+
+	tests := []struct {
+		key            string
+		floor, ceiling interface{}
+	}{
+		{"a", nil, "b"},
+		{"b", "b", "b"},
+		{"c", "b", "d"},
+		{"f", "f", "f"},
+		{"g", "f", nil},
+	}
+	for _, tt := range tests {
+		key, value, ok := avlTree.Floor(tt.key)
+		assert.Equal(tt.floor, key, "floor of %s", tt.key)
+		assert.Equal(tt.floor != nil, ok)
+		if ok {
+			assert.Equal(key.(string)+"-value", value)
+		}
+
+		key, _, ok = avlTree.Ceiling(tt.key)
+		assert.Equal(tt.ceiling, key, "ceiling of %s", tt.key)
+		assert.Equal(tt.ceiling != nil, ok)
+	}
+
+	min, _, ok := avlTree.Min()
+	assert.True(ok)
+	assert.Equal("b", min)
+	max, _, ok := avlTree.Max()
+	assert.True(ok)
+	assert.Equal("f", max)
+
+	_, _, ok = NewAVLTree().Min()
+	assert.False(ok)
+}
+
+func TestAVLTree_AscendRange(t *testing.T) {
+	assert := assert.New(t)
+	avlTree := NewAVLTree()
+	for i := 0; i < 20; i++ {
+		avlTree.Insert(i)
+	}
+
+	var got []interface{}
+	avlTree.AscendRange(5, 9, func(key, _ interface{}) bool {
+		got = append(got, key)
+		return true
+	})
+	assert.Equal([]interface{}{5, 6, 7, 8}, got)
+
+	got = nil
+	avlTree.AscendRange(nil, 3, func(key, _ interface{}) bool {
+		got = append(got, key)
+		return true
+	})
+	assert.Equal([]interface{}{0, 1, 2}, got)
+
+	// The iteration stops once the callback returns false.
+	got = nil
+	avlTree.AscendRange(15, nil, func(key, _ interface{}) bool {
+		got = append(got, key)
+		return len(got) < 2
+	})
+	assert.Equal([]interface{}{15, 16}, got)
+}
+
+// TestAVLTree_RandomOperations runs random insertions and
+// deletions against a map and ensures that the tree holds
+// the same keys and keeps the AVL invariant after each one.
+func TestAVLTree_RandomOperations(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	avlTree := NewAVLTree()
+	model := make(map[int]int)
+
+	for i := 0; i < 5000; i++ {
+		key := rnd.Intn(500)
+		if rnd.Intn(3) == 0 {
+			err := avlTree.Delete(key)
+			if _, ok := model[key]; ok {
+				assert.Nil(t, err)
+			} else {
+				assert.Equal(t, ErrNodeDoesntExist, err)
+			}
+			delete(model, key)
+		} else {
+			avlTree.Put(key, i)
+			model[key] = i
+		}
+
+		if !checkAVL(t, avlTree) {
+			return
+		}
+	}
+
+	want := make([]interface{}, 0, len(model))
+	for key := range model {
+		want = append(want, key)
+	}
+	sort.Slice(want, func(i, j int) bool { return want[i].(int) < want[j].(int) })
+	assert.Equal(t, want, keys(avlTree))
+
+	for key, value := range model {
+		got, ok := avlTree.Get(key)
+		assert.True(t, ok)
+		assert.Equal(t, value, got)
+	}
+}
+
+// keys returns the keys of the tree in order.
+func keys(avlTree *AVLTree) []interface{} {
+	var keys []interface{}
+	avlTree.Ascend(func(key, _ interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// checkAVL checks that the keys of the tree are ordered,
+// that the heights of the nodes are right and that the
+// heights of the subtrees of every node differ by at most
+// one.
+func checkAVL(t *testing.T, avlTree *AVLTree) bool {
+	var (
+		count int
+		check func(node *AVLNode, min, max interface{}) int
+		ok    = true
+	)
+	check = func(node *AVLNode, min, max interface{}) int {
+		if node == nil {
+			return 0
+		}
+		count++
+
+		if min != nil && Compare(node.Key, min) <= 0 ||
+			max != nil && Compare(node.Key, max) >= 0 {
+			ok = assert.Fail(t, "keys out of order", "%v isn't within %v and %v", node.Key, min, max)
+		}
+
+		left := check(node.Left, min, node.Key)
+		right := check(node.Right, node.Key, max)
+		if left-right > 1 || right-left > 1 {
+			ok = assert.Fail(t, "unbalanced node", "%v has subtrees of heights %d and %d", node.Key, left, right)
+		}
+
+		height := left + 1
+		if right > left {
+			height = right + 1
+		}
+		if node.Height != height {
+			ok = assert.Fail(t, "wrong height", "%v has height %d instead of %d", node.Key, node.Height, height)
+		}
+		return height
+	}
+
+	check(avlTree.headNode, nil, nil)
+	return assert.Equal(t, avlTree.Len(), count) && ok
 }
@@ -0,0 +1,146 @@
+package tree
+
+import (
+	"bytes"
+	"encoding/gob"
+	"strings"
+)
+
+// CompareFunc orders the keys of a tree. It returns a
+// negative number if a is smaller than b, a positive
+// number if a is larger than b, and zero if they're equal.
+type CompareFunc func(a, b interface{}) int
+
+// Compare is the default CompareFunc of the trees.
+//
+// Strings and byte slices are ordered lexicographically
+// and numbers by their value. Keys of any other type, or
+// of two types which can't be compared with each other,
+// are ordered by their gob encoding, which is consistent
+// but not meaningful.
+func Compare(a, b interface{}) int {
+	switch a := a.(type) {
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b)
+		}
+	case []byte:
+		if b, ok := b.([]byte); ok {
+			return bytes.Compare(a, b)
+		}
+	}
+
+	if a, ok := toInt(a); ok {
+		if b, ok := toInt(b); ok {
+			return compareOrdered(a < b, a > b)
+		}
+	}
+	if a, ok := toUint(a); ok {
+		if b, ok := toUint(b); ok {
+			return compareOrdered(a < b, a > b)
+		}
+	}
+	if a, ok := toInt(a); ok {
+		if b, ok := toUint(b); ok {
+			return compareIntUint(a, b)
+		}
+	}
+	if a, ok := toUint(a); ok {
+		if b, ok := toInt(b); ok {
+			return -compareIntUint(b, a)
+		}
+	}
+	if a, ok := toFloat(a); ok {
+		if b, ok := toFloat(b); ok {
+			return compareOrdered(a < b, a > b)
+		}
+	}
+
+	return bytes.Compare(gobBytes(a), gobBytes(b))
+}
+
+// compareOrdered turns the result of comparing two
+// values into the result of a CompareFunc.
+func compareOrdered(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// compareIntUint compares a signed integer with an
+// unsigned one exactly. A negative integer is smaller
+// than any unsigned one, and the others are compared as
+// unsigned integers.
+func compareIntUint(a int64, b uint64) int {
+	if a < 0 {
+		return -1
+	}
+	return compareOrdered(uint64(a) < b, uint64(a) > b)
+}
+
+// toInt returns the value of a signed integer.
+func toInt(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	}
+	return 0, false
+}
+
+// toUint returns the value of an unsigned integer.
+func toUint(v interface{}) (uint64, bool) {
+	switch v := v.(type) {
+	case uint:
+		return uint64(v), true
+	case uint8:
+		return uint64(v), true
+	case uint16:
+		return uint64(v), true
+	case uint32:
+		return uint64(v), true
+	case uint64:
+		return v, true
+	}
+	return 0, false
+}
+
+// toFloat returns the value of any number as a float,
+// which is how floats are compared with integers.
+func toFloat(v interface{}) (float64, bool) {
+	if i, ok := toInt(v); ok {
+		return float64(i), true
+	}
+	if u, ok := toUint(v); ok {
+		return float64(u), true
+	}
+
+	switch v := v.(type) {
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// gobBytes returns the gob encoding of the value.
+func gobBytes(v interface{}) []byte {
+	var buf bytes.Buffer
+	encoder := gob.NewEncoder(&buf)
+	encoder.Encode(v)
+
+	return buf.Bytes()
+}
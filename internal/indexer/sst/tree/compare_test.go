@@ -0,0 +1,33 @@
+package tree
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a, b interface{}
+		want int
+	}{
+		{"a", "b", -1},
+		{"b", "a", 1},
+		{"a", "a", 0},
+		{[]byte("ab"), []byte("b"), -1},
+		{-2, 1, -1},
+		{int64(3), int8(3), 0},
+		{uint(10), uint64(2), 1},
+		{-1, uint(1), -1},
+		{uint(1), -1, 1},
+		// Past 2^53 the keys differ but their floats don't.
+		{int64(1<<53 + 1), uint64(1 << 53), 1},
+		{uint64(1<<53 + 1), int64(1 << 53), 1},
+		{int64(1 << 62), uint64(1<<62 + 1), -1},
+		{int64(5), uint8(5), 0},
+		{1.5, 1, 1},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, Compare(tt.a, tt.b), "comparing %v with %v", tt.a, tt.b)
+	}
+}
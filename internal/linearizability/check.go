@@ -0,0 +1,194 @@
+package linearizability
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Violation is the error returned by Check for a history
+// which isn't linearizable.
+type Violation struct {
+	// Key is the key whose operations aren't linearizable.
+	Key string
+	// History is a smallest part of the operations on the
+	// key which isn't linearizable. Leaving out any more of
+	// them makes it linearizable, unless they're the writes
+	// of values which the queries left in it read.
+	History History
+}
+
+func (v *Violation) Error() string {
+	return fmt.Sprintf("the operations on %q aren't linearizable:\n%s", v.Key, v.History)
+}
+
+// Check checks that the history is linearizable against a
+// key-value register holding no keys to begin with: that
+// every operation can be taken to happen at once, at some
+// point between the times it was invoked and returned at,
+// such that every query reads the value last inserted with
+// its key, or nothing if there's none or it was deleted
+// since. Pending writes may take effect at any point after
+// they were invoked, or not at all.
+//
+// As the keys don't affect each other, the operations of
+// every key are checked on their own. A *Violation is
+// returned for the first key, in order, whose operations
+// aren't linearizable.
+//
+// Checking is exponential in the number of operations on a
+// key which overlap each other, and is meant for histories
+// of tests.
+func Check(h History) error {
+	byKey := make(map[string]History)
+	for _, op := range h {
+		byKey[op.Key] = append(byKey[op.Key], op)
+	}
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		ops := byKey[key]
+		sort.Slice(ops, func(i, j int) bool { return ops[i].Invoke < ops[j].Invoke })
+		if !linearizable(ops) {
+			return &Violation{Key: key, History: shrink(ops)}
+		}
+	}
+	return nil
+}
+
+// register is the state of a key.
+type register struct {
+	value string
+	found bool
+}
+
+// apply applies the operation to the register, and reports
+// whether the operation could have returned what it did.
+func (r register) apply(op Operation) (register, bool) {
+	switch op.Kind {
+	case Insert:
+		return register{value: op.Value, found: true}, true
+	case Delete:
+		return register{}, true
+	default:
+		return r, r.found == op.Found && r.value == op.Value
+	}
+}
+
+// linearizable reports whether the operations on a key,
+// ordered by the time they were invoked at, are
+// linearizable.
+//
+// The operations are taken in the order they're taken to
+// happen in, trying every operation which can happen next
+// and backtracking once none can. Every set of operations
+// taken along with the state of the key they leave is only
+// tried once.
+func linearizable(ops History) bool {
+	var (
+		taken = make([]byte, (len(ops)+7)/8)
+		// left is the number of operations left which
+		// returned, and so must be taken.
+		left = 0
+		// tried holds the sets of operations taken along
+		// with the state they left, which were tried.
+		tried = make(map[string]bool)
+	)
+	for _, op := range ops {
+		if op.Return != Pending {
+			left++
+		}
+	}
+
+	var search func(r register) bool
+	search = func(r register) bool {
+		if left == 0 {
+			return true
+		}
+		state := string(taken) + fmt.Sprintf("%t%s", r.found, r.value)
+		if tried[state] {
+			return false
+		}
+		tried[state] = true
+
+		// An operation can happen next if it was invoked
+		// before every operation left returned.
+		next := int64(Pending)
+		for i, op := range ops {
+			if taken[i/8]&(1<<(i%8)) == 0 && op.Return < next {
+				next = op.Return
+			}
+		}
+
+		for i, op := range ops {
+			if op.Invoke > next {
+				break
+			}
+			if taken[i/8]&(1<<(i%8)) != 0 {
+				continue
+			}
+			after, ok := r.apply(op)
+			if !ok {
+				continue
+			}
+
+			taken[i/8] |= 1 << (i % 8)
+			if op.Return != Pending {
+				left--
+			}
+			if search(after) {
+				return true
+			}
+			taken[i/8] &^= 1 << (i % 8)
+			if op.Return != Pending {
+				left++
+			}
+		}
+		return false
+	}
+	return search(register{})
+}
+
+// shrink returns a smallest part of the operations on a
+// key which isn't linearizable, found by leaving out one
+// operation after another for as long as what's left isn't
+// linearizable. An insert of a value which a query left
+// reads, and a delete while a query left reads nothing,
+// are kept to explain what the queries read.
+func shrink(ops History) History {
+	for shrunk := true; shrunk; {
+		shrunk = false
+		for i := 0; i < len(ops); i++ {
+			if explains(ops, ops[i]) {
+				continue
+			}
+			candidate := append(append(History(nil), ops[:i]...), ops[i+1:]...)
+			if !linearizable(candidate) {
+				ops = candidate
+				shrunk = true
+				i--
+			}
+		}
+	}
+	return ops
+}
+
+// explains reports whether the write may explain what one
+// of the queries of the operations read.
+func explains(ops History, write Operation) bool {
+	for _, op := range ops {
+		if op.Kind != Query {
+			continue
+		}
+		if write.Kind == Insert && op.Found && op.Value == write.Value {
+			return true
+		}
+		if write.Kind == Delete && !op.Found {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package linearizability
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func insert(client int, key, value string, invoke, ret int64) Operation {
+	return Operation{Client: client, Kind: Insert, Key: key, Value: value, Invoke: invoke, Return: ret}
+}
+
+func del(client int, key string, invoke, ret int64) Operation {
+	return Operation{Client: client, Kind: Delete, Key: key, Invoke: invoke, Return: ret}
+}
+
+func query(client int, key, value string, invoke, ret int64) Operation {
+	return Operation{Client: client, Kind: Query, Key: key, Value: value, Found: value != "", Invoke: invoke, Return: ret}
+}
+
+func TestCheck_Linearizable(t *testing.T) {
+	for name, h := range map[string]History{
+		"empty": nil,
+		"sequential": {
+			query(0, "k", "", 1, 2),
+			insert(0, "k", "1", 3, 4),
+			query(1, "k", "1", 5, 6),
+			del(1, "k", 7, 8),
+			query(0, "k", "", 9, 10),
+		},
+		// The query overlaps both inserts, so it may read
+		// either value.
+		"overlapping": {
+			insert(0, "k", "1", 1, 4),
+			insert(1, "k", "2", 2, 5),
+			query(2, "k", "1", 3, 6),
+			query(2, "k", "1", 7, 8),
+		},
+		// The insert failed but a query read its value.
+		"pending": {
+			insert(0, "k", "1", 1, Pending),
+			query(1, "k", "", 2, 3),
+			query(1, "k", "1", 4, 5),
+		},
+		// The keys don't affect each other.
+		"keys": {
+			insert(0, "a", "1", 1, 2),
+			insert(0, "b", "2", 3, 4),
+			query(1, "a", "1", 5, 6),
+			query(1, "b", "2", 7, 8),
+		},
+	} {
+		assert.Nil(t, Check(h), name)
+	}
+}
+
+func TestCheck_Violation(t *testing.T) {
+	stale := History{
+		insert(0, "other", "1", 1, 2),
+		insert(0, "k", "1", 3, 4),
+		query(2, "k", "1", 5, 6),
+		insert(1, "k", "2", 7, 8),
+		query(2, "k", "2", 9, 10),
+		query(0, "k", "1", 11, 12),
+	}
+	err := Check(stale)
+	v, ok := err.(*Violation)
+	assert.True(t, ok)
+	assert.Equal(t, "k", v.Key)
+	// The first query doesn't matter, and neither does the
+	// second one once the insert of 2 returned before the
+	// stale read.
+	assert.Equal(t, History{
+		insert(0, "k", "1", 3, 4),
+		insert(1, "k", "2", 7, 8),
+		query(0, "k", "1", 11, 12),
+	}, v.History)
+
+	// The value read was never written.
+	err = Check(History{
+		insert(0, "k", "1", 1, 2),
+		query(1, "k", "3", 3, 4),
+	})
+	assert.Equal(t, &Violation{Key: "k", History: History{query(1, "k", "3", 3, 4)}}, err)
+
+	// A read can't come back after a delete returned.
+	err = Check(History{
+		insert(0, "k", "1", 1, 2),
+		del(0, "k", 3, 4),
+		query(1, "k", "1", 5, 6),
+	})
+	assert.NotNil(t, err)
+	assert.Len(t, err.(*Violation).History, 3)
+}
+
+// mapStore is a store which is linearizable, and may lose
+// its writes if lossy is set.
+type mapStore struct {
+	mu     sync.Mutex
+	values map[string]interface{}
+	lossy  bool
+	writes int
+}
+
+func (s *mapStore) Insert(key []byte, value interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writes++
+	if s.lossy && s.writes%3 == 0 {
+		return nil
+	}
+	s.values[string(key)] = value
+	return nil
+}
+
+func (s *mapStore) Query(key []byte) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.values[string(key)]
+	if !ok {
+		return nil, storage.ErrDataNotFound
+	}
+	return value, nil
+}
+
+func (s *mapStore) Delete(key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if string(key) == "broken" {
+		return errors.New("broken")
+	}
+	delete(s.values, string(key))
+	return nil
+}
+
+func TestRecorder(t *testing.T) {
+	s := &mapStore{values: make(map[string]interface{})}
+	r := NewRecorder(s)
+
+	var wg sync.WaitGroup
+	for c := 0; c < 4; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				key := []byte{'a' + byte(i%3)}
+				switch i % 4 {
+				case 0:
+					r.Insert(c, key, c*100+i)
+				case 1:
+					r.Delete(c, key)
+				default:
+					r.Query(c, key)
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	h := r.History()
+	assert.Len(t, h, 200)
+	assert.Nil(t, Check(h))
+
+	assert.NotNil(t, r.Delete(0, []byte("broken")))
+	h = r.History()
+	assert.Equal(t, int64(Pending), h[len(h)-1].Return)
+
+	// A store losing writes is caught.
+	s = &mapStore{values: make(map[string]interface{}), lossy: true}
+	r = NewRecorder(s)
+	for i := 0; i < 3; i++ {
+		r.Insert(0, []byte("k"), i)
+	}
+	r.Query(0, []byte("k"))
+	assert.NotNil(t, Check(r.History()))
+}
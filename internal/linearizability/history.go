@@ -0,0 +1,201 @@
+package linearizability
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/storage"
+)
+
+// Kind is the kind of an operation on a key-value store.
+type Kind int
+
+const (
+	// Insert stores a value with a key.
+	Insert Kind = iota
+	// Query reads the value of a key.
+	Query
+	// Delete removes the value of a key.
+	Delete
+)
+
+// String returns the name of the kind.
+func (k Kind) String() string {
+	switch k {
+	case Insert:
+		return "insert"
+	case Query:
+		return "query"
+	default:
+		return "delete"
+	}
+}
+
+// Pending is the return time of a write which failed. It
+// may or may not have taken effect, at any time after it
+// was invoked, as though it never returned.
+const Pending = math.MaxInt64
+
+// Operation is an operation made by a client of a store,
+// along with what it returned.
+type Operation struct {
+	// Client is the client which made the operation. The
+	// operations of a client don't overlap.
+	Client int
+	Kind   Kind
+	Key    string
+	// Value is the JSON encoding of the value inserted, or
+	// of the value read by a query. Values are compared by
+	// their encoding, which is what the store keeps.
+	Value string
+	// Found tells whether a query found a value.
+	Found bool
+	// Invoke and Return are the times the operation was
+	// invoked and returned at. An operation which returned
+	// before another was invoked must take effect before it.
+	Invoke, Return int64
+}
+
+// String describes the operation.
+func (op Operation) String() string {
+	var s strings.Builder
+	s.WriteString("client " + strconv.Itoa(op.Client) + ": " + op.Kind.String() + " " + op.Key)
+	switch {
+	case op.Kind == Insert:
+		s.WriteString(" = " + op.Value)
+	case op.Kind == Query && op.Found:
+		s.WriteString(" -> " + op.Value)
+	case op.Kind == Query:
+		s.WriteString(" -> nothing")
+	}
+
+	s.WriteString(" [" + strconv.FormatInt(op.Invoke, 10) + ", ")
+	if op.Return == Pending {
+		s.WriteString("pending]")
+	} else {
+		s.WriteString(strconv.FormatInt(op.Return, 10) + "]")
+	}
+	return s.String()
+}
+
+// History is the operations made by the clients of a store.
+type History []Operation
+
+// String describes the operations, one per line.
+func (h History) String() string {
+	var s strings.Builder
+	for _, op := range h {
+		s.WriteString(op.String() + "\n")
+	}
+	return s.String()
+}
+
+// Store is a key-value store whose operations can be
+// recorded, which database.Database is.
+type Store interface {
+	Insert([]byte, interface{}) error
+	Query([]byte) (interface{}, error)
+	Delete([]byte) error
+}
+
+// Recorder makes operations on a store on behalf of its
+// clients and records them in a history, stamped with the
+// times they were invoked and returned at.
+//
+// The times are taken from a counter rather than a clock,
+// so no two of them are the same and an operation recorded
+// as returning before another was invoked really did.
+//
+// This is a race-safe type.
+type Recorder struct {
+	// now is the last time handed out.
+	now int64
+	db  Store
+	// mu guards history.
+	mu      sync.Mutex
+	history History
+}
+
+// NewRecorder returns a recorder of the operations on the
+// store.
+func NewRecorder(db Store) *Recorder {
+	return &Recorder{db: db}
+}
+
+// Insert inserts the value with the key on behalf of the
+// client. A failed insert is recorded as pending.
+func (r *Recorder) Insert(client int, key []byte, value interface{}) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	op := Operation{Client: client, Kind: Insert, Key: string(key), Value: string(encoded), Invoke: r.tick()}
+	err = r.db.Insert(key, value)
+	op.Return = r.tick()
+	if err != nil {
+		op.Return = Pending
+	}
+	r.record(op)
+	return err
+}
+
+// Query queries the key on behalf of the client. A query
+// which fails other than with storage.ErrDataNotFound isn't
+// recorded, as it tells nothing about the store.
+func (r *Recorder) Query(client int, key []byte) (interface{}, error) {
+	op := Operation{Client: client, Kind: Query, Key: string(key), Invoke: r.tick()}
+	value, err := r.db.Query(key)
+	op.Return = r.tick()
+
+	switch err {
+	case nil:
+		encoded, encodeErr := json.Marshal(value)
+		if encodeErr != nil {
+			return value, err
+		}
+		op.Value = string(encoded)
+		op.Found = true
+	case storage.ErrDataNotFound:
+	default:
+		return value, err
+	}
+	r.record(op)
+	return value, err
+}
+
+// Delete deletes the key on behalf of the client. A failed
+// delete is recorded as pending.
+func (r *Recorder) Delete(client int, key []byte) error {
+	op := Operation{Client: client, Kind: Delete, Key: string(key), Invoke: r.tick()}
+	err := r.db.Delete(key)
+	op.Return = r.tick()
+	if err != nil {
+		op.Return = Pending
+	}
+	r.record(op)
+	return err
+}
+
+// History returns the operations recorded so far.
+func (r *Recorder) History() History {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append(History(nil), r.history...)
+}
+
+// tick returns the next time.
+func (r *Recorder) tick() int64 {
+	return atomic.AddInt64(&r.now, 1)
+}
+
+// record adds the operation to the history.
+func (r *Recorder) record(op Operation) {
+	r.mu.Lock()
+	r.history = append(r.history, op)
+	r.mu.Unlock()
+}
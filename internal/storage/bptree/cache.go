@@ -0,0 +1,85 @@
+package bptree
+
+import (
+	"container/list"
+	"sync"
+)
+
+// cache holds the most recently used nodes of the tree,
+// up to a number of pages, evicting the least recently
+// used one when it's full.
+//
+// The nodes are parsed pages, so a cached node is found
+// without reading or parsing its page again. Nodes never
+// change once written, so a cached node stays valid until
+// its page is freed.
+//
+// The cache is race-safe, as readers of the tree fill it
+// alongside each other.
+type cache struct {
+	mu       sync.Mutex
+	capacity int
+	// lru holds the nodes, most recently used first.
+	lru   *list.List
+	nodes map[pgid]*list.Element
+}
+
+// newCache creates a cache holding up to capacity nodes.
+func newCache(capacity int) *cache {
+	return &cache{
+		capacity: capacity,
+		lru:      list.New(),
+		nodes:    make(map[pgid]*list.Element),
+	}
+}
+
+// get returns the node of the page, if it's cached.
+func (c *cache) get(id pgid) (*node, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.nodes[id]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*node), true
+}
+
+// put caches the node, replacing the one cached for its
+// page before, if any.
+func (c *cache) put(n *node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.nodes[n.id]; ok {
+		e.Value = n
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	c.nodes[n.id] = c.lru.PushFront(n)
+	for c.lru.Len() > c.capacity {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.nodes, e.Value.(*node).id)
+	}
+}
+
+// remove drops the node of the page, whose page was freed.
+func (c *cache) remove(id pgid) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.nodes[id]; ok {
+		c.lru.Remove(e)
+		delete(c.nodes, id)
+	}
+}
+
+// len returns the number of cached nodes.
+func (c *cache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
@@ -0,0 +1,34 @@
+package bptree
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := newCache(2)
+	c.put(&node{id: 1})
+	c.put(&node{id: 2})
+
+	_, ok := c.get(1)
+	assert.True(t, ok)
+
+	c.put(&node{id: 3})
+	assert.Equal(t, 2, c.len())
+	_, ok = c.get(2)
+	assert.False(t, ok)
+	_, ok = c.get(1)
+	assert.True(t, ok)
+
+	replacement := &node{id: 3, leaf: true}
+	c.put(replacement)
+	n, ok := c.get(3)
+	assert.True(t, ok)
+	assert.Equal(t, replacement, n)
+
+	c.remove(3)
+	_, ok = c.get(3)
+	assert.False(t, ok)
+	assert.Equal(t, 1, c.len())
+}
@@ -0,0 +1,29 @@
+package bptree
+
+// Error is a helper type for creating constant errors.
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+const (
+	// ErrKeyNotFound indicates that the key isn't in the tree.
+	ErrKeyNotFound Error = "the key does not exist in the tree"
+	// ErrKeyTooLarge indicates that a key doesn't fit in a quarter
+	// of a page, which is the most a key may take.
+	ErrKeyTooLarge Error = "the key is too large for the page size of the tree"
+	// ErrTreeClosed indicates that the tree was used after it was
+	// closed.
+	ErrTreeClosed Error = "the tree is closed"
+	// ErrCorruptPage indicates that a page of the file failed its
+	// checksum or couldn't be parsed.
+	ErrCorruptPage Error = "the page is corrupt"
+	// ErrInvalidFile indicates that neither meta page of the file
+	// is valid, so the file isn't a tree or is damaged beyond use.
+	ErrInvalidFile Error = "the file is not a valid tree"
+	// ErrComparatorMismatch indicates that a tree was opened with a
+	// comparator other than the one its keys are ordered by.
+	ErrComparatorMismatch Error = "the comparator doesn't match the one the tree was created with"
+	// ErrComparatorNameTooLong indicates that the name of a comparator
+	// doesn't fit in a meta page.
+	ErrComparatorNameTooLong Error = "the name of the comparator is too long to be recorded"
+)
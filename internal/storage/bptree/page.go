@@ -0,0 +1,417 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"math"
+)
+
+// pgid is the id of a page, which is its position in the
+// file. Page 0 holds the meta pages, so no node is ever
+// kept there and 0 stands for no page.
+type pgid uint64
+
+// pageKind tells what a page holds.
+type pageKind byte
+
+const (
+	leafPage pageKind = iota + 1
+	branchPage
+	overflowPage
+	freelistPage
+	metaPage
+)
+
+const (
+	// pageHeaderSize is the size of the header every page
+	// starts with, laid out as,
+	//
+	//	kind | 3 reserved bytes | crc32
+	//
+	// where the checksum covers the whole page besides
+	// itself.
+	pageHeaderSize = 8
+	// metaSize is the size of each of the two meta pages.
+	// Both are kept in page 0, so a meta page can be found
+	// before the page size is known.
+	metaSize = 512
+	// minPageSize is the smallest page size of a tree.
+	minPageSize = 2 * metaSize
+	// overflowHeaderSize is the size of the next page id
+	// and length which follow the header of an overflow
+	// or freelist page.
+	overflowHeaderSize = pageHeaderSize + 8 + 4
+)
+
+// metaMagic marks the beginning of every meta page.
+var metaMagic = []byte("KVSBTRE1")
+
+// meta describes a committed state of the tree.
+//
+// A meta page is laid out as,
+//
+//	header | magic | page size u32 | txid | root | page count | freelist | keys | comparator length u16 | comparator
+//
+// where every field is big-endian and takes 8 bytes
+// unless noted otherwise.
+type meta struct {
+	pageSize int
+	// txid is the id of the commit which wrote the meta
+	// page. The meta page with the highest valid txid is
+	// the current one.
+	txid uint64
+	// root is the page of the root node, or 0 if the tree
+	// is empty.
+	root pgid
+	// pageCount is the number of pages of the file which
+	// are in use or free. Pages past it are allocated by
+	// growing the file.
+	pageCount pgid
+	// freelist is the first page of the free list, or 0
+	// if there are no free pages.
+	freelist pgid
+	// keys is the number of keys in the tree.
+	keys int64
+	// comparator is the name of the comparator the keys
+	// are ordered by.
+	comparator string
+}
+
+// maxComparatorNameSize is the longest comparator name
+// which fits in a meta page.
+const maxComparatorNameSize = metaSize - pageHeaderSize - 8 - 4 - 5*8 - 2
+
+// encode returns the meta page.
+func (m meta) encode() []byte {
+	buf := make([]byte, metaSize)
+	buf[0] = byte(metaPage)
+
+	p := buf[pageHeaderSize:]
+	p = p[copy(p, metaMagic):]
+	binary.BigEndian.PutUint32(p, uint32(m.pageSize))
+	p = p[4:]
+	for _, v := range []uint64{m.txid, uint64(m.root), uint64(m.pageCount), uint64(m.freelist), uint64(m.keys)} {
+		binary.BigEndian.PutUint64(p, v)
+		p = p[8:]
+	}
+	binary.BigEndian.PutUint16(p, uint16(len(m.comparator)))
+	copy(p[2:], m.comparator)
+
+	seal(buf)
+	return buf
+}
+
+// decodeMeta parses a meta page. It returns false if the
+// page isn't a valid meta page, which is the case for a
+// meta page torn by a crash while it was written.
+func decodeMeta(buf []byte) (meta, bool) {
+	var m meta
+	if len(buf) != metaSize || pageKind(buf[0]) != metaPage || !verify(buf) {
+		return m, false
+	}
+
+	p := buf[pageHeaderSize:]
+	if string(p[:len(metaMagic)]) != string(metaMagic) {
+		return m, false
+	}
+	p = p[len(metaMagic):]
+
+	m.pageSize = int(binary.BigEndian.Uint32(p))
+	p = p[4:]
+	fields := make([]uint64, 5)
+	for i := range fields {
+		fields[i] = binary.BigEndian.Uint64(p)
+		p = p[8:]
+	}
+	m.txid, m.root, m.pageCount, m.freelist, m.keys = fields[0], pgid(fields[1]), pgid(fields[2]), pgid(fields[3]), int64(fields[4])
+
+	n := int(binary.BigEndian.Uint16(p))
+	if n > maxComparatorNameSize || m.pageSize < minPageSize {
+		return m, false
+	}
+	m.comparator = string(p[2 : 2+n])
+	return m, true
+}
+
+// seal writes the checksum of the page into its header.
+func seal(buf []byte) {
+	binary.BigEndian.PutUint32(buf[4:pageHeaderSize], checksum(buf))
+}
+
+// verify reports whether the checksum in the header of the
+// page matches its contents.
+func verify(buf []byte) bool {
+	return binary.BigEndian.Uint32(buf[4:pageHeaderSize]) == checksum(buf)
+}
+
+// checksum returns the checksum of the page, leaving out
+// the checksum in its header.
+func checksum(buf []byte) uint32 {
+	crc := crc32.NewIEEE()
+	crc.Write(buf[:4])
+	crc.Write(buf[pageHeaderSize:])
+	return crc.Sum32()
+}
+
+// value is the value of a key in a leaf. Values too large
+// to be kept in the leaf are kept in a chain of overflow
+// pages instead, and the leaf holds the first of them.
+type value struct {
+	// data is the value if it's kept in the leaf.
+	data string
+	// overflow is the first page of the value if it's kept
+	// in overflow pages, or 0.
+	overflow pgid
+	// size is the size of the value.
+	size int
+}
+
+// node is a node of the tree as held in a page.
+//
+// A leaf holds keys along with their values and a branch
+// holds the pages of its children, separated by keys. All
+// the keys below children[i] come before keys[i], and all
+// those below children[i+1] come at or after it.
+//
+// Nodes read from the file are shared by every reader and
+// never changed. A write changes copies of the nodes it
+// touches, which are written to new pages.
+type node struct {
+	id       pgid
+	leaf     bool
+	keys     []string
+	values   []value
+	children []pgid
+}
+
+// clone returns a copy of the node which can be changed,
+// with no page yet.
+func (n *node) clone() *node {
+	c := &node{leaf: n.leaf}
+	c.keys = append([]string(nil), n.keys...)
+	c.values = append([]value(nil), n.values...)
+	c.children = append([]pgid(nil), n.children...)
+	return c
+}
+
+// empty reports whether the node holds nothing at all.
+func (n *node) empty() bool {
+	if n.leaf {
+		return len(n.keys) == 0
+	}
+	return len(n.children) == 0
+}
+
+// nodeHeaderSize is the space taken in a page of a node
+// by the header and the number of keys or children.
+const nodeHeaderSize = pageHeaderSize + binary.MaxVarintLen32
+
+// size returns the number of bytes taken by the node in
+// its page.
+func (n *node) size() int {
+	size := nodeHeaderSize
+	for i, key := range n.keys {
+		size += uvarintSize(len(key)) + len(key)
+		if n.leaf {
+			size += valueSize(n.values[i])
+		}
+	}
+	if !n.leaf {
+		size += 8 * len(n.children)
+	}
+	return size
+}
+
+// valueSize returns the number of bytes taken by the value
+// in a leaf page.
+func valueSize(v value) int {
+	size := 1 + uvarintSize(v.size)
+	if v.overflow != 0 {
+		return size + 8
+	}
+	return size + len(v.data)
+}
+
+// uvarintSize returns the number of bytes taken by v
+// encoded as a uvarint.
+func uvarintSize(v int) int {
+	size := 1
+	for ; v >= 0x80; v >>= 7 {
+		size++
+	}
+	return size
+}
+
+// encode returns the page of the node, which must fit in
+// a page of the given size.
+//
+// A leaf is laid out as,
+//
+//	header | key count | cells...
+//
+// where every cell is the key length and key followed by
+// a flag telling whether the value overflows, the value
+// size and either the value or its first overflow page.
+// A branch is laid out as,
+//
+//	header | child count | child | (key length | key | child)...
+//
+// Lengths and counts are uvarints and page ids big-endian
+// 8 byte integers.
+func (n *node) encode(pageSize int) []byte {
+	buf := make([]byte, pageSize)
+	p := buf[pageHeaderSize:]
+
+	putUvarint := func(v int) {
+		p = p[binary.PutUvarint(p, uint64(v)):]
+	}
+	putString := func(s string) {
+		putUvarint(len(s))
+		p = p[copy(p, s):]
+	}
+	putPgid := func(id pgid) {
+		binary.BigEndian.PutUint64(p, uint64(id))
+		p = p[8:]
+	}
+
+	if n.leaf {
+		buf[0] = byte(leafPage)
+		putUvarint(len(n.keys))
+		for i, key := range n.keys {
+			putString(key)
+			v := n.values[i]
+			if v.overflow != 0 {
+				p[0] = 1
+				p = p[1:]
+				putUvarint(v.size)
+				putPgid(v.overflow)
+			} else {
+				p[0] = 0
+				p = p[1:]
+				putString(v.data)
+			}
+		}
+	} else {
+		buf[0] = byte(branchPage)
+		putUvarint(len(n.children))
+		putPgid(n.children[0])
+		for i, key := range n.keys {
+			putString(key)
+			putPgid(n.children[i+1])
+		}
+	}
+
+	seal(buf)
+	return buf
+}
+
+// decodeNode parses the page of a node.
+func decodeNode(id pgid, buf []byte) (*node, error) {
+	kind := pageKind(buf[0])
+	if (kind != leafPage && kind != branchPage) || !verify(buf) {
+		return nil, ErrCorruptPage
+	}
+
+	var (
+		p   = buf[pageHeaderSize:]
+		bad bool
+	)
+	uvarint := func() int {
+		v, n := binary.Uvarint(p)
+		if n <= 0 || v > math.MaxInt32 {
+			bad = true
+			return 0
+		}
+		p = p[n:]
+		return int(v)
+	}
+	bytes := func(n int) string {
+		if bad || n > len(p) {
+			bad = true
+			return ""
+		}
+		s := string(p[:n])
+		p = p[n:]
+		return s
+	}
+	readPgid := func() pgid {
+		if bad || len(p) < 8 {
+			bad = true
+			return 0
+		}
+		id := pgid(binary.BigEndian.Uint64(p))
+		p = p[8:]
+		return id
+	}
+
+	n := &node{id: id, leaf: kind == leafPage}
+	count := uvarint()
+	if n.leaf {
+		for i := 0; i < count && !bad; i++ {
+			n.keys = append(n.keys, bytes(uvarint()))
+			overflows := bytes(1) == "\x01"
+
+			var v value
+			if overflows {
+				v.size = uvarint()
+				v.overflow = readPgid()
+			} else {
+				v.data = bytes(uvarint())
+				v.size = len(v.data)
+			}
+			n.values = append(n.values, v)
+		}
+	} else if count > 0 {
+		n.children = append(n.children, readPgid())
+		for i := 1; i < count && !bad; i++ {
+			n.keys = append(n.keys, bytes(uvarint()))
+			n.children = append(n.children, readPgid())
+		}
+	}
+
+	if bad {
+		return nil, ErrCorruptPage
+	}
+	return n, nil
+}
+
+// chainPage is a page of a chain of pages, which hold
+// either an overflowing value or the free list.
+//
+// It's laid out as,
+//
+//	header | next page | length u32 | data
+//
+// where next is 0 for the last page of the chain.
+type chainPage struct {
+	next pgid
+	data []byte
+}
+
+// encodeChainPage returns the page of a chain.
+func encodeChainPage(kind pageKind, pageSize int, next pgid, data []byte) []byte {
+	buf := make([]byte, pageSize)
+	buf[0] = byte(kind)
+	binary.BigEndian.PutUint64(buf[pageHeaderSize:], uint64(next))
+	binary.BigEndian.PutUint32(buf[pageHeaderSize+8:], uint32(len(data)))
+	copy(buf[overflowHeaderSize:], data)
+	seal(buf)
+	return buf
+}
+
+// decodeChainPage parses the page of a chain of the given
+// kind.
+func decodeChainPage(kind pageKind, buf []byte) (chainPage, error) {
+	if pageKind(buf[0]) != kind || !verify(buf) {
+		return chainPage{}, ErrCorruptPage
+	}
+
+	n := int(binary.BigEndian.Uint32(buf[pageHeaderSize+8:]))
+	if n > len(buf)-overflowHeaderSize {
+		return chainPage{}, ErrCorruptPage
+	}
+	return chainPage{
+		next: pgid(binary.BigEndian.Uint64(buf[pageHeaderSize:])),
+		data: buf[overflowHeaderSize : overflowHeaderSize+n],
+	}, nil
+}
@@ -0,0 +1,73 @@
+package bptree
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNode_EncodeDecode(t *testing.T) {
+	nodes := []*node{
+		{
+			id:   3,
+			leaf: true,
+			keys: []string{"", "a", "b"},
+			values: []value{
+				{data: "", size: 0},
+				{data: "value", size: 5},
+				{overflow: 7, size: 5000},
+			},
+		},
+		{
+			id:       4,
+			keys:     []string{"k", "m"},
+			children: []pgid{1, 2, 9},
+		},
+	}
+
+	for _, n := range nodes {
+		buf := n.encode(minPageSize)
+		assert.Len(t, buf, minPageSize)
+		assert.True(t, n.size() <= minPageSize)
+
+		decoded, err := decodeNode(n.id, buf)
+		assert.Nil(t, err)
+		assert.Equal(t, n, decoded)
+
+		buf[len(buf)-1] ^= 1
+		_, err = decodeNode(n.id, buf)
+		assert.Equal(t, ErrCorruptPage, err)
+	}
+}
+
+func TestMeta_EncodeDecode(t *testing.T) {
+	m := meta{
+		pageSize:   DefaultPageSize,
+		txid:       7,
+		root:       3,
+		pageCount:  10,
+		freelist:   9,
+		keys:       42,
+		comparator: "bytewise",
+	}
+
+	buf := m.encode()
+	decoded, ok := decodeMeta(buf)
+	assert.True(t, ok)
+	assert.Equal(t, m, decoded)
+
+	buf[100] ^= 1
+	_, ok = decodeMeta(buf)
+	assert.False(t, ok)
+}
+
+func TestChainPage_EncodeDecode(t *testing.T) {
+	buf := encodeChainPage(overflowPage, minPageSize, 5, []byte("data"))
+	page, err := decodeChainPage(overflowPage, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, pgid(5), page.next)
+	assert.Equal(t, "data", string(page.data))
+
+	_, err = decodeChainPage(freelistPage, buf)
+	assert.Equal(t, ErrCorruptPage, err)
+}
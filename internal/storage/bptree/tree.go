@@ -0,0 +1,610 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/comparator"
+	"github.com/SystemBuilders/KeyValueStore/internal/vfs"
+)
+
+const (
+	// DefaultPageSize is the page size of a new tree if
+	// none is set.
+	DefaultPageSize = 4096
+	// defaultCacheSize is the number of cached pages if
+	// none is set.
+	defaultCacheSize = 1024
+	// maxHeight is the height past which a tree is taken
+	// to be corrupt, as no file could hold a tree that
+	// high.
+	maxHeight = 64
+)
+
+// Options holds the settings of a tree.
+type Options struct {
+	// PageSize is the size of the pages of a new tree. A
+	// tree which already exists keeps the page size it was
+	// created with. Keys and values larger than a quarter
+	// of a page can't be kept in the leaves, so a key can
+	// take at most a quarter of a page and larger values
+	// are kept in overflow pages.
+	//
+	// A zero value means DefaultPageSize. It can't be less
+	// than 1024.
+	PageSize int
+	// CacheSize is the number of pages whose nodes are
+	// kept in memory.
+	//
+	// A zero value means defaultCacheSize.
+	CacheSize int
+	// Comparator orders the keys of the tree. Its name is
+	// recorded in the file, and a tree can't be opened
+	// again with a comparator of another name.
+	//
+	// A nil value means comparator.Bytewise.
+	Comparator comparator.Comparator
+	// NoSync leaves out syncing the file as writes are
+	// committed. A crash of the machine may then lose the
+	// latest writes or even leave the file unreadable, but
+	// a crash of the process alone can't.
+	NoSync bool
+	// FS is the filesystem holding the file of the tree.
+	//
+	// A nil value means vfs.OS.
+	FS vfs.FS
+}
+
+// pageSize returns the page size of the options, applying
+// the default.
+func (opts Options) pageSize() int {
+	switch {
+	case opts.PageSize == 0:
+		return DefaultPageSize
+	case opts.PageSize < minPageSize:
+		return minPageSize
+	}
+	return opts.PageSize
+}
+
+// cacheSize returns the cache size of the options,
+// applying the default.
+func (opts Options) cacheSize() int {
+	if opts.CacheSize == 0 {
+		return defaultCacheSize
+	}
+	return opts.CacheSize
+}
+
+// comparator returns the comparator of the options,
+// applying the default.
+func (opts Options) comparator() comparator.Comparator {
+	if opts.Comparator == nil {
+		return comparator.Bytewise
+	}
+	return opts.Comparator
+}
+
+// fs returns the filesystem of the options, applying the
+// default.
+func (opts Options) fs() vfs.FS {
+	if opts.FS == nil {
+		return vfs.OS
+	}
+	return opts.FS
+}
+
+// Tree is a B+tree kept in the pages of a file.
+//
+// The keys and values are kept in the leaves, ordered by
+// the comparator of the tree, and the branches above them
+// lead to the leaf of any key in as many page reads as the
+// tree is high. Nodes are split as they outgrow their page
+// and merged with a sibling as they shrink, so the tree
+// stays balanced.
+//
+// Pages are never updated in place. A write copies every
+// node on the path from the root to its leaf into pages
+// which are free, and then commits by writing a meta page
+// pointing at the new root. There are two meta pages, and
+// commits alternate between them, so a crash while writing
+// one leaves the other, and the tree as of the commit
+// before, in place. The pages the commit replaced are free
+// once it's done and are reused by the following writes,
+// and the list of free pages is kept in the file along
+// with the tree.
+//
+// The most recently used nodes are kept in a page cache.
+//
+// Tree is safe for concurrent use. Writes are serialised
+// and reads run alongside each other.
+type Tree struct {
+	l   sync.RWMutex
+	f   vfs.File
+	cmp comparator.Comparator
+	// noSync is set if commits don't sync the file.
+	noSync bool
+	// meta describes the last commit.
+	meta meta
+	// free holds the pages which are free as of the last
+	// commit, in order.
+	free []pgid
+	// freelistPages hold the free list of the last commit.
+	freelistPages []pgid
+	cache         *cache
+	closed        bool
+}
+
+// frame is a node on the path from the root of a tree to
+// a leaf, along with the position of the child the path
+// goes on through.
+type frame struct {
+	n *node
+	i int
+}
+
+// Open opens the tree kept in the file at the path of the
+// filesystem of the options, which is created if it doesn't
+// exist.
+//
+// ErrComparatorMismatch is returned if the keys of the
+// tree are ordered by a comparator other than the one of
+// the options.
+func Open(path string, opts Options) (*Tree, error) {
+	cmp := opts.comparator()
+	if len(cmp.Name()) > maxComparatorNameSize {
+		return nil, ErrComparatorNameTooLong
+	}
+
+	f, err := opts.fs().OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Tree{
+		f:      f,
+		cmp:    cmp,
+		noSync: opts.NoSync,
+		cache:  newCache(opts.cacheSize()),
+	}
+	err = t.load(opts)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// load reads the current meta page and the free list of
+// the file, or sets up the meta pages of a new tree if
+// the file is empty.
+func (t *Tree) load(opts Options) error {
+	info, err := t.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() == 0 {
+		m := meta{
+			pageSize:   opts.pageSize(),
+			pageCount:  1,
+			comparator: t.cmp.Name(),
+		}
+		buf := make([]byte, m.pageSize)
+		copy(buf, m.encode())
+		m.txid++
+		copy(buf[metaSize:], m.encode())
+
+		_, err = t.f.WriteAt(buf, 0)
+		if err == nil {
+			err = t.sync()
+		}
+		t.meta = m
+		return err
+	}
+
+	buf := make([]byte, 2*metaSize)
+	_, err = t.f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	var found bool
+	for slot := 0; slot < 2; slot++ {
+		m, ok := decodeMeta(buf[slot*metaSize : (slot+1)*metaSize])
+		if ok && (!found || m.txid > t.meta.txid) {
+			t.meta, found = m, true
+		}
+	}
+	if !found {
+		return ErrInvalidFile
+	}
+	if t.meta.comparator != t.cmp.Name() {
+		return ErrComparatorMismatch
+	}
+
+	for id := t.meta.freelist; id != 0; {
+		if len(t.freelistPages) >= int(t.meta.pageCount) {
+			return ErrCorruptPage
+		}
+
+		buf, err := t.readPage(id)
+		if err != nil {
+			return err
+		}
+		page, err := decodeChainPage(freelistPage, buf)
+		if err != nil {
+			return err
+		}
+
+		t.freelistPages = append(t.freelistPages, id)
+		for p := page.data; len(p) >= 8; p = p[8:] {
+			t.free = append(t.free, pgid(binary.BigEndian.Uint64(p)))
+		}
+		id = page.next
+	}
+	sort.Slice(t.free, func(i, j int) bool { return t.free[i] < t.free[j] })
+	return nil
+}
+
+// Get returns the value of the key.
+//
+// This is a race-safe method.
+func (t *Tree) Get(key []byte) ([]byte, error) {
+	t.l.RLock()
+	defer t.l.RUnlock()
+
+	if t.closed {
+		return nil, ErrTreeClosed
+	}
+
+	path, err := t.path(string(key))
+	if err != nil || len(path) == 0 {
+		if err == nil {
+			err = ErrKeyNotFound
+		}
+		return nil, err
+	}
+
+	leaf := path[len(path)-1].n
+	i, found := t.search(leaf, string(key))
+	if !found {
+		return nil, ErrKeyNotFound
+	}
+	return t.readValue(leaf.values[i])
+}
+
+// Put stores the value of the key, replacing the value it
+// was stored with before, if any, and commits it.
+//
+// ErrKeyTooLarge is returned for a key larger than a
+// quarter of a page.
+//
+// This is a race-safe method.
+func (t *Tree) Put(key, value []byte) error {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	if t.closed {
+		return ErrTreeClosed
+	}
+	if len(key) > t.maxSize() {
+		return ErrKeyTooLarge
+	}
+
+	tx := t.begin()
+	err := tx.put(string(key), value)
+	if err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// Delete removes the key from the tree and commits it.
+// ErrKeyNotFound is returned if the key isn't in the tree.
+//
+// This is a race-safe method.
+func (t *Tree) Delete(key []byte) error {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	if t.closed {
+		return ErrTreeClosed
+	}
+
+	tx := t.begin()
+	err := tx.delete(string(key))
+	if err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// Scan calls fn with the keys of the tree from start up to
+// but not including end and their values in order, until
+// fn returns false. A nil start scans from the first key
+// and a nil end up to the last one.
+//
+// The tree can't be written to until the scan is done, so
+// fn mustn't write to the tree.
+//
+// This is a race-safe method.
+func (t *Tree) Scan(start, end []byte, fn func(key, value []byte) bool) error {
+	t.l.RLock()
+	defer t.l.RUnlock()
+
+	if t.closed {
+		return ErrTreeClosed
+	}
+	if t.meta.root == 0 {
+		return nil
+	}
+
+	var from, to *string
+	if start != nil {
+		s := string(start)
+		from = &s
+	}
+	if end != nil {
+		e := string(end)
+		to = &e
+	}
+
+	_, err := t.scan(t.meta.root, from, to, fn, 0)
+	return err
+}
+
+// scan calls fn with the keys below the node of the page
+// within the bounds, as described by Scan. It reports
+// whether the scan goes on past the node.
+func (t *Tree) scan(id pgid, from, to *string, fn func(key, value []byte) bool, depth int) (bool, error) {
+	if depth > maxHeight {
+		return false, ErrCorruptPage
+	}
+
+	n, err := t.node(id)
+	if err != nil {
+		return false, err
+	}
+
+	if n.leaf {
+		i := 0
+		if from != nil {
+			i, _ = t.search(n, *from)
+		}
+		for ; i < len(n.keys); i++ {
+			if to != nil && t.cmp.Compare(n.keys[i], *to) >= 0 {
+				return false, nil
+			}
+
+			value, err := t.readValue(n.values[i])
+			if err != nil {
+				return false, err
+			}
+			if !fn([]byte(n.keys[i]), value) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+
+	i := 0
+	if from != nil {
+		i = t.childIndex(n, *from)
+	}
+	for ; i < len(n.children); i++ {
+		if to != nil && i > 0 && t.cmp.Compare(n.keys[i-1], *to) >= 0 {
+			return false, nil
+		}
+
+		more, err := t.scan(n.children[i], from, to, fn, depth+1)
+		if !more || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Len returns the number of keys in the tree.
+//
+// This is a race-safe method.
+func (t *Tree) Len() int64 {
+	t.l.RLock()
+	defer t.l.RUnlock()
+	return t.meta.keys
+}
+
+// Stats describes the pages of a tree.
+type Stats struct {
+	// PageSize is the size of the pages of the tree.
+	PageSize int
+	// Pages is the number of pages of the file, in use or
+	// free.
+	Pages int64
+	// FreePages is the number of pages which are free to
+	// be reused by the following writes.
+	FreePages int64
+	// Keys is the number of keys in the tree.
+	Keys int64
+	// CachedPages is the number of pages whose nodes are
+	// in the page cache.
+	CachedPages int
+}
+
+// Stats returns the number of pages of the tree and how
+// many of them are free.
+//
+// This is a race-safe method.
+func (t *Tree) Stats() Stats {
+	t.l.RLock()
+	defer t.l.RUnlock()
+
+	return Stats{
+		PageSize:    t.meta.pageSize,
+		Pages:       int64(t.meta.pageCount),
+		FreePages:   int64(len(t.free)),
+		Keys:        t.meta.keys,
+		CachedPages: t.cache.len(),
+	}
+}
+
+// Sync commits the file of the tree to disk. This is only
+// needed for a tree opened with NoSync, as the writes are
+// otherwise committed to disk as they return.
+//
+// This is a race-safe method.
+func (t *Tree) Sync() error {
+	t.l.RLock()
+	defer t.l.RUnlock()
+
+	if t.closed {
+		return ErrTreeClosed
+	}
+	return t.f.Sync()
+}
+
+// Close closes the file of the tree. The tree can't be
+// used after it's closed.
+//
+// This is a race-safe method.
+func (t *Tree) Close() error {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	return t.f.Close()
+}
+
+// maxSize returns the largest key, and the largest value
+// kept in a leaf, which is a quarter of a page.
+func (t *Tree) maxSize() int {
+	return t.meta.pageSize / 4
+}
+
+// path returns the nodes from the root down to the leaf
+// where the key is or would be, or nothing if the tree is
+// empty.
+func (t *Tree) path(key string) ([]frame, error) {
+	var path []frame
+	for id := t.meta.root; id != 0; {
+		if len(path) > maxHeight {
+			return nil, ErrCorruptPage
+		}
+
+		n, err := t.node(id)
+		if err != nil {
+			return nil, err
+		}
+		if n.leaf {
+			return append(path, frame{n: n}), nil
+		}
+
+		i := t.childIndex(n, key)
+		path = append(path, frame{n: n, i: i})
+		id = n.children[i]
+	}
+	return path, nil
+}
+
+// search returns the position of the first key of the leaf
+// not before the key, and whether it's the key.
+func (t *Tree) search(leaf *node, key string) (int, bool) {
+	i := sort.Search(len(leaf.keys), func(i int) bool {
+		return t.cmp.Compare(leaf.keys[i], key) >= 0
+	})
+	return i, i < len(leaf.keys) && t.cmp.Compare(leaf.keys[i], key) == 0
+}
+
+// childIndex returns the position of the child of the
+// branch the key is below.
+func (t *Tree) childIndex(branch *node, key string) int {
+	return sort.Search(len(branch.keys), func(i int) bool {
+		return t.cmp.Compare(branch.keys[i], key) > 0
+	})
+}
+
+// node returns the node of the page, from the cache if
+// it's there.
+func (t *Tree) node(id pgid) (*node, error) {
+	if n, ok := t.cache.get(id); ok {
+		return n, nil
+	}
+
+	buf, err := t.readPage(id)
+	if err != nil {
+		return nil, err
+	}
+	n, err := decodeNode(id, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	t.cache.put(n)
+	return n, nil
+}
+
+// readValue returns the value, reading it from its
+// overflow pages if it isn't kept in the leaf.
+func (t *Tree) readValue(v value) ([]byte, error) {
+	if v.overflow == 0 {
+		return []byte(v.data), nil
+	}
+
+	data := make([]byte, 0, v.size)
+	for id := v.overflow; id != 0; {
+		if len(data) > v.size {
+			return nil, ErrCorruptPage
+		}
+
+		buf, err := t.readPage(id)
+		if err != nil {
+			return nil, err
+		}
+		page, err := decodeChainPage(overflowPage, buf)
+		if err != nil {
+			return nil, err
+		}
+
+		data = append(data, page.data...)
+		id = page.next
+	}
+
+	if len(data) != v.size {
+		return nil, ErrCorruptPage
+	}
+	return data, nil
+}
+
+// readPage reads the page from the file.
+func (t *Tree) readPage(id pgid) ([]byte, error) {
+	if id == 0 || id >= t.meta.pageCount {
+		return nil, ErrCorruptPage
+	}
+
+	buf := make([]byte, t.meta.pageSize)
+	_, err := t.f.ReadAt(buf, int64(id)*int64(t.meta.pageSize))
+	if err == io.EOF {
+		return nil, ErrCorruptPage
+	}
+	return buf, err
+}
+
+// writePage writes the page to the file.
+func (t *Tree) writePage(id pgid, buf []byte) error {
+	_, err := t.f.WriteAt(buf, int64(id)*int64(t.meta.pageSize))
+	return err
+}
+
+// sync syncs the file, unless the tree doesn't sync.
+func (t *Tree) sync() error {
+	if t.noSync {
+		return nil
+	}
+	return t.f.Sync()
+}
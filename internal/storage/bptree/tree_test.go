@@ -0,0 +1,371 @@
+package bptree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/comparator"
+	"github.com/stretchr/testify/assert"
+)
+
+// openTree opens a tree in a fresh file of the test.
+func openTree(t *testing.T, opts Options) (*Tree, string) {
+	path := filepath.Join(t.TempDir(), "tree")
+	tree, err := Open(path, opts)
+	assert.Nil(t, err)
+	return tree, path
+}
+
+// checkTree ensures that the tree is well formed: every
+// node fits in its page and holds its keys in order within
+// the bounds set by the branches above it, all the leaves
+// are as deep, and every page of the file is either in use
+// or free, but not both.
+func checkTree(t *testing.T, tree *Tree) {
+	pages := map[pgid]string{0: "meta"}
+	use := func(id pgid, what string) {
+		if prev, ok := pages[id]; ok {
+			t.Fatalf("page %d is both %s and %s", id, prev, what)
+		}
+		pages[id] = what
+	}
+
+	for _, id := range tree.free {
+		use(id, "free")
+	}
+	for _, id := range tree.freelistPages {
+		use(id, "free list")
+	}
+
+	var (
+		keys       int64
+		leafDepths = make(map[int]bool)
+	)
+	var walk func(id pgid, lo, hi *string, depth int)
+	walk = func(id pgid, lo, hi *string, depth int) {
+		use(id, "node")
+		n, err := tree.node(id)
+		if !assert.Nil(t, err) {
+			return
+		}
+		assert.True(t, n.size() <= tree.meta.pageSize, "node %d overflows its page", id)
+
+		for i, key := range n.keys {
+			if i > 0 {
+				assert.True(t, tree.cmp.Compare(n.keys[i-1], key) < 0, "keys out of order")
+			}
+			if lo != nil {
+				assert.True(t, tree.cmp.Compare(key, *lo) >= 0, "key below its bound")
+			}
+			if hi != nil {
+				assert.True(t, tree.cmp.Compare(key, *hi) < 0, "key above its bound")
+			}
+		}
+
+		if n.leaf {
+			leafDepths[depth] = true
+			keys += int64(len(n.keys))
+			for _, v := range n.values {
+				for id := v.overflow; id != 0; {
+					use(id, "overflow")
+					buf, err := tree.readPage(id)
+					assert.Nil(t, err)
+					page, err := decodeChainPage(overflowPage, buf)
+					assert.Nil(t, err)
+					id = page.next
+				}
+			}
+			return
+		}
+
+		assert.Equal(t, len(n.keys)+1, len(n.children))
+		for i, child := range n.children {
+			childLo, childHi := lo, hi
+			if i > 0 {
+				childLo = &n.keys[i-1]
+			}
+			if i < len(n.keys) {
+				childHi = &n.keys[i]
+			}
+			walk(child, childLo, childHi, depth+1)
+		}
+	}
+	if tree.meta.root != 0 {
+		walk(tree.meta.root, nil, nil, 0)
+	}
+
+	assert.Equal(t, tree.meta.keys, keys)
+	assert.True(t, len(leafDepths) <= 1, "leaves at depths %v", leafDepths)
+	assert.Equal(t, int(tree.meta.pageCount), len(pages), "pages neither in use nor free")
+}
+
+// scanAll returns the keys and values the tree scans
+// through between start and end.
+func scanAll(t *testing.T, tree *Tree, start, end []byte) ([]string, []string) {
+	var keys, values []string
+	err := tree.Scan(start, end, func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		values = append(values, string(value))
+		return true
+	})
+	assert.Nil(t, err)
+	return keys, values
+}
+
+func TestTree_PutGetDelete(t *testing.T) {
+	tree, _ := openTree(t, Options{})
+	defer tree.Close()
+
+	_, err := tree.Get([]byte("key"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, ErrKeyNotFound, tree.Delete([]byte("key")))
+
+	assert.Nil(t, tree.Put([]byte("key"), []byte("value")))
+	assert.Nil(t, tree.Put([]byte("key"), []byte("value1")))
+	value, err := tree.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value1", string(value))
+	assert.Equal(t, int64(1), tree.Len())
+
+	assert.Nil(t, tree.Delete([]byte("key")))
+	_, err = tree.Get([]byte("key"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Zero(t, tree.Len())
+	checkTree(t, tree)
+
+	assert.Equal(t, ErrKeyTooLarge, tree.Put(bytes.Repeat([]byte("k"), DefaultPageSize), nil))
+}
+
+// TestTree_LargeValues ensures that values larger than a
+// leaf holds are kept in overflow pages, which are freed
+// as the values are overwritten.
+func TestTree_LargeValues(t *testing.T) {
+	tree, path := openTree(t, Options{PageSize: 1024})
+
+	large := bytes.Repeat([]byte("0123456789"), 1000)
+	assert.Nil(t, tree.Put([]byte("large"), large))
+	assert.Nil(t, tree.Put([]byte("small"), []byte("value")))
+	checkTree(t, tree)
+
+	value, err := tree.Get([]byte("large"))
+	assert.Nil(t, err)
+	assert.Equal(t, large, value)
+
+	pages := tree.Stats().Pages
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, tree.Put([]byte("large"), large[i:]))
+	}
+	assert.True(t, tree.Stats().Pages <= 2*pages, "overflow pages aren't reused")
+	checkTree(t, tree)
+	assert.Nil(t, tree.Close())
+
+	tree, err = Open(path, Options{})
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	value, err = tree.Get([]byte("large"))
+	assert.Nil(t, err)
+	assert.Equal(t, large[9:], value)
+	assert.Equal(t, 1024, tree.Stats().PageSize)
+}
+
+// TestTree_Random ensures that the tree behaves like a map
+// whose keys are kept in order, across random puts and
+// deletes which split and merge its nodes, and across
+// reopening it.
+func TestTree_Random(t *testing.T) {
+	opts := Options{PageSize: 1024, CacheSize: 8, NoSync: true}
+	tree, path := openTree(t, opts)
+
+	var (
+		want = make(map[string]string)
+		rnd  = rand.New(rand.NewSource(1))
+	)
+	for i := 0; i < 4000; i++ {
+		key := fmt.Sprintf("key%04d", rnd.Intn(800))
+		switch {
+		case rnd.Intn(3) == 0:
+			_, ok := want[key]
+			err := tree.Delete([]byte(key))
+			if ok {
+				assert.Nil(t, err)
+			} else {
+				assert.Equal(t, ErrKeyNotFound, err)
+			}
+			delete(want, key)
+		default:
+			value := strings.Repeat(string('a'+byte(rnd.Intn(26))), rnd.Intn(400))
+			assert.Nil(t, tree.Put([]byte(key), []byte(value)))
+			want[key] = value
+		}
+
+		if i%500 != 0 {
+			continue
+		}
+
+		checkTree(t, tree)
+		if i%1000 == 0 {
+			assert.Nil(t, tree.Close())
+			var err error
+			tree, err = Open(path, opts)
+			assert.Nil(t, err)
+		}
+
+		var keys, values []string
+		for key := range want {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			values = append(values, want[key])
+		}
+
+		gotKeys, gotValues := scanAll(t, tree, nil, nil)
+		assert.Equal(t, keys, gotKeys)
+		assert.Equal(t, values, gotValues)
+	}
+
+	for key := range want {
+		assert.Nil(t, tree.Delete([]byte(key)))
+	}
+	checkTree(t, tree)
+	assert.Zero(t, tree.meta.root)
+
+	stats := tree.Stats()
+	assert.Equal(t, stats.Pages-1-int64(len(tree.freelistPages)), stats.FreePages)
+	assert.Nil(t, tree.Close())
+}
+
+func TestTree_Scan(t *testing.T) {
+	tree, _ := openTree(t, Options{PageSize: 1024, NoSync: true})
+	defer tree.Close()
+
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, tree.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprint(i))))
+	}
+
+	keys, values := scanAll(t, tree, []byte("key100"), []byte("key103"))
+	assert.Equal(t, []string{"key100", "key101", "key102"}, keys)
+	assert.Equal(t, []string{"100", "101", "102"}, values)
+
+	keys, _ = scanAll(t, tree, []byte("key4965"), nil)
+	assert.Equal(t, []string{"key497", "key498", "key499"}, keys)
+
+	keys, _ = scanAll(t, tree, nil, []byte("key002"))
+	assert.Equal(t, []string{"key000", "key001"}, keys)
+
+	var n int
+	assert.Nil(t, tree.Scan(nil, nil, func(_, _ []byte) bool {
+		n++
+		return n < 10
+	}))
+	assert.Equal(t, 10, n)
+}
+
+// TestTree_Comparator ensures that the keys are kept in the
+// order of the comparator of the tree, which can't be
+// opened again with another one.
+func TestTree_Comparator(t *testing.T) {
+	reverse := comparator.Reverse(comparator.Bytewise)
+	tree, path := openTree(t, Options{PageSize: 1024, Comparator: reverse, NoSync: true})
+
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, tree.Put([]byte(fmt.Sprintf("key%03d", i)), nil))
+	}
+	checkTree(t, tree)
+
+	keys, _ := scanAll(t, tree, []byte("key150"), []byte("key147"))
+	assert.Equal(t, []string{"key150", "key149", "key148"}, keys)
+	assert.Nil(t, tree.Close())
+
+	_, err := Open(path, Options{})
+	assert.Equal(t, ErrComparatorMismatch, err)
+
+	tree, err = Open(path, Options{Comparator: reverse})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(200), tree.Len())
+	assert.Nil(t, tree.Close())
+}
+
+// TestTree_TornMetaPage ensures that a tree whose last
+// commit didn't get its meta page in place opens as of the
+// commit before.
+func TestTree_TornMetaPage(t *testing.T) {
+	tree, path := openTree(t, Options{})
+	assert.Nil(t, tree.Put([]byte("first"), []byte("1")))
+	assert.Nil(t, tree.Put([]byte("second"), []byte("2")))
+	slot := int64(tree.meta.txid % 2)
+	assert.Nil(t, tree.Close())
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte("torn"), slot*metaSize+100)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	tree, err = Open(path, Options{})
+	assert.Nil(t, err)
+	_, err = tree.Get([]byte("second"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	value, err := tree.Get([]byte("first"))
+	assert.Nil(t, err)
+	assert.Equal(t, "1", string(value))
+	checkTree(t, tree)
+
+	// The next commit goes over the torn meta page.
+	assert.Nil(t, tree.Put([]byte("third"), []byte("3")))
+	assert.Nil(t, tree.Close())
+
+	tree, err = Open(path, Options{})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), tree.Len())
+	checkTree(t, tree)
+	assert.Nil(t, tree.Close())
+
+	f, err = os.OpenFile(path, os.O_RDWR, 0)
+	assert.Nil(t, err)
+	_, err = f.WriteAt(make([]byte, 2*metaSize), 0)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	_, err = Open(path, Options{})
+	assert.Equal(t, ErrInvalidFile, err)
+}
+
+func TestTree_Closed(t *testing.T) {
+	tree, _ := openTree(t, Options{})
+	assert.Nil(t, tree.Close())
+	assert.Nil(t, tree.Close())
+
+	_, err := tree.Get([]byte("key"))
+	assert.Equal(t, ErrTreeClosed, err)
+	assert.Equal(t, ErrTreeClosed, tree.Put([]byte("key"), nil))
+	assert.Equal(t, ErrTreeClosed, tree.Delete([]byte("key")))
+	assert.Equal(t, ErrTreeClosed, tree.Scan(nil, nil, nil))
+}
+
+// BenchmarkTree_Get measures reading keys of a tree larger
+// than its page cache.
+func BenchmarkTree_Get(b *testing.B) {
+	tree, err := Open(filepath.Join(b.TempDir(), "tree"), Options{CacheSize: 64, NoSync: true})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer tree.Close()
+
+	const keys = 1 << 14
+	for i := 0; i < keys; i++ {
+		tree.Put([]byte(fmt.Sprintf("key%08d", i)), []byte("value"))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.Get([]byte(fmt.Sprintf("key%08d", i%keys)))
+	}
+}
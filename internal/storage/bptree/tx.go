@@ -0,0 +1,465 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// tx is a single write to a tree, which is either
+// committed as a whole or not at all.
+//
+// The nodes a write changes are copied into pages which
+// are free as of the last commit, so the tree of the last
+// commit stays whole until the meta page of the write is
+// in place. The pages the write no longer needs can't be
+// reused before then, and are only freed once it's
+// committed.
+type tx struct {
+	t *Tree
+	// meta is the meta page the write commits.
+	meta meta
+	// free holds the pages free as of the last commit which
+	// the write hasn't taken yet.
+	free []pgid
+	// freed holds the pages the write no longer needs.
+	freed []pgid
+	// nodes hold the nodes the write puts in new pages.
+	nodes []*node
+}
+
+// begin starts a write.
+func (t *Tree) begin() *tx {
+	return &tx{
+		t:    t,
+		meta: t.meta,
+		free: append([]pgid(nil), t.free...),
+	}
+}
+
+// put stores the value of the key.
+func (tx *tx) put(key string, data []byte) error {
+	v, err := tx.newValue(data)
+	if err != nil {
+		return err
+	}
+
+	path, err := tx.t.path(key)
+	if err != nil {
+		return err
+	}
+	if len(path) == 0 {
+		tx.meta.keys++
+		return tx.rewrite(nil, &node{
+			leaf:   true,
+			keys:   []string{key},
+			values: []value{v},
+		})
+	}
+
+	leaf := path[len(path)-1].n.clone()
+	i, found := tx.t.search(leaf, key)
+	if found {
+		err = tx.freeValue(leaf.values[i])
+		if err != nil {
+			return err
+		}
+		leaf.values[i] = v
+	} else {
+		leaf.keys = append(leaf.keys, "")
+		copy(leaf.keys[i+1:], leaf.keys[i:])
+		leaf.keys[i] = key
+		leaf.values = append(leaf.values, value{})
+		copy(leaf.values[i+1:], leaf.values[i:])
+		leaf.values[i] = v
+		tx.meta.keys++
+	}
+
+	return tx.rewrite(path, leaf)
+}
+
+// delete removes the key.
+func (tx *tx) delete(key string) error {
+	path, err := tx.t.path(key)
+	if err != nil {
+		return err
+	}
+	if len(path) == 0 {
+		return ErrKeyNotFound
+	}
+
+	leaf := path[len(path)-1].n
+	i, found := tx.t.search(leaf, key)
+	if !found {
+		return ErrKeyNotFound
+	}
+
+	err = tx.freeValue(leaf.values[i])
+	if err != nil {
+		return err
+	}
+
+	leaf = leaf.clone()
+	leaf.keys = append(leaf.keys[:i], leaf.keys[i+1:]...)
+	leaf.values = append(leaf.values[:i], leaf.values[i+1:]...)
+	tx.meta.keys--
+
+	return tx.rewrite(path, leaf)
+}
+
+// rewrite puts the node in place of the last node of the
+// path, copying every node above it with the pages of the
+// nodes below. The node is removed if it's empty, merged
+// with a sibling if it takes less than a quarter of a page
+// and the two fit in one, and split if it doesn't fit in
+// a page, which may in turn split its parent and so on up
+// to the root.
+func (tx *tx) rewrite(path []frame, n *node) error {
+	for level := len(path) - 1; level > 0; level-- {
+		tx.freePage(path[level].n.id)
+		parent := path[level-1].n.clone()
+		i := path[level-1].i
+
+		if n.empty() {
+			parent.removeChild(i)
+			n = parent
+			continue
+		}
+
+		if n.size() < tx.meta.pageSize/4 {
+			var err error
+			n, i, err = tx.merge(parent, i, n)
+			if err != nil {
+				return err
+			}
+		}
+
+		parts, seps := tx.split(n)
+		tx.place(parts)
+		parent.replaceChild(i, parts, seps)
+		n = parent
+	}
+	if len(path) > 0 {
+		tx.freePage(path[0].n.id)
+	}
+
+	// The root is left out if it's empty or a branch with
+	// a single child, which then becomes the root. A root
+	// which doesn't fit in a page is split under a new
+	// root.
+	for {
+		switch {
+		case n.empty():
+			tx.meta.root = 0
+			return nil
+		case !n.leaf && len(n.children) == 1:
+			tx.meta.root = n.children[0]
+			return nil
+		}
+
+		parts, seps := tx.split(n)
+		tx.place(parts)
+		if len(parts) == 1 {
+			tx.meta.root = parts[0].id
+			return nil
+		}
+
+		n = &node{keys: seps}
+		for _, part := range parts {
+			n.children = append(n.children, part.id)
+		}
+	}
+}
+
+// merge merges the node, which is the child of the parent
+// at position i, with its sibling to the left, or to the
+// right for the first child, if the two fit in a page. It
+// returns the merged node and its position in the parent,
+// or the node and its position as they are if they don't
+// fit.
+func (tx *tx) merge(parent *node, i int, n *node) (*node, int, error) {
+	sibling := i - 1
+	if i == 0 {
+		sibling = 1
+	}
+	if sibling >= len(parent.children) {
+		return n, i, nil
+	}
+
+	s, err := tx.t.node(parent.children[sibling])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	left, right, sep := s, n, i-1
+	if i == 0 {
+		left, right, sep = n, s, 0
+	}
+
+	merged := &node{leaf: n.leaf}
+	merged.keys = append(merged.keys, left.keys...)
+	if !n.leaf {
+		merged.keys = append(merged.keys, parent.keys[sep])
+	}
+	merged.keys = append(merged.keys, right.keys...)
+	merged.values = append(append(merged.values, left.values...), right.values...)
+	merged.children = append(append(merged.children, left.children...), right.children...)
+
+	if merged.size() > tx.meta.pageSize {
+		return n, i, nil
+	}
+
+	tx.freePage(s.id)
+	parent.keys = append(parent.keys[:sep], parent.keys[sep+1:]...)
+	parent.children = append(parent.children[:sep+1], parent.children[sep+2:]...)
+	return merged, sep, nil
+}
+
+// split splits the node into nodes which fit in a page,
+// in order. It returns them along with the keys which
+// separate them.
+func (tx *tx) split(n *node) ([]*node, []string) {
+	if n.size() <= tx.meta.pageSize {
+		return []*node{n}, nil
+	}
+
+	// The node is split where the first half of its bytes
+	// ends, and each half is split again if it's still too
+	// large. A leaf hands the first key of the right half
+	// to its parent, while a branch moves the key which
+	// separates its halves up into its parent.
+	half, size := n.size()/2, nodeHeaderSize
+	var left, right *node
+	var sep string
+	if n.leaf {
+		m := 1
+		for ; m < len(n.keys)-1; m++ {
+			size += uvarintSize(len(n.keys[m-1])) + len(n.keys[m-1]) + valueSize(n.values[m-1])
+			if size >= half {
+				break
+			}
+		}
+		left = &node{leaf: true, keys: n.keys[:m:m], values: n.values[:m:m]}
+		right = &node{leaf: true, keys: n.keys[m:], values: n.values[m:]}
+		sep = n.keys[m]
+	} else {
+		m := 1
+		for ; m < len(n.children)-1; m++ {
+			size += 8 + uvarintSize(len(n.keys[m-1])) + len(n.keys[m-1])
+			if size >= half {
+				break
+			}
+		}
+		left = &node{keys: n.keys[: m-1 : m-1], children: n.children[:m:m]}
+		right = &node{keys: n.keys[m:], children: n.children[m:]}
+		sep = n.keys[m-1]
+	}
+
+	leftParts, leftSeps := tx.split(left)
+	rightParts, rightSeps := tx.split(right)
+	seps := append(append(leftSeps, sep), rightSeps...)
+	return append(leftParts, rightParts...), seps
+}
+
+// place gives every node a page and queues it to be
+// written.
+func (tx *tx) place(nodes []*node) {
+	for _, n := range nodes {
+		n.id = tx.allocate()
+		tx.nodes = append(tx.nodes, n)
+	}
+}
+
+// allocate takes a page for the write, the first free page
+// if there is any and a page past the end of the file
+// otherwise.
+func (tx *tx) allocate() pgid {
+	if len(tx.free) > 0 {
+		id := tx.free[0]
+		tx.free = tx.free[1:]
+		return id
+	}
+
+	id := tx.meta.pageCount
+	tx.meta.pageCount++
+	return id
+}
+
+// freePage frees the page once the write is committed.
+func (tx *tx) freePage(id pgid) {
+	tx.freed = append(tx.freed, id)
+}
+
+// newValue returns the value holding the data, writing
+// the data to overflow pages if it's too large for a leaf.
+func (tx *tx) newValue(data []byte) (value, error) {
+	if len(data) <= tx.t.maxSize() {
+		return value{data: string(data), size: len(data)}, nil
+	}
+
+	chunk := tx.meta.pageSize - overflowHeaderSize
+	ids := make([]pgid, (len(data)+chunk-1)/chunk)
+	for i := range ids {
+		ids[i] = tx.allocate()
+	}
+
+	for i, id := range ids {
+		var next pgid
+		if i+1 < len(ids) {
+			next = ids[i+1]
+		}
+
+		end := (i + 1) * chunk
+		if end > len(data) {
+			end = len(data)
+		}
+		err := tx.t.writePage(id, encodeChainPage(overflowPage, tx.meta.pageSize, next, data[i*chunk:end]))
+		if err != nil {
+			return value{}, err
+		}
+	}
+
+	return value{overflow: ids[0], size: len(data)}, nil
+}
+
+// freeValue frees the overflow pages of the value, if any.
+func (tx *tx) freeValue(v value) error {
+	for id := v.overflow; id != 0; {
+		buf, err := tx.t.readPage(id)
+		if err != nil {
+			return err
+		}
+		page, err := decodeChainPage(overflowPage, buf)
+		if err != nil {
+			return err
+		}
+
+		tx.freePage(id)
+		id = page.next
+	}
+	return nil
+}
+
+// commit writes the new nodes and the free list of the
+// write, and then the meta page pointing at them. The tree
+// takes on the write once the meta page is in place.
+func (tx *tx) commit() error {
+	t := tx.t
+	for _, n := range tx.nodes {
+		err := t.writePage(n.id, n.encode(tx.meta.pageSize))
+		if err != nil {
+			return err
+		}
+	}
+
+	free, freelistPages, err := tx.writeFreelist()
+	if err != nil {
+		return err
+	}
+
+	// The pages are synced before the meta page is written,
+	// so the meta page never points at pages which aren't
+	// in place.
+	err = t.sync()
+	if err != nil {
+		return err
+	}
+
+	tx.meta.txid++
+	_, err = t.f.WriteAt(tx.meta.encode(), int64(tx.meta.txid%2)*metaSize)
+	if err == nil {
+		err = t.sync()
+	}
+	if err != nil {
+		return err
+	}
+
+	t.meta = tx.meta
+	t.free = free
+	t.freelistPages = freelistPages
+	for _, id := range tx.freed {
+		t.cache.remove(id)
+	}
+	for _, n := range tx.nodes {
+		t.cache.put(n)
+	}
+	return nil
+}
+
+// writeFreelist writes the list of the pages which are
+// free once the write is committed, which are those left
+// free by the write along with those it freed and the
+// pages of the last free list. The pages of the new list
+// are taken from those left free by the write. It returns
+// the free pages along with the pages of the list.
+func (tx *tx) writeFreelist() ([]pgid, []pgid, error) {
+	perPage := (tx.meta.pageSize - overflowHeaderSize) / 8
+	count := len(tx.free) + len(tx.freed) + len(tx.t.freelistPages)
+
+	ids := make([]pgid, (count+perPage-1)/perPage)
+	for i := range ids {
+		ids[i] = tx.allocate()
+	}
+
+	free := append(append(tx.free, tx.freed...), tx.t.freelistPages...)
+	sort.Slice(free, func(i, j int) bool { return free[i] < free[j] })
+
+	tx.meta.freelist = 0
+	if len(ids) > 0 {
+		tx.meta.freelist = ids[0]
+	}
+
+	data := make([]byte, 8*perPage)
+	for i, id := range ids {
+		var next pgid
+		if i+1 < len(ids) {
+			next = ids[i+1]
+		}
+
+		// Taking the pages of the list may have left fewer
+		// free pages than there's room for, so the last pages
+		// of the list may hold fewer of them or none.
+		start, end := i*perPage, (i+1)*perPage
+		if start > len(free) {
+			start = len(free)
+		}
+		if end > len(free) {
+			end = len(free)
+		}
+		chunk := free[start:end]
+		for j, freeID := range chunk {
+			binary.BigEndian.PutUint64(data[8*j:], uint64(freeID))
+		}
+
+		err := tx.t.writePage(id, encodeChainPage(freelistPage, tx.meta.pageSize, next, data[:8*len(chunk)]))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return free, ids, nil
+}
+
+// removeChild removes the child at position i from the
+// branch along with the key separating it from its
+// neighbour.
+func (n *node) removeChild(i int) {
+	n.children = append(n.children[:i], n.children[i+1:]...)
+	switch {
+	case i > 0:
+		n.keys = append(n.keys[:i-1], n.keys[i:]...)
+	case len(n.keys) > 0:
+		n.keys = n.keys[1:]
+	}
+}
+
+// replaceChild replaces the child at position i of the
+// branch with the nodes, separated by the keys.
+func (n *node) replaceChild(i int, nodes []*node, seps []string) {
+	ids := make([]pgid, len(nodes))
+	for j, part := range nodes {
+		ids[j] = part.id
+	}
+
+	n.children = append(n.children[:i], append(ids, n.children[i+1:]...)...)
+	n.keys = append(n.keys[:i], append(seps, n.keys[i:]...)...)
+}
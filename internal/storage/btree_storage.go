@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/bptree"
+)
+
+// btreeFileName is the name of the file holding the tree
+// of a BTreeStorage in its directory.
+const btreeFileName = "data.btree"
+
+// BTreeStorage implements Storage.
+//
+// BTreeStorage keeps the data in a B+tree in the pages of
+// a single file, as described by bptree.Tree. Unlike the
+// log-structured storages, the data of a key is updated in
+// place, in that the pages holding older data of the key
+// are freed as it's written and reused by later writes, so
+// there are no segments to merge or compact and no work
+// running in the background. Every write is committed to
+// the file before it returns.
+//
+// Keys are sorted by the comparator of the storage, which
+// is recorded in the file, and can be scanned through in
+// order with Scan.
+//
+// BTreeStorage is safe for concurrent use. Writes are
+// serialised and queries run alongside each other.
+type BTreeStorage struct {
+	ctx context.Context
+	// opts are the options the storage was created with.
+	opts Options
+	// tree holds the data of the storage.
+	tree *bptree.Tree
+}
+
+var (
+	_ (Storage) = (*BTreeStorage)(nil)
+	_ (Scanner) = (*BTreeStorage)(nil)
+)
+
+// NewBTreeStorage creates a new instance of BTreeStorage,
+// opening the tree in the directory of the storage or
+// creating it if there is none yet.
+//
+// ErrComparatorMismatch is returned if the tree is ordered
+// by a comparator other than the one of the options.
+func NewBTreeStorage(ctx context.Context, opts Options) (*BTreeStorage, error) {
+	if opts.Dir != "" {
+		err := opts.fs().MkdirAll(opts.Dir, 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tree, err := bptree.Open(filepath.Join(opts.Dir, btreeFileName), bptree.Options{
+		PageSize:   opts.PageSize,
+		CacheSize:  opts.PageCacheSize,
+		Comparator: opts.comparator(),
+		FS:         opts.fs(),
+	})
+	if err != nil {
+		return nil, btreeError(err)
+	}
+
+	return &BTreeStorage{
+		ctx:  ctx,
+		opts: opts,
+		tree: tree,
+	}, nil
+}
+
+// Append stores the data of the key in the tree, in place
+// of the data stored for it before.
+func (s *BTreeStorage) Append(key, data []byte) error {
+	return btreeError(s.tree.Put(key, data))
+}
+
+// Query returns the data stored for the key.
+func (s *BTreeStorage) Query(key []byte) (string, error) {
+	data, err := s.tree.Get(key)
+	if err != nil {
+		return "", btreeError(err)
+	}
+	return string(data), nil
+}
+
+// Delete removes the key from the tree. Deleting a key
+// which isn't stored is not an error.
+func (s *BTreeStorage) Delete(key []byte) error {
+	err := s.tree.Delete(key)
+	if err == bptree.ErrKeyNotFound {
+		return nil
+	}
+	return btreeError(err)
+}
+
+// Scan calls fn with the keys from start up to but not
+// including end and their data, in the order of the
+// comparator of the storage, until fn returns false. A nil
+// start scans from the first key and a nil end up to the
+// last one.
+//
+// The storage can't be written to until the scan is done,
+// so fn mustn't write to the storage.
+func (s *BTreeStorage) Scan(start, end []byte, fn func(key []byte, data string) bool) error {
+	err := s.tree.Scan(start, end, func(key, value []byte) bool {
+		return fn(key, string(value))
+	})
+	return btreeError(err)
+}
+
+// Sync commits the tree to disk. Every write was already
+// committed as it returned.
+func (s *BTreeStorage) Sync() error {
+	return btreeError(s.tree.Sync())
+}
+
+// PauseBackgroundWork does nothing, as a BTreeStorage has
+// no background work.
+func (s *BTreeStorage) PauseBackgroundWork() {}
+
+// ResumeBackgroundWork does nothing, as a BTreeStorage has
+// no background work.
+func (s *BTreeStorage) ResumeBackgroundWork() {}
+
+// Close closes the file of the tree.
+func (s *BTreeStorage) Close() error {
+	return s.tree.Close()
+}
+
+// Stats describes the file of the tree as a single segment,
+// whose free pages are its dead bytes.
+func (s *BTreeStorage) Stats() Stats {
+	st := s.tree.Stats()
+	pageSize := int64(st.PageSize)
+
+	sg := SegmentStats{
+		Size:             st.Pages * pageSize,
+		LiveBytes:        (st.Pages - st.FreePages) * pageSize,
+		DeadBytes:        st.FreePages * pageSize,
+		IndexMemoryUsage: int64(st.CachedPages) * pageSize,
+		Active:           true,
+	}
+	if sg.Size > 0 {
+		sg.GarbageRatio = float64(sg.DeadBytes) / float64(sg.Size)
+	}
+	return Stats{Segments: []SegmentStats{sg}}
+}
+
+// btreeError returns the error of the storage matching the
+// error of the tree.
+func btreeError(err error) error {
+	switch err {
+	case bptree.ErrKeyNotFound:
+		return ErrDataNotFound
+	case bptree.ErrTreeClosed:
+		return ErrStorageClosed
+	case bptree.ErrComparatorMismatch:
+		return ErrComparatorMismatch
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/comparator"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestBTreeStorage_Reopen ensures that the data written
+// and deleted is served as it was after the storage is
+// created again.
+func TestBTreeStorage_Reopen(t *testing.T) {
+	opts := Options{Dir: t.TempDir(), PageSize: 1024}
+
+	s, err := NewBTreeStorage(context.Background(), opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		key := "key" + strconv.Itoa(i%37)
+		assert.Nil(t, s.Append([]byte(key), record(t, key, "value"+strconv.Itoa(i))))
+	}
+	assert.Nil(t, s.Delete([]byte("key0")))
+	assert.Nil(t, s.Delete([]byte("missing")))
+	assert.Nil(t, s.Close())
+
+	_, err = s.Query([]byte("key1"))
+	assert.Equal(t, ErrStorageClosed, err)
+	assert.Equal(t, ErrStorageClosed, s.Append([]byte("key1"), nil))
+
+	reopened, err := NewBTreeStorage(context.Background(), opts)
+	assert.Nil(t, err)
+	defer reopened.Close()
+
+	for i := 63; i < 100; i++ {
+		key := "key" + strconv.Itoa(i%37)
+		data, err := reopened.Query([]byte(key))
+		if key == "key0" {
+			assert.Equal(t, ErrDataNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, string(record(t, key, "value"+strconv.Itoa(i))), data)
+	}
+}
+
+// TestBTreeStorage_FreePageReuse ensures that overwriting
+// the data of the same keys over and over reuses the pages
+// of the file rather than growing it, and that the free
+// pages are accounted as dead bytes.
+func TestBTreeStorage_FreePageReuse(t *testing.T) {
+	s, err := NewBTreeStorage(context.Background(), Options{Dir: t.TempDir(), PageSize: 1024})
+	assert.Nil(t, err)
+	defer s.Close()
+
+	write := func(version int) {
+		for i := 0; i < 50; i++ {
+			key := "key" + strconv.Itoa(i)
+			assert.Nil(t, s.Append([]byte(key), record(t, key, "value"+strconv.Itoa(version))))
+		}
+	}
+
+	write(0)
+	size := s.Stats().Segments[0].Size
+	for v := 1; v < 10; v++ {
+		write(v)
+	}
+
+	stats := s.Stats().Segments[0]
+	assert.True(t, stats.Size <= 2*size, "the file grew from %d to %d bytes", size, stats.Size)
+	assert.Equal(t, stats.Size, stats.LiveBytes+stats.DeadBytes)
+	assert.NotZero(t, stats.IndexMemoryUsage)
+
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, s.Delete([]byte("key"+strconv.Itoa(i))))
+	}
+	assert.True(t, s.Stats().Segments[0].GarbageRatio > 0.5)
+}
+
+// TestBTreeStorage_Scan ensures that the keys are scanned
+// through in the order of the comparator of the storage,
+// which can't be created again with another one.
+func TestBTreeStorage_Scan(t *testing.T) {
+	dir := t.TempDir()
+	reverse := comparator.Reverse(comparator.Bytewise)
+
+	s, err := NewBTreeStorage(context.Background(), Options{Dir: dir, Comparator: reverse})
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		key := "key" + strconv.Itoa(i)
+		assert.Nil(t, s.Append([]byte(key), record(t, key, "value")))
+	}
+
+	var keys []string
+	assert.Nil(t, s.Scan([]byte("key7"), []byte("key3"), func(key []byte, data string) bool {
+		keys = append(keys, string(key))
+		assert.Equal(t, string(record(t, string(key), "value")), data)
+		return true
+	}))
+	assert.Equal(t, []string{"key7", "key6", "key5", "key4"}, keys)
+	assert.Nil(t, s.Close())
+
+	_, err = NewBTreeStorage(context.Background(), Options{Dir: dir})
+	assert.Equal(t, ErrComparatorMismatch, err)
+}
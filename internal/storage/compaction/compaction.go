@@ -0,0 +1,103 @@
+package compaction
+
+import "github.com/SystemBuilders/KeyValueStore/internal/storage/comparator"
+
+// Table describes a sorted segment of the storage as
+// seen by a compaction strategy.
+type Table struct {
+	// ID is the id of the segment.
+	ID int64
+	// Size is the size of the data file of the segment.
+	Size int64
+	// MinKey and MaxKey are the smallest and largest keys
+	// stored in the segment, in the order of the comparator
+	// of the storage.
+	MinKey, MaxKey string
+}
+
+// Compaction describes a compaction picked by a Strategy.
+//
+// The tables of the compaction are merged into new tables
+// holding only the most recent record of each key, which
+// then replace them.
+type Compaction struct {
+	// Level is the level the inputs are taken from.
+	Level int
+	// Inputs are the tables of Level to compact.
+	Inputs []Table
+	// OutputLevel is the level the merged tables are
+	// placed in.
+	OutputLevel int
+	// Overlaps are the tables of OutputLevel whose key
+	// ranges overlap the inputs, which are merged along
+	// with them. This is always empty if OutputLevel is
+	// the same as Level.
+	Overlaps []Table
+	// TargetTableSize is the size after which the merged
+	// records are split into a new table. A zero value
+	// produces a single table.
+	TargetTableSize int64
+}
+
+// Strategy decides which tables of a log-structured
+// storage are compacted and when, trading off write
+// amplification against read and space amplification.
+//
+// Tables are organised in levels. Level 0 holds tables
+// whose key ranges may overlap, ordered newest first,
+// and is where freshly flushed tables are placed. Every
+// other level holds tables with non-overlapping key
+// ranges, ordered by key, each of which is older than
+// any table in a lower level. Keys are ordered by the
+// comparator of the storage.
+//
+// The tables of a level 0 compaction whose output stays
+// in level 0 must be adjacent, as the merged table takes
+// their place in the order.
+type Strategy interface {
+	// Name returns the name of the strategy.
+	Name() string
+	// Pick returns the next compaction to run given the
+	// tables of every level and the comparator ordering
+	// their keys, or false if none is needed.
+	Pick(levels [][]Table, cmp comparator.Comparator) (Compaction, bool)
+	// PendingBytes estimates the number of bytes waiting
+	// to be compacted given the tables of every level.
+	PendingBytes(levels [][]Table) int64
+}
+
+// levelSize returns the total size of the tables.
+func levelSize(tables []Table) int64 {
+	var size int64
+	for _, t := range tables {
+		size += t.Size
+	}
+	return size
+}
+
+// overlapping returns the tables whose key ranges overlap
+// the range from minKey to maxKey.
+func overlapping(tables []Table, minKey, maxKey string, cmp comparator.Comparator) []Table {
+	var overlaps []Table
+	for _, t := range tables {
+		if cmp.Compare(t.MaxKey, minKey) >= 0 && cmp.Compare(t.MinKey, maxKey) <= 0 {
+			overlaps = append(overlaps, t)
+		}
+	}
+	return overlaps
+}
+
+// keyRange returns the smallest and largest keys of the
+// tables.
+func keyRange(tables []Table, cmp comparator.Comparator) (string, string) {
+	minKey, maxKey := tables[0].MinKey, tables[0].MaxKey
+	for _, t := range tables[1:] {
+		if cmp.Compare(t.MinKey, minKey) < 0 {
+			minKey = t.MinKey
+		}
+		if cmp.Compare(t.MaxKey, maxKey) > 0 {
+			maxKey = t.MaxKey
+		}
+	}
+	return minKey, maxKey
+}
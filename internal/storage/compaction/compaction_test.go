@@ -0,0 +1,104 @@
+package compaction
+
+import (
+	"testing"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/comparator"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSizeTiered_Pick ensures that only runs of similarly
+// sized tables long enough are picked, oldest first.
+func TestSizeTiered_Pick(t *testing.T) {
+	st := NewSizeTiered()
+
+	levels := [][]Table{{
+		{ID: 6, Size: 100},
+		{ID: 5, Size: 100},
+		{ID: 4, Size: 100},
+		{ID: 3, Size: 1000},
+		{ID: 2, Size: 1000},
+		{ID: 1, Size: 1000},
+	}}
+	_, ok := st.Pick(levels, comparator.Bytewise)
+	assert.False(t, ok)
+	assert.Zero(t, st.PendingBytes(levels))
+
+	levels[0] = append([]Table{{ID: 7, Size: 100}}, levels[0]...)
+	levels[0] = append(levels[0], Table{ID: 0, Size: 900})
+
+	c, ok := st.Pick(levels, comparator.Bytewise)
+	assert.True(t, ok)
+	assert.Equal(t, 0, c.OutputLevel)
+	assert.Equal(t, levels[0][4:], c.Inputs)
+	assert.Equal(t, int64(3900), st.PendingBytes(levels))
+}
+
+// TestLeveled_Pick ensures that level 0 is compacted into
+// level 1 once it reaches its trigger, along with the
+// overlapping level 1 tables, and that a level over its
+// target size has its tables compacted in turn.
+func TestLeveled_Pick(t *testing.T) {
+	l := NewLeveled()
+	l.BaseLevelSize = 100
+
+	levels := [][]Table{
+		{
+			{ID: 4, Size: 10, MinKey: "c", MaxKey: "d"},
+			{ID: 3, Size: 10, MinKey: "a", MaxKey: "b"},
+			{ID: 2, Size: 10, MinKey: "b", MaxKey: "c"},
+		},
+		{
+			{ID: 0, Size: 60, MinKey: "a", MaxKey: "b"},
+			{ID: 1, Size: 60, MinKey: "x", MaxKey: "z"},
+		},
+	}
+
+	assert.Equal(t, int64(20), l.PendingBytes(levels))
+
+	c, ok := l.Pick(levels, comparator.Bytewise)
+	assert.True(t, ok)
+	assert.Equal(t, 1, c.Level)
+	assert.Equal(t, []Table{levels[1][0]}, c.Inputs)
+	assert.Equal(t, 2, c.OutputLevel)
+
+	c, ok = l.Pick(levels, comparator.Bytewise)
+	assert.True(t, ok)
+	assert.Equal(t, []Table{levels[1][1]}, c.Inputs)
+
+	levels[0] = append([]Table{{ID: 5, Size: 10, MinKey: "e", MaxKey: "f"}}, levels[0]...)
+	assert.Equal(t, int64(60), l.PendingBytes(levels))
+	c, ok = l.Pick(levels, comparator.Bytewise)
+	assert.True(t, ok)
+	assert.Equal(t, 0, c.Level)
+	assert.Equal(t, levels[0], c.Inputs)
+	assert.Equal(t, 1, c.OutputLevel)
+	assert.Equal(t, []Table{levels[1][0]}, c.Overlaps)
+
+	levels[1] = levels[1][:1]
+	levels[0] = levels[0][:1]
+	_, ok = l.Pick(levels, comparator.Bytewise)
+	assert.False(t, ok)
+}
+
+// TestLeveled_PickWithComparator ensures that key ranges
+// are compared in the order of the comparator given.
+func TestLeveled_PickWithComparator(t *testing.T) {
+	l := NewLeveled()
+	l.L0Trigger = 1
+
+	levels := [][]Table{
+		{
+			{ID: 2, Size: 10, MinKey: "c", MaxKey: "b"},
+		},
+		{
+			{ID: 1, Size: 10, MinKey: "z", MaxKey: "x"},
+			{ID: 0, Size: 10, MinKey: "b", MaxKey: "a"},
+		},
+	}
+
+	c, ok := l.Pick(levels, comparator.Reverse(comparator.Bytewise))
+	assert.True(t, ok)
+	assert.Equal(t, levels[0], c.Inputs)
+	assert.Equal(t, []Table{levels[1][1]}, c.Overlaps)
+}
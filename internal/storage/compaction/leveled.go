@@ -0,0 +1,153 @@
+package compaction
+
+import "github.com/SystemBuilders/KeyValueStore/internal/storage/comparator"
+
+// Leveled implements Strategy.
+//
+// Leveled keeps the tables of every level other than 0
+// non-overlapping and bounds the size of each level to
+// a multiple of the level above it. Once level 0 has
+// enough tables they are merged into level 1, and once
+// a level grows past its target one of its tables is
+// merged into the next level. A key thus exists in at
+// most one table per level, which keeps reads and space
+// amplification low at the cost of rewriting records
+// more often.
+type Leveled struct {
+	// L0Trigger is the number of level 0 tables that
+	// triggers their compaction into level 1.
+	L0Trigger int
+	// BaseLevelSize is the target size of level 1.
+	BaseLevelSize int64
+	// LevelMultiplier is how many times larger the target
+	// size of a level is than that of the level above it.
+	LevelMultiplier int64
+	// MaxLevels is the number of levels, including level 0.
+	MaxLevels int
+	// TargetTableSize is the size of the tables written
+	// by compactions.
+	TargetTableSize int64
+
+	// cursors hold the largest key of the last table
+	// compacted out of every level, so that the tables of
+	// a level are compacted in a round-robin fashion.
+	cursors map[int]string
+}
+
+var _ Strategy = (*Leveled)(nil)
+
+// NewLeveled returns a leveled strategy with the default
+// level sizes.
+func NewLeveled() *Leveled {
+	return &Leveled{
+		L0Trigger:       4,
+		BaseLevelSize:   16 << 10,
+		LevelMultiplier: 10,
+		MaxLevels:       7,
+		TargetTableSize: 4 << 10,
+		cursors:         make(map[int]string),
+	}
+}
+
+// Name returns the name of the strategy.
+func (l *Leveled) Name() string {
+	return "leveled"
+}
+
+// Pick returns a compaction of all of level 0 into level 1
+// if level 0 has reached its trigger. Otherwise, the level
+// most over its target size, if any, has its next table in
+// round-robin order compacted into the level below it.
+func (l *Leveled) Pick(levels [][]Table, cmp comparator.Comparator) (Compaction, bool) {
+	if len(levels) > 0 && len(levels[0]) >= l.L0Trigger {
+		inputs := levels[0]
+		minKey, maxKey := keyRange(inputs, cmp)
+		return Compaction{
+			Level:           0,
+			Inputs:          inputs,
+			OutputLevel:     1,
+			Overlaps:        overlapping(l.level(levels, 1), minKey, maxKey, cmp),
+			TargetTableSize: l.TargetTableSize,
+		}, true
+	}
+
+	var (
+		bestLevel int
+		bestScore = 1.0
+	)
+	for level := 1; level < len(levels) && level < l.MaxLevels-1; level++ {
+		score := float64(levelSize(levels[level])) / float64(l.targetSize(level))
+		if score > bestScore {
+			bestLevel, bestScore = level, score
+		}
+	}
+	if bestLevel == 0 {
+		return Compaction{}, false
+	}
+
+	input := l.nextTable(bestLevel, levels[bestLevel], cmp)
+	return Compaction{
+		Level:           bestLevel,
+		Inputs:          []Table{input},
+		OutputLevel:     bestLevel + 1,
+		Overlaps:        overlapping(l.level(levels, bestLevel+1), input.MinKey, input.MaxKey, cmp),
+		TargetTableSize: l.TargetTableSize,
+	}, true
+}
+
+// PendingBytes returns the size of level 0 once it has
+// reached its trigger, plus how far every other level is
+// over its target size.
+func (l *Leveled) PendingBytes(levels [][]Table) int64 {
+	var pending int64
+	if len(levels) > 0 && len(levels[0]) >= l.L0Trigger {
+		pending += levelSize(levels[0])
+	}
+
+	for level := 1; level < len(levels) && level < l.MaxLevels-1; level++ {
+		if over := levelSize(levels[level]) - l.targetSize(level); over > 0 {
+			pending += over
+		}
+	}
+	return pending
+}
+
+// targetSize returns the target size of the level.
+func (l *Leveled) targetSize(level int) int64 {
+	size := l.BaseLevelSize
+	for i := 1; i < level; i++ {
+		size *= l.LevelMultiplier
+	}
+	return size
+}
+
+// nextTable returns the first table of the level after
+// the cursor of the level, wrapping around, and moves the
+// cursor past it.
+func (l *Leveled) nextTable(level int, tables []Table, cmp comparator.Comparator) Table {
+	if l.cursors == nil {
+		l.cursors = make(map[int]string)
+	}
+
+	next := tables[0]
+	if cursor, ok := l.cursors[level]; ok {
+		for _, t := range tables {
+			if cmp.Compare(t.MinKey, cursor) > 0 {
+				next = t
+				break
+			}
+		}
+	}
+
+	l.cursors[level] = next.MaxKey
+	return next
+}
+
+// level returns the tables of the level, which may not
+// exist yet.
+func (l *Leveled) level(levels [][]Table, level int) []Table {
+	if level >= len(levels) {
+		return nil
+	}
+	return levels[level]
+}
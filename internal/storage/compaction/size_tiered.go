@@ -0,0 +1,100 @@
+package compaction
+
+import "github.com/SystemBuilders/KeyValueStore/internal/storage/comparator"
+
+// SizeTiered implements Strategy.
+//
+// SizeTiered keeps every table in level 0 and merges
+// runs of adjacent tables of similar sizes into a single
+// larger table. This writes every record only about once
+// per tier, at the cost of reads having to look through
+// more tables and of overwritten records lingering until
+// their tier fills up.
+type SizeTiered struct {
+	// MinThreshold is the number of similarly sized tables
+	// needed before they are compacted.
+	MinThreshold int
+	// MaxThreshold is the most tables compacted at once.
+	MaxThreshold int
+	// BucketLow and BucketHigh bound the sizes of the tables
+	// in a run, as fractions of the average size of the run.
+	BucketLow, BucketHigh float64
+}
+
+var _ Strategy = (*SizeTiered)(nil)
+
+// NewSizeTiered returns a size-tiered strategy with the
+// default thresholds.
+func NewSizeTiered() *SizeTiered {
+	return &SizeTiered{
+		MinThreshold: 4,
+		MaxThreshold: 32,
+		BucketLow:    0.5,
+		BucketHigh:   1.5,
+	}
+}
+
+// Name returns the name of the strategy.
+func (st *SizeTiered) Name() string {
+	return "size-tiered"
+}
+
+// Pick returns a compaction of the first run of adjacent
+// level 0 tables, oldest first, whose sizes are all within
+// the bucket bounds of the run's average and which is at
+// least MinThreshold tables long. The keys of the tables
+// don't come into it.
+func (st *SizeTiered) Pick(levels [][]Table, cmp comparator.Comparator) (Compaction, bool) {
+	if len(levels) == 0 {
+		return Compaction{}, false
+	}
+
+	tables := levels[0]
+	for end := len(tables); end >= st.MinThreshold; end-- {
+		var (
+			start = end - 1
+			total = tables[start].Size
+		)
+		for start > 0 && end-start < st.MaxThreshold {
+			next := tables[start-1].Size
+			avg := float64(total+next) / float64(end-start+1)
+			if !st.fits(tables[start-1:end], avg) {
+				break
+			}
+			start--
+			total += next
+		}
+
+		if end-start >= st.MinThreshold {
+			return Compaction{
+				Level:       0,
+				Inputs:      tables[start:end],
+				OutputLevel: 0,
+			}, true
+		}
+	}
+
+	return Compaction{}, false
+}
+
+// PendingBytes returns the size of the tables of the run
+// Pick returns, if any.
+func (st *SizeTiered) PendingBytes(levels [][]Table) int64 {
+	c, ok := st.Pick(levels, comparator.Bytewise)
+	if !ok {
+		return 0
+	}
+	return levelSize(c.Inputs)
+}
+
+// fits reports whether the sizes of all the tables are
+// within the bucket bounds of the average.
+func (st *SizeTiered) fits(tables []Table, avg float64) bool {
+	for _, t := range tables {
+		size := float64(t.Size)
+		if size < avg*st.BucketLow || size > avg*st.BucketHigh {
+			return false
+		}
+	}
+	return true
+}
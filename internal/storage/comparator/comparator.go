@@ -0,0 +1,59 @@
+package comparator
+
+import "strings"
+
+// Comparator orders the keys of a storage.
+//
+// Keys are given as strings holding their bytes, which is
+// how the storage keeps them. Everything that keeps keys
+// in order, the memtables, the sorted segments and the
+// compactions, orders them with the same Comparator.
+type Comparator interface {
+	// Compare returns a negative number if a is ordered
+	// before b, a positive number if a is ordered after b,
+	// and zero if they're the same key. Keys are also
+	// looked up by their bytes, so only keys with the same
+	// bytes may be the same key.
+	Compare(a, b string) int
+	// Name identifies the order of the comparator. It's
+	// recorded on disk along with the data ordered by the
+	// comparator, which can't be opened with a comparator
+	// of another name, so it must change whenever the order
+	// does.
+	Name() string
+}
+
+// Bytewise orders keys lexicographically by their bytes,
+// which is the order used if no other is set.
+var Bytewise Comparator = bytewise{}
+
+// bytewise implements Comparator.
+type bytewise struct{}
+
+func (bytewise) Compare(a, b string) int {
+	return strings.Compare(a, b)
+}
+
+func (bytewise) Name() string {
+	return "bytewise"
+}
+
+// Reverse returns a Comparator ordering keys the other
+// way around from the given one, which suits keys such as
+// timestamps that are mostly read from the latest.
+func Reverse(c Comparator) Comparator {
+	return reverse{c}
+}
+
+// reverse implements Comparator.
+type reverse struct {
+	c Comparator
+}
+
+func (r reverse) Compare(a, b string) int {
+	return r.c.Compare(b, a)
+}
+
+func (r reverse) Name() string {
+	return "reverse(" + r.c.Name() + ")"
+}
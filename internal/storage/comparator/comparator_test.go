@@ -0,0 +1,31 @@
+package comparator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestBytewise ensures that keys are ordered by their
+// bytes, with a key ordered before any longer key it's
+// a prefix of.
+func TestBytewise(t *testing.T) {
+	assert.Equal(t, "bytewise", Bytewise.Name())
+	assert.Equal(t, -1, Bytewise.Compare("a", "b"))
+	assert.Equal(t, -1, Bytewise.Compare("a", "ab"))
+	assert.Equal(t, 1, Bytewise.Compare("\xff", "\x01\x00"))
+	assert.Equal(t, 0, Bytewise.Compare("key", "key"))
+}
+
+// TestReverse ensures that a reversed comparator orders
+// keys the other way around and is named after the one
+// it reverses.
+func TestReverse(t *testing.T) {
+	r := Reverse(Bytewise)
+	assert.Equal(t, "reverse(bytewise)", r.Name())
+	assert.Equal(t, 1, r.Compare("a", "b"))
+	assert.Equal(t, -1, r.Compare("ab", "a"))
+	assert.Equal(t, 0, r.Compare("key", "key"))
+
+	assert.Equal(t, -1, Reverse(r).Compare("a", "b"))
+}
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/dataobject"
+	_map "github.com/SystemBuilders/KeyValueStore/internal/indexer/map"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/compaction"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	stressWriters  = 4
+	stressReaders  = 4
+	stressKeys     = 8
+	stressVersions = 25
+)
+
+// stressKey returns the key owned by the writer.
+func stressKey(writer, key int) string {
+	return "w" + strconv.Itoa(writer) + "-k" + strconv.Itoa(key)
+}
+
+// stressVersion returns the version held by the record
+// returned for the key, which is the value it was
+// appended with.
+func stressVersion(t *testing.T, key, data string) int {
+	var obj dataobject.Object
+	assert.Nil(t, json.Unmarshal([]byte(data), &obj))
+
+	version, err := strconv.Atoi(obj.Value.(string))
+	assert.Nil(t, err)
+	assert.Equal(t, string(record(t, key, obj.Value.(string))), data)
+	return version
+}
+
+// testConcurrentAccess runs writers on keys of their own
+// and on a key they all share, along with readers querying
+// every key, while the storage merges or compacts in the
+// background.
+//
+// Every writer appends increasing versions of its keys and
+// deletes the first one at the end, so a reader must never
+// see the version of a key go backwards, and once all the
+// writers are done the last version of every key is found.
+func testConcurrentAccess(t *testing.T, s Storage) {
+	var (
+		writers sync.WaitGroup
+		readers sync.WaitGroup
+		done    = make(chan struct{})
+	)
+
+	for w := 0; w < stressWriters; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+
+			for v := 0; v < stressVersions; v++ {
+				for k := 0; k < stressKeys; k++ {
+					key := stressKey(w, k)
+					assert.Nil(t, s.Append([]byte(key), record(t, key, strconv.Itoa(v))))
+				}
+				assert.Nil(t, s.Append([]byte("shared"), record(t, "shared", strconv.Itoa(v))))
+			}
+			assert.Nil(t, s.Delete([]byte(stressKey(w, 0))))
+		}(w)
+	}
+
+	for r := 0; r < stressReaders; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+
+			seen := make(map[string]int)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				for w := 0; w < stressWriters; w++ {
+					for k := 1; k < stressKeys; k++ {
+						key := stressKey(w, k)
+						data, err := s.Query([]byte(key))
+						if err == ErrDataNotFound {
+							_, ok := seen[key]
+							assert.False(t, ok, "%s disappeared", key)
+							continue
+						}
+						if !assert.Nil(t, err) {
+							return
+						}
+
+						version := stressVersion(t, key, data)
+						if last, ok := seen[key]; ok {
+							assert.GreaterOrEqual(t, version, last, "%s went backwards", key)
+						}
+						seen[key] = version
+					}
+				}
+
+				s.Stats()
+			}
+		}()
+	}
+
+	writers.Wait()
+	close(done)
+	readers.Wait()
+
+	for w := 0; w < stressWriters; w++ {
+		_, err := s.Query([]byte(stressKey(w, 0)))
+		assert.Equal(t, ErrDataNotFound, err)
+
+		for k := 1; k < stressKeys; k++ {
+			key := stressKey(w, k)
+			data, err := s.Query([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, string(record(t, key, strconv.Itoa(stressVersions-1))), data)
+		}
+	}
+
+	data, err := s.Query([]byte("shared"))
+	assert.Nil(t, err)
+	assert.Equal(t, string(record(t, "shared", strconv.Itoa(stressVersions-1))), data)
+}
+
+// TestStorageV1_ConcurrentAccess ensures that StorageV1 can
+// be written to and queried at once while it merges its
+// segments, which is meant to be run with -race.
+func TestStorageV1_ConcurrentAccess(t *testing.T) {
+	s, err := NewStorageV1(context.Background(), _map.NewMapIndexerGenerator(), Options{
+		Dir: t.TempDir(),
+	})
+	assert.Nil(t, err)
+	defer s.Close()
+
+	testConcurrentAccess(t, s)
+	s.scheduler.Wait()
+	assert.Nil(t, s.scheduler.Err())
+}
+
+// TestBTreeStorage_ConcurrentAccess ensures that
+// BTreeStorage can be written to and queried at once,
+// which is meant to be run with -race.
+func TestBTreeStorage_ConcurrentAccess(t *testing.T) {
+	s, err := NewBTreeStorage(context.Background(), Options{
+		Dir:      t.TempDir(),
+		PageSize: 1024,
+	})
+	assert.Nil(t, err)
+	defer s.Close()
+
+	testConcurrentAccess(t, s)
+}
+
+// TestMemoryStorage_ConcurrentAccess ensures that
+// MemoryStorage can be written to and queried at once,
+// which is meant to be run with -race.
+func TestMemoryStorage_ConcurrentAccess(t *testing.T) {
+	s := NewMemoryStorage(context.Background(), Options{EvictionPolicy: EvictionLFU})
+	defer s.Close()
+
+	testConcurrentAccess(t, s)
+}
+
+// TestSSTStorage_ConcurrentAccess ensures that SSTStorage
+// can be written to and queried at once while it flushes
+// and compacts its tables with either strategy and either
+// memtable, which is meant to be run with -race.
+func TestSSTStorage_ConcurrentAccess(t *testing.T) {
+	strategies := []func() compaction.Strategy{
+		func() compaction.Strategy { return compaction.NewSizeTiered() },
+		func() compaction.Strategy { return compaction.NewLeveled() },
+	}
+	memtables := map[string]MemtableType{
+		"avl":      MemtableAVLTree,
+		"skiplist": MemtableSkiplist,
+	}
+
+	for _, newStrategy := range strategies {
+		for name, memtableType := range memtables {
+			strategy := newStrategy()
+			t.Run(strategy.Name()+"/"+name, func(t *testing.T) {
+				s, err := NewSSTStorage(context.Background(), _map.NewMapIndexerGenerator(), Options{
+					Dir:                t.TempDir(),
+					MemtableSize:       512,
+					MemtableType:       memtableType,
+					CompactionStrategy: strategy,
+				})
+				assert.Nil(t, err)
+				defer s.Close()
+
+				testConcurrentAccess(t, s)
+				s.scheduler.Wait()
+				assert.Nil(t, s.scheduler.Err())
+			})
+		}
+	}
+}
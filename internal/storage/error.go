@@ -7,4 +7,10 @@ func (e Error) Error() string { return string(e) }
 
 const (
 	ErrDataNotFound Error = "the queried data does not exist in the storage"
+	// ErrStorageClosed indicates that the storage was used
+	// after it was closed.
+	ErrStorageClosed Error = "the storage is closed"
+	// ErrComparatorMismatch indicates that a storage was opened
+	// with a comparator other than the one its data is ordered by.
+	ErrComparatorMismatch Error = "the comparator doesn't match the one the storage was created with"
 )
@@ -0,0 +1,158 @@
+package storage
+
+import "container/list"
+
+// EvictionPolicy decides which keys a MemoryStorage evicts
+// once it holds more than its capacity.
+type EvictionPolicy int
+
+const (
+	// EvictionLRU evicts the least recently written or
+	// queried key first.
+	EvictionLRU EvictionPolicy = iota
+	// EvictionLFU evicts the least frequently written or
+	// queried key first, and the least recently used of
+	// those written or queried equally often.
+	EvictionLFU
+)
+
+// memoryEntry is a key held by a MemoryStorage.
+type memoryEntry struct {
+	key  string
+	data string
+	// elem is the element of the entry in the list of its
+	// evictor.
+	elem *list.Element
+	// bucket is the element of the frequency bucket of the
+	// entry, for an lfuEvictor.
+	bucket *list.Element
+}
+
+// size returns the number of bytes the entry accounts for.
+func (e *memoryEntry) size() int64 {
+	return int64(len(e.key) + len(e.data))
+}
+
+// evictor keeps the entries of a MemoryStorage in the order
+// they are to be evicted in.
+type evictor interface {
+	// add adds a new entry.
+	add(e *memoryEntry)
+	// touch records a use of the entry.
+	touch(e *memoryEntry)
+	// remove removes the entry.
+	remove(e *memoryEntry)
+	// victim returns the entry to be evicted next other
+	// than skip, or nil if there is none.
+	victim(skip *memoryEntry) *memoryEntry
+}
+
+// newEvictor returns an evictor for the policy.
+func newEvictor(policy EvictionPolicy) evictor {
+	switch policy {
+	case EvictionLFU:
+		return newLFUEvictor()
+	default:
+		return newLRUEvictor()
+	}
+}
+
+// lruEvictor evicts the least recently used entry first.
+type lruEvictor struct {
+	// entries hold the entries, most recently used first.
+	entries *list.List
+}
+
+func newLRUEvictor() *lruEvictor {
+	return &lruEvictor{entries: list.New()}
+}
+
+func (ev *lruEvictor) add(e *memoryEntry) {
+	e.elem = ev.entries.PushFront(e)
+}
+
+func (ev *lruEvictor) touch(e *memoryEntry) {
+	ev.entries.MoveToFront(e.elem)
+}
+
+func (ev *lruEvictor) remove(e *memoryEntry) {
+	ev.entries.Remove(e.elem)
+}
+
+func (ev *lruEvictor) victim(skip *memoryEntry) *memoryEntry {
+	for elem := ev.entries.Back(); elem != nil; elem = elem.Prev() {
+		if e := elem.Value.(*memoryEntry); e != skip {
+			return e
+		}
+	}
+	return nil
+}
+
+// lfuBucket holds the entries used equally often, most
+// recently used first.
+type lfuBucket struct {
+	freq    int
+	entries *list.List
+}
+
+// lfuEvictor evicts the least frequently used entry first.
+//
+// The entries are kept in buckets by how often they were
+// used, and the buckets are ordered by frequency, so every
+// operation takes constant time.
+type lfuEvictor struct {
+	// buckets hold the buckets of the entries, least
+	// frequently used first. Empty buckets are removed.
+	buckets *list.List
+}
+
+func newLFUEvictor() *lfuEvictor {
+	return &lfuEvictor{buckets: list.New()}
+}
+
+func (ev *lfuEvictor) add(e *memoryEntry) {
+	first := ev.buckets.Front()
+	if first == nil || first.Value.(*lfuBucket).freq != 1 {
+		first = ev.buckets.PushFront(&lfuBucket{freq: 1, entries: list.New()})
+	}
+	ev.place(e, first)
+}
+
+func (ev *lfuEvictor) touch(e *memoryEntry) {
+	curr := e.bucket
+	freq := curr.Value.(*lfuBucket).freq
+
+	next := curr.Next()
+	if next == nil || next.Value.(*lfuBucket).freq != freq+1 {
+		next = ev.buckets.InsertAfter(&lfuBucket{freq: freq + 1, entries: list.New()}, curr)
+	}
+	ev.remove(e)
+	ev.place(e, next)
+}
+
+func (ev *lfuEvictor) remove(e *memoryEntry) {
+	b := e.bucket.Value.(*lfuBucket)
+	b.entries.Remove(e.elem)
+	if b.entries.Len() == 0 {
+		ev.buckets.Remove(e.bucket)
+	}
+}
+
+func (ev *lfuEvictor) victim(skip *memoryEntry) *memoryEntry {
+	for bucket := ev.buckets.Front(); bucket != nil; bucket = bucket.Next() {
+		entries := bucket.Value.(*lfuBucket).entries
+		for elem := entries.Back(); elem != nil; elem = elem.Prev() {
+			if e := elem.Value.(*memoryEntry); e != skip {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// place puts the entry in the bucket as its most recently
+// used entry.
+func (ev *lfuEvictor) place(e *memoryEntry, bucket *list.Element) {
+	e.bucket = bucket
+	e.elem = bucket.Value.(*lfuBucket).entries.PushFront(e)
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	_map "github.com/SystemBuilders/KeyValueStore/internal/indexer/map"
+	"github.com/SystemBuilders/KeyValueStore/internal/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+// fileStorages create the storages which keep their data
+// in files.
+var fileStorages = map[string]func(opts Options) (Storage, error){
+	"v1": func(opts Options) (Storage, error) {
+		return NewStorageV1(context.Background(), _map.NewMapIndexerGenerator(), opts)
+	},
+	"sst": func(opts Options) (Storage, error) {
+		return NewSSTStorage(context.Background(), _map.NewMapIndexerGenerator(), opts)
+	},
+	"btree": func(opts Options) (Storage, error) {
+		return NewBTreeStorage(context.Background(), opts)
+	},
+}
+
+// TestStorage_MemFS ensures that the storages keeping
+// their data in files run on a vfs.MemFS without touching
+// the disk, and load what they wrote to it when they are
+// created again.
+func TestStorage_MemFS(t *testing.T) {
+	for name, newStorage := range fileStorages {
+		t.Run(name, func(t *testing.T) {
+			fs := vfs.NewMemFS()
+			opts := Options{
+				Dir:            filepath.Join(t.TempDir(), "store"),
+				FS:             fs,
+				MemtableSize:   256,
+				ValueThreshold: 100,
+			}
+			s, err := newStorage(opts)
+			assert.Nil(t, err)
+
+			// Every third value is large enough to be kept
+			// in the value log.
+			want := make(map[string]string)
+			for i := 0; i < 200; i++ {
+				key := "key" + strconv.Itoa(i%30)
+				data := record(t, key, strings.Repeat("v", i%3*50)+strconv.Itoa(i))
+				assert.Nil(t, s.Append([]byte(key), data))
+				want[key] = string(data)
+
+				if i%7 == 0 {
+					assert.Nil(t, s.Delete([]byte(key)))
+					delete(want, key)
+				}
+			}
+			waitForBackgroundWork(s)
+
+			check := func(s Storage) {
+				for i := 0; i < 30; i++ {
+					key := "key" + strconv.Itoa(i)
+					data, err := s.Query([]byte(key))
+					if value, ok := want[key]; ok {
+						assert.Nil(t, err)
+						assert.Equal(t, value, data)
+					} else {
+						assert.Equal(t, ErrDataNotFound, err)
+					}
+				}
+			}
+
+			check(s)
+			assert.Nil(t, s.Close())
+			s, err = newStorage(opts)
+			assert.Nil(t, err)
+			check(s)
+			assert.Nil(t, s.Close())
+
+			infos, err := fs.ReadDir(opts.Dir)
+			assert.Nil(t, err)
+			assert.NotEmpty(t, infos)
+			_, err = os.Stat(opts.Dir)
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
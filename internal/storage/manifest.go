@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/vfs"
+)
+
+// manifestFileName is the name of the manifest file in
+// the directory of an SSTStorage.
+const manifestFileName = "MANIFEST"
+
+// manifest records which tables make up each level of
+// an SSTStorage. Tables in the directory which are not
+// in the manifest are leftovers of interrupted flushes
+// or compactions.
+//
+// A StorageV1 only records its comparator in it.
+type manifest struct {
+	// Comparator is the name of the comparator the keys
+	// of the tables are ordered by. Manifests written
+	// before it was recorded leave it empty, and their
+	// tables are ordered by comparator.Bytewise.
+	Comparator string `json:",omitempty"`
+	// Sequence is the sequence number of the last record
+	// flushed to a table.
+	Sequence uint64
+	// Levels hold the ids of the tables of every level in
+	// the order they are kept in.
+	Levels [][]int64
+}
+
+// readManifest reads the manifest in the directory of the
+// filesystem. An empty manifest is returned if there is
+// none yet.
+func readManifest(fs vfs.FS, dir string) (manifest, error) {
+	var m manifest
+
+	data, err := vfs.ReadFile(fs, filepath.Join(dir, manifestFileName))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
+
+// writeManifest replaces the manifest in the directory of
+// the filesystem.
+//
+// The manifest is written to a temporary file which is
+// then renamed over the old one, so that a crash leaves
+// either the old or the new manifest in place.
+func writeManifest(fs vfs.FS, dir string, m manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, manifestFileName)
+	file, err := fs.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return fs.Rename(path+".tmp", path)
+}
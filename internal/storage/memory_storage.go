@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// MemoryStorage implements Storage.
+//
+// MemoryStorage keeps the data in memory only, with no
+// files at all, so it's lost once the storage is closed.
+// It suits tests and serving as a cache in front of
+// another store.
+//
+// A MemoryStorage with a MemoryCapacity evicts keys once
+// the keys and data it holds take more than the capacity,
+// picking the keys to evict by its EvictionPolicy. The key
+// being written is never evicted, so a single record
+// larger than the capacity is still held.
+//
+// MemoryStorage is safe for concurrent use. Queries are
+// serialised along with the writes, as they change the
+// order of eviction.
+type MemoryStorage struct {
+	ctx context.Context
+	// opts are the options the storage was created with.
+	opts Options
+	// mu guards the fields below it.
+	mu sync.Mutex
+	// entries hold the entries of the storage by key.
+	entries map[string]*memoryEntry
+	// evictor orders the entries for eviction.
+	evictor evictor
+	// bytes is the number of bytes taken by the keys and
+	// data of the entries.
+	bytes int64
+	// evictions is the number of keys evicted.
+	evictions int64
+	// closed is set once the storage is closed.
+	closed bool
+}
+
+var (
+	_ (Storage) = (*MemoryStorage)(nil)
+	_ (Scanner) = (*MemoryStorage)(nil)
+)
+
+// NewMemoryStorage creates a new, empty instance of
+// MemoryStorage.
+func NewMemoryStorage(ctx context.Context, opts Options) *MemoryStorage {
+	return &MemoryStorage{
+		ctx:     ctx,
+		opts:    opts,
+		entries: make(map[string]*memoryEntry),
+		evictor: newEvictor(opts.EvictionPolicy),
+	}
+}
+
+// Append stores the data of the key in place of the data
+// stored for it before, evicting other keys if the storage
+// holds more than its capacity.
+func (s *MemoryStorage) Append(key, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrStorageClosed
+	}
+
+	e, ok := s.entries[string(key)]
+	if ok {
+		s.bytes -= e.size()
+		e.data = string(data)
+		s.evictor.touch(e)
+	} else {
+		e = &memoryEntry{key: string(key), data: string(data)}
+		s.entries[e.key] = e
+		s.evictor.add(e)
+	}
+	s.bytes += e.size()
+
+	s.evict(e)
+	return nil
+}
+
+// Query returns the data stored for the key.
+func (s *MemoryStorage) Query(key []byte) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return "", ErrStorageClosed
+	}
+
+	e, ok := s.entries[string(key)]
+	if !ok {
+		return "", ErrDataNotFound
+	}
+	s.evictor.touch(e)
+	return e.data, nil
+}
+
+// Delete removes the key from the storage. Deleting a key
+// which isn't stored is not an error.
+func (s *MemoryStorage) Delete(key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrStorageClosed
+	}
+
+	if e, ok := s.entries[string(key)]; ok {
+		s.remove(e)
+	}
+	return nil
+}
+
+// Scan calls fn with the keys from start up to but not
+// including end and their data, in the order of the
+// comparator of the storage, until fn returns false. A nil
+// start scans from the first key and a nil end up to the
+// last one.
+//
+// The keys are scanned as they were when Scan was called,
+// and scanning them doesn't change the order of eviction.
+func (s *MemoryStorage) Scan(start, end []byte, fn func(key []byte, data string) bool) error {
+	cmp := s.opts.comparator()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrStorageClosed
+	}
+	var entries []memoryEntry
+	for key, e := range s.entries {
+		if start != nil && cmp.Compare(key, string(start)) < 0 {
+			continue
+		}
+		if end != nil && cmp.Compare(key, string(end)) >= 0 {
+			continue
+		}
+		entries = append(entries, memoryEntry{key: e.key, data: e.data})
+	}
+	s.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return cmp.Compare(entries[i].key, entries[j].key) < 0
+	})
+	for _, e := range entries {
+		if !fn([]byte(e.key), e.data) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Sync does nothing, as a MemoryStorage keeps nothing on
+// disk.
+func (s *MemoryStorage) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrStorageClosed
+	}
+	return nil
+}
+
+// PauseBackgroundWork does nothing, as a MemoryStorage has
+// no background work.
+func (s *MemoryStorage) PauseBackgroundWork() {}
+
+// ResumeBackgroundWork does nothing, as a MemoryStorage has
+// no background work.
+func (s *MemoryStorage) ResumeBackgroundWork() {}
+
+// Close drops the data of the storage.
+func (s *MemoryStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.entries = nil
+	s.evictor = nil
+	s.bytes = 0
+	return nil
+}
+
+// Stats describes the data of the storage as a single
+// segment with no dead bytes, along with the number of
+// keys evicted.
+func (s *MemoryStorage) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return Stats{
+		Segments: []SegmentStats{{
+			Size:      s.bytes,
+			LiveBytes: s.bytes,
+			Active:    true,
+		}},
+		Evictions: s.evictions,
+	}
+}
+
+// evict evicts keys other than the one of the given entry
+// until the storage holds no more than its capacity. It
+// must be called with mu held.
+func (s *MemoryStorage) evict(written *memoryEntry) {
+	if s.opts.MemoryCapacity == 0 {
+		return
+	}
+
+	for s.bytes > s.opts.MemoryCapacity {
+		e := s.evictor.victim(written)
+		if e == nil {
+			return
+		}
+		s.remove(e)
+		s.evictions++
+	}
+}
+
+// remove removes the entry from the storage and must be
+// called with mu held.
+func (s *MemoryStorage) remove(e *memoryEntry) {
+	delete(s.entries, e.key)
+	s.evictor.remove(e)
+	s.bytes -= e.size()
+}
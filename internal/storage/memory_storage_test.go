@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// storedKeys returns which of the keys are held by the
+// storage.
+func storedKeys(s Storage, keys ...string) []string {
+	var stored []string
+	for _, key := range keys {
+		if _, err := s.Query([]byte(key)); err == nil {
+			stored = append(stored, key)
+		}
+	}
+	return stored
+}
+
+func TestMemoryStorage(t *testing.T) {
+	s := NewMemoryStorage(context.Background(), Options{})
+
+	for i := 0; i < 100; i++ {
+		key := "key" + strconv.Itoa(i%10)
+		assert.Nil(t, s.Append([]byte(key), record(t, key, strconv.Itoa(i))))
+	}
+	assert.Nil(t, s.Delete([]byte("key0")))
+	assert.Nil(t, s.Delete([]byte("missing")))
+
+	_, err := s.Query([]byte("key0"))
+	assert.Equal(t, ErrDataNotFound, err)
+	for i := 91; i < 100; i++ {
+		key := "key" + strconv.Itoa(i%10)
+		data, err := s.Query([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, string(record(t, key, strconv.Itoa(i))), data)
+	}
+
+	stats := s.Stats()
+	assert.Equal(t, int64(0), stats.Evictions)
+	assert.Equal(t, int64(9*(4+len(record(t, "key1", "91")))), stats.Segments[0].Size)
+
+	assert.Nil(t, s.Close())
+	_, err = s.Query([]byte("key1"))
+	assert.Equal(t, ErrStorageClosed, err)
+	assert.Equal(t, ErrStorageClosed, s.Append([]byte("key1"), nil))
+}
+
+func TestMemoryStorage_EvictionLRU(t *testing.T) {
+	// Every key and its data take 8 bytes, so 3 keys fit.
+	s := NewMemoryStorage(context.Background(), Options{MemoryCapacity: 24})
+	defer s.Close()
+
+	for _, key := range []string{"a", "b", "c"} {
+		assert.Nil(t, s.Append([]byte(key), []byte("1234567")))
+	}
+	_, err := s.Query([]byte("a"))
+	assert.Nil(t, err)
+
+	// b is the least recently used.
+	assert.Nil(t, s.Append([]byte("d"), []byte("1234567")))
+	assert.Equal(t, []string{"a", "c", "d"}, storedKeys(s, "a", "b", "c", "d"))
+
+	// Checking the stored keys queried a, c and d in that
+	// order, so c is now the least recently used.
+	assert.Nil(t, s.Append([]byte("a"), []byte("12345678")))
+	assert.Equal(t, []string{"a", "d"}, storedKeys(s, "a", "b", "c", "d"))
+	assert.Equal(t, int64(2), s.Stats().Evictions)
+	assert.Equal(t, int64(17), s.Stats().Segments[0].Size)
+}
+
+func TestMemoryStorage_EvictionLFU(t *testing.T) {
+	s := NewMemoryStorage(context.Background(), Options{
+		MemoryCapacity: 24,
+		EvictionPolicy: EvictionLFU,
+	})
+	defer s.Close()
+
+	for _, key := range []string{"a", "b", "c"} {
+		assert.Nil(t, s.Append([]byte(key), []byte("1234567")))
+	}
+	for i := 0; i < 3; i++ {
+		_, err := s.Query([]byte("a"))
+		assert.Nil(t, err)
+	}
+	_, err := s.Query([]byte("b"))
+	assert.Nil(t, err)
+
+	// c is the least frequently used.
+	assert.Nil(t, s.Append([]byte("d"), []byte("1234567")))
+	_, err = s.Query([]byte("c"))
+	assert.Equal(t, ErrDataNotFound, err)
+
+	// d was only written, so it's the least frequently
+	// used besides the key being written.
+	assert.Nil(t, s.Append([]byte("e"), []byte("1234567")))
+	assert.Equal(t, []string{"a", "b", "e"}, storedKeys(s, "a", "b", "d", "e"))
+
+	// A key larger than the capacity evicts every other
+	// key but stays itself.
+	assert.Nil(t, s.Append([]byte("f"), make([]byte, 100)))
+	assert.Equal(t, []string{"f"}, storedKeys(s, "a", "b", "e", "f"))
+	assert.Equal(t, int64(5), s.Stats().Evictions)
+
+	assert.Nil(t, s.Delete([]byte("f")))
+	assert.Nil(t, s.Append([]byte("g"), []byte("1234567")))
+	assert.Equal(t, []string{"g"}, storedKeys(s, "f", "g"))
+}
+
+// TestMemoryStorage_Scan ensures that the keys within the
+// bounds are scanned in order, that the scan stops when
+// asked to and that scanning doesn't count as an access
+// for eviction.
+func TestMemoryStorage_Scan(t *testing.T) {
+	s := NewMemoryStorage(context.Background(), Options{})
+	for _, key := range []string{"c", "a", "d", "b"} {
+		assert.Nil(t, s.Append([]byte(key), []byte(key+"-data")))
+	}
+	assert.Nil(t, s.Delete([]byte("d")))
+
+	var keys, data []string
+	assert.Nil(t, s.Scan(nil, nil, func(key []byte, d string) bool {
+		keys = append(keys, string(key))
+		data = append(data, d)
+		return true
+	}))
+	assert.Equal(t, []string{"a", "b", "c"}, keys)
+	assert.Equal(t, []string{"a-data", "b-data", "c-data"}, data)
+
+	keys = nil
+	assert.Nil(t, s.Scan([]byte("b"), []byte("c"), func(key []byte, _ string) bool {
+		keys = append(keys, string(key))
+		return true
+	}))
+	assert.Equal(t, []string{"b"}, keys)
+
+	keys = nil
+	assert.Nil(t, s.Scan(nil, nil, func(key []byte, _ string) bool {
+		keys = append(keys, string(key))
+		return false
+	}))
+	assert.Equal(t, []string{"a"}, keys)
+
+	// Scanning the oldest key keeps it the first to go.
+	s.opts.MemoryCapacity = s.Stats().Segments[0].Size
+	assert.Nil(t, s.Scan([]byte("c"), nil, func([]byte, string) bool { return true }))
+	assert.Nil(t, s.Append([]byte("e"), []byte("e-data")))
+	assert.Equal(t, []string{"a", "b", "e"}, storedKeys(s, "a", "b", "c", "e"))
+
+	assert.Nil(t, s.Close())
+	assert.Equal(t, ErrStorageClosed, s.Scan(nil, nil, func([]byte, string) bool { return true }))
+}
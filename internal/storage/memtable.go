@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"sync"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/indexer/sst/tree"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/comparator"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/skiplist"
+)
+
+// MemtableType is the data structure holding the memtable
+// of an SSTStorage.
+type MemtableType int
+
+const (
+	// MemtableAVLTree holds the memtable in an AVL tree
+	// guarded by a lock.
+	MemtableAVLTree MemtableType = iota
+	// MemtableSkiplist holds the memtable in a skiplist,
+	// which is read without taking any lock and lets
+	// writes go on while it's iterated, which suits
+	// write-heavy workloads. Its size accounts for the
+	// memory taken by the skiplist itself, so it holds
+	// fewer records than a MemtableAVLTree of the same
+	// MemtableSize.
+	MemtableSkiplist
+)
+
+// memtable holds the data most recently written to an
+// SSTStorage in memory, until it's flushed to a table.
+//
+// A memtable is safe for concurrent use, so queries can
+// read it while it's being written to.
+type memtable interface {
+	// put stores the record for the key, replacing any
+	// record stored for it before.
+	put(key string, e memtableEntry)
+	// get returns the record stored for the key and
+	// whether there is one.
+	get(key string) (memtableEntry, bool)
+	// ascend calls fn with every key of the memtable and
+	// its record in the order of the keys, until fn
+	// returns false.
+	ascend(fn func(key string, e memtableEntry) bool)
+	// len returns the number of keys in the memtable.
+	len() int
+	// size returns the approximate number of bytes taken
+	// by the memtable, which decides when it's flushed.
+	size() int64
+}
+
+// memtableEntry is a record held in the memtable.
+type memtableEntry struct {
+	data      string
+	seq       uint64
+	tombstone bool
+}
+
+// newMemtable returns an empty memtable of the type
+// given by the options, ordering its keys with the
+// comparator of the options.
+func newMemtable(opts Options) memtable {
+	cmp := opts.comparator()
+	switch opts.MemtableType {
+	case MemtableSkiplist:
+		return newSkiplistMemtable(cmp, opts.Seed)
+	default:
+		return newTreeMemtable(cmp)
+	}
+}
+
+// treeMemtable is a memtable holding its records in an
+// AVL tree, guarded by a lock.
+type treeMemtable struct {
+	mu   sync.RWMutex
+	tree *tree.AVLTree
+	// bytes is the number of bytes taken by the keys and
+	// data in the memtable.
+	bytes int64
+}
+
+// newTreeMemtable returns an empty treeMemtable ordering
+// its keys with the comparator.
+func newTreeMemtable(cmp comparator.Comparator) *treeMemtable {
+	return &treeMemtable{
+		tree: tree.NewAVLTreeWithCompare(func(a, b interface{}) int {
+			return cmp.Compare(a.(string), b.(string))
+		}),
+	}
+}
+
+func (m *treeMemtable) put(key string, e memtableEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if prev, ok := m.tree.Get(key); ok {
+		m.bytes -= int64(len(key) + len(prev.(memtableEntry).data))
+	}
+
+	m.tree.Put(key, e)
+	m.bytes += int64(len(key) + len(e.data))
+}
+
+func (m *treeMemtable) get(key string) (memtableEntry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	e, ok := m.tree.Get(key)
+	if !ok {
+		return memtableEntry{}, false
+	}
+	return e.(memtableEntry), true
+}
+
+// ascend holds the lock of the memtable for reading
+// throughout the iteration, so writes wait for it.
+func (m *treeMemtable) ascend(fn func(key string, e memtableEntry) bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	m.tree.Ascend(func(key, e interface{}) bool {
+		return fn(key.(string), e.(memtableEntry))
+	})
+}
+
+func (m *treeMemtable) len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.tree.Len()
+}
+
+func (m *treeMemtable) size() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.bytes
+}
+
+// skiplistMemtable is a memtable holding its records in a
+// skiplist, which is read without taking any lock and
+// suits write-heavy workloads.
+//
+// Its size accounts for the nodes of the skiplist along
+// with the keys and data, which is what it takes in memory.
+type skiplistMemtable struct {
+	sl *skiplist.Skiplist
+}
+
+// newSkiplistMemtable returns an empty skiplistMemtable
+// ordering its keys with the comparator, whose skiplist is
+// seeded with the seed unless it's zero.
+func newSkiplistMemtable(cmp comparator.Comparator, seed int64) *skiplistMemtable {
+	if seed == 0 {
+		return &skiplistMemtable{sl: skiplist.NewWithCompare(cmp.Compare)}
+	}
+	return &skiplistMemtable{sl: skiplist.NewWithSeed(cmp.Compare, seed)}
+}
+
+func (m *skiplistMemtable) put(key string, e memtableEntry) {
+	m.sl.Put(key, e, len(e.data))
+}
+
+func (m *skiplistMemtable) get(key string) (memtableEntry, bool) {
+	e, ok := m.sl.Get(key)
+	if !ok {
+		return memtableEntry{}, false
+	}
+	return e.(memtableEntry), true
+}
+
+// ascend carries on while the memtable is written to.
+func (m *skiplistMemtable) ascend(fn func(key string, e memtableEntry) bool) {
+	it := m.sl.NewIterator()
+	for it.First(); it.Valid(); it.Next() {
+		if !fn(it.Key(), it.Value().(memtableEntry)) {
+			return
+		}
+	}
+}
+
+func (m *skiplistMemtable) len() int {
+	return m.sl.Len()
+}
+
+func (m *skiplistMemtable) size() int64 {
+	return m.sl.Size()
+}
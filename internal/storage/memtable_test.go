@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/comparator"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMemtable ensures that both memtables store and order
+// their records alike and account for the data they hold.
+func TestMemtable(t *testing.T) {
+	memtables := map[string]MemtableType{
+		"avl":      MemtableAVLTree,
+		"skiplist": MemtableSkiplist,
+	}
+
+	for name, memtableType := range memtables {
+		t.Run(name, func(t *testing.T) {
+			mem := newMemtable(Options{MemtableType: memtableType})
+			assert.Zero(t, mem.size())
+
+			for i := 9; i >= 0; i-- {
+				mem.put("key"+strconv.Itoa(i), memtableEntry{data: "value", seq: uint64(i)})
+			}
+			mem.put("key3", memtableEntry{data: "v", seq: 10, tombstone: true})
+
+			e, ok := mem.get("key3")
+			assert.True(t, ok)
+			assert.Equal(t, memtableEntry{data: "v", seq: 10, tombstone: true}, e)
+			_, ok = mem.get("key10")
+			assert.False(t, ok)
+			assert.Equal(t, 10, mem.len())
+
+			// The size covers at least the keys and data.
+			assert.True(t, mem.size() >= int64(10*len("key0")+9*len("value")+len("v")))
+
+			var keys []string
+			mem.ascend(func(key string, _ memtableEntry) bool {
+				keys = append(keys, key)
+				return len(keys) < 5
+			})
+			assert.Equal(t, []string{"key0", "key1", "key2", "key3", "key4"}, keys)
+		})
+	}
+}
+
+// TestMemtable_Comparator ensures that both memtables order
+// their keys with the comparator of the options.
+func TestMemtable_Comparator(t *testing.T) {
+	memtables := map[string]MemtableType{
+		"avl":      MemtableAVLTree,
+		"skiplist": MemtableSkiplist,
+	}
+
+	for name, memtableType := range memtables {
+		t.Run(name, func(t *testing.T) {
+			mem := newMemtable(Options{
+				MemtableType: memtableType,
+				Comparator:   comparator.Reverse(comparator.Bytewise),
+			})
+			for i := 0; i < 10; i++ {
+				mem.put("key"+strconv.Itoa(i), memtableEntry{data: "value", seq: uint64(i)})
+			}
+
+			var keys []string
+			mem.ascend(func(key string, _ memtableEntry) bool {
+				keys = append(keys, key)
+				return len(keys) < 3
+			})
+			assert.Equal(t, []string{"key9", "key8", "key7"}, keys)
+		})
+	}
+}
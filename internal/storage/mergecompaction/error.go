@@ -0,0 +1,12 @@
+package mergecompaction
+
+// Error is a helper type for creating constant errors.
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+const (
+	// ErrNothingToMerge indicates that a merge was asked
+	// for without any segments to merge.
+	ErrNothingToMerge Error = "no segments were given to merge"
+)
@@ -0,0 +1,107 @@
+package mergecompaction
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/dataobject"
+)
+
+// Decision is what a CompactionFilter decides to do with
+// a record being merged.
+type Decision int
+
+const (
+	// Keep copies the record over as it is.
+	Keep Decision = iota
+	// Drop removes the key from the merged segments.
+	Drop
+	// Replace copies the record over with the value
+	// returned by the filter in place of its own.
+	Replace
+)
+
+// CompactionFilter lets the application drop or rewrite
+// records while they are merged, without a separate pass
+// over the whole store.
+//
+// Filter is called with the key and value of the most
+// recent record of every key that survives a merge. The
+// tombstones of deleted keys and raw objects are not
+// passed to it. The decision only takes effect as part
+// of the merged segments, so it's applied atomically
+// along with the rest of the merge.
+type CompactionFilter interface {
+	Filter(key []byte, value interface{}) (Decision, interface{})
+}
+
+// FilterFunc is an adapter to use ordinary functions as
+// a CompactionFilter.
+type FilterFunc func(key []byte, value interface{}) (Decision, interface{})
+
+// Filter calls f(key, value).
+func (f FilterFunc) Filter(key []byte, value interface{}) (Decision, interface{}) {
+	return f(key, value)
+}
+
+// applyFilter passes the record to the filter of the
+// options and returns the record to write in its place,
+// or false if nothing is to be written.
+//
+// A dropped key is written as a tombstone unless the
+// merge drops tombstones, so that records of the key in
+// older segments which aren't merged stay shadowed.
+func applyFilter(r mergedRecord, opts Options) (mergedRecord, bool, error) {
+	if opts.Filter == nil || r.e.Tombstone {
+		return r, true, nil
+	}
+
+	data := r.data
+	if opts.Resolve != nil {
+		var (
+			ok  bool
+			err error
+		)
+		data, ok, err = opts.Resolve(data)
+		if err != nil {
+			return r, false, err
+		}
+		if !ok {
+			return r, true, nil
+		}
+	}
+
+	// Raw objects carry no value the filter could decide
+	// on, and are copied over as they are.
+	if strings.HasPrefix(data, dataobject.RawMarker) {
+		return r, true, nil
+	}
+
+	var obj dataobject.Object
+	err := json.Unmarshal([]byte(data), &obj)
+	if err != nil {
+		return r, false, err
+	}
+
+	key := []byte(r.e.Key)
+	decision, value := opts.Filter.Filter(key, obj.Value)
+	switch decision {
+	case Drop:
+		if opts.DropTombstones {
+			return r, false, nil
+		}
+		obj = dataobject.NewTombstone(key)
+		r.e.Tombstone = true
+	case Replace:
+		obj = dataobject.NewObject(key, value)
+	default:
+		return r, true, nil
+	}
+
+	replaced, err := json.Marshal(obj)
+	if err != nil {
+		return r, false, err
+	}
+	r.data = string(replaced)
+	return r, true, nil
+}
@@ -1,195 +1,346 @@
 package mergecompaction
 
 import (
-	"bufio"
 	"context"
-	"fmt"
-	"os"
-	"strings"
+	"sort"
 
-	"github.com/SystemBuilders/KeyValueStore/internal/dataobject"
+	"github.com/SystemBuilders/KeyValueStore/internal/indexer"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/comparator"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/scheduler"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/segment"
+	"github.com/SystemBuilders/KeyValueStore/internal/vfs"
 )
 
-// WatchSet is a collection of objects that a merge job
-// needs to keep an eye on and use.
-type WatchSet struct {
-	ctx       context.Context
-	mergeFunc func()
+// Options control which records survive a merge.
+type Options struct {
+	// IsLive reports whether the record described by the
+	// entry of the given segment is still the most recent
+	// record of its key in the whole store. Records it
+	// reports as shadowed are dropped.
+	//
+	// If IsLive is nil, the most recent record of every
+	// key among the merged segments survives.
+	IsLive func(*segment.Segment, segment.Entry) bool
+	// DropTombstones drops the tombstones of deleted keys.
+	// This is only safe if no segment older than the ones
+	// being merged remains, as the tombstones could be
+	// shadowing records in such segments.
+	DropTombstones bool
+	// TargetSize is the size after which MergeSorted moves
+	// on to a new segment. A zero value writes all the
+	// records to a single segment.
+	TargetSize int64
+	// Filter, if set, decides whether each surviving record
+	// is kept, dropped or written with a new value.
+	Filter CompactionFilter
+	// Resolve, if set, returns the record holding the value
+	// of a record passed to the filter, for records which
+	// only refer to their value kept elsewhere, or false if
+	// the record is to be kept without being filtered. The
+	// records are written as they are unless the filter
+	// replaces or drops them.
+	Resolve func(data string) (string, bool, error)
+	// Limiter, if set, limits the rate at which the merged
+	// records are written.
+	Limiter *scheduler.RateLimiter
+	// Comparator orders the keys of the segments written
+	// by MergeSorted.
+	//
+	// A nil value means comparator.Bytewise.
+	Comparator comparator.Comparator
+	// FS is the filesystem the merged segments are written
+	// to, which must be the one holding the directory.
+	//
+	// A nil value means vfs.OS.
+	FS vfs.FS
+	// IDs hands out the ids of the segments written by
+	// MergeSorted, which must be the ids of the store the
+	// segments are merged into.
+	//
+	// A nil value means ids taken from the clock of the
+	// filesystem, ordered after the merged segments alone.
+	IDs *segment.IDs
 }
 
-// NewWatchSet returns a new WatchSet.
-func NewWatchSet(
-	f func(),
-) *WatchSet {
-	return &WatchSet{
-		mergeFunc: f,
+// comparator returns the comparator of the options,
+// applying the default.
+func (opts Options) comparator() comparator.Comparator {
+	if opts.Comparator == nil {
+		return comparator.Bytewise
 	}
+	return opts.Comparator
 }
 
-// RunJob is to be run on a goroutine in parallel to the
-// other operations. (TODO: This might have a lot of
-// closing issues since its on a different goroutine.)
-//
-// This function checks whether the trigger is set by
-// functions who actually have the data about the segment
-// and can take the decisions and performs the operation
-// if the trigger is set.
-//
-// TODO: First figure out how do we merge.
-//
-// This function opens all non-operational files, at
-// once (this is possible based on the estimate of the
-// KV Store on how many files can stay on the memory
-// safely) and use a merge-sort method to merge all the
-// files in a new file, appended in a sorted manner.
-//
-// The simplest way to do this is to handover the operation
-// to the routine Append function that is used by the
-// Insert functionality. This allows us to not worry
-// about updating the segment when there's an overshot
-// of the file size etc. I just have a pseudo start of
-// the segments portrayed to the Append function which
-// takes care of the job.
-//     The bad way to do this of course be to take
-// control of the segments and appends, which I don't
-// intend to do.
-func (w *WatchSet) RunJob() {
-
-	for {
-		select {
-		case <-w.ctx.Done():
-			return
-		default:
-
-			// if w.f.MergeNeeded {
-			// 	w.mu.Lock()
-			// 	w.f.MergeNeeded = false
-
-			// 	fmt.Println("Merging operation commencing")
-			// 	// Record the merging index so that we can delete the
-			// 	// files until this file index.
-			// 	mergingIndex := w.f.currSegment
-			// 	// Creating the pseudo start point for the append function.
-			// 	w.mu.Unlock()
-			// 	err := w.f.createNewFileSegment()
-			// 	if err != nil {
-			// 		fmt.Println(err)
-			// 		return
-			// 	}
-
-			// 	w.mu.Lock()
-			// 	fmt.Println("Merging file created " + w.f.fName[len(w.f.fName)-1])
-			// 	currSegment := w.f.currSegment + 1
-			// 	offsets := make([]int, len(w.f.fs))
-			// 	w.mu.Unlock()
-
-			// 	for {
-			// 		w.mu.Lock()
-			// 		next, err := getNextElement(w.f, &offsets)
-			// 		if err != nil {
-			// 			w.mu.Unlock()
-			// 			break
-			// 		}
-			// 		fmt.Print(next)
-			// 		w.mu.Unlock()
-			// 		objLoc, err := w.f.appendAtSegment(next, currSegment)
-			// 		if err != nil {
-			// 		}
-			// 		w.idxr.Store(next, objLoc)
-			// 		fmt.Println("Watchset")
-			// 		w.idxr.Print()
-			// 		fmt.Println(("Watchset"))
-			// 	}
-
-			// 	fmt.Println(mergingIndex)
-			// 	w.f.deleteFilesTillIndex(mergingIndex + 1)
-			// }
-		}
+// fs returns the filesystem of the options, applying the
+// default.
+func (opts Options) fs() vfs.FS {
+	if opts.FS == nil {
+		return vfs.OS
+	}
+	return opts.FS
+}
+
+// ids returns the segment ids of the options, applying
+// the default.
+func (opts Options) ids() *segment.IDs {
+	if opts.IDs == nil {
+		return segment.NewIDs(vfs.ClockOf(opts.fs()))
 	}
+	return opts.IDs
 }
 
-// getNextElement returns the next element in the merging operation
-// based on the comparison function.
+// Merge merges the given segments, ordered oldest first,
+// into a single segment which holds only the most recent
+// record of every key found in them.
 //
-// It maintains the offset slice passed to it by updating the
-// last read offset on choosing the next element to be returned.
-func getNextElement(f *FileV1, offsets *[]int) (string, error) {
+// The merged segment takes over the id of the newest of
+// the merged segments so that it is ordered exactly where
+// they were. It is written to temporary files and installed
+// in place of the newest segment only once it is complete,
+// after which all the merged segments are made obsolete,
+// leaving them to be removed once nothing references them.
+// As a crash can leave some of them behind, a tombstone is
+// kept even if tombstones are dropped while the segments
+// before its own hold records of its key.
+// If no record survives, all the segments are made obsolete
+// and a nil segment is returned.
+//
+// The records are copied over in the order of their
+// sequence numbers, which keeps the position of a record
+// on disk in line with how recent it is.
+//
+// The merge is abandoned once the context is done, in
+// which case the given segments are left untouched.
+func Merge(
+	ctx context.Context,
+	dir string,
+	segments []*segment.Segment,
+	idxr indexer.Indexer,
+	opts Options,
+) (*segment.Segment, error) {
+	if len(segments) == 0 {
+		return nil, ErrNothingToMerge
+	}
 
-	val, err := readNext(f.fs[0], (*offsets)[0])
+	survivors, err := survivingRecords(segments, opts, true)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	sort.Slice(survivors, func(i, j int) bool {
+		return survivors[i].e.Sequence < survivors[j].e.Sequence
+	})
 
-	//
-	least := 1
-	(*offsets)[least] += (*offsets)[least-1] + len(val) + len(defaultDelimter)
+	if len(survivors) == 0 {
+		for _, sg := range segments {
+			err := sg.Obsolete()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+
+	newest := segments[len(segments)-1]
+	merged, err := segment.NewMergeSegment(opts.fs(), dir, newest.ID(), idxr)
+	if err != nil {
+		return nil, err
+	}
 
-	for i := 1; i < len(f.fs); i++ {
-		next, err := readNext(f.fs[i], (*offsets)[i])
+	for _, r := range survivors {
+		err = opts.Limiter.WaitN(ctx, len(r.data))
+		if err == nil {
+			err = merged.AppendRecord(r.e, r.data)
+		}
 		if err != nil {
-			return "", err
+			merged.Remove()
+			return nil, err
 		}
-		val = dataobject.LeastCmpFnc(val, next)
-		if next == val {
-			least = i
+	}
+
+	err = merged.Replace(newest)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sg := range segments[:len(segments)-1] {
+		err = sg.Obsolete()
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	(*offsets)[least] += (*offsets)[least-1] + len(val) + len(defaultDelimter)
-	return val, nil
+	return merged, nil
 }
 
-// readNext reads the next object that was stored in the file
-// after the provided offset.
+// MergeSorted merges the given segments into new segments
+// which hold the most recent record of every key found in
+// them, in the order of the keys given by the comparator
+// of the options.
 //
-// readNext reads the file byte-by-byte checking for the delimiter,
-// which on reaching, it ends the iteration and returns the string,
-func readNext(f *os.File, offset int) (string, error) {
-	_, err := f.Seek(int64(offset), 0)
+// Unlike Merge, the merged segments get fresh ids and the
+// given segments are left untouched. It is up to the caller
+// to put the merged segments in their place and remove the
+// given ones. The merged segments are sealed and none of
+// them is larger than the target size by more than a record.
+//
+// The merge is abandoned once the context is done, in
+// which case no merged segment is left behind.
+func MergeSorted(
+	ctx context.Context,
+	dir string,
+	segments []*segment.Segment,
+	idxrGntr indexer.IndexerGenerator,
+	opts Options,
+) ([]*segment.Segment, error) {
+	if len(segments) == 0 {
+		return nil, ErrNothingToMerge
+	}
+
+	survivors, err := survivingRecords(segments, opts, false)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	cmp := opts.comparator()
+	sort.Slice(survivors, func(i, j int) bool {
+		return cmp.Compare(survivors[i].e.Key, survivors[j].e.Key) < 0
+	})
+
+	// The merged segments are ordered after the segments
+	// they're merged from.
+	ids := opts.ids()
+	for _, sg := range segments {
+		ids.Observe(sg.ID())
 	}
 
 	var (
-		stringBuilder strings.Builder
-		readBytes     = 0
+		merged []*segment.Segment
+		curr   *segment.Segment
 	)
-	reader := bufio.NewReader(f)
-	for {
-		data, err := reader.Peek(len(defaultDelimter))
-		if err != nil {
-			return "", err
+	removeAll := func() {
+		for _, sg := range merged {
+			sg.Remove()
 		}
+	}
+	for _, r := range survivors {
+		if curr == nil || (opts.TargetSize > 0 && curr.Size() >= opts.TargetSize) {
+			if curr != nil {
+				err := curr.Seal()
+				if err != nil {
+					removeAll()
+					return nil, err
+				}
+			}
 
-		if string(data) == defaultDelimter {
-			break
+			sg, err := segment.CreateSegmentWithComparator(opts.fs(), dir, ids, 0, idxrGntr.Generate(), cmp)
+			if err != nil {
+				removeAll()
+				return nil, err
+			}
+			merged = append(merged, sg)
+			curr = sg
 		}
 
-		nextByte := make([]byte, 1)
-
-		_, err = reader.Read(nextByte)
-
-		_, err = stringBuilder.Write(nextByte)
+		err = opts.Limiter.WaitN(ctx, len(r.data))
+		if err == nil {
+			err = curr.AppendRecord(r.e, r.data)
+		}
 		if err != nil {
-			return "", err
+			removeAll()
+			return nil, err
 		}
-		readBytes++
-		fmt.Println(string(data))
-		fmt.Println(string(data[0]))
-		_, err = f.Seek(int64(offset+readBytes), 0)
+	}
+
+	if curr != nil {
+		err := curr.Seal()
 		if err != nil {
-			return "", err
+			removeAll()
+			return nil, err
 		}
 	}
 
-	return stringBuilder.String(), nil
+	return merged, nil
+}
+
+// source is a record of one of the segments being merged.
+type source struct {
+	sg *segment.Segment
+	e  segment.Entry
 }
 
-/*
+// mergedRecord is a record to be written to a merged
+// segment.
+type mergedRecord struct {
+	e    segment.Entry
+	data string
+}
+
+// survivingRecords returns the most recent record of every
+// key found in the segments, leaving out the records the
+// options drop and applying the filter of the options to
+// the rest.
+//
+// stepwise tells that the segments, ordered oldest first,
+// are removed one by one once merged, in which case a
+// tombstone shadowing records of the key in the segments
+// before its own is kept, since a crash could leave those
+// segments behind.
+func survivingRecords(segments []*segment.Segment, opts Options, stepwise bool) ([]mergedRecord, error) {
+	var (
+		latest = make(map[string]source)
+		// keys hold the keys in the order they're found in,
+		// which is the order their records are read in.
+		keys []string
+		// first holds the first of the segments with a record
+		// of every key.
+		first = make(map[string]*segment.Segment)
+	)
+	for _, sg := range segments {
+		entries, err := sg.Entries()
+		if err != nil {
+			return nil, err
+		}
+
+		// A crash during a merge can leave the records it
+		// copied, which keep their sequence numbers, both in
+		// the merged segment and in the segments it replaces.
+		// Of two records with the same sequence number, the
+		// one in the later segment wins, as in the storage.
+		for _, e := range entries {
+			curr, ok := latest[e.Key]
+			if !ok {
+				keys = append(keys, e.Key)
+			}
+			if !ok || e.Sequence >= curr.e.Sequence {
+				latest[e.Key] = source{sg, e}
+			}
+			if _, ok := first[e.Key]; !ok {
+				first[e.Key] = sg
+			}
+		}
+	}
 
-This "getNextelemement" and the logic inside the merging is complete rubbish and doesnt merge.
-What its doing is --- you know.
+	survivors := make([]mergedRecord, 0, len(latest))
+	for _, key := range keys {
+		src := latest[key]
+		if src.e.Tombstone && opts.DropTombstones && (!stepwise || first[src.e.Key] == src.sg) {
+			continue
+		}
+		if opts.IsLive != nil && !opts.IsLive(src.sg, src.e) {
+			continue
+		}
 
-Need to create the actual merging logic and it needs to be optimal and in a different package as well.
+		data, err := src.sg.ReadEntry(src.e)
+		if err != nil {
+			return nil, err
+		}
 
-*/
+		r, ok, err := applyFilter(mergedRecord{src.e, data}, opts)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			survivors = append(survivors, r)
+		}
+	}
+	return survivors, nil
+}
@@ -0,0 +1,310 @@
+package mergecompaction
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/clock"
+	"github.com/SystemBuilders/KeyValueStore/internal/dataobject"
+	_map "github.com/SystemBuilders/KeyValueStore/internal/indexer/map"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/segment"
+	"github.com/SystemBuilders/KeyValueStore/internal/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+// testIDs hands out the ids of the segments the tests
+// create.
+var testIDs = segment.NewIDs(clock.Real)
+
+// record returns the marshalled data object for the
+// key and value, as the key-value store would append it.
+func record(t *testing.T, key, value string) string {
+	data, err := json.Marshal(dataobject.NewObject([]byte(key), value))
+	assert.Nil(t, err)
+	return string(data)
+}
+
+// TestMerge ensures that merging keeps only the latest
+// record of every key, replaces the newest merged segment
+// on disk and removes the others.
+func TestMerge(t *testing.T) {
+	dir := t.TempDir()
+
+	first, err := segment.CreateSegment(vfs.OS, dir, testIDs, 0, _map.NewMapIndexer())
+	assert.Nil(t, err)
+	assert.Nil(t, first.Append("key1", record(t, "key1", "old")))
+	assert.Nil(t, first.Append("key2", record(t, "key2", "value2")))
+	assert.Nil(t, first.Seal())
+
+	second, err := segment.CreateSegment(vfs.OS, dir, testIDs, first.Sequence(), _map.NewMapIndexer())
+	assert.Nil(t, err)
+	assert.Nil(t, second.Append("key1", record(t, "key1", "new")))
+	assert.Nil(t, second.Seal())
+
+	merged, err := Merge(context.Background(), dir, []*segment.Segment{first, second}, _map.NewMapIndexer(), Options{})
+	assert.Nil(t, err)
+	assert.Equal(t, second.ID(), merged.ID())
+	assert.Equal(t, uint64(3), merged.Sequence())
+
+	entries, err := merged.Entries()
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "key2", entries[0].Key)
+	assert.Equal(t, "key1", entries[1].Key)
+
+	ids, err := segment.ListSegmentIDs(vfs.OS, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{second.ID()}, ids)
+
+	opened, err := segment.OpenSegment(vfs.OS, dir, second.ID(), 0, _map.NewMapIndexer())
+	assert.Nil(t, err)
+	data, err := opened.Query("key1")
+	assert.Nil(t, err)
+	assert.Equal(t, record(t, "key1", "new"), data)
+}
+
+// TestMerge_Options ensures that records reported as
+// shadowed are dropped, that tombstones are dropped only
+// when asked to and that nothing is left behind when no
+// record survives.
+func TestMerge_Options(t *testing.T) {
+	dir := t.TempDir()
+
+	sg, err := segment.CreateSegment(vfs.OS, dir, testIDs, 0, _map.NewMapIndexer())
+	assert.Nil(t, err)
+	assert.Nil(t, sg.Append("key1", record(t, "key1", "value1")))
+	assert.Nil(t, sg.Append("key2", record(t, "key2", "value2")))
+	assert.Nil(t, sg.Delete("key3"))
+	assert.Nil(t, sg.Seal())
+
+	shadowed := func(_ *segment.Segment, e segment.Entry) bool {
+		return e.Key != "key1"
+	}
+	merged, err := Merge(context.Background(), dir, []*segment.Segment{sg}, _map.NewMapIndexer(), Options{IsLive: shadowed})
+	assert.Nil(t, err)
+
+	entries, err := merged.Entries()
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "key2", entries[0].Key)
+	assert.True(t, entries[1].Tombstone)
+
+	merged, err = Merge(context.Background(), dir, []*segment.Segment{merged}, _map.NewMapIndexer(), Options{
+		IsLive:         shadowed,
+		DropTombstones: true,
+	})
+	assert.Nil(t, err)
+
+	entries, err = merged.Entries()
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+
+	merged, err = Merge(context.Background(), dir, []*segment.Segment{merged}, _map.NewMapIndexer(), Options{
+		IsLive: func(*segment.Segment, segment.Entry) bool { return false },
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, merged)
+
+	ids, err := segment.ListSegmentIDs(vfs.OS, dir)
+	assert.Nil(t, err)
+	assert.Empty(t, ids)
+}
+
+// TestMerge_ShadowingTombstone ensures that a tombstone
+// shadowing a record of an older merged segment is kept
+// even when tombstones are dropped, and that it's dropped
+// once that record is gone.
+func TestMerge_ShadowingTombstone(t *testing.T) {
+	dir := t.TempDir()
+
+	older, err := segment.CreateSegment(vfs.OS, dir, testIDs, 0, _map.NewMapIndexer())
+	assert.Nil(t, err)
+	assert.Nil(t, older.Append("key1", record(t, "key1", "value1")))
+	assert.Nil(t, older.Seal())
+
+	newer, err := segment.CreateSegment(vfs.OS, dir, testIDs, older.Sequence(), _map.NewMapIndexer())
+	assert.Nil(t, err)
+	assert.Nil(t, newer.Delete("key1"))
+	assert.Nil(t, newer.Delete("key2"))
+	assert.Nil(t, newer.Seal())
+
+	merged, err := Merge(context.Background(), dir, []*segment.Segment{older, newer}, _map.NewMapIndexer(), Options{DropTombstones: true})
+	assert.Nil(t, err)
+
+	entries, err := merged.Entries()
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "key1", entries[0].Key)
+	assert.True(t, entries[0].Tombstone)
+
+	merged, err = Merge(context.Background(), dir, []*segment.Segment{merged}, _map.NewMapIndexer(), Options{DropTombstones: true})
+	assert.Nil(t, err)
+	assert.Nil(t, merged)
+}
+
+// TestMergeSorted ensures that the most recent record of
+// every key is written in key order, split at the target
+// size, and that the merged segments are left in place.
+func TestMergeSorted(t *testing.T) {
+	dir := t.TempDir()
+
+	older, err := segment.CreateSegment(vfs.OS, dir, testIDs, 0, _map.NewMapIndexer())
+	assert.Nil(t, err)
+	assert.Nil(t, older.Append("key3", record(t, "key3", "old")))
+	assert.Nil(t, older.Append("key1", record(t, "key1", "value1")))
+	assert.Nil(t, older.Append("key2", record(t, "key2", "value2")))
+	assert.Nil(t, older.Seal())
+
+	newer, err := segment.CreateSegment(vfs.OS, dir, testIDs, older.Sequence(), _map.NewMapIndexer())
+	assert.Nil(t, err)
+	assert.Nil(t, newer.Append("key3", record(t, "key3", "new")))
+	assert.Nil(t, newer.Delete("key2"))
+	assert.Nil(t, newer.Seal())
+
+	merged, err := MergeSorted(context.Background(), dir, []*segment.Segment{older, newer}, _map.NewMapIndexerGenerator(), Options{
+		DropTombstones: true,
+		TargetSize:     1,
+	})
+	assert.Nil(t, err)
+	assert.Len(t, merged, 2)
+
+	minKey, maxKey := merged[0].KeyRange()
+	assert.Equal(t, "key1", minKey)
+	assert.Equal(t, "key1", maxKey)
+
+	data, err := merged[1].Query("key3")
+	assert.Nil(t, err)
+	assert.Equal(t, record(t, "key3", "new"), data)
+
+	ids, err := segment.ListSegmentIDs(vfs.OS, dir)
+	assert.Nil(t, err)
+	assert.Len(t, ids, 4)
+}
+
+// TestMerge_Filter ensures that the filter can keep, drop
+// and replace records, that a dropped key is written as a
+// tombstone unless tombstones are dropped and that the
+// filter isn't called for tombstones.
+func TestMerge_Filter(t *testing.T) {
+	dir := t.TempDir()
+
+	sg, err := segment.CreateSegment(vfs.OS, dir, testIDs, 0, _map.NewMapIndexer())
+	assert.Nil(t, err)
+	assert.Nil(t, sg.Append("keep", record(t, "keep", "value")))
+	assert.Nil(t, sg.Append("drop", record(t, "drop", "value")))
+	assert.Nil(t, sg.Append("replace", record(t, "replace", "old")))
+	assert.Nil(t, sg.Delete("deleted"))
+	assert.Nil(t, sg.Seal())
+
+	var filtered []string
+	filter := FilterFunc(func(key []byte, value interface{}) (Decision, interface{}) {
+		filtered = append(filtered, string(key))
+		switch string(key) {
+		case "drop":
+			return Drop, nil
+		case "replace":
+			return Replace, value.(string) + "-new"
+		}
+		return Keep, nil
+	})
+
+	merged, err := Merge(context.Background(), dir, []*segment.Segment{sg}, _map.NewMapIndexer(), Options{Filter: filter})
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"keep", "drop", "replace"}, filtered)
+
+	data, err := merged.Query("keep")
+	assert.Nil(t, err)
+	assert.Equal(t, record(t, "keep", "value"), data)
+
+	data, err = merged.Query("replace")
+	assert.Nil(t, err)
+	assert.Equal(t, record(t, "replace", "old-new"), data)
+
+	_, err = merged.Query("drop")
+	assert.Equal(t, segment.ErrDataDeletedInSegment, err)
+
+	merged, err = Merge(context.Background(), dir, []*segment.Segment{merged}, _map.NewMapIndexer(), Options{
+		Filter:         filter,
+		DropTombstones: true,
+	})
+	assert.Nil(t, err)
+
+	entries, err := merged.Entries()
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+}
+
+// TestMerge_FilterResolve ensures that the filter sees the
+// values the records refer to, and that the records it
+// keeps are written as they are.
+func TestMerge_FilterResolve(t *testing.T) {
+	dir := t.TempDir()
+
+	sg, err := segment.CreateSegment(vfs.OS, dir, testIDs, 0, _map.NewMapIndexer())
+	assert.Nil(t, err)
+	assert.Nil(t, sg.Append("keep", "ref:keep"))
+	assert.Nil(t, sg.Append("replace", "ref:replace"))
+	assert.Nil(t, sg.Append("unresolved", "ref:unresolved"))
+	assert.Nil(t, sg.Seal())
+
+	values := make(map[string]interface{})
+	filter := FilterFunc(func(key []byte, value interface{}) (Decision, interface{}) {
+		values[string(key)] = value
+		if string(key) == "replace" {
+			return Replace, "new"
+		}
+		return Keep, nil
+	})
+	resolve := func(data string) (string, bool, error) {
+		if data == "ref:unresolved" {
+			return "", false, nil
+		}
+		return record(t, data[len("ref:"):], "resolved"), true, nil
+	}
+
+	merged, err := Merge(context.Background(), dir, []*segment.Segment{sg}, _map.NewMapIndexer(), Options{
+		Filter:  filter,
+		Resolve: resolve,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"keep": "resolved", "replace": "resolved"}, values)
+
+	for key, want := range map[string]string{
+		"keep":       "ref:keep",
+		"replace":    record(t, "replace", "new"),
+		"unresolved": "ref:unresolved",
+	} {
+		data, err := merged.Query(key)
+		assert.Nil(t, err)
+		assert.Equal(t, want, data)
+	}
+}
+
+// TestMerge_Cancelled ensures that a merge whose context
+// is done is abandoned without touching the segments.
+func TestMerge_Cancelled(t *testing.T) {
+	dir := t.TempDir()
+
+	sg, err := segment.CreateSegment(vfs.OS, dir, testIDs, 0, _map.NewMapIndexer())
+	assert.Nil(t, err)
+	assert.Nil(t, sg.Append("key1", record(t, "key1", "value1")))
+	assert.Nil(t, sg.Seal())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = Merge(ctx, dir, []*segment.Segment{sg}, _map.NewMapIndexer(), Options{})
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = MergeSorted(ctx, dir, []*segment.Segment{sg}, _map.NewMapIndexerGenerator(), Options{})
+	assert.Equal(t, context.Canceled, err)
+
+	ids, err := segment.ListSegmentIDs(vfs.OS, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{sg.ID()}, ids)
+
+	data, err := sg.Query("key1")
+	assert.Nil(t, err)
+	assert.Equal(t, record(t, "key1", "value1"), data)
+}
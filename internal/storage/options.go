@@ -0,0 +1,334 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/clock"
+	"github.com/SystemBuilders/KeyValueStore/internal/indexer"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/compaction"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/comparator"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/mergecompaction"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/scheduler"
+	"github.com/SystemBuilders/KeyValueStore/internal/vfs"
+)
+
+// Options holds the settings of a storage engine.
+type Options struct {
+	// Dir is the directory where the segment files, their
+	// hint files and index snapshots are kept, or the file
+	// of a BTreeStorage. Any segments or tree already in the
+	// directory are loaded when the storage is created.
+	//
+	// An empty Dir means the working directory.
+	Dir string
+	// FS is the filesystem holding Dir, which every file of
+	// the storage is read from and written to. A storage on
+	// a vfs.MemFS runs without touching the disk.
+	//
+	// A nil value means vfs.OS.
+	FS vfs.FS
+	// GarbageRatioThreshold is the fraction of a sealed
+	// segment that must be taken by overwritten or deleted
+	// records for the segment to be merged.
+	//
+	// A zero value means defaultGarbageRatioThreshold.
+	GarbageRatioThreshold float64
+	// MemtableSize is the approximate number of bytes the
+	// memtable of an SSTStorage holds before it's flushed
+	// to a table.
+	//
+	// A zero value means defaultMemtableSize.
+	MemtableSize int64
+	// MemtableType is the data structure holding the
+	// memtable of an SSTStorage.
+	//
+	// The zero value is MemtableAVLTree.
+	MemtableType MemtableType
+	// Comparator orders the keys of an SSTStorage, in its
+	// memtables, its tables and its compactions, those of a
+	// BTreeStorage and those a StorageV1 or a MemoryStorage
+	// scans. Its name is recorded in the manifest or the
+	// tree, and a storage can't be opened again with a
+	// comparator of another name.
+	//
+	// A nil value means comparator.Bytewise.
+	Comparator comparator.Comparator
+	// PageSize is the size of the pages of a BTreeStorage,
+	// which keeps the page size it was created with.
+	//
+	// A zero value means bptree.DefaultPageSize.
+	PageSize int
+	// PageCacheSize is the number of pages of a BTreeStorage
+	// kept in memory.
+	//
+	// A zero value means the default of bptree.Options.
+	PageCacheSize int
+	// ValueThreshold is the size past which the records of
+	// a StorageV1 or an SSTStorage are written to a value log
+	// in the directory of the storage, leaving the segments
+	// and tables to hold only pointers to them. Merges and
+	// compactions then copy the pointers rather than the
+	// records themselves.
+	//
+	// A zero value keeps every record in the segments. Raw
+	// objects are written to the value log whatever their
+	// size, see dataobject.NewRaw.
+	ValueThreshold int
+	// ValueLogFileSize is the size past which the value log
+	// moves on to a new file. Only the files it moved on
+	// from are collected.
+	//
+	// A zero value means vlog.DefaultFileSize.
+	ValueLogFileSize int64
+	// ValueLogGCRatio is the fraction of a value log file
+	// that must be taken by records which were overwritten
+	// or deleted for the file to be collected, copying the
+	// records still live in it to the head of the value log.
+	//
+	// A zero value means defaultValueLogGCRatio.
+	ValueLogGCRatio float64
+	// MemoryCapacity is the number of bytes of keys and data
+	// a MemoryStorage holds before it evicts keys.
+	//
+	// A zero value means no limit.
+	MemoryCapacity int64
+	// EvictionPolicy decides which keys a MemoryStorage
+	// evicts once it holds more than its capacity.
+	//
+	// The zero value is EvictionLRU.
+	EvictionPolicy EvictionPolicy
+	// CompactionStrategy decides how the tables of an
+	// SSTStorage are compacted. A strategy may keep state
+	// about the storage it picks compactions for, as the
+	// leveled one does, so a strategy mustn't be shared by
+	// storages.
+	//
+	// A nil value means a new compaction.NewLeveled() for
+	// every storage.
+	CompactionStrategy compaction.Strategy
+	// CompactionFilter, if set, is applied to every record
+	// which survives a merge of segments or a compaction
+	// of tables. See mergecompaction.CompactionFilter.
+	CompactionFilter mergecompaction.CompactionFilter
+	// BackgroundWorkers is the number of goroutines which
+	// run flushes and compactions in the background.
+	//
+	// A zero value means defaultBackgroundWorkers.
+	BackgroundWorkers int
+	// CompactionRateLimit is the number of bytes per second
+	// that merges and compactions may write.
+	//
+	// A zero value means no limit.
+	CompactionRateLimit int64
+	// SoftSegmentLimit is the number of segments waiting to
+	// be compacted at which writes are slowed down. These
+	// are the sealed segments past the garbage ratio
+	// threshold for a StorageV1 and the level 0 tables for
+	// an SSTStorage.
+	//
+	// A zero value means defaultSoftSegmentLimit.
+	SoftSegmentLimit int
+	// HardSegmentLimit is the number of segments waiting to
+	// be compacted at which writes are blocked until the
+	// background work catches up.
+	//
+	// A zero value means defaultHardSegmentLimit.
+	HardSegmentLimit int
+	// SoftPendingCompactionBytes is the number of bytes
+	// waiting to be compacted at which writes are slowed
+	// down.
+	//
+	// A zero value means no limit.
+	SoftPendingCompactionBytes int64
+	// HardPendingCompactionBytes is the number of bytes
+	// waiting to be compacted at which writes are blocked
+	// until the background work catches up.
+	//
+	// A zero value means no limit.
+	HardPendingCompactionBytes int64
+	// Clock is what a storage reads the time from and waits
+	// on, when it names its segments, limits the rate of
+	// its compactions and holds back writes. Segments are
+	// named by the clock of FS, see vfs.ClockOf, which
+	// should be the same clock.
+	//
+	// A nil value means clock.Real.
+	Clock clock.Clock
+	// NewScheduler returns the scheduler which runs the
+	// flushes, merges, compactions and value log
+	// collections of a storage, given the context of the
+	// storage and BackgroundWorkers. A simulation returns a
+	// manual scheduler, see scheduler.NewManualScheduler,
+	// to decide when the background work happens.
+	//
+	// A nil value means scheduler.NewScheduler.
+	NewScheduler func(ctx context.Context, workers int) *scheduler.Scheduler
+	// Seed, unless zero, seeds the random choices made by
+	// a storage, such as the heights of the nodes of a
+	// skiplist memtable, which then take the same course
+	// in every run.
+	//
+	// A zero value leaves them to the global source of
+	// package math/rand.
+	Seed int64
+}
+
+const (
+	// defaultGarbageRatioThreshold is the garbage ratio
+	// threshold used if none is set.
+	defaultGarbageRatioThreshold = 0.5
+	// defaultMemtableSize is the memtable size used if
+	// none is set.
+	defaultMemtableSize = 4096
+	// defaultBackgroundWorkers is the number of background
+	// workers used if none is set.
+	defaultBackgroundWorkers = 2
+	// defaultSoftSegmentLimit and defaultHardSegmentLimit
+	// are the segment limits used if none are set.
+	defaultSoftSegmentLimit = 20
+	defaultHardSegmentLimit = 36
+	// defaultValueLogGCRatio is the value log garbage
+	// collection ratio used if none is set.
+	defaultValueLogGCRatio = 0.5
+)
+
+// DefaultOptions returns the options used when none are
+// provided.
+func DefaultOptions() Options {
+	return Options{
+		GarbageRatioThreshold: defaultGarbageRatioThreshold,
+		MemtableSize:          defaultMemtableSize,
+		BackgroundWorkers:     defaultBackgroundWorkers,
+		SoftSegmentLimit:      defaultSoftSegmentLimit,
+		HardSegmentLimit:      defaultHardSegmentLimit,
+	}
+}
+
+// fs returns the filesystem of the options, applying the
+// default.
+func (opts Options) fs() vfs.FS {
+	if opts.FS == nil {
+		return vfs.OS
+	}
+	return opts.FS
+}
+
+// garbageRatioThreshold returns the garbage ratio
+// threshold of the options, applying the default.
+func (opts Options) garbageRatioThreshold() float64 {
+	if opts.GarbageRatioThreshold == 0 {
+		return defaultGarbageRatioThreshold
+	}
+	return opts.GarbageRatioThreshold
+}
+
+// memtableSize returns the memtable size of the options,
+// applying the default.
+func (opts Options) memtableSize() int64 {
+	if opts.MemtableSize == 0 {
+		return defaultMemtableSize
+	}
+	return opts.MemtableSize
+}
+
+// comparator returns the comparator of the options,
+// applying the default.
+func (opts Options) comparator() comparator.Comparator {
+	if opts.Comparator == nil {
+		return comparator.Bytewise
+	}
+	return opts.Comparator
+}
+
+// comparatorGenerator is implemented by the generators of
+// ordered indexers, such as the SSTable one, which can be
+// made to order their keys with a comparator.
+type comparatorGenerator interface {
+	WithComparator(comparator.Comparator) indexer.IndexerGenerator
+}
+
+// indexerGenerator returns the generator the segments of
+// a storage are indexed with, whose indexers order their
+// keys with the comparator of the options if they're
+// ordered at all.
+func (opts Options) indexerGenerator(idxrGntr indexer.IndexerGenerator) indexer.IndexerGenerator {
+	if g, ok := idxrGntr.(comparatorGenerator); ok {
+		return g.WithComparator(opts.comparator())
+	}
+	return idxrGntr
+}
+
+// compactionStrategy returns the compaction strategy of
+// the options, applying the default, which is created
+// anew for every call.
+func (opts Options) compactionStrategy() compaction.Strategy {
+	if opts.CompactionStrategy == nil {
+		return compaction.NewLeveled()
+	}
+	return opts.CompactionStrategy
+}
+
+// backgroundWorkers returns the number of background
+// workers of the options, applying the default.
+func (opts Options) backgroundWorkers() int {
+	if opts.BackgroundWorkers == 0 {
+		return defaultBackgroundWorkers
+	}
+	return opts.BackgroundWorkers
+}
+
+// compactionRateLimiter returns a rate limiter for the
+// compaction rate limit of the options, or nil if there
+// is no limit.
+func (opts Options) compactionRateLimiter() *scheduler.RateLimiter {
+	if opts.CompactionRateLimit == 0 {
+		return nil
+	}
+	return scheduler.NewRateLimiterWithClock(opts.CompactionRateLimit, 0, opts.clock())
+}
+
+// clock returns the clock of the options, applying the
+// default.
+func (opts Options) clock() clock.Clock {
+	if opts.Clock == nil {
+		return clock.Real
+	}
+	return opts.Clock
+}
+
+// newScheduler returns the scheduler for the background
+// work of a storage, running with the number of background
+// workers of the options.
+func (opts Options) newScheduler(ctx context.Context) *scheduler.Scheduler {
+	if opts.NewScheduler == nil {
+		return scheduler.NewScheduler(ctx, opts.backgroundWorkers())
+	}
+	return opts.NewScheduler(ctx, opts.backgroundWorkers())
+}
+
+// softSegmentLimit returns the soft segment limit of the
+// options, applying the default.
+func (opts Options) softSegmentLimit() int {
+	if opts.SoftSegmentLimit == 0 {
+		return defaultSoftSegmentLimit
+	}
+	return opts.SoftSegmentLimit
+}
+
+// hardSegmentLimit returns the hard segment limit of the
+// options, applying the default.
+func (opts Options) hardSegmentLimit() int {
+	if opts.HardSegmentLimit == 0 {
+		return defaultHardSegmentLimit
+	}
+	return opts.HardSegmentLimit
+}
+
+// valueLogGCRatio returns the value log garbage collection
+// ratio of the options, applying the default.
+func (opts Options) valueLogGCRatio() float64 {
+	if opts.ValueLogGCRatio == 0 {
+		return defaultValueLogGCRatio
+	}
+	return opts.ValueLogGCRatio
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"sort"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/comparator"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/segment"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/vlog"
+)
+
+// scanRecord is the most recent record of a key found by
+// a scan, held either by a memtable or by a segment.
+type scanRecord struct {
+	key string
+	// data is the record held by a memtable. The record
+	// held by a segment is read from sg only once the scan
+	// reaches it.
+	data      string
+	sg        *segment.Segment
+	entry     segment.Entry
+	tombstone bool
+}
+
+// scanMerge merges the memtables and the segments of a
+// storage into the most recent record of every key from
+// start up to but not including end.
+//
+// The sources are added from the newest to the oldest, so
+// the record of a key found first shadows those of the
+// sources added after it.
+type scanMerge struct {
+	cmp        comparator.Comparator
+	start, end []byte
+	records    map[string]scanRecord
+}
+
+// newScanMerge returns a scanMerge for the range of a scan
+// ordered by the comparator.
+func newScanMerge(cmp comparator.Comparator, start, end []byte) *scanMerge {
+	return &scanMerge{
+		cmp:     cmp,
+		start:   start,
+		end:     end,
+		records: make(map[string]scanRecord),
+	}
+}
+
+// beforeStart reports whether the key comes before the
+// range of the scan.
+func (m *scanMerge) beforeStart(key string) bool {
+	return m.start != nil && m.cmp.Compare(key, string(m.start)) < 0
+}
+
+// pastEnd reports whether the key comes after the range
+// of the scan.
+func (m *scanMerge) pastEnd(key string) bool {
+	return m.end != nil && m.cmp.Compare(key, string(m.end)) >= 0
+}
+
+// addMemtable adds the records of the memtable, which is
+// newer than the sources added after it.
+func (m *scanMerge) addMemtable(mem memtable) {
+	if mem == nil {
+		return
+	}
+	mem.ascend(func(key string, e memtableEntry) bool {
+		if m.pastEnd(key) {
+			return false
+		}
+		if _, ok := m.records[key]; ok || m.beforeStart(key) {
+			return true
+		}
+		m.records[key] = scanRecord{
+			key:       key,
+			data:      e.data,
+			tombstone: e.tombstone,
+		}
+		return true
+	})
+}
+
+// addSegment adds the records of the segment, which is
+// newer than the sources added after it.
+func (m *scanMerge) addSegment(sg *segment.Segment) error {
+	entries, err := sg.Entries()
+	if err != nil {
+		return err
+	}
+
+	// The records of a key in the segment are appended in
+	// the order they were written, so its last one is the
+	// most recent and shadows the rest.
+	latest := make(map[string]segment.Entry)
+	for _, e := range entries {
+		if m.beforeStart(e.Key) || m.pastEnd(e.Key) {
+			continue
+		}
+		latest[e.Key] = e
+	}
+
+	for key, e := range latest {
+		if _, ok := m.records[key]; ok {
+			continue
+		}
+		m.records[key] = scanRecord{
+			key:       key,
+			sg:        sg,
+			entry:     e,
+			tombstone: e.Tombstone,
+		}
+	}
+	return nil
+}
+
+// run calls fn with the keys which weren't deleted and
+// their data, in the order of the comparator, until fn
+// returns false.
+//
+// Data a record only points at is read from the value log.
+// The file of the value log it points into may have been
+// collected since the sources were pinned, in which case
+// the key is queried again with query, which finds the
+// record written in its place.
+func (m *scanMerge) run(
+	values *valueLog,
+	query func(key []byte) (string, error),
+	fn func(key []byte, data string) bool,
+) error {
+	records := make([]scanRecord, 0, len(m.records))
+	for _, r := range m.records {
+		if !r.tombstone {
+			records = append(records, r)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return m.cmp.Compare(records[i].key, records[j].key) < 0
+	})
+
+	for _, r := range records {
+		record := r.data
+		if r.sg != nil {
+			var err error
+			record, err = r.sg.ReadEntry(r.entry)
+			if err != nil {
+				return err
+			}
+		}
+
+		data, err := values.resolve(record)
+		switch err {
+		case nil:
+		case vlog.ErrFileRemoved:
+			data, err = query([]byte(r.key))
+			if err == ErrDataNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		case vlog.ErrLogClosed:
+			return ErrStorageClosed
+		default:
+			return err
+		}
+
+		if !fn([]byte(r.key), data) {
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+package scheduler
+
+// Error is a helper type for creating constant errors.
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+const (
+	// ErrSchedulerClosed indicates that a job was scheduled
+	// after the scheduler was closed.
+	ErrSchedulerClosed Error = "scheduler is closed"
+)
@@ -0,0 +1,89 @@
+package scheduler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/clock"
+)
+
+// RateLimiter is a token bucket limiting the rate at
+// which background jobs write to disk.
+//
+// The bucket holds up to burst tokens and is refilled
+// at rate tokens per second, where a token stands for a
+// byte. A write larger than what's in the bucket is let
+// through once enough tokens have been added to cover it,
+// which lets writes larger than the burst through without
+// exceeding the rate over time.
+//
+// A nil RateLimiter doesn't limit anything.
+type RateLimiter struct {
+	mu     sync.Mutex
+	clock  clock.Clock
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a rate limiter letting through
+// the given number of bytes per second, in bursts of up
+// to burst bytes. A non-positive burst means a burst of
+// one second worth of bytes.
+func NewRateLimiter(bytesPerSec, burst int64) *RateLimiter {
+	return NewRateLimiterWithClock(bytesPerSec, burst, clock.Real)
+}
+
+// NewRateLimiterWithClock returns a rate limiter like
+// NewRateLimiter does, which is refilled as the time of
+// the given clock passes.
+func NewRateLimiterWithClock(bytesPerSec, burst int64, c clock.Clock) *RateLimiter {
+	if burst <= 0 {
+		burst = bytesPerSec
+	}
+
+	return &RateLimiter{
+		clock:  c,
+		rate:   float64(bytesPerSec),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   c.Now(),
+	}
+}
+
+// WaitN blocks until n bytes may be written or the context
+// is done, in which case the error of the context is
+// returned and the bytes aren't accounted for.
+func (rl *RateLimiter) WaitN(ctx context.Context, n int) error {
+	if rl == nil {
+		return ctx.Err()
+	}
+
+	rl.mu.Lock()
+	now := rl.clock.Now()
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.last = now
+
+	rl.tokens -= float64(n)
+	if rl.tokens >= 0 {
+		rl.mu.Unlock()
+		return ctx.Err()
+	}
+	wait := time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+	rl.mu.Unlock()
+
+	select {
+	case <-rl.clock.After(wait):
+		return nil
+	case <-ctx.Done():
+		rl.mu.Lock()
+		rl.tokens += float64(n)
+		rl.mu.Unlock()
+		return ctx.Err()
+	}
+}
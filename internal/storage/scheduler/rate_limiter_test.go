@@ -0,0 +1,52 @@
+package scheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRateLimiter_WaitN ensures that writes within the
+// burst pass straight through, that writes past it are
+// held back according to the rate and that waiting can
+// be cancelled.
+func TestRateLimiter_WaitN(t *testing.T) {
+	rl := NewRateLimiter(1000, 100)
+	ctx := context.Background()
+
+	start := time.Now()
+	assert.Nil(t, rl.WaitN(ctx, 100))
+	assert.Less(t, int64(time.Since(start)), int64(20*time.Millisecond))
+
+	assert.Nil(t, rl.WaitN(ctx, 50))
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(40*time.Millisecond))
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.Equal(t, context.Canceled, rl.WaitN(ctx, 1000))
+
+	var unlimited *RateLimiter
+	assert.Nil(t, unlimited.WaitN(context.Background(), 1<<30))
+}
+
+// TestRateLimiter_Clock ensures that the rate limiter waits
+// on and is refilled by the time of its clock.
+func TestRateLimiter_Clock(t *testing.T) {
+	start := time.Unix(0, 0)
+	c := clock.NewSim(start)
+	rl := NewRateLimiterWithClock(1000, 100, c)
+	ctx := context.Background()
+
+	assert.Nil(t, rl.WaitN(ctx, 100))
+	assert.Equal(t, start, c.Now())
+
+	assert.Nil(t, rl.WaitN(ctx, 50))
+	assert.Equal(t, start.Add(50*time.Millisecond), c.Now())
+
+	c.Advance(time.Second)
+	assert.Nil(t, rl.WaitN(ctx, 100))
+	assert.Equal(t, start.Add(1050*time.Millisecond), c.Now())
+}
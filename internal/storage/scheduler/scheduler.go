@@ -0,0 +1,300 @@
+package scheduler
+
+import (
+	"context"
+	"sync"
+)
+
+// Job is a unit of background work, such as flushing a
+// memtable or compacting segments.
+//
+// The context passed to a job is cancelled once the
+// scheduler is closed, and a job is expected to stop
+// and clean up after itself when that happens.
+type Job func(ctx context.Context) error
+
+// Scheduler runs background jobs on a fixed pool of
+// worker goroutines.
+//
+// Jobs are scheduled under a name, and a job isn't queued
+// again while another job of the same name is queued. A
+// job scheduled while another job of the same name is
+// running is queued once that job returns, so jobs of the
+// same name never run at once and no request to run one
+// is lost. This lets the storage ask for a compaction
+// after every write that may need one without piling up
+// duplicates, as the job that runs will see all the writes
+// before it.
+//
+// The first error returned by a job is kept and can be
+// read with Err. Jobs keep being run after an error, it's
+// up to the owner of the scheduler to decide whether to
+// carry on.
+//
+// A manual scheduler has no workers and runs a job only
+// when asked to with Run, which lets a simulation decide
+// when the background work of a storage happens.
+type Scheduler struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// queue holds the jobs waiting for a worker, in the
+	// order they were scheduled.
+	queue []task
+	// queued holds the names of the jobs in the queue.
+	queued map[string]bool
+	// active holds the names of the jobs being run.
+	active map[string]bool
+	// rerun holds the jobs to queue once the running job
+	// of the same name returns.
+	rerun map[string]Job
+	// running is the number of jobs being run.
+	running int
+	paused  bool
+	closed  bool
+	manual  bool
+	err     error
+
+	wg sync.WaitGroup
+}
+
+// task is a job queued under its name.
+type task struct {
+	name string
+	job  Job
+}
+
+// NewScheduler returns a new scheduler running jobs on the
+// given number of workers, with at least one worker.
+//
+// The scheduler is closed if the context is cancelled.
+func NewScheduler(ctx context.Context, workers int) *Scheduler {
+	if workers < 1 {
+		workers = 1
+	}
+
+	s := newScheduler(ctx)
+	s.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+	return s
+}
+
+// NewManualScheduler returns a new manual scheduler, whose
+// jobs are only run by Run.
+//
+// The scheduler is closed if the context is cancelled.
+func NewManualScheduler(ctx context.Context) *Scheduler {
+	s := newScheduler(ctx)
+	s.manual = true
+	return s
+}
+
+// newScheduler returns a new scheduler without workers.
+func newScheduler(ctx context.Context) *Scheduler {
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Scheduler{
+		ctx:    ctx,
+		cancel: cancel,
+		queued: make(map[string]bool),
+		active: make(map[string]bool),
+		rerun:  make(map[string]Job),
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		s.closed = true
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}()
+
+	return s
+}
+
+// Schedule queues the job under the name. It returns false
+// if a job of the same name is already waiting to be run,
+// in which case the job isn't queued.
+func (s *Scheduler) Schedule(name string, job Job) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false, ErrSchedulerClosed
+	}
+	if s.queued[name] || s.rerun[name] != nil {
+		return false, nil
+	}
+
+	if s.active[name] {
+		s.rerun[name] = job
+		return true, nil
+	}
+
+	s.enqueue(task{name, job})
+	return true, nil
+}
+
+// enqueue adds the task to the queue.
+func (s *Scheduler) enqueue(t task) {
+	s.queued[t.name] = true
+	s.queue = append(s.queue, t)
+	s.cond.Broadcast()
+}
+
+// Pause stops the workers from starting any more jobs
+// until Resume is called. Jobs which are already running
+// are left to finish.
+func (s *Scheduler) Pause() {
+	s.mu.Lock()
+	s.paused = true
+	s.mu.Unlock()
+}
+
+// Resume lets the workers start jobs again after Pause.
+func (s *Scheduler) Resume() {
+	s.mu.Lock()
+	s.paused = false
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// Wait blocks until no job is queued or running, or the
+// scheduler is closed. A paused scheduler with jobs queued
+// is waited on until it's resumed.
+//
+// A manual scheduler runs the queued jobs itself, in the
+// order they were queued, and returns once none is left or
+// it's paused.
+func (s *Scheduler) Wait() {
+	if s.manual {
+		for {
+			names := s.Queued()
+			if len(names) == 0 || !s.Run(names[0]) {
+				return
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for !s.closed && (len(s.queue) > 0 || s.running > 0) {
+		s.cond.Wait()
+	}
+}
+
+// Manual reports whether the scheduler is a manual one.
+func (s *Scheduler) Manual() bool {
+	return s.manual
+}
+
+// Queued returns the names of the jobs waiting to be run,
+// in the order they were queued.
+func (s *Scheduler) Queued() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, len(s.queue))
+	for i, t := range s.queue {
+		names[i] = t.name
+	}
+	return names
+}
+
+// Run runs the job queued under the name on the calling
+// goroutine and reports whether there was one. No job is
+// run while the scheduler is paused or once it's closed.
+//
+// Run is meant for manual schedulers, but the job is run
+// as if a worker had picked it up on any scheduler.
+func (s *Scheduler) Run(name string) bool {
+	s.mu.Lock()
+	if s.closed || s.paused || !s.queued[name] {
+		s.mu.Unlock()
+		return false
+	}
+
+	for i, t := range s.queue {
+		if t.name == name {
+			s.queue = append(s.queue[:i:i], s.queue[i+1:]...)
+			s.run(t)
+			break
+		}
+	}
+	s.mu.Unlock()
+	return true
+}
+
+// Err returns the first error returned by a job, if any.
+func (s *Scheduler) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close cancels the context of the running jobs, waits for
+// them to return and drops the jobs still queued. It returns
+// the first error returned by a job, if any.
+//
+// Closing is idempotent.
+func (s *Scheduler) Close() error {
+	s.cancel()
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return s.Err()
+}
+
+// work runs queued jobs until the scheduler is closed.
+func (s *Scheduler) work() {
+	defer s.wg.Done()
+
+	for {
+		s.mu.Lock()
+		for !s.closed && (s.paused || len(s.queue) == 0) {
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+
+		t := s.queue[0]
+		s.queue = s.queue[1:]
+		s.run(t)
+		s.mu.Unlock()
+	}
+}
+
+// run runs the task taken off the queue and must be called
+// with mu held, which is released while the job runs.
+func (s *Scheduler) run(t task) {
+	delete(s.queued, t.name)
+	s.active[t.name] = true
+	s.running++
+	s.mu.Unlock()
+
+	err := t.job(s.ctx)
+
+	s.mu.Lock()
+	s.running--
+	delete(s.active, t.name)
+	if job, ok := s.rerun[t.name]; ok {
+		delete(s.rerun, t.name)
+		s.enqueue(task{t.name, job})
+	}
+	// A job interrupted by the scheduler closing didn't
+	// fail on its own.
+	if err != nil && s.err == nil && s.ctx.Err() == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+}
@@ -0,0 +1,175 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestScheduler_Schedule ensures that scheduled jobs are
+// run and that a job isn't queued again while another job
+// of the same name is queued.
+func TestScheduler_Schedule(t *testing.T) {
+	s := NewScheduler(context.Background(), 2)
+	defer s.Close()
+
+	var runs int32
+	job := func(context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		return nil
+	}
+
+	s.Pause()
+	ok, err := s.Schedule("job", job)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = s.Schedule("job", job)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	ok, err = s.Schedule("other", job)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	s.Resume()
+	s.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&runs))
+}
+
+// TestScheduler_Rerun ensures that a job scheduled while
+// another job of the same name is running is run once
+// that job returns, and not alongside it.
+func TestScheduler_Rerun(t *testing.T) {
+	s := NewScheduler(context.Background(), 2)
+	defer s.Close()
+
+	var (
+		runs, running int32
+		started       = make(chan struct{}, 2)
+		release       = make(chan struct{})
+	)
+	job := func(context.Context) error {
+		assert.Equal(t, int32(1), atomic.AddInt32(&running, 1))
+		started <- struct{}{}
+		<-release
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&runs, 1)
+		return nil
+	}
+
+	_, err := s.Schedule("job", job)
+	assert.Nil(t, err)
+	<-started
+
+	ok, err := s.Schedule("job", job)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = s.Schedule("job", job)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	close(release)
+	s.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&runs))
+}
+
+// TestScheduler_PauseResume ensures that no job is started
+// while the scheduler is paused.
+func TestScheduler_PauseResume(t *testing.T) {
+	s := NewScheduler(context.Background(), 1)
+	defer s.Close()
+
+	var runs int32
+	s.Pause()
+	_, err := s.Schedule("job", func(context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		return nil
+	})
+	assert.Nil(t, err)
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&runs))
+
+	s.Resume()
+	s.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&runs))
+}
+
+// TestScheduler_Close ensures that closing cancels the
+// running jobs, keeps the first error returned by a job
+// and refuses any more jobs.
+func TestScheduler_Close(t *testing.T) {
+	s := NewScheduler(context.Background(), 2)
+
+	failure := errors.New("failure")
+	_, err := s.Schedule("failing", func(context.Context) error {
+		return failure
+	})
+	assert.Nil(t, err)
+	s.Wait()
+	assert.Equal(t, failure, s.Err())
+
+	started := make(chan struct{})
+	_, err = s.Schedule("blocking", func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	assert.Nil(t, err)
+	<-started
+
+	assert.Equal(t, failure, s.Close())
+
+	_, err = s.Schedule("job", func(context.Context) error { return nil })
+	assert.Equal(t, ErrSchedulerClosed, err)
+}
+
+// TestScheduler_Manual ensures that a manual scheduler runs
+// the jobs only when asked to, on the calling goroutine,
+// and that a job scheduling itself as it runs is queued
+// again.
+func TestScheduler_Manual(t *testing.T) {
+	s := NewManualScheduler(context.Background())
+	assert.True(t, s.Manual())
+
+	var order []string
+	job := func(name string) Job {
+		return func(context.Context) error {
+			order = append(order, name)
+			return nil
+		}
+	}
+
+	_, err := s.Schedule("first", job("first"))
+	assert.Nil(t, err)
+	_, err = s.Schedule("second", func(context.Context) error {
+		order = append(order, "second")
+		_, err := s.Schedule("second", job("again"))
+		return err
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"first", "second"}, s.Queued())
+	assert.Empty(t, order)
+
+	assert.False(t, s.Run("none"))
+	assert.True(t, s.Run("second"))
+	assert.Equal(t, []string{"first", "second"}, s.Queued())
+
+	s.Pause()
+	assert.False(t, s.Run("first"))
+	s.Resume()
+
+	s.Wait()
+	assert.Empty(t, s.Queued())
+	assert.Equal(t, []string{"second", "first", "again"}, order)
+
+	assert.Nil(t, s.Close())
+	_, err = s.Schedule("first", job("first"))
+	assert.Equal(t, ErrSchedulerClosed, err)
+}
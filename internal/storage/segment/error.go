@@ -7,4 +7,16 @@ func (e Error) Error() string { return string(e) }
 
 const (
 	ErrDataDoesntExistInSegment Error = "the queried key is not indexed in this segment"
+	// ErrDataDeletedInSegment indicates that the most recent
+	// record of the queried key in the segment is a tombstone.
+	ErrDataDeletedInSegment Error = "the queried key is deleted in this segment"
+	// ErrInvalidHintFile indicates that a hint file is damaged or
+	// doesn't belong to the data file next to it.
+	ErrInvalidHintFile Error = "the hint file is invalid for the segment"
+	// ErrInvalidIndexSnapshot indicates that an index snapshot is
+	// damaged or doesn't belong to the data file next to it.
+	ErrInvalidIndexSnapshot Error = "the index snapshot is invalid for the segment"
+	// ErrCorruptSegment indicates that a complete record in the data
+	// file of a segment couldn't be parsed.
+	ErrCorruptSegment Error = "the segment contains a corrupt record"
 )
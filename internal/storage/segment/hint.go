@@ -0,0 +1,170 @@
+package segment
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/vfs"
+)
+
+// hintMagic marks the beginning of every hint file.
+var hintMagic = []byte("KVSHINT2")
+
+// hintFlagTombstone is set in the flags of the entry
+// of a tombstone.
+const hintFlagTombstone = 1 << 0
+
+// Entry describes a single record of a segment as it
+// is recorded in the segment's hint file.
+//
+// A hint file is a compact list of entries kept next
+// to the data file of a sealed segment. Loading the
+// entries is all that's needed to rebuild the indexer
+// of the segment, which saves reading and parsing every
+// record in the data file.
+type Entry struct {
+	// Key is the key the record was appended with.
+	Key string
+	// Offset is where the record starts in the data file.
+	Offset int64
+	// Size is the size of the record including the
+	// trailing delimiter.
+	Size int
+	// Sequence is the store wide sequence number of the
+	// record. A higher sequence number means a more recent
+	// write.
+	Sequence uint64
+	// Tombstone signifies that the record marks the
+	// deletion of the key.
+	Tombstone bool
+}
+
+// writeHintFile writes the entries to a hint file at
+// the given path of the filesystem.
+//
+// The hint file is laid out as,
+//
+//	magic | data file size | entries... | crc32
+//
+// where each entry is a series of uvarints, sequence,
+// offset, size, flags and key length followed by the key.
+// The data file size ties the hint file to the data file
+// it was written for and the checksum covers everything
+// before it.
+func writeHintFile(fs vfs.FS, path string, dataSize int64, entries []Entry) error {
+	file, err := fs.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	var (
+		buf     = bufio.NewWriter(file)
+		scratch = make([]byte, binary.MaxVarintLen64)
+	)
+
+	buf.Write(hintMagic)
+	binary.BigEndian.PutUint64(scratch, uint64(dataSize))
+	buf.Write(scratch[:8])
+
+	crc := crc32.NewIEEE()
+	crc.Write(hintMagic)
+	crc.Write(scratch[:8])
+
+	putUvarint := func(v uint64) {
+		n := binary.PutUvarint(scratch, v)
+		buf.Write(scratch[:n])
+		crc.Write(scratch[:n])
+	}
+	for _, e := range entries {
+		var flags uint64
+		if e.Tombstone {
+			flags |= hintFlagTombstone
+		}
+
+		putUvarint(e.Sequence)
+		putUvarint(uint64(e.Offset))
+		putUvarint(uint64(e.Size))
+		putUvarint(flags)
+		putUvarint(uint64(len(e.Key)))
+		buf.WriteString(e.Key)
+		crc.Write([]byte(e.Key))
+	}
+
+	binary.BigEndian.PutUint32(scratch, crc.Sum32())
+	buf.Write(scratch[:4])
+
+	err = buf.Flush()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// readHintFile reads the entries of the hint file at the
+// given path of the filesystem.
+//
+// ErrInvalidHintFile is returned if the file is truncated,
+// fails its checksum or wasn't written for a data file of
+// the given size. Callers are expected to fall back to
+// scanning the data file in that case.
+func readHintFile(fs vfs.FS, path string, dataSize int64) ([]Entry, error) {
+	data, err := vfs.ReadFile(fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	headerSize := len(hintMagic) + 8
+	if len(data) < headerSize+4 || !bytes.Equal(data[:len(hintMagic)], hintMagic) {
+		return nil, ErrInvalidHintFile
+	}
+
+	body, sum := data[:len(data)-4], data[len(data)-4:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(sum) {
+		return nil, ErrInvalidHintFile
+	}
+
+	if int64(binary.BigEndian.Uint64(body[len(hintMagic):headerSize])) != dataSize {
+		return nil, ErrInvalidHintFile
+	}
+
+	var (
+		entries []Entry
+		r       = bytes.NewReader(body[headerSize:])
+	)
+	for r.Len() > 0 {
+		var fields [5]uint64
+		for i := range fields {
+			fields[i], err = binary.ReadUvarint(r)
+			if err != nil {
+				return nil, ErrInvalidHintFile
+			}
+		}
+
+		if fields[4] > uint64(r.Len()) {
+			return nil, ErrInvalidHintFile
+		}
+		key := make([]byte, fields[4])
+		r.Read(key)
+
+		entries = append(entries, Entry{
+			Key:       string(key),
+			Offset:    int64(fields[1]),
+			Size:      int(fields[2]),
+			Sequence:  fields[0],
+			Tombstone: fields[3]&hintFlagTombstone != 0,
+		})
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,114 @@
+package segment
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/dataobject"
+	_map "github.com/SystemBuilders/KeyValueStore/internal/indexer/map"
+	"github.com/SystemBuilders/KeyValueStore/internal/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+// record returns the marshalled data object for the
+// key and value, as the key-value store would append it.
+func record(t *testing.T, key, value string) string {
+	data, err := json.Marshal(dataobject.NewObject([]byte(key), value))
+	assert.Nil(t, err)
+	return string(data)
+}
+
+// Test_SealAndOpen ensures that a sealed segment can be
+// opened again from its hint file and serves the same data.
+func Test_SealAndOpen(t *testing.T) {
+	dir := t.TempDir()
+	sg, err := CreateSegment(vfs.OS, dir, testIDs, 10, _map.NewMapIndexer())
+	assert.Nil(t, err)
+
+	assert.Nil(t, sg.Append("key1", record(t, "key1", "value1")))
+	assert.Nil(t, sg.Append("key2", record(t, "key2", "value2")))
+	assert.Nil(t, sg.Append("key1", record(t, "key1", "value3")))
+	assert.Equal(t, uint64(13), sg.Sequence())
+
+	assert.Nil(t, sg.Seal())
+	assert.True(t, sg.IsFull)
+
+	entries, err := readHintFile(vfs.OS, sg.hintPath(), sg.offset)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, Entry{Key: "key1", Offset: entries[2].Offset, Size: entries[2].Size, Sequence: 13}, entries[2])
+
+	opened, err := OpenSegment(vfs.OS, dir, sg.ID(), 0, _map.NewMapIndexer())
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(13), opened.Sequence())
+
+	data, err := opened.Query("key1")
+	assert.Nil(t, err)
+	assert.Equal(t, record(t, "key1", "value3"), data)
+}
+
+// Test_OpenWithInvalidHintFile ensures that a damaged hint
+// file is ignored, the data file is scanned instead and a
+// valid hint file is written in its place.
+func Test_OpenWithInvalidHintFile(t *testing.T) {
+	dir := t.TempDir()
+	sg, err := CreateSegment(vfs.OS, dir, testIDs, 0, _map.NewMapIndexer())
+	assert.Nil(t, err)
+
+	assert.Nil(t, sg.Append("key1", record(t, "key1", "value1")))
+	assert.Nil(t, sg.Append("key2", record(t, "key2", "value2")))
+	assert.Nil(t, sg.Seal())
+
+	hint, err := ioutil.ReadFile(sg.hintPath())
+	assert.Nil(t, err)
+	hint[len(hint)-6] ^= 0xff
+	assert.Nil(t, ioutil.WriteFile(sg.hintPath(), hint, 0644))
+
+	_, err = readHintFile(vfs.OS, sg.hintPath(), sg.offset)
+	assert.Equal(t, ErrInvalidHintFile, err)
+
+	// The segment would be indexed from its index snapshot
+	// without reading the hint file otherwise.
+	assert.Nil(t, os.Remove(sg.snapshotPath()))
+
+	opened, err := OpenSegment(vfs.OS, dir, sg.ID(), 0, _map.NewMapIndexer())
+	assert.Nil(t, err)
+
+	data, err := opened.Query("key2")
+	assert.Nil(t, err)
+	assert.Equal(t, record(t, "key2", "value2"), data)
+
+	entries, err := readHintFile(vfs.OS, sg.hintPath(), sg.offset)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+}
+
+// Test_OpenUnsealedSegment ensures that a segment which was
+// never sealed, with a partially written record at its end,
+// is scanned up to its last complete record.
+func Test_OpenUnsealedSegment(t *testing.T) {
+	dir := t.TempDir()
+	sg, err := CreateSegment(vfs.OS, dir, testIDs, 5, _map.NewMapIndexer())
+	assert.Nil(t, err)
+
+	assert.Nil(t, sg.Append("key1", record(t, "key1", "value1")))
+	assert.Nil(t, sg.Append("key2", record(t, "key2", "value2")))
+	_, err = sg.f.WriteString(record(t, "key3", "value3")[:10])
+	assert.Nil(t, err)
+
+	_, err = os.Stat(sg.hintPath())
+	assert.True(t, os.IsNotExist(err))
+
+	opened, err := OpenSegment(vfs.OS, dir, sg.ID(), 5, _map.NewMapIndexer())
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(7), opened.Sequence())
+
+	_, err = opened.Query("key3")
+	assert.Equal(t, ErrDataDoesntExistInSegment, err)
+
+	data, err := opened.Query("key2")
+	assert.Nil(t, err)
+	assert.Equal(t, record(t, "key2", "value2"), data)
+}
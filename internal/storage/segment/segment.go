@@ -1,12 +1,24 @@
 package segment
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
-	"time"
+	"sync"
 
+	"github.com/SystemBuilders/KeyValueStore/internal/clock"
+	"github.com/SystemBuilders/KeyValueStore/internal/dataobject"
 	"github.com/SystemBuilders/KeyValueStore/internal/indexer"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/comparator"
+	"github.com/SystemBuilders/KeyValueStore/internal/vfs"
 )
 
 var (
@@ -16,11 +28,24 @@ var (
 	// defaultDelimiter is the delimiter set as default for
 	// writing to the file.
 	defaultDelimter string = "\\o/"
+	// segmentFileExt is the extension of the data file
+	// of a segment.
+	segmentFileExt = ".segment"
+	// hintFileExt is the extension of the hint file
+	// of a segment.
+	hintFileExt = ".hint"
+	// snapshotFileExt is the extension of the index
+	// snapshot of a segment.
+	snapshotFileExt = ".index"
+	// mergeFileExt is appended to the files of a segment
+	// that is being written by a merge and hasn't been
+	// installed yet.
+	mergeFileExt = ".merge"
 )
 
 // Segment describes a logical segment where the
 // key-value data is stored. Each segment is
-// associated with an underlying file as os.File
+// associated with an underlying file of a vfs.FS
 // which is where the data exists.
 //		Each segment is also associated with an indexer.
 // The indexer being located at this level has an
@@ -31,26 +56,67 @@ var (
 // There are no limits for appending into a single
 // segment object enforced as such by the Segment API.
 // Any existing limits will originate only from the
-// underlying os.File API implementation and thus care
+// underlying vfs.File implementation and thus care
 // must be taken by the users of this API to set safe
 // file size limits during init of this segment.
 //
+// A segment is safe for concurrent use. Queries don't
+// wait for appends to the segment, as the indexer and the
+// data file can be read while a record is being appended.
+//
 // TODO: Configurable segment sizes. Low priority.
 type Segment struct {
+	// fs is the filesystem holding the files of the
+	// segment.
+	fs vfs.FS
 	// f is the handle for the underlying file
-	// os.File implementation. This is where the
+	// vfs.File implementation. This is where the
 	// data is written in an append-only fashion.
-	f *os.File
+	f vfs.File
 	// fName is the name of this file. It will be used
 	// to open the file if it's already created but closed.
 	fName string
+	// id identifies the segment and orders it among
+	// the other segments. A segment with a higher id
+	// holds more recent data.
+	id int64
 	// idxr is the indexer decided by the user attached
 	// to the particular segment. This indexer indexes
 	// only the data in this particular file segment.
 	idxr indexer.Indexer
+	// mu guards the fields below it, which change as
+	// records are appended and the segment is sealed.
+	mu sync.RWMutex
 	// offset holds the current offset at which the
 	// last byte is written in the segment's file.
 	offset int64
+	// baseSeq is the sequence number of the last record
+	// written before this segment was created.
+	baseSeq uint64
+	// seq is the sequence number of the last record
+	// appended to this segment.
+	seq uint64
+	// entries collects the hint file entries of the
+	// records appended to this segment until it is
+	// sealed.
+	entries []Entry
+	// sealed signifies that the hint file of the segment
+	// is written and no more data will be appended.
+	sealed bool
+	// deadBytes is the number of bytes in the data file
+	// taken by records that were shadowed by later writes
+	// of their key, in this segment or a more recent one.
+	// These bytes are reclaimed when the segment is merged.
+	deadBytes int64
+	// minKey and maxKey are the smallest and largest keys
+	// appended to the segment in the order of cmp, once
+	// hasKeys is set.
+	minKey, maxKey string
+	// hasKeys is set once a key is appended to the segment,
+	// which may be the empty key.
+	hasKeys bool
+	// cmp orders the keys of the segment.
+	cmp comparator.Comparator
 	// IsFull signifies whether this segment has run over
 	// the preset limit for the associated file. Default
 	// value is FALSE.
@@ -60,35 +126,312 @@ type Segment struct {
 	// can be appended. However, if a merging or
 	// compaction operation was performed, it can change
 	// this status.
+	//
+	// IsFull is guarded by mu, use Full to read it while
+	// the segment may be appended to.
 	IsFull bool
+	// refs counts the references held on the segment with
+	// Ref, which keep its files around.
+	refs int
+	// obsolete marks a segment which is no longer part of
+	// the storage. It's removed once the last reference to
+	// it is released.
+	obsolete bool
+	// replaced marks a segment whose files were taken over
+	// by the segment which replaced it, so only its file
+	// handle is left to close once it's released.
+	replaced bool
 }
 
-// newSegment is an internal only function used to
-// create new instances of the segment object.
+// NewSegment creates a new segment in the working
+// directory of the OS.
 //
 // This involves creating a new file which is the
 // base of this segment and returning the segment object.
 func NewSegment(idxr indexer.Indexer) (*Segment, error) {
-	f, fName, err := createNewFileForSegment()
+	return CreateSegment(vfs.OS, "", NewIDs(clock.Real), 0, idxr)
+}
+
+// CreateSegment creates a new segment in the given
+// directory of the filesystem, whose id is taken from
+// ids. baseSeq is the sequence number of the last
+// record written to the store before this segment, the
+// records of this segment are numbered after it.
+func CreateSegment(fs vfs.FS, dir string, ids *IDs, baseSeq uint64, idxr indexer.Indexer) (*Segment, error) {
+	return CreateSegmentWithComparator(fs, dir, ids, baseSeq, idxr, comparator.Bytewise)
+}
+
+// CreateSegmentWithComparator creates a new segment like
+// CreateSegment does, whose key range is worked out in
+// the order of the given comparator.
+func CreateSegmentWithComparator(
+	fs vfs.FS,
+	dir string,
+	ids *IDs,
+	baseSeq uint64,
+	idxr indexer.Indexer,
+	cmp comparator.Comparator,
+) (*Segment, error) {
+	id := ids.Next()
+	f, fName, err := createNewFileForSegment(fs, segmentPath(dir, id))
 	if err != nil {
 		return nil, err
 	}
 	return &Segment{
-		f:      f,
-		fName:  fName,
-		idxr:   idxr,
-		offset: 0,
-		IsFull: false,
+		fs:      fs,
+		f:       f,
+		fName:   fName,
+		id:      id,
+		idxr:    idxr,
+		offset:  0,
+		baseSeq: baseSeq,
+		seq:     baseSeq,
+		cmp:     cmp,
+		IsFull:  false,
 	}, nil
 }
 
+// NewMergeSegment creates a segment that a merge can
+// write to and which will take over the id of an
+// existing segment once it is installed using Replace.
+//
+// Until then, the files of the segment carry a
+// temporary extension so that an interrupted merge
+// never shadows the segments it was merging.
+func NewMergeSegment(fs vfs.FS, dir string, id int64, idxr indexer.Indexer) (*Segment, error) {
+	f, fName, err := createNewFileForSegment(fs, segmentPath(dir, id)+mergeFileExt)
+	if err != nil {
+		return nil, err
+	}
+	return &Segment{
+		fs:    fs,
+		f:     f,
+		fName: fName,
+		id:    id,
+		idxr:  idxr,
+		cmp:   comparator.Bytewise,
+	}, nil
+}
+
+// OpenSegment opens an existing segment with the given
+// id in the directory of the filesystem and indexes its
+// records into the indexer.
+//
+// The indexer is loaded from the segment's index snapshot
+// if a valid one exists, which is the quickest way. Failing
+// that, the records are indexed from the segment's hint file
+// if a valid one exists, or else the data file is scanned,
+// numbering the records after baseSeq, and a hint file is
+// written for the next time. In either case a new index
+// snapshot is written too. The returned segment is always
+// sealed.
+//
+// The store opening the segment observes its id with the
+// IDs it creates new segments with.
+func OpenSegment(fs vfs.FS, dir string, id int64, baseSeq uint64, idxr indexer.Indexer) (*Segment, error) {
+	return OpenSegmentWithComparator(fs, dir, id, baseSeq, idxr, comparator.Bytewise)
+}
+
+// OpenSegmentWithComparator opens an existing segment like
+// OpenSegment does, whose key range is worked out in the
+// order of the given comparator.
+func OpenSegmentWithComparator(
+	fs vfs.FS,
+	dir string,
+	id int64,
+	baseSeq uint64,
+	idxr indexer.Indexer,
+	cmp comparator.Comparator,
+) (*Segment, error) {
+	fName := segmentPath(dir, id)
+	f, err := fs.OpenFile(fName, os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	sg := &Segment{
+		fs:      fs,
+		f:       f,
+		fName:   fName,
+		id:      id,
+		idxr:    idxr,
+		offset:  info.Size(),
+		baseSeq: baseSeq,
+		seq:     baseSeq,
+		cmp:     cmp,
+		sealed:  true,
+		IsFull:  true,
+	}
+
+	snapshot, seq, err := readIndexSnapshot(fs, sg.snapshotPath(), sg.offset)
+	if err == nil {
+		sg.restore(snapshot, seq)
+		return sg, nil
+	}
+
+	entries, err := readHintFile(sg.fs, sg.hintPath(), sg.offset)
+	if err != nil {
+		entries, err = sg.scan()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		err = writeHintFile(sg.fs, sg.hintPath(), sg.offset, entries)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	for _, e := range entries {
+		sg.index(e)
+	}
+
+	err = writeIndexSnapshot(sg.fs, sg.snapshotPath(), sg.offset, sg.seq, sg.idxr)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return sg, nil
+}
+
+// ListSegmentIDs returns the ids of all the segments
+// in the given directory of the filesystem in ascending
+// order.
+//
+// Files of merges that were never installed are not
+// considered to be segments.
+func ListSegmentIDs(fs vfs.FS, dir string) ([]int64, error) {
+	infos, err := fs.ReadDir(dirOrWorkingDir(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int64
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, segmentFileExt) {
+			continue
+		}
+
+		id, err := strconv.ParseInt(strings.TrimSuffix(name, segmentFileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// RemoveIncompleteMerges deletes the files of merge
+// segments in the directory of the filesystem that were
+// never installed.
+func RemoveIncompleteMerges(fs vfs.FS, dir string) error {
+	infos, err := fs.ReadDir(dirOrWorkingDir(dir))
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), mergeFileExt) {
+			err = fs.Remove(filepath.Join(dir, info.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RemoveSegment deletes the files of the segment with
+// the given id in the directory of the filesystem,
+// without opening it.
+func RemoveSegment(fs vfs.FS, dir string, id int64) error {
+	fName := segmentPath(dir, id)
+	for _, ext := range []string{snapshotFileExt, hintFileExt} {
+		err := fs.Remove(strings.TrimSuffix(fName, segmentFileExt) + ext)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return fs.Remove(fName)
+}
+
+// ID returns the id of the segment.
+func (sg *Segment) ID() int64 {
+	return sg.id
+}
+
+// Sequence returns the sequence number of the last
+// record appended to the segment.
+func (sg *Segment) Sequence() uint64 {
+	sg.mu.RLock()
+	defer sg.mu.RUnlock()
+	return sg.seq
+}
+
+// Full reports whether the segment has run over the size
+// limit of its file, or is sealed.
+func (sg *Segment) Full() bool {
+	sg.mu.RLock()
+	defer sg.mu.RUnlock()
+	return sg.IsFull
+}
+
 // Append appends the given data to the given segment.
 //
 // After writing to the active file, it also indexes
 // the object with the key in its respective indexer
 // using the associated key.
 func (sg *Segment) Append(key string, data string) error {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	return sg.appendRecord(Entry{Key: key, Sequence: sg.seq + 1}, data)
+}
+
+// Delete appends a tombstone for the key to the segment,
+// which shadows any record of the key appended before it.
+func (sg *Segment) Delete(key string) error {
+	data, err := json.Marshal(dataobject.NewTombstone([]byte(key)))
+	if err != nil {
+		return err
+	}
+
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	return sg.appendRecord(Entry{
+		Key:       key,
+		Sequence:  sg.seq + 1,
+		Tombstone: true,
+	}, string(data))
+}
+
+// AppendRecord appends the given data to the segment
+// as the record described by the key, sequence number
+// and tombstone flag of the entry. The offset and size
+// of the entry are filled in by the segment.
+//
+// This is used by merges, which must retain the sequence
+// numbers of the records they copy over.
+func (sg *Segment) AppendRecord(e Entry, data string) error {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	return sg.appendRecord(e, data)
+}
 
+// appendRecord appends the record described by the entry
+// and must be called with mu held.
+func (sg *Segment) appendRecord(e Entry, data string) error {
 	data += defaultDelimter
 
 	_, err := sg.f.WriteString(data)
@@ -101,16 +444,236 @@ func (sg *Segment) Append(key string, data string) error {
 		return err
 	}
 
-	objLoc := indexer.ObjectLocation{
-		Offset: sg.offset,
-		Size:   len(data),
-	}
+	e.Offset = sg.offset
+	e.Size = len(data)
 	sg.offset += int64(len(data))
 
-	sg.idxr.Store(key, objLoc)
+	sg.entries = append(sg.entries, e)
+	sg.index(e)
 	return nil
 }
 
+// Seal marks the segment as read-only and writes its
+// hint file next to the data file.
+//
+// Sealing is idempotent.
+func (sg *Segment) Seal() error {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	return sg.seal()
+}
+
+// Sync commits the records appended to the segment to
+// disk. A sealed segment was committed as it was sealed.
+func (sg *Segment) Sync() error {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+
+	if sg.sealed {
+		return nil
+	}
+	return sg.f.Sync()
+}
+
+// seal seals the segment and must be called with mu held.
+func (sg *Segment) seal() error {
+	if sg.sealed {
+		return nil
+	}
+
+	err := sg.f.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = writeHintFile(sg.fs, sg.hintPath(), sg.offset, sg.entries)
+	if err != nil {
+		return err
+	}
+
+	err = writeIndexSnapshot(sg.fs, sg.snapshotPath(), sg.offset, sg.seq, sg.idxr)
+	if err != nil {
+		return err
+	}
+
+	sg.entries = nil
+	sg.sealed = true
+	sg.IsFull = true
+	return nil
+}
+
+// Entries returns the entries of all records in the
+// segment in the order they were appended.
+//
+// For a sealed segment, these are read from the hint
+// file, falling back to scanning the data file.
+func (sg *Segment) Entries() ([]Entry, error) {
+	sg.mu.RLock()
+	defer sg.mu.RUnlock()
+
+	if !sg.sealed {
+		entries := make([]Entry, len(sg.entries))
+		copy(entries, sg.entries)
+		return entries, nil
+	}
+
+	entries, err := readHintFile(sg.fs, sg.hintPath(), sg.offset)
+	if err == nil {
+		return entries, nil
+	}
+	return sg.scan()
+}
+
+// ReadEntry returns the data of the record described
+// by the entry.
+func (sg *Segment) ReadEntry(e Entry) (string, error) {
+	data, err := sg.readAt(indexer.ObjectLocation{
+		Offset: e.Offset,
+		Size:   e.Size,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return removeDelimiter(data), nil
+}
+
+// Replace installs this merge segment in place of the
+// old segment. The old segment's files are replaced
+// by the files of this segment and the old segment is
+// made obsolete, so it's closed once it's no longer
+// referenced.
+//
+// The data file is renamed before the hint file and
+// the index snapshot, and the old ones are removed before
+// any of them, so a crash at any point leaves either the
+// old segment or this one with a hint file and an index
+// snapshot that are valid for it, if any.
+func (sg *Segment) Replace(old *Segment) error {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	old.mu.Lock()
+	defer old.mu.Unlock()
+
+	err := sg.seal()
+	if err != nil {
+		return err
+	}
+
+	// The data file of the old segment is renamed over but
+	// it stays open, so whoever still references the old
+	// segment keeps reading its records.
+	for _, path := range []string{old.snapshotPath(), old.hintPath()} {
+		err = sg.fs.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	err = sg.fs.Rename(sg.fName, old.fName)
+	if err != nil {
+		return err
+	}
+
+	err = sg.fs.Rename(sg.hintPath(), old.hintPath())
+	if err != nil {
+		return err
+	}
+
+	err = sg.fs.Rename(sg.snapshotPath(), old.snapshotPath())
+	if err != nil {
+		return err
+	}
+
+	sg.fName = old.fName
+	old.replaced = true
+	return old.markObsolete()
+}
+
+// Close closes the data file of the segment. The segment
+// can't be used after it's closed.
+func (sg *Segment) Close() error {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	return sg.closeFileOfSegment()
+}
+
+// Remove closes the segment and deletes its files.
+func (sg *Segment) Remove() error {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	return sg.remove()
+}
+
+// Ref takes a reference on the segment, which keeps its
+// files around until the reference is released with Unref,
+// even once the segment is obsolete.
+func (sg *Segment) Ref() {
+	sg.mu.Lock()
+	sg.refs++
+	sg.mu.Unlock()
+}
+
+// Unref releases a reference taken with Ref. Releasing the
+// last reference to an obsolete segment removes it.
+func (sg *Segment) Unref() error {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+
+	sg.refs--
+	if sg.refs > 0 || !sg.obsolete {
+		return nil
+	}
+	return sg.release()
+}
+
+// Obsolete marks the segment as no longer part of the
+// storage, such as once it's merged into another segment.
+// The segment is removed right away if it isn't referenced,
+// or else once the last reference to it is released.
+func (sg *Segment) Obsolete() error {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	return sg.markObsolete()
+}
+
+// markObsolete marks the segment as obsolete and must be
+// called with mu held.
+func (sg *Segment) markObsolete() error {
+	sg.obsolete = true
+	if sg.refs > 0 {
+		return nil
+	}
+	return sg.release()
+}
+
+// release gets rid of an obsolete segment which is no
+// longer referenced and must be called with mu held.
+func (sg *Segment) release() error {
+	if sg.replaced {
+		return sg.closeFileOfSegment()
+	}
+	return sg.remove()
+}
+
+// remove closes the segment and deletes its files and
+// must be called with mu held.
+func (sg *Segment) remove() error {
+	err := sg.closeFileOfSegment()
+	if err != nil {
+		return err
+	}
+
+	for _, path := range []string{sg.snapshotPath(), sg.hintPath()} {
+		err = sg.fs.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return sg.fs.Remove(sg.fName)
+}
+
 // Query returns the data associated with the key argument
 // and raises an error if it doesn't exist in this segment.
 //
@@ -123,6 +686,9 @@ func (sg *Segment) Query(key string) (string, error) {
 	if err == indexer.ErrDataDoesntExistInIndexer {
 		return "", ErrDataDoesntExistInSegment
 	}
+	if objLoc.Tombstone {
+		return "", ErrDataDeletedInSegment
+	}
 
 	data, err := sg.readAt(objLoc)
 	if err != nil {
@@ -132,6 +698,69 @@ func (sg *Segment) Query(key string) (string, error) {
 	return removeDelimiter(data), nil
 }
 
+// Locate returns the location of the most recent record
+// of the key in this segment, which may be a tombstone,
+// and whether there is one.
+func (sg *Segment) Locate(key string) (indexer.ObjectLocation, bool) {
+	objLoc, err := sg.idxr.Query(key)
+	if err != nil {
+		return indexer.ObjectLocation{}, false
+	}
+	return objLoc, true
+}
+
+// MarkDead records that a record of the given size in
+// this segment was shadowed by a write to a more recent
+// segment.
+func (sg *Segment) MarkDead(size int) {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	sg.deadBytes += int64(size)
+}
+
+// KeyRange returns the smallest and largest keys stored
+// in the segment, in the order of the comparator of the
+// segment. Both are empty for a segment without keys.
+func (sg *Segment) KeyRange() (string, string) {
+	sg.mu.RLock()
+	defer sg.mu.RUnlock()
+	return sg.minKey, sg.maxKey
+}
+
+// IndexMemoryUsage returns the approximate number of bytes
+// taken in memory by the index of the segment.
+func (sg *Segment) IndexMemoryUsage() int64 {
+	return sg.idxr.ApproximateMemoryUsage()
+}
+
+// Size returns the size of the data file of the segment.
+func (sg *Segment) Size() int64 {
+	sg.mu.RLock()
+	defer sg.mu.RUnlock()
+	return sg.offset
+}
+
+// DeadBytes returns the number of bytes taken by records
+// of the segment that were shadowed by later writes.
+func (sg *Segment) DeadBytes() int64 {
+	sg.mu.RLock()
+	defer sg.mu.RUnlock()
+	return sg.deadBytes
+}
+
+// GarbageRatio returns the fraction of the data file of
+// the segment taken by shadowed records. This is the
+// fraction of the segment a merge would reclaim.
+func (sg *Segment) GarbageRatio() float64 {
+	sg.mu.RLock()
+	defer sg.mu.RUnlock()
+
+	if sg.offset == 0 {
+		return 0
+	}
+	return float64(sg.deadBytes) / float64(sg.offset)
+}
+
 // Print prints the associated indexer of the segment.
 func (sg *Segment) Print() {
 	sg.idxr.Print()
@@ -148,7 +777,7 @@ func (sg *Segment) Print() {
 // This has the file size as an argument so that it's
 // configurable always.
 func (sg *Segment) verifyFileSizeLimits(fileSize int64) error {
-	info, err := os.Stat(sg.fName)
+	info, err := sg.fs.Stat(sg.fName)
 	if err != nil {
 		return err
 	}
@@ -160,6 +789,123 @@ func (sg *Segment) verifyFileSizeLimits(fileSize int64) error {
 	return nil
 }
 
+// index stores the location of the record described
+// by the entry in the indexer of the segment.
+//
+// A record of the same key indexed before it is shadowed
+// and its bytes are accounted as dead. index must be
+// called with mu held, unless the segment is still being
+// opened.
+func (sg *Segment) index(e Entry) {
+	if e.Sequence > sg.seq {
+		sg.seq = e.Sequence
+	}
+
+	if prev, ok := sg.Locate(e.Key); ok {
+		sg.deadBytes += int64(prev.Size)
+	}
+
+	sg.extendKeyRange(e.Key)
+	sg.idxr.Store(e.Key, indexer.ObjectLocation{
+		Offset:    e.Offset,
+		Size:      e.Size,
+		Tombstone: e.Tombstone,
+	})
+}
+
+// extendKeyRange extends the key range of the segment to
+// hold the key.
+func (sg *Segment) extendKeyRange(key string) {
+	if !sg.hasKeys {
+		sg.minKey, sg.maxKey = key, key
+		sg.hasKeys = true
+	} else if sg.cmp.Compare(key, sg.minKey) < 0 {
+		sg.minKey = key
+	} else if sg.cmp.Compare(key, sg.maxKey) > 0 {
+		sg.maxKey = key
+	}
+}
+
+// restore fills in the indexer of the segment with the
+// entries of its index snapshot, along with everything
+// else indexing its records would work out. Every record
+// of the data file which isn't the latest of its key, and
+// so isn't indexed, is shadowed.
+func (sg *Segment) restore(entries []snapshotEntry, seq uint64) {
+	if seq > sg.seq {
+		sg.seq = seq
+	}
+
+	var live int64
+	for _, e := range entries {
+		sg.extendKeyRange(e.key)
+		live += int64(e.loc.Size)
+		sg.idxr.Store(e.key, e.loc)
+	}
+	sg.deadBytes = sg.offset - live
+}
+
+// scan reads every record of the data file of the
+// segment and returns an entry for each of them,
+// numbering them after the base sequence number of
+// the segment.
+//
+// A trailing record without a delimiter was never
+// completely written and is ignored.
+func (sg *Segment) scan() ([]Entry, error) {
+	scanner := bufio.NewScanner(io.NewSectionReader(sg.f, 0, sg.offset))
+	scanner.Buffer(make([]byte, 4096), math.MaxInt32)
+	scanner.Split(splitRecords)
+
+	var (
+		entries []Entry
+		offset  int64
+		seq     = sg.baseSeq
+	)
+	for scanner.Scan() {
+		record := scanner.Bytes()
+		key, tombstone, err := dataobject.KeyOf(record)
+		if err != nil {
+			return nil, ErrCorruptSegment
+		}
+
+		seq++
+		size := len(record) + len(defaultDelimter)
+		entries = append(entries, Entry{
+			Key:       string(key),
+			Offset:    offset,
+			Size:      size,
+			Sequence:  seq,
+			Tombstone: tombstone,
+		})
+		offset += int64(size)
+	}
+
+	return entries, scanner.Err()
+}
+
+// hintPath returns the path of the hint file of the
+// segment.
+func (sg *Segment) hintPath() string {
+	return sg.pathWithExt(hintFileExt)
+}
+
+// snapshotPath returns the path of the index snapshot
+// of the segment.
+func (sg *Segment) snapshotPath() string {
+	return sg.pathWithExt(snapshotFileExt)
+}
+
+// pathWithExt returns the path of the file of the
+// segment with the given extension, which lies next to
+// its data file.
+func (sg *Segment) pathWithExt(ext string) string {
+	if strings.HasSuffix(sg.fName, mergeFileExt) {
+		return strings.TrimSuffix(sg.fName, segmentFileExt+mergeFileExt) + ext + mergeFileExt
+	}
+	return strings.TrimSuffix(sg.fName, segmentFileExt) + ext
+}
+
 // readAt reads the data in the file associated with
 // the segment using the objectLocation argument.
 func (sg *Segment) readAt(objLoc indexer.ObjectLocation) (string, error) {
@@ -177,7 +923,7 @@ func (sg *Segment) readAt(objLoc indexer.ObjectLocation) (string, error) {
 // segment and writes the file pointer to the segment
 // object's file pointer store.
 func (sg *Segment) openFileOfSegment() error {
-	file, err := os.OpenFile(sg.fName, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	file, err := sg.fs.OpenFile(sg.fName, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return err
 	}
@@ -195,11 +941,10 @@ func (sg *Segment) closeFileOfSegment() error {
 }
 
 // createNewFileForSegment creates a new file for the segment
-// based on the current time as the file name and returns the
-// file pointer, file name and any possible errors.
-func createNewFileForSegment() (*os.File, string, error) {
-	fName := time.Now().String()
-	file, err := os.OpenFile(fName, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+// with the given name on the filesystem and returns the file
+// pointer, file name and any possible errors.
+func createNewFileForSegment(fs vfs.FS, fName string) (vfs.File, string, error) {
+	file, err := fs.OpenFile(fName, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return nil, "", err
 	}
@@ -207,6 +952,81 @@ func createNewFileForSegment() (*os.File, string, error) {
 	return file, fName, nil
 }
 
+// segmentPath returns the path of the data file of the
+// segment with the given id.
+func segmentPath(dir string, id int64) string {
+	return filepath.Join(dir, strconv.FormatInt(id, 10)+segmentFileExt)
+}
+
+// dirOrWorkingDir returns the directory to list for the
+// given segment directory.
+func dirOrWorkingDir(dir string) string {
+	if dir == "" {
+		return "."
+	}
+	return dir
+}
+
+// IDs hands out the ids of the new segments of a store,
+// which are the times of a clock they're created at. Segment
+// ids must only grow since they order the segments on disk,
+// so every id handed out is greater than any id handed out
+// or observed before, even if the clock didn't move on.
+//
+// Every store keeps its own IDs, so that a store on a
+// simulated clock hands out the same ids in every run.
+//
+// This is a race-safe type.
+type IDs struct {
+	clock clock.Clock
+	// mu guards last.
+	mu sync.Mutex
+	// last is the most recent id handed out or observed.
+	last int64
+}
+
+// NewIDs returns ids taken from the time of the clock.
+func NewIDs(c clock.Clock) *IDs {
+	return &IDs{clock: c}
+}
+
+// Next returns a new segment id.
+func (ids *IDs) Next() int64 {
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+
+	id := ids.clock.Now().UnixNano()
+	if id <= ids.last {
+		id = ids.last + 1
+	}
+	ids.last = id
+	return id
+}
+
+// Observe records the id of an existing segment so that
+// new segments are always ordered after it.
+func (ids *IDs) Observe(id int64) {
+	ids.mu.Lock()
+	if id > ids.last {
+		ids.last = id
+	}
+	ids.mu.Unlock()
+}
+
+// splitRecords is a bufio.SplitFunc which splits the
+// data file of a segment into its records, dropping
+// the delimiters.
+func splitRecords(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.Index(data, []byte(defaultDelimter)); i >= 0 {
+		return i + len(defaultDelimter), data[:i], nil
+	}
+
+	if atEOF {
+		return len(data), nil, nil
+	}
+	return 0, nil, nil
+}
+
 // removeDelimiter removes the trailing delimiter from
 // the string.
 // This might be an expensive operation, but we have to
@@ -2,19 +2,29 @@ package segment
 
 import (
 	"io/ioutil"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/SystemBuilders/KeyValueStore/internal/clock"
 	_map "github.com/SystemBuilders/KeyValueStore/internal/indexer/map"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/comparator"
+	"github.com/SystemBuilders/KeyValueStore/internal/vfs"
 	"github.com/stretchr/testify/assert"
 )
 
+// testIDs hands out the ids of the segments the tests
+// create.
+var testIDs = NewIDs(clock.Real)
+
 // Test_AppendAndQuery ensures that the data being
 // written to the segment is what is being given
 // out on a query to the segment.
 func Test_AppendAndQuery(t *testing.T) {
 
 	idxr := _map.NewMapIndexer()
-	sg, err := NewSegment(idxr)
+	sg, err := CreateSegment(vfs.OS, t.TempDir(), testIDs, 0, idxr)
 	assert.Nil(t, err)
 
 	testKey := "keyString"
@@ -39,7 +49,7 @@ func Test_AppendAndQuery(t *testing.T) {
 // TODO: Can check all file offsets etc.
 func Test_Append(t *testing.T) {
 	idxr := _map.NewMapIndexer()
-	sg, err := NewSegment(idxr)
+	sg, err := CreateSegment(vfs.OS, t.TempDir(), testIDs, 0, idxr)
 	assert.Nil(t, err)
 
 	testKey := "keyString"
@@ -60,7 +70,7 @@ func Test_Append(t *testing.T) {
 // same as the appended one.
 func Test_Query(t *testing.T) {
 	idxr := _map.NewMapIndexer()
-	sg, err := NewSegment(idxr)
+	sg, err := CreateSegment(vfs.OS, t.TempDir(), testIDs, 0, idxr)
 	assert.Nil(t, err)
 
 	testKey := "keyString"
@@ -85,7 +95,7 @@ func Test_verifyFileSizeLimits(t *testing.T) {
 	idxr := _map.NewMapIndexer()
 
 	// Testing true case.
-	sg, err := NewSegment(idxr)
+	sg, err := CreateSegment(vfs.OS, t.TempDir(), testIDs, 0, idxr)
 	assert.Nil(t, err)
 
 	testData := "dataStringJustExtendingTheSpaceNow"
@@ -99,7 +109,7 @@ func Test_verifyFileSizeLimits(t *testing.T) {
 
 	// Testing false case.
 	testData = "smolData"
-	sg2, err := NewSegment(idxr)
+	sg2, err := CreateSegment(vfs.OS, t.TempDir(), testIDs, 0, idxr)
 	assert.Nil(t, err)
 	_, err = sg2.f.WriteString(testData)
 	assert.Nil(t, err)
@@ -119,7 +129,7 @@ func Test_verifyFileSizeLimits(t *testing.T) {
 // be used to get the location of the object.
 func Test_readAt(t *testing.T) {
 	idxr := _map.NewMapIndexer()
-	sg, err := NewSegment(idxr)
+	sg, err := CreateSegment(vfs.OS, t.TempDir(), testIDs, 0, idxr)
 	assert.Nil(t, err)
 
 	testKey := "keyString"
@@ -137,3 +147,159 @@ func Test_readAt(t *testing.T) {
 	expectedString := testData + defaultDelimter
 	assert.Equal(t, expectedString, obtainedString)
 }
+
+// Test_ConcurrentAppendAndQuery ensures that a segment can
+// be queried while it's being appended to, which is meant
+// to be run with -race.
+func Test_ConcurrentAppendAndQuery(t *testing.T) {
+	sg, err := CreateSegment(vfs.OS, t.TempDir(), testIDs, 0, _map.NewMapIndexer())
+	assert.Nil(t, err)
+	defer sg.Close()
+
+	const records = 8
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				for i := 0; i < records; i++ {
+					data, err := sg.Query("k" + strconv.Itoa(i))
+					if err == ErrDataDoesntExistInSegment {
+						continue
+					}
+					assert.Nil(t, err)
+					assert.Equal(t, "d"+strconv.Itoa(i), data)
+				}
+				_, err := sg.Entries()
+				assert.Nil(t, err)
+				sg.Size()
+				sg.KeyRange()
+			}
+		}()
+	}
+
+	for i := 0; i < records; i++ {
+		assert.Nil(t, sg.Append("k"+strconv.Itoa(i), "d"+strconv.Itoa(i)))
+	}
+	close(done)
+	wg.Wait()
+
+	assert.Equal(t, uint64(records), sg.Sequence())
+}
+
+// Test_ReplaceWhileReferenced ensures that a segment which
+// is replaced while it's referenced keeps serving its own
+// records until it's released.
+func Test_ReplaceWhileReferenced(t *testing.T) {
+	dir := t.TempDir()
+	old, err := CreateSegment(vfs.OS, dir, testIDs, 0, _map.NewMapIndexer())
+	assert.Nil(t, err)
+	assert.Nil(t, old.Append("key", "old"))
+	assert.Nil(t, old.Seal())
+	old.Ref()
+
+	merged, err := NewMergeSegment(vfs.OS, dir, old.ID(), _map.NewMapIndexer())
+	assert.Nil(t, err)
+	assert.Nil(t, merged.AppendRecord(Entry{Key: "key", Sequence: 1}, "new"))
+	assert.Nil(t, merged.Replace(old))
+	defer merged.Close()
+
+	data, err := old.Query("key")
+	assert.Nil(t, err)
+	assert.Equal(t, "old", data)
+
+	data, err = merged.Query("key")
+	assert.Nil(t, err)
+	assert.Equal(t, "new", data)
+
+	// Releasing the old segment doesn't touch the files it
+	// handed over.
+	assert.Nil(t, old.Unref())
+	ids, err := ListSegmentIDs(vfs.OS, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{old.ID()}, ids)
+
+	reopened, err := OpenSegment(vfs.OS, dir, old.ID(), 0, _map.NewMapIndexer())
+	assert.Nil(t, err)
+	defer reopened.Close()
+	data, err = reopened.Query("key")
+	assert.Nil(t, err)
+	assert.Equal(t, "new", data)
+}
+
+// Test_KeyRangeWithComparator ensures that the key range
+// of a segment is worked out in the order of its
+// comparator, including once it's opened again.
+func Test_KeyRangeWithComparator(t *testing.T) {
+	dir := t.TempDir()
+	cmp := comparator.Reverse(comparator.Bytewise)
+	sg, err := CreateSegmentWithComparator(vfs.OS, dir, testIDs, 0, _map.NewMapIndexer(), cmp)
+	assert.Nil(t, err)
+
+	for _, key := range []string{"b", "c", "a", "bb"} {
+		assert.Nil(t, sg.Append(key, key))
+	}
+	minKey, maxKey := sg.KeyRange()
+	assert.Equal(t, "c", minKey)
+	assert.Equal(t, "a", maxKey)
+	assert.Nil(t, sg.Seal())
+
+	opened, err := OpenSegmentWithComparator(vfs.OS, dir, sg.ID(), 0, _map.NewMapIndexer(), cmp)
+	assert.Nil(t, err)
+	minKey, maxKey = opened.KeyRange()
+	assert.Equal(t, "c", minKey)
+	assert.Equal(t, "a", maxKey)
+}
+
+// Test_KeyRangeEmptyKey ensures that the empty key counts
+// towards the key range like any other key.
+func Test_KeyRangeEmptyKey(t *testing.T) {
+	dir := t.TempDir()
+	sg, err := CreateSegment(vfs.OS, dir, testIDs, 0, _map.NewMapIndexer())
+	assert.Nil(t, err)
+
+	minKey, maxKey := sg.KeyRange()
+	assert.Equal(t, "", minKey)
+	assert.Equal(t, "", maxKey)
+
+	for _, key := range []string{"", "b", "a"} {
+		assert.Nil(t, sg.Append(key, "value"))
+	}
+	minKey, maxKey = sg.KeyRange()
+	assert.Equal(t, "", minKey)
+	assert.Equal(t, "b", maxKey)
+	assert.Nil(t, sg.Seal())
+
+	opened, err := OpenSegment(vfs.OS, dir, sg.ID(), 0, _map.NewMapIndexer())
+	assert.Nil(t, err)
+	minKey, maxKey = opened.KeyRange()
+	assert.Equal(t, "", minKey)
+	assert.Equal(t, "b", maxKey)
+}
+
+// TestIDs ensures that ids are taken from the clock and
+// keep growing while it stands still.
+func TestIDs(t *testing.T) {
+	c := clock.NewSim(time.Unix(0, 100))
+	ids := NewIDs(c)
+	assert.Equal(t, int64(100), ids.Next())
+	assert.Equal(t, int64(101), ids.Next())
+
+	ids.Observe(200)
+	ids.Observe(150)
+	assert.Equal(t, int64(201), ids.Next())
+
+	c.Advance(time.Microsecond)
+	assert.Equal(t, int64(1100), ids.Next())
+
+	// Other ids on the same clock are kept apart.
+	assert.Equal(t, int64(1100), NewIDs(c).Next())
+}
@@ -0,0 +1,169 @@
+package segment
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/indexer"
+	"github.com/SystemBuilders/KeyValueStore/internal/vfs"
+)
+
+// snapshotMagic marks the beginning of every index
+// snapshot.
+var snapshotMagic = []byte("KVSINDX1")
+
+// snapshotFlagTombstone is set in the flags of the
+// location of a tombstone.
+const snapshotFlagTombstone = 1 << 0
+
+// snapshotEntry is a key of an index snapshot along with
+// its location in the data file.
+type snapshotEntry struct {
+	key string
+	loc indexer.ObjectLocation
+}
+
+// writeIndexSnapshot writes the contents of the indexer
+// to an index snapshot at the given path of the
+// filesystem.
+//
+// Unlike a hint file, which lists every record of the
+// data file, an index snapshot holds only what the indexer
+// holds, which is the location of the latest record of
+// every key. Loading it is all that's needed to fill in
+// the indexer of a sealed segment again.
+//
+// The index snapshot is laid out as,
+//
+//	magic | data file size | sequence | entries... | crc32
+//
+// where each entry is a series of uvarints, offset, size,
+// flags and key length followed by the key. The sequence
+// is that of the last record of the segment, and the
+// checksum covers everything before it.
+func writeIndexSnapshot(fs vfs.FS, path string, dataSize int64, seq uint64, idxr indexer.Indexer) error {
+	file, err := fs.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	var (
+		buf     = bufio.NewWriter(file)
+		crc     = crc32.NewIEEE()
+		scratch = make([]byte, binary.MaxVarintLen64)
+	)
+
+	write := func(p []byte) {
+		buf.Write(p)
+		crc.Write(p)
+	}
+	putUvarint := func(v uint64) {
+		n := binary.PutUvarint(scratch, v)
+		write(scratch[:n])
+	}
+
+	write(snapshotMagic)
+	binary.BigEndian.PutUint64(scratch, uint64(dataSize))
+	write(scratch[:8])
+	binary.BigEndian.PutUint64(scratch, seq)
+	write(scratch[:8])
+
+	idxr.Iterate(func(key interface{}, loc indexer.ObjectLocation) bool {
+		var flags uint64
+		if loc.Tombstone {
+			flags |= snapshotFlagTombstone
+		}
+
+		// Segments index their keys as strings.
+		k := key.(string)
+		putUvarint(uint64(loc.Offset))
+		putUvarint(uint64(loc.Size))
+		putUvarint(flags)
+		putUvarint(uint64(len(k)))
+		write([]byte(k))
+		return true
+	})
+
+	binary.BigEndian.PutUint32(scratch, crc.Sum32())
+	buf.Write(scratch[:4])
+
+	err = buf.Flush()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// readIndexSnapshot reads the index snapshot at the given
+// path of the filesystem, returning its entries and the
+// sequence number of the last record of the segment.
+//
+// ErrInvalidIndexSnapshot is returned if the file is
+// truncated, fails its checksum, wasn't written for a data
+// file of the given size or locates a record outside of
+// it. Callers are expected to fall back to the hint file
+// or to scanning the data file in that case.
+func readIndexSnapshot(fs vfs.FS, path string, dataSize int64) ([]snapshotEntry, uint64, error) {
+	data, err := vfs.ReadFile(fs, path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	headerSize := len(snapshotMagic) + 16
+	if len(data) < headerSize+4 || !bytes.Equal(data[:len(snapshotMagic)], snapshotMagic) {
+		return nil, 0, ErrInvalidIndexSnapshot
+	}
+
+	body, sum := data[:len(data)-4], data[len(data)-4:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(sum) {
+		return nil, 0, ErrInvalidIndexSnapshot
+	}
+
+	header := body[len(snapshotMagic):headerSize]
+	if int64(binary.BigEndian.Uint64(header[:8])) != dataSize {
+		return nil, 0, ErrInvalidIndexSnapshot
+	}
+	seq := binary.BigEndian.Uint64(header[8:])
+
+	var (
+		entries []snapshotEntry
+		r       = bytes.NewReader(body[headerSize:])
+	)
+	for r.Len() > 0 {
+		var fields [4]uint64
+		for i := range fields {
+			fields[i], err = binary.ReadUvarint(r)
+			if err != nil {
+				return nil, 0, ErrInvalidIndexSnapshot
+			}
+		}
+
+		if fields[0]+fields[1] > uint64(dataSize) || fields[3] > uint64(r.Len()) {
+			return nil, 0, ErrInvalidIndexSnapshot
+		}
+		key := make([]byte, fields[3])
+		r.Read(key)
+
+		entries = append(entries, snapshotEntry{
+			key: string(key),
+			loc: indexer.ObjectLocation{
+				Offset:    int64(fields[0]),
+				Size:      int(fields[1]),
+				Tombstone: fields[2]&snapshotFlagTombstone != 0,
+			},
+		})
+	}
+
+	return entries, seq, nil
+}
@@ -0,0 +1,128 @@
+package segment
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	_map "github.com/SystemBuilders/KeyValueStore/internal/indexer/map"
+	"github.com/SystemBuilders/KeyValueStore/internal/indexer/sst"
+	"github.com/SystemBuilders/KeyValueStore/internal/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_OpenFromIndexSnapshot ensures that a sealed segment
+// is opened from its index snapshot alone, and ends up the
+// same as it would from its hint file.
+func Test_OpenFromIndexSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	sg, err := CreateSegment(vfs.OS, dir, testIDs, 10, _map.NewMapIndexer())
+	assert.Nil(t, err)
+
+	assert.Nil(t, sg.Append("key2", record(t, "key2", "value1")))
+	assert.Nil(t, sg.Append("key1", record(t, "key1", "value2")))
+	assert.Nil(t, sg.Append("key2", record(t, "key2", "value3")))
+	assert.Nil(t, sg.Delete("key3"))
+	assert.Nil(t, sg.Seal())
+
+	// The hint file isn't needed, so it isn't written again
+	// either.
+	assert.Nil(t, os.Remove(sg.hintPath()))
+
+	opened, err := OpenSegment(vfs.OS, dir, sg.ID(), 0, _map.NewMapIndexer())
+	assert.Nil(t, err)
+	assert.Equal(t, sg.Sequence(), opened.Sequence())
+	assert.Equal(t, sg.DeadBytes(), opened.DeadBytes())
+
+	minKey, maxKey := opened.KeyRange()
+	assert.Equal(t, "key1", minKey)
+	assert.Equal(t, "key3", maxKey)
+
+	data, err := opened.Query("key2")
+	assert.Nil(t, err)
+	assert.Equal(t, record(t, "key2", "value3"), data)
+
+	_, err = opened.Query("key3")
+	assert.Equal(t, ErrDataDeletedInSegment, err)
+
+	_, err = os.Stat(sg.hintPath())
+	assert.True(t, os.IsNotExist(err))
+}
+
+// Test_IndexSnapshotOfOrderedIndexer ensures that the index
+// snapshot written from one kind of indexer can be loaded
+// into another.
+func Test_IndexSnapshotOfOrderedIndexer(t *testing.T) {
+	dir := t.TempDir()
+	sg, err := CreateSegment(vfs.OS, dir, testIDs, 0, sst.NewSSTableIndexer())
+	assert.Nil(t, err)
+
+	assert.Nil(t, sg.Append("key1", record(t, "key1", "value1")))
+	assert.Nil(t, sg.Append("key2", record(t, "key2", "value2")))
+	assert.Nil(t, sg.Seal())
+
+	idxr := _map.NewMapIndexer()
+	opened, err := OpenSegment(vfs.OS, dir, sg.ID(), 0, idxr)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, idxr.Len())
+
+	data, err := opened.Query("key1")
+	assert.Nil(t, err)
+	assert.Equal(t, record(t, "key1", "value1"), data)
+}
+
+// Test_OpenWithInvalidIndexSnapshot ensures that a damaged
+// index snapshot, or one written for another data file, is
+// ignored and a valid one is written in its place.
+func Test_OpenWithInvalidIndexSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	sg, err := CreateSegment(vfs.OS, dir, testIDs, 0, _map.NewMapIndexer())
+	assert.Nil(t, err)
+
+	assert.Nil(t, sg.Append("key1", record(t, "key1", "value1")))
+	assert.Nil(t, sg.Append("key2", record(t, "key2", "value2")))
+	assert.Nil(t, sg.Seal())
+
+	_, _, err = readIndexSnapshot(vfs.OS, sg.snapshotPath(), sg.offset+1)
+	assert.Equal(t, ErrInvalidIndexSnapshot, err)
+
+	snapshot, err := ioutil.ReadFile(sg.snapshotPath())
+	assert.Nil(t, err)
+	snapshot[len(snapshot)-6] ^= 0xff
+	assert.Nil(t, ioutil.WriteFile(sg.snapshotPath(), snapshot, 0644))
+
+	_, _, err = readIndexSnapshot(vfs.OS, sg.snapshotPath(), sg.offset)
+	assert.Equal(t, ErrInvalidIndexSnapshot, err)
+
+	opened, err := OpenSegment(vfs.OS, dir, sg.ID(), 0, _map.NewMapIndexer())
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), opened.Sequence())
+
+	data, err := opened.Query("key2")
+	assert.Nil(t, err)
+	assert.Equal(t, record(t, "key2", "value2"), data)
+
+	entries, seq, err := readIndexSnapshot(vfs.OS, sg.snapshotPath(), sg.offset)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, uint64(2), seq)
+}
+
+// Test_RemoveSegmentWithIndexSnapshot ensures that the
+// index snapshot of a segment goes along with the rest
+// of its files.
+func Test_RemoveSegmentWithIndexSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	sg, err := CreateSegment(vfs.OS, dir, testIDs, 0, _map.NewMapIndexer())
+	assert.Nil(t, err)
+
+	assert.Nil(t, sg.Append("key1", record(t, "key1", "value1")))
+	assert.Nil(t, sg.Seal())
+	assert.Nil(t, sg.Close())
+
+	assert.Nil(t, RemoveSegment(vfs.OS, dir, sg.ID()))
+
+	infos, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, infos)
+}
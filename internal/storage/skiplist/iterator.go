@@ -0,0 +1,49 @@
+package skiplist
+
+// Iterator walks the keys of a skiplist in order.
+//
+// Iterating goes on while the skiplist is written to. An
+// iterator never sees a key twice or out of order, and
+// sees the keys put before it moved past their position,
+// while it may or may not see those put during the
+// iteration.
+type Iterator struct {
+	sl   *Skiplist
+	node *node
+}
+
+// First positions the iterator on the smallest key of the
+// skiplist.
+func (it *Iterator) First() {
+	it.node = it.sl.head.nextAt(0)
+}
+
+// Seek positions the iterator on the smallest key which
+// is larger than or equal to the key.
+func (it *Iterator) Seek(key string) {
+	it.node = it.sl.seek(key)
+}
+
+// Valid reports whether the iterator is positioned on a
+// key.
+func (it *Iterator) Valid() bool {
+	return it.node != nil
+}
+
+// Next moves the iterator on to the next key. The
+// iterator must be valid.
+func (it *Iterator) Next() {
+	it.node = it.node.nextAt(0)
+}
+
+// Key returns the key the iterator is positioned on. The
+// iterator must be valid.
+func (it *Iterator) Key() string {
+	return it.node.key
+}
+
+// Value returns the current value of the key the iterator
+// is positioned on. The iterator must be valid.
+func (it *Iterator) Value() interface{} {
+	return it.node.value()
+}
@@ -0,0 +1,267 @@
+package skiplist
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	// maxHeight is the number of levels of the skiplist,
+	// which keeps lookups logarithmic up to about 4^12
+	// keys.
+	maxHeight = 12
+	// branching is the inverse of the probability of a
+	// node reaching the next level.
+	branching = 4
+	// nodeOverhead is the number of bytes taken by a node
+	// besides its key, its value and its next pointers.
+	nodeOverhead = int64(unsafe.Sizeof(node{}) + unsafe.Sizeof(entry{}))
+	// pointerSize is the number of bytes taken by every
+	// next pointer of a node.
+	pointerSize = int64(unsafe.Sizeof(unsafe.Pointer(nil)))
+)
+
+// Skiplist is an ordered map from string keys to values,
+// made of sorted linked lists stacked on each other, each
+// one skipping over more of the keys than the one below.
+//
+// A Skiplist is safe for concurrent use. Reads take no
+// lock and never wait for writes, and writes don't wait
+// for each other either, as nodes are linked in with
+// compare-and-swap. Keys are never removed, which is what
+// keeps it this simple, and a key put again gets its
+// value replaced in place.
+//
+// Keys are ordered by their bytes unless the skiplist is
+// created with another compare function.
+type Skiplist struct {
+	head *node
+	// compare orders the keys of the skiplist.
+	compare func(a, b string) int
+	// height is the number of levels in use.
+	height int32
+	// length is the number of keys in the skiplist.
+	length int64
+	// size is the number of bytes taken by the keys, the
+	// values and the nodes holding them.
+	size int64
+	// rand, if set, picks the heights of new nodes in
+	// place of the global source. randLock guards it.
+	rand     *rand.Rand
+	randLock sync.Mutex
+}
+
+// node holds a key of the skiplist. Its next pointers,
+// one per level the node reaches, are only ever changed
+// atomically.
+type node struct {
+	key   string
+	entry unsafe.Pointer
+	next  []unsafe.Pointer
+}
+
+// entry is the value of a node along with the number of
+// bytes it takes, which are replaced together.
+type entry struct {
+	value interface{}
+	size  int64
+}
+
+// New returns an empty skiplist.
+func New() *Skiplist {
+	return NewWithCompare(strings.Compare)
+}
+
+// NewWithCompare returns an empty skiplist ordering its
+// keys with the given compare function, which returns a
+// negative number, zero or a positive number as a is
+// ordered before, the same as or after b.
+func NewWithCompare(compare func(a, b string) int) *Skiplist {
+	return &Skiplist{
+		head:    &node{next: make([]unsafe.Pointer, maxHeight)},
+		compare: compare,
+		height:  1,
+	}
+}
+
+// NewWithSeed returns an empty skiplist like
+// NewWithCompare, whose nodes get their heights from a
+// source seeded with the seed rather than the global one.
+// Skiplists put the same keys with the same seed end up
+// the same, down to their size.
+func NewWithSeed(compare func(a, b string) int, seed int64) *Skiplist {
+	sl := NewWithCompare(compare)
+	sl.rand = rand.New(rand.NewSource(seed))
+	return sl
+}
+
+// Put stores the value with the key, replacing the value
+// stored with it before. valueSize is the number of bytes
+// the value takes, which is accounted in the size of the
+// skiplist.
+func (sl *Skiplist) Put(key string, value interface{}, valueSize int) {
+	e := unsafe.Pointer(&entry{value, int64(valueSize)})
+
+	var preds, succs [maxHeight]*node
+	for {
+		if sl.findSplice(key, &preds, &succs) {
+			// The key is already in the skiplist, so only
+			// its value is replaced.
+			prev := (*entry)(atomic.SwapPointer(&succs[0].entry, e))
+			atomic.AddInt64(&sl.size, int64(valueSize)-prev.size)
+			return
+		}
+
+		height := sl.randomHeight()
+		n := &node{
+			key:   key,
+			entry: e,
+			next:  make([]unsafe.Pointer, height),
+		}
+		for h := 0; h < height; h++ {
+			n.next[h] = unsafe.Pointer(succs[h])
+		}
+
+		// The node is in the skiplist once it's linked in
+		// at the bottom level, which may fail if another
+		// node was linked in between the splice, in which
+		// case the splice is found again.
+		if !atomic.CompareAndSwapPointer(&preds[0].next[0], unsafe.Pointer(succs[0]), unsafe.Pointer(n)) {
+			continue
+		}
+
+		sl.raiseHeight(height)
+		for h := 1; h < height; h++ {
+			sl.linkAt(n, h, preds[h], succs[h])
+		}
+
+		atomic.AddInt64(&sl.length, 1)
+		atomic.AddInt64(&sl.size, nodeOverhead+int64(height)*pointerSize+int64(len(key))+int64(valueSize))
+		return
+	}
+}
+
+// Get returns the value stored with the key and whether
+// the key is in the skiplist.
+func (sl *Skiplist) Get(key string) (interface{}, bool) {
+	n := sl.seek(key)
+	if n == nil || sl.compare(n.key, key) != 0 {
+		return nil, false
+	}
+	return n.value(), true
+}
+
+// Len returns the number of keys in the skiplist.
+func (sl *Skiplist) Len() int {
+	return int(atomic.LoadInt64(&sl.length))
+}
+
+// Size returns the number of bytes taken by the keys and
+// values of the skiplist along with the nodes holding
+// them.
+func (sl *Skiplist) Size() int64 {
+	return atomic.LoadInt64(&sl.size)
+}
+
+// NewIterator returns an iterator over the skiplist, which
+// isn't positioned on any key until it's moved with First
+// or Seek.
+func (sl *Skiplist) NewIterator() *Iterator {
+	return &Iterator{sl: sl}
+}
+
+// findSplice fills in the nodes of every level between
+// which the key belongs, and reports whether the key is
+// already in the skiplist, in which case succs[0] holds
+// it.
+func (sl *Skiplist) findSplice(key string, preds, succs *[maxHeight]*node) bool {
+	pred := sl.head
+	for h := maxHeight - 1; h >= 0; h-- {
+		succ := pred.nextAt(h)
+		for succ != nil && sl.compare(succ.key, key) < 0 {
+			pred = succ
+			succ = pred.nextAt(h)
+		}
+		preds[h], succs[h] = pred, succ
+	}
+	return succs[0] != nil && sl.compare(succs[0].key, key) == 0
+}
+
+// linkAt links the node in at the given level, between
+// the given nodes if nothing was linked in between them
+// meanwhile, or else where it belongs now.
+func (sl *Skiplist) linkAt(n *node, h int, pred, succ *node) {
+	for {
+		atomic.StorePointer(&n.next[h], unsafe.Pointer(succ))
+		if atomic.CompareAndSwapPointer(&pred.next[h], unsafe.Pointer(succ), unsafe.Pointer(n)) {
+			return
+		}
+
+		pred = sl.head
+		for h2 := maxHeight - 1; h2 >= h; h2-- {
+			succ = pred.nextAt(h2)
+			for succ != nil && sl.compare(succ.key, n.key) < 0 {
+				pred = succ
+				succ = pred.nextAt(h2)
+			}
+		}
+	}
+}
+
+// raiseHeight raises the height of the skiplist to the
+// given height, unless it's already higher.
+func (sl *Skiplist) raiseHeight(height int) {
+	for {
+		curr := atomic.LoadInt32(&sl.height)
+		if int32(height) <= curr || atomic.CompareAndSwapInt32(&sl.height, curr, int32(height)) {
+			return
+		}
+	}
+}
+
+// seek returns the node of the smallest key which is
+// larger than or equal to the key, or nil if there is
+// no such key.
+func (sl *Skiplist) seek(key string) *node {
+	pred := sl.head
+	var succ *node
+	for h := int(atomic.LoadInt32(&sl.height)) - 1; h >= 0; h-- {
+		succ = pred.nextAt(h)
+		for succ != nil && sl.compare(succ.key, key) < 0 {
+			pred = succ
+			succ = pred.nextAt(h)
+		}
+	}
+	return succ
+}
+
+// nextAt returns the next node at the given level.
+func (n *node) nextAt(h int) *node {
+	return (*node)(atomic.LoadPointer(&n.next[h]))
+}
+
+// value returns the current value of the node.
+func (n *node) value() interface{} {
+	return (*entry)(atomic.LoadPointer(&n.entry)).value
+}
+
+// randomHeight returns the height of a new node, which
+// reaches every level with a probability of 1/branching
+// of reaching the one below it.
+func (sl *Skiplist) randomHeight() int {
+	intn := rand.Intn
+	if sl.rand != nil {
+		sl.randLock.Lock()
+		defer sl.randLock.Unlock()
+		intn = sl.rand.Intn
+	}
+
+	height := 1
+	for height < maxHeight && intn(branching) == 0 {
+		height++
+	}
+	return height
+}
@@ -0,0 +1,192 @@
+package skiplist
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkiplist_PutAndGet(t *testing.T) {
+	sl := New()
+
+	_, ok := sl.Get("key")
+	assert.False(t, ok)
+
+	sl.Put("key", "first", 5)
+	sl.Put("other", "value", 5)
+	sl.Put("key", "second", 6)
+
+	value, ok := sl.Get("key")
+	assert.True(t, ok)
+	assert.Equal(t, "second", value)
+	assert.Equal(t, 2, sl.Len())
+
+	_, ok = sl.Get("kez")
+	assert.False(t, ok)
+}
+
+func TestSkiplist_Size(t *testing.T) {
+	sl := New()
+	assert.Zero(t, sl.Size())
+
+	sl.Put("key", "value", 5)
+	size := sl.Size()
+	assert.True(t, size > int64(len("key")+5))
+
+	// Replacing the value only accounts for the change in
+	// its size.
+	sl.Put("key", "longer value", 12)
+	assert.Equal(t, size+7, sl.Size())
+}
+
+func TestSkiplist_Iterator(t *testing.T) {
+	sl := New()
+	rnd := rand.New(rand.NewSource(1))
+	want := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(rnd.Intn(500))
+		sl.Put(key, key, len(key))
+		want[key] = true
+	}
+
+	var wantKeys []string
+	for key := range want {
+		wantKeys = append(wantKeys, key)
+	}
+	sort.Strings(wantKeys)
+
+	var keys []string
+	it := sl.NewIterator()
+	for it.First(); it.Valid(); it.Next() {
+		assert.Equal(t, it.Key(), it.Value())
+		keys = append(keys, it.Key())
+	}
+	assert.Equal(t, wantKeys, keys)
+
+	it.Seek("45")
+	assert.True(t, it.Valid())
+	assert.Equal(t, wantKeys[sort.SearchStrings(wantKeys, "45")], it.Key())
+
+	it.Seek("a")
+	assert.False(t, it.Valid())
+}
+
+// TestSkiplist_Compare ensures that a skiplist keeps its
+// keys in the order of its compare function.
+func TestSkiplist_Compare(t *testing.T) {
+	sl := NewWithCompare(func(a, b string) int {
+		return strings.Compare(b, a)
+	})
+	for _, key := range []string{"b", "c", "a"} {
+		sl.Put(key, key, len(key))
+	}
+
+	value, ok := sl.Get("c")
+	assert.True(t, ok)
+	assert.Equal(t, "c", value)
+
+	var keys []string
+	it := sl.NewIterator()
+	for it.First(); it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+	}
+	assert.Equal(t, []string{"c", "b", "a"}, keys)
+
+	it.Seek("bb")
+	assert.True(t, it.Valid())
+	assert.Equal(t, "b", it.Key())
+}
+
+// TestSkiplist_Seed ensures that skiplists with the same
+// seed take the same size for the same keys.
+func TestSkiplist_Seed(t *testing.T) {
+	first := NewWithSeed(strings.Compare, 1)
+	second := NewWithSeed(strings.Compare, 1)
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		first.Put(key, key, len(key))
+		second.Put(key, key, len(key))
+	}
+	assert.Equal(t, first.Size(), second.Size())
+	assert.Equal(t, first.height, second.height)
+}
+
+// TestSkiplist_Concurrent ensures that concurrent writers
+// and readers, some of which iterate over the skiplist,
+// see the keys in order and that no write is lost, which
+// is meant to be run with -race.
+func TestSkiplist_Concurrent(t *testing.T) {
+	const (
+		writers = 8
+		keys    = 500
+	)
+	sl := New()
+
+	var (
+		wg   sync.WaitGroup
+		done = make(chan struct{})
+	)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < keys; i++ {
+				// Half of the keys are shared by all the
+				// writers.
+				key := "k" + strconv.Itoa(i)
+				if i%2 == 0 {
+					key += "-w" + strconv.Itoa(w)
+				}
+				sl.Put(key, w, 1)
+			}
+		}(w)
+	}
+
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				prev := ""
+				it := sl.NewIterator()
+				for it.First(); it.Valid(); it.Next() {
+					assert.True(t, prev < it.Key(), "%q comes after %q", it.Key(), prev)
+					prev = it.Key()
+				}
+				sl.Get("k1")
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	assert.Equal(t, writers*keys/2+keys/2, sl.Len())
+	for w := 0; w < writers; w++ {
+		for i := 0; i < keys; i += 2 {
+			value, ok := sl.Get("k" + strconv.Itoa(i) + "-w" + strconv.Itoa(w))
+			assert.True(t, ok)
+			assert.Equal(t, w, value)
+		}
+	}
+
+	var count int
+	it := sl.NewIterator()
+	for it.First(); it.Valid(); it.Next() {
+		count++
+	}
+	assert.Equal(t, sl.Len(), count)
+}
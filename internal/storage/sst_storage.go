@@ -0,0 +1,1097 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/dataobject"
+	"github.com/SystemBuilders/KeyValueStore/internal/indexer"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/compaction"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/comparator"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/mergecompaction"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/scheduler"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/segment"
+)
+
+// walDirName is the name of the directory holding the
+// write-ahead log segments of an SSTStorage.
+const walDirName = "wal"
+
+// SSTStorage implements Storage.
+//
+// SSTStorage is a log-structured merge storage. Incoming
+// data is appended to a write-ahead log and then kept in
+// an in-memory memtable. Once the memtable is full, it is
+// flushed to disk as a segment sorted by key, a table,
+// which goes into level 0. Keys are sorted by the
+// comparator of the storage, which is recorded in the
+// manifest.
+//
+// The tables are organised in levels, as described by
+// compaction.Strategy, and the compaction strategy of the
+// storage decides how they are merged into fewer tables
+// over time. Which tables make up each level is recorded
+// in the manifest of the storage.
+//
+// Flushes and compactions run in the background. A full
+// memtable is set aside as the immutable memtable, which
+// keeps serving reads until its table is in place, and a
+// new memtable takes the writes meanwhile.
+//
+// SSTStorage is safe for concurrent use. Writes are
+// serialised and queries run alongside them and the
+// background work, reading the tables through the version
+// of the storage they pinned as they started.
+type SSTStorage struct {
+	ctx context.Context
+	// opts are the options the storage was created with.
+	opts Options
+	// idxrGntr is the indexer generator used to index
+	// every table and log segment.
+	idxrGntr indexer.IndexerGenerator
+	// ids hands out the ids of the tables and log segments
+	// the storage creates.
+	ids *segment.IDs
+	// strategy decides the compactions of the tables.
+	strategy compaction.Strategy
+	// cmp orders the keys of the memtables and tables.
+	cmp comparator.Comparator
+	// wl is the write lock, serialising the writes of the
+	// storage. It guards the log segments and the fields
+	// which aren't otherwise guarded.
+	wl sync.Mutex
+	// l guards what queries look at. Queries hold it for
+	// reading while they pin the current version and pick
+	// up the memtables. The memtables, flushedSeq, the
+	// levels and the current version are only changed with
+	// both wl and l held, so either of them is enough to
+	// read those.
+	l sync.RWMutex
+	// versions hold the current version of the levels,
+	// which queries look through.
+	versions versionSet
+	// mem holds the data written since the last flush.
+	mem memtable
+	// imm is the memtable being flushed, if any.
+	imm memtable
+	// immWALs are the log segments holding the data of
+	// imm, which are removed once it's flushed.
+	immWALs []*segment.Segment
+	// flushedSeq is the sequence number of the last record
+	// flushed to a table.
+	flushedSeq uint64
+	// wal is the log segment every write is appended to
+	// before it's applied to the memtable.
+	wal *segment.Segment
+	// oldWALs are the log segments of a previous run whose
+	// data was replayed into the memtable. They are removed
+	// along with wal once the memtable is flushed.
+	oldWALs []*segment.Segment
+	// levels hold the tables of every level. Level 0 is
+	// ordered newest first and every other level by key.
+	levels [][]*segment.Segment
+	// scheduler runs the flushes and compactions of the
+	// storage in the background.
+	scheduler *scheduler.Scheduler
+	// limiter limits the rate at which compactions write.
+	limiter *scheduler.RateLimiter
+	// values is the value log the records past the value
+	// threshold are separated into, or nil.
+	values *valueLog
+	// wc holds back writes while flushes and compactions
+	// fall behind.
+	wc *writeController
+	// bgErr is the error the first failed flush or
+	// compaction returned.
+	bgErr error
+	// closed is set once the storage is closed.
+	closed bool
+}
+
+var (
+	_ (Storage) = (*SSTStorage)(nil)
+	_ (Scanner) = (*SSTStorage)(nil)
+)
+
+// NewSSTStorage creates a new instance of SSTStorage.
+//
+// The tables listed in the manifest of the directory of
+// the storage are loaded and any log segments left over
+// from a previous run are replayed into the memtable.
+//
+// ErrComparatorMismatch is returned if the tables are
+// ordered by a comparator other than the one of the
+// options.
+func NewSSTStorage(ctx context.Context,
+	idxrGntr indexer.IndexerGenerator,
+	opts Options,
+) (*SSTStorage, error) {
+	walDir := filepath.Join(opts.Dir, walDirName)
+	err := opts.fs().MkdirAll(walDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := readManifest(opts.fs(), opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	cmp := opts.comparator()
+	if m.Comparator == "" && len(m.Levels) > 0 {
+		m.Comparator = comparator.Bytewise.Name()
+	}
+	if m.Comparator != "" && m.Comparator != cmp.Name() {
+		return nil, ErrComparatorMismatch
+	}
+	idxrGntr = opts.indexerGenerator(idxrGntr)
+
+	s := &SSTStorage{
+		ctx:      ctx,
+		opts:     opts,
+		idxrGntr: idxrGntr,
+		ids:      segment.NewIDs(opts.clock()),
+		strategy: opts.compactionStrategy(),
+		cmp:      cmp,
+		mem:      newMemtable(opts),
+	}
+	s.wc = newWriteController(&s.wl, opts)
+
+	seq := m.Sequence
+	s.flushedSeq = m.Sequence
+	inManifest := make(map[int64]bool)
+	for level, ids := range m.Levels {
+		s.levels = append(s.levels, nil)
+		for _, id := range ids {
+			s.ids.Observe(id)
+			sg, err := segment.OpenSegmentWithComparator(opts.fs(), opts.Dir, id, 0, idxrGntr.Generate(), cmp)
+			if err != nil {
+				return nil, err
+			}
+			if sg.Sequence() > seq {
+				seq = sg.Sequence()
+			}
+
+			s.levels[level] = append(s.levels[level], sg)
+			inManifest[id] = true
+		}
+	}
+
+	err = s.versions.install(s.levels)
+	if err != nil {
+		return nil, err
+	}
+
+	// The comparator is recorded before anything is
+	// ordered by it.
+	if m.Comparator == "" {
+		err = s.writeManifest()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ids, err := segment.ListSegmentIDs(opts.fs(), opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if !inManifest[id] {
+			err = segment.RemoveSegment(opts.fs(), opts.Dir, id)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// The value log is opened first so that the records
+	// replayed can be checked against it.
+	s.values, err = openValueLog(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err = segment.ListSegmentIDs(opts.fs(), walDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		s.ids.Observe(id)
+		wal, err := segment.OpenSegment(opts.fs(), walDir, id, seq, idxrGntr.Generate())
+		if err != nil {
+			return nil, err
+		}
+
+		err = s.replay(wal)
+		if err != nil {
+			return nil, err
+		}
+		seq = wal.Sequence()
+		s.oldWALs = append(s.oldWALs, wal)
+	}
+
+	s.wal, err = segment.CreateSegment(opts.fs(), walDir, s.ids, seq, idxrGntr.Generate())
+	if err != nil {
+		return nil, err
+	}
+
+	s.scheduler = opts.newScheduler(ctx)
+	s.wc.scheduler = s.scheduler
+	s.limiter = opts.compactionRateLimiter()
+
+	// The replayed data may already fill the memtable and
+	// the tables loaded may be due for a compaction, as may
+	// the value log for a collection.
+	err = s.maybeFlush()
+	if err == nil {
+		err = s.scheduleCompaction()
+	}
+	if err == nil && s.values.sealed() {
+		err = s.scheduleValueLogGC()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Append appends the data to the write-ahead log and
+// stores it in the memtable, flushing the memtable if
+// it's full.
+//
+// Data past the value threshold is written to the value
+// log, and the memtable holds a record pointing at it.
+func (s *SSTStorage) Append(key, data []byte) error {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+
+	err := s.checkWritable()
+	if err == nil {
+		err = s.wc.wait(s.writeStall, s.checkWritable)
+	}
+	if err != nil {
+		return err
+	}
+
+	record, rotated, err := s.values.separate(string(key), string(data))
+	if err != nil {
+		return err
+	}
+	err = s.put(string(key), record)
+	if err == nil && rotated {
+		err = s.scheduleValueLogGC()
+	}
+	return err
+}
+
+// put appends the record of the key to the write-ahead
+// log and stores it in the memtable. It must be called
+// with wl held.
+func (s *SSTStorage) put(key, record string) error {
+	err := s.wal.Append(key, record)
+	if err != nil {
+		return err
+	}
+
+	s.mem.put(key, memtableEntry{
+		data: record,
+		seq:  s.wal.Sequence(),
+	})
+	return s.maybeFlush()
+}
+
+// Query returns the most recent data stored for the key,
+// looking in the memtable and the immutable memtable, then
+// the level 0 tables from the newest to the oldest and then
+// the single table of every other level whose key range
+// holds the key.
+//
+// The tables are looked through in the version pinned by
+// the query, so they stay readable even if a compaction
+// makes them obsolete meanwhile. Data the record found
+// only points at is read from the value log.
+func (s *SSTStorage) Query(key []byte) (string, error) {
+	return s.values.query(func() (string, error) {
+		return s.get(string(key))
+	})
+}
+
+// get returns the most recent record of the key.
+func (s *SSTStorage) get(key string) (string, error) {
+	s.l.RLock()
+	if s.closed {
+		s.l.RUnlock()
+		return "", ErrStorageClosed
+	}
+	mems := []memtable{s.mem, s.imm}
+	v := s.versions.pin()
+	s.l.RUnlock()
+
+	data, err := s.query(v, mems, key)
+	unpinErr := s.versions.unpin(v)
+	if err == nil {
+		err = unpinErr
+	}
+	return data, err
+}
+
+// query looks for the key in the memtables and then the
+// tables of the version.
+func (s *SSTStorage) query(v *version, mems []memtable, k string) (string, error) {
+	for _, mem := range mems {
+		if mem == nil {
+			continue
+		}
+		if e, ok := mem.get(k); ok {
+			if e.tombstone {
+				return "", ErrDataNotFound
+			}
+			return e.data, nil
+		}
+	}
+
+	for level, tables := range v.levels {
+		if level == 0 {
+			for _, sg := range tables {
+				data, found, err := queryTable(sg, k)
+				if found || err != nil {
+					return data, err
+				}
+			}
+			continue
+		}
+
+		i := sort.Search(len(tables), func(i int) bool {
+			_, maxKey := tables[i].KeyRange()
+			return s.cmp.Compare(maxKey, k) >= 0
+		})
+		if i < len(tables) {
+			data, found, err := queryTable(tables[i], k)
+			if found || err != nil {
+				return data, err
+			}
+		}
+	}
+
+	return "", ErrDataNotFound
+}
+
+// Scan calls fn with the keys from start up to but not
+// including end and their most recent data, in the order
+// of the comparator of the storage, until fn returns false.
+//
+// The memtable and the immutable memtable are merged with
+// the tables of the version pinned by the scan, the newest
+// record of every key shadowing the older ones. Keys whose
+// most recent record is a tombstone are left out.
+func (s *SSTStorage) Scan(start, end []byte, fn func(key []byte, data string) bool) error {
+	s.l.RLock()
+	if s.closed {
+		s.l.RUnlock()
+		return ErrStorageClosed
+	}
+	mems := []memtable{s.mem, s.imm}
+	v := s.versions.pin()
+	s.l.RUnlock()
+
+	err := s.scan(v, mems, start, end, fn)
+	unpinErr := s.versions.unpin(v)
+	if err == nil {
+		err = unpinErr
+	}
+	return err
+}
+
+// scan merges the memtables and the tables of the version
+// for Scan. The level 0 tables are added from the newest to
+// the oldest, and every level is newer than the ones below.
+func (s *SSTStorage) scan(
+	v *version,
+	mems []memtable,
+	start, end []byte,
+	fn func(key []byte, data string) bool,
+) error {
+	m := newScanMerge(s.cmp, start, end)
+	for _, mem := range mems {
+		m.addMemtable(mem)
+	}
+	for _, tables := range v.levels {
+		for _, sg := range tables {
+			err := m.addSegment(sg)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return m.run(s.values, s.Query, fn)
+}
+
+// Delete appends a tombstone for the key to the
+// write-ahead log and stores it in the memtable.
+//
+// The tombstone travels down the levels with the
+// compactions, shadowing the older records of the key,
+// until it reaches the last level holding any data.
+func (s *SSTStorage) Delete(key []byte) error {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+
+	err := s.checkWritable()
+	if err == nil {
+		err = s.wc.wait(s.writeStall, s.checkWritable)
+	}
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(dataobject.NewTombstone(key))
+	if err != nil {
+		return err
+	}
+
+	e := segment.Entry{
+		Key:       string(key),
+		Sequence:  s.wal.Sequence() + 1,
+		Tombstone: true,
+	}
+	err = s.wal.AppendRecord(e, string(data))
+	if err != nil {
+		return err
+	}
+
+	s.mem.put(e.Key, memtableEntry{
+		data:      string(data),
+		seq:       e.Sequence,
+		tombstone: true,
+	})
+	return s.maybeFlush()
+}
+
+// Sync commits the records of the memtables to disk by
+// syncing their log segments, after the values they point
+// at in the value log. The tables were committed as they
+// were written.
+func (s *SSTStorage) Sync() error {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+
+	err := s.checkWritable()
+	if err != nil {
+		return err
+	}
+
+	err = s.values.sync()
+	if err != nil {
+		return err
+	}
+	return s.syncWALs()
+}
+
+// PauseBackgroundWork stops any more flushes and
+// compactions from being started until
+// ResumeBackgroundWork is called.
+func (s *SSTStorage) PauseBackgroundWork() {
+	s.scheduler.Pause()
+}
+
+// ResumeBackgroundWork lets flushes and compactions be
+// started again.
+func (s *SSTStorage) ResumeBackgroundWork() {
+	s.scheduler.Resume()
+}
+
+// ValueLogGC collects the files of the value log with
+// enough garbage in them right away, rather than once the
+// value log moves on to a new file. It does nothing if the
+// storage has no value log.
+func (s *SSTStorage) ValueLogGC() error {
+	s.wl.Lock()
+	err := s.checkWritable()
+	s.wl.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.collectValueLog(s.ctx)
+}
+
+// Close stops the flushes and compactions of the storage,
+// waiting for the running ones to be abandoned, and closes
+// the tables, log segments and the value log. The data of
+// the memtables is replayed from the log segments on the
+// next start. It returns the error a background job failed
+// with, if any.
+func (s *SSTStorage) Close() error {
+	s.wl.Lock()
+	if s.closed {
+		s.wl.Unlock()
+		return nil
+	}
+	s.l.Lock()
+	s.closed = true
+	s.l.Unlock()
+	s.wl.Unlock()
+	s.wc.signal()
+
+	// The scheduler is closed without holding the locks
+	// as the running jobs need them to finish. The queries
+	// still reading the tables are waited for before the
+	// tables are closed.
+	bgErr := s.scheduler.Close()
+	s.versions.wait()
+
+	s.wl.Lock()
+	defer s.wl.Unlock()
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	segments := append([]*segment.Segment{s.wal}, s.oldWALs...)
+	segments = append(segments, s.immWALs...)
+	for _, tables := range s.levels {
+		segments = append(segments, tables...)
+	}
+	for _, sg := range segments {
+		err := sg.Close()
+		if err != nil {
+			return err
+		}
+	}
+	err := s.values.close()
+	if err != nil {
+		return err
+	}
+	return bgErr
+}
+
+// Stats returns the sizes of the tables of the storage
+// along with their levels.
+func (s *SSTStorage) Stats() Stats {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+
+	var stats Stats
+	for level, tables := range s.levels {
+		for _, sg := range tables {
+			stats.Segments = append(stats.Segments, SegmentStats{
+				ID:               sg.ID(),
+				Level:            level,
+				Size:             sg.Size(),
+				LiveBytes:        sg.Size() - sg.DeadBytes(),
+				DeadBytes:        sg.DeadBytes(),
+				GarbageRatio:     sg.GarbageRatio(),
+				IndexMemoryUsage: sg.IndexMemoryUsage(),
+			})
+		}
+	}
+
+	stats.PendingCompactionBytes = s.strategy.PendingBytes(s.tables())
+	stats.ValueLogSize = s.values.size()
+	stats.WriteStall = s.writeStall()
+	stats.StalledWrites = s.wc.stalledWrites
+	stats.StallDuration = s.wc.stallDuration
+	return stats
+}
+
+// replay applies the records of a log segment left over
+// from a previous run to the memtable, but for those whose
+// value didn't survive the crash the run ended with.
+func (s *SSTStorage) replay(wal *segment.Segment) error {
+	entries, err := wal.Entries()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		data, err := wal.ReadEntry(e)
+		if err != nil {
+			return err
+		}
+		ok, _, err := s.values.recovered(data)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		s.mem.put(e.Key, memtableEntry{
+			data:      data,
+			seq:       e.Sequence,
+			tombstone: e.Tombstone,
+		})
+	}
+	return nil
+}
+
+// checkWritable returns the error the storage can't be
+// written to with, if any.
+//
+// A failed flush or compaction leaves the storage as it
+// was before it, but the failure is reported on the
+// following writes so that it isn't silently ignored.
+func (s *SSTStorage) checkWritable() error {
+	if s.closed {
+		return ErrStorageClosed
+	}
+	return s.bgErr
+}
+
+// writeStall returns how writes are to be held back.
+//
+// Writes are blocked while the memtable is full and the
+// previous one is still being flushed, and are otherwise
+// held back according to the level 0 tables and the bytes
+// the strategy has yet to compact.
+func (s *SSTStorage) writeStall() WriteStall {
+	if s.imm != nil && s.mem.size() >= s.opts.memtableSize() {
+		return WriteStallStop
+	}
+
+	var l0 int
+	if len(s.levels) > 0 {
+		l0 = len(s.levels[0])
+	}
+	return s.wc.state(l0, s.strategy.PendingBytes(s.tables()))
+}
+
+// failBackgroundJob records the error a flush or compaction
+// failed with, which is then returned by the following
+// writes, and wakes the writers held back by the storage.
+// The error of a job abandoned as the storage is closed
+// isn't recorded.
+func (s *SSTStorage) failBackgroundJob(ctx context.Context, err error) error {
+	s.wl.Lock()
+	if ctx.Err() == nil && s.bgErr == nil {
+		s.bgErr = err
+	}
+	s.wl.Unlock()
+
+	s.wc.signal()
+	return err
+}
+
+// maybeFlush sets the memtable aside to be flushed in the
+// background once it's full, unless another memtable is
+// still being flushed.
+//
+// The writes carry on to a new memtable and log segment
+// meanwhile. The values the memtable points at are
+// committed first, as its log segments are removed once
+// it's flushed. It must be called with wl held.
+func (s *SSTStorage) maybeFlush() error {
+	if s.imm != nil || s.mem.size() < s.opts.memtableSize() {
+		return nil
+	}
+
+	err := s.values.sync()
+	if err != nil {
+		return err
+	}
+
+	wal, err := segment.CreateSegment(s.opts.fs(), filepath.Join(s.opts.Dir, walDirName), s.ids, s.wal.Sequence(), s.idxrGntr.Generate())
+	if err != nil {
+		return err
+	}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.imm = s.mem
+	s.immWALs = append(s.oldWALs, s.wal)
+	s.mem = newMemtable(s.opts)
+	s.wal = wal
+	s.oldWALs = nil
+
+	_, err = s.scheduler.Schedule("flush", s.flushJob)
+	return err
+}
+
+// scheduleValueLogGC schedules a collection of the value
+// log in the background, unless one is already pending.
+func (s *SSTStorage) scheduleValueLogGC() error {
+	_, err := s.scheduler.Schedule("valuelog-gc", s.valueLogGCJob)
+	return err
+}
+
+// valueLogGCJob is the background job collecting the
+// value log, while flushes and compactions carry on. It
+// only holds the write lock of the storage to rewrite the
+// values it moves and to sync.
+func (s *SSTStorage) valueLogGCJob(ctx context.Context) error {
+	err := s.collectValueLog(ctx)
+	if err == ErrStorageClosed {
+		return nil
+	}
+	if err != nil {
+		return s.failBackgroundJob(ctx, err)
+	}
+	return nil
+}
+
+// collectValueLog collects the value log, writing the
+// records pointing at the values it moves like any other
+// write. It takes wl as it needs it.
+func (s *SSTStorage) collectValueLog(ctx context.Context) error {
+	return s.values.collect(ctx, &s.wl, s.checkWritable, s.get, s.put, s.syncWALs)
+}
+
+// syncWALs syncs the log segments of the memtables and
+// must be called with wl held.
+func (s *SSTStorage) syncWALs() error {
+	for _, wal := range append([]*segment.Segment{s.wal}, append(s.oldWALs, s.immWALs...)...) {
+		err := wal.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scheduleCompaction schedules the compactions picked by
+// the strategy in the background, unless they're already
+// pending.
+func (s *SSTStorage) scheduleCompaction() error {
+	_, err := s.scheduler.Schedule("compaction", s.compactionJob)
+	return err
+}
+
+// flushJob is the background job flushing the immutable
+// memtable, and any memtable which filled up meanwhile.
+func (s *SSTStorage) flushJob(ctx context.Context) error {
+	for {
+		s.l.RLock()
+		imm := s.imm
+		s.l.RUnlock()
+
+		if imm == nil || ctx.Err() != nil {
+			return nil
+		}
+
+		err := s.flush(imm)
+		if err != nil {
+			return s.failBackgroundJob(ctx, err)
+		}
+	}
+}
+
+// flush writes the immutable memtable out as a new level 0
+// table and removes the log segments holding its data.
+//
+// The table is written without holding the locks of the
+// storage, as nothing but this flush changes imm. The
+// table is added to the manifest before the log segments
+// are removed, so a crash in between replays data which
+// is already in a table, which is harmless.
+func (s *SSTStorage) flush(imm memtable) error {
+	table, err := segment.CreateSegmentWithComparator(s.opts.fs(), s.opts.Dir, s.ids, 0, s.idxrGntr.Generate(), s.cmp)
+	if err != nil {
+		return err
+	}
+
+	var seq uint64
+	imm.ascend(func(key string, e memtableEntry) bool {
+		err = table.AppendRecord(segment.Entry{
+			Key:       key,
+			Sequence:  e.seq,
+			Tombstone: e.tombstone,
+		}, e.data)
+		if e.seq > seq {
+			seq = e.seq
+		}
+		return err == nil
+	})
+	if err != nil {
+		table.Remove()
+		return err
+	}
+
+	err = table.Seal()
+	if err != nil {
+		table.Remove()
+		return err
+	}
+
+	s.wl.Lock()
+	defer s.wl.Unlock()
+	defer s.wc.signal()
+
+	err = s.installFlush(table, seq)
+	if err != nil {
+		return err
+	}
+
+	err = s.maybeFlush()
+	if err != nil {
+		return err
+	}
+	return s.scheduleCompaction()
+}
+
+// installFlush puts the table flushed from the immutable
+// memtable in front of level 0 and drops the memtable along
+// with its log segments.
+func (s *SSTStorage) installFlush(table *segment.Segment, seq uint64) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if len(s.levels) == 0 {
+		s.levels = append(s.levels, nil)
+	}
+	s.levels[0] = append([]*segment.Segment{table}, s.levels[0]...)
+	if seq > s.flushedSeq {
+		s.flushedSeq = seq
+	}
+
+	err := s.writeManifest()
+	if err != nil {
+		return err
+	}
+
+	err = s.versions.install(s.levels)
+	if err != nil {
+		return err
+	}
+
+	for _, wal := range s.immWALs {
+		err = wal.Remove()
+		if err != nil {
+			return err
+		}
+	}
+	s.imm = nil
+	s.immWALs = nil
+	return nil
+}
+
+// compactionJob is the background job running the
+// compactions picked by the strategy of the storage until
+// it picks none.
+//
+// Only one compaction job runs at a time, so the tables
+// picked for a compaction aren't changed by anything but
+// the compaction itself. Flushes only add tables in front
+// of level 0 meanwhile.
+func (s *SSTStorage) compactionJob(ctx context.Context) error {
+	for {
+		s.wl.Lock()
+		if s.closed {
+			s.wl.Unlock()
+			return nil
+		}
+		c, ok := s.strategy.Pick(s.tables(), s.cmp)
+		if !ok {
+			s.wl.Unlock()
+			return nil
+		}
+
+		s.l.Lock()
+		for len(s.levels) <= c.OutputLevel {
+			s.levels = append(s.levels, nil)
+		}
+		s.l.Unlock()
+		inputs, _ := pickTables(s.levels[c.Level], c.Inputs)
+		overlaps, _ := pickTables(s.levels[c.OutputLevel], c.Overlaps)
+		opts := mergecompaction.Options{
+			DropTombstones: s.isBottommost(c),
+			TargetSize:     c.TargetTableSize,
+			Filter:         s.opts.CompactionFilter,
+			Resolve:        s.values.resolveForFilter,
+			Limiter:        s.limiter,
+			Comparator:     s.cmp,
+			FS:             s.opts.fs(),
+			IDs:            s.ids,
+		}
+		s.wl.Unlock()
+
+		merged, err := mergecompaction.MergeSorted(
+			ctx,
+			s.opts.Dir,
+			append(inputs, overlaps...),
+			s.idxrGntr,
+			opts,
+		)
+		if err != nil {
+			return s.failBackgroundJob(ctx, err)
+		}
+
+		err = s.installCompaction(c, inputs, overlaps, merged)
+		if err != nil {
+			return s.failBackgroundJob(ctx, err)
+		}
+	}
+}
+
+// installCompaction puts the merged tables of the
+// compaction in place of its inputs and overlaps.
+//
+// The manifest is updated before the merged tables are
+// removed, so a crash in between leaves either the merged
+// tables or the new ones in use and the others behind as
+// leftovers. The replaced tables are made obsolete, and
+// are only removed once no query is left reading them.
+func (s *SSTStorage) installCompaction(
+	c compaction.Compaction,
+	inputs, overlaps, merged []*segment.Segment,
+) error {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+	defer s.wc.signal()
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	_, position := pickTables(s.levels[c.Level], c.Inputs)
+	s.levels[c.Level] = withoutTables(s.levels[c.Level], inputs)
+	if c.OutputLevel == c.Level {
+		level := append([]*segment.Segment{}, s.levels[c.Level][:position]...)
+		level = append(level, merged...)
+		s.levels[c.Level] = append(level, s.levels[c.Level][position:]...)
+	} else {
+		level := append(withoutTables(s.levels[c.OutputLevel], overlaps), merged...)
+		sort.Slice(level, func(i, j int) bool {
+			minI, _ := level[i].KeyRange()
+			minJ, _ := level[j].KeyRange()
+			return s.cmp.Compare(minI, minJ) < 0
+		})
+		s.levels[c.OutputLevel] = level
+	}
+
+	err := s.writeManifest()
+	if err != nil {
+		return err
+	}
+
+	err = s.versions.install(s.levels)
+	if err != nil {
+		return err
+	}
+
+	for _, sg := range append(inputs, overlaps...) {
+		err = sg.Obsolete()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isBottommost reports whether no table outside the
+// compaction is older than its output, in which case
+// the tombstones can be dropped from it.
+func (s *SSTStorage) isBottommost(c compaction.Compaction) bool {
+	for level := c.OutputLevel + 1; level < len(s.levels); level++ {
+		if len(s.levels[level]) > 0 {
+			return false
+		}
+	}
+
+	if c.OutputLevel > 0 {
+		return true
+	}
+
+	oldest := s.levels[0][len(s.levels[0])-1]
+	for _, t := range c.Inputs {
+		if t.ID == oldest.ID() {
+			return true
+		}
+	}
+	return false
+}
+
+// tables describes the tables of every level for the
+// compaction strategy.
+func (s *SSTStorage) tables() [][]compaction.Table {
+	levels := make([][]compaction.Table, len(s.levels))
+	for level, tables := range s.levels {
+		for _, sg := range tables {
+			minKey, maxKey := sg.KeyRange()
+			levels[level] = append(levels[level], compaction.Table{
+				ID:     sg.ID(),
+				Size:   sg.Size(),
+				MinKey: minKey,
+				MaxKey: maxKey,
+			})
+		}
+	}
+	return levels
+}
+
+// writeManifest records the current levels of the storage
+// in its manifest.
+func (s *SSTStorage) writeManifest() error {
+	m := manifest{
+		Comparator: s.cmp.Name(),
+		Sequence:   s.flushedSeq,
+		Levels:     make([][]int64, len(s.levels)),
+	}
+	for level, tables := range s.levels {
+		m.Levels[level] = []int64{}
+		for _, sg := range tables {
+			m.Levels[level] = append(m.Levels[level], sg.ID())
+		}
+	}
+
+	return writeManifest(s.opts.fs(), s.opts.Dir, m)
+}
+
+// queryTable queries a single table for the key. found
+// is false if the table holds no record of the key, in
+// which case older tables must be looked at.
+func queryTable(sg *segment.Segment, key string) (string, bool, error) {
+	data, err := sg.Query(key)
+	switch err {
+	case nil:
+		return data, true, nil
+	case segment.ErrDataDoesntExistInSegment:
+		return "", false, nil
+	case segment.ErrDataDeletedInSegment:
+		return "", true, ErrDataNotFound
+	default:
+		return "", true, err
+	}
+}
+
+// pickTables returns the segments of the level that are
+// described by the tables, in the order of the level,
+// along with the position of the first of them.
+func pickTables(level []*segment.Segment, tables []compaction.Table) ([]*segment.Segment, int) {
+	ids := make(map[int64]bool)
+	for _, t := range tables {
+		ids[t.ID] = true
+	}
+
+	var (
+		picked   []*segment.Segment
+		position = -1
+	)
+	for i, sg := range level {
+		if ids[sg.ID()] {
+			picked = append(picked, sg)
+			if position == -1 {
+				position = i
+			}
+		}
+	}
+	return picked, position
+}
+
+// withoutTables returns the segments of the level except
+// the removed ones.
+func withoutTables(level, removed []*segment.Segment) []*segment.Segment {
+	var kept []*segment.Segment
+	for _, sg := range level {
+		isRemoved := false
+		for _, r := range removed {
+			if sg == r {
+				isRemoved = true
+				break
+			}
+		}
+		if !isRemoved {
+			kept = append(kept, sg)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,375 @@
+package storage
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	_map "github.com/SystemBuilders/KeyValueStore/internal/indexer/map"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/compaction"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/comparator"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSSTStorage_Reopen ensures that data which was only
+// in the write-ahead log, as well as data flushed to
+// tables, is served after the storage is created again.
+func TestSSTStorage_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{Dir: dir, MemtableSize: 256}
+
+	s, err := NewSSTStorage(context.Background(), _map.NewMapIndexerGenerator(), opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 30; i++ {
+		key := "key" + strconv.Itoa(i%11)
+		assert.Nil(t, s.Append([]byte(key), record(t, key, "value"+strconv.Itoa(i))))
+	}
+	assert.Nil(t, s.Delete([]byte("key0")))
+	s.scheduler.Wait()
+	assert.NotEmpty(t, s.Stats().Segments)
+
+	// The flushes are done, so this is only in the
+	// write-ahead log and the memtable.
+	assert.Nil(t, s.Append([]byte("last"), record(t, "last", "value")))
+	assert.NotZero(t, s.mem.len())
+	assert.Nil(t, s.Close())
+
+	reopened, err := NewSSTStorage(context.Background(), _map.NewMapIndexerGenerator(), opts)
+	assert.Nil(t, err)
+	defer reopened.Close()
+	assert.Equal(t, s.wal.Sequence(), reopened.wal.Sequence())
+
+	for i := 19; i < 30; i++ {
+		key := "key" + strconv.Itoa(i%11)
+		data, err := reopened.Query([]byte(key))
+		if key == "key0" {
+			assert.Equal(t, ErrDataNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, string(record(t, key, "value"+strconv.Itoa(i))), data)
+	}
+}
+
+// TestSSTStorage_Compaction ensures that the data stays
+// correct through the compactions of both strategies and
+// that deleted keys aren't found again.
+func TestSSTStorage_Compaction(t *testing.T) {
+	strategies := []func() compaction.Strategy{
+		func() compaction.Strategy {
+			st := compaction.NewSizeTiered()
+			st.MinThreshold = 2
+			return st
+		},
+		func() compaction.Strategy {
+			l := compaction.NewLeveled()
+			l.L0Trigger = 2
+			l.BaseLevelSize = 1 << 10
+			l.TargetTableSize = 512
+			return l
+		},
+	}
+
+	for _, strategy := range strategies {
+		opts := Options{
+			Dir:                t.TempDir(),
+			MemtableSize:       512,
+			CompactionStrategy: strategy(),
+		}
+		t.Run(opts.CompactionStrategy.Name(), func(t *testing.T) {
+			s, err := NewSSTStorage(context.Background(), _map.NewMapIndexerGenerator(), opts)
+			assert.Nil(t, err)
+
+			latest := make(map[string]string)
+			for i := 0; i < 500; i++ {
+				key := "key" + strconv.Itoa(i*7%53)
+				if i%9 == 0 {
+					assert.Nil(t, s.Delete([]byte(key)))
+					delete(latest, key)
+					continue
+				}
+
+				data := record(t, key, "value"+strconv.Itoa(i))
+				assert.Nil(t, s.Append([]byte(key), data))
+				latest[key] = string(data)
+			}
+
+			s.scheduler.Wait()
+			stats := s.Stats()
+			assert.Nil(t, s.Close())
+
+			reopened, err := NewSSTStorage(context.Background(), _map.NewMapIndexerGenerator(), opts)
+			assert.Nil(t, err)
+			defer reopened.Close()
+			reopened.scheduler.Wait()
+			assert.Equal(t, len(stats.Segments), len(reopened.Stats().Segments))
+
+			for i := 0; i < 53; i++ {
+				key := "key" + strconv.Itoa(i)
+				data, err := reopened.Query([]byte(key))
+				if expected, ok := latest[key]; ok {
+					assert.Nil(t, err)
+					assert.Equal(t, expected, data)
+				} else {
+					assert.Equal(t, ErrDataNotFound, err)
+				}
+			}
+		})
+	}
+}
+
+// TestSSTStorage_Comparator ensures that the tables of a
+// storage are ordered by its comparator through flushes
+// and compactions, and that it can't be opened again with
+// another comparator.
+func TestSSTStorage_Comparator(t *testing.T) {
+	strategy := compaction.NewLeveled()
+	strategy.L0Trigger = 2
+	strategy.BaseLevelSize = 1 << 10
+	strategy.TargetTableSize = 512
+
+	cmp := comparator.Reverse(comparator.Bytewise)
+	opts := Options{
+		Dir:                t.TempDir(),
+		MemtableSize:       512,
+		CompactionStrategy: strategy,
+		Comparator:         cmp,
+	}
+
+	s, err := NewSSTStorage(context.Background(), _map.NewMapIndexerGenerator(), opts)
+	assert.Nil(t, err)
+
+	latest := make(map[string]string)
+	for i := 0; i < 300; i++ {
+		key := "key" + strconv.Itoa(i*7%61)
+		data := record(t, key, "value"+strconv.Itoa(i))
+		assert.Nil(t, s.Append([]byte(key), data))
+		latest[key] = string(data)
+	}
+	s.scheduler.Wait()
+
+	s.l.RLock()
+	levels := s.levels
+	s.l.RUnlock()
+	assert.True(t, len(levels) > 1)
+	for level, tables := range levels {
+		for i, sg := range tables {
+			minKey, maxKey := sg.KeyRange()
+			assert.True(t, cmp.Compare(minKey, maxKey) <= 0)
+			if level > 0 && i > 0 {
+				_, prevMax := tables[i-1].KeyRange()
+				assert.True(t, cmp.Compare(prevMax, minKey) < 0, "level %d is out of order", level)
+			}
+		}
+	}
+
+	for key, expected := range latest {
+		data, err := s.Query([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, data)
+	}
+	assert.Nil(t, s.Close())
+
+	m, err := readManifest(opts.fs(), opts.Dir)
+	assert.Nil(t, err)
+	assert.Equal(t, "reverse(bytewise)", m.Comparator)
+
+	_, err = NewSSTStorage(context.Background(), _map.NewMapIndexerGenerator(), Options{Dir: opts.Dir})
+	assert.Equal(t, ErrComparatorMismatch, err)
+
+	opts.CompactionStrategy = nil
+	reopened, err := NewSSTStorage(context.Background(), _map.NewMapIndexerGenerator(), opts)
+	assert.Nil(t, err)
+	defer reopened.Close()
+
+	data, err := reopened.Query([]byte("key0"))
+	assert.Nil(t, err)
+	assert.Equal(t, latest["key0"], data)
+}
+
+// TestSSTStorage_Scan ensures that a scan merges the
+// memtables with the tables of every level in the order of
+// the comparator of the storage, the most recent data of a
+// key shadowing the older data and deleted keys left out.
+func TestSSTStorage_Scan(t *testing.T) {
+	strategy := compaction.NewLeveled()
+	strategy.L0Trigger = 2
+	strategy.BaseLevelSize = 1 << 10
+	strategy.TargetTableSize = 512
+
+	cmp := comparator.Reverse(comparator.Bytewise)
+	opts := Options{
+		Dir:                t.TempDir(),
+		MemtableSize:       512,
+		CompactionStrategy: strategy,
+		Comparator:         cmp,
+		ValueThreshold:     48,
+	}
+
+	s, err := NewSSTStorage(context.Background(), _map.NewMapIndexerGenerator(), opts)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	latest := make(map[string]string)
+	for i := 0; i < 300; i++ {
+		key := "key" + strconv.Itoa(i*7%61)
+		data := record(t, key, "value"+strconv.Itoa(i))
+		assert.Nil(t, s.Append([]byte(key), data))
+		latest[key] = string(data)
+	}
+	s.scheduler.Wait()
+	for i := 0; i < 61; i += 5 {
+		key := "key" + strconv.Itoa(i)
+		assert.Nil(t, s.Delete([]byte(key)))
+		delete(latest, key)
+	}
+	// This is only in the memtable and shadows the data
+	// of the key in the tables.
+	assert.Nil(t, s.Append([]byte("key1"), record(t, "key1", "last")))
+	latest["key1"] = string(record(t, "key1", "last"))
+
+	s.l.RLock()
+	levels := s.levels
+	s.l.RUnlock()
+	assert.True(t, len(levels) > 1)
+
+	var keys []string
+	assert.Nil(t, s.Scan(nil, nil, func(key []byte, data string) bool {
+		if len(keys) > 0 {
+			assert.True(t, cmp.Compare(keys[len(keys)-1], string(key)) < 0)
+		}
+		keys = append(keys, string(key))
+		assert.Equal(t, latest[string(key)], data)
+		return true
+	}))
+	assert.Equal(t, len(latest), len(keys))
+
+	keys = nil
+	assert.Nil(t, s.Scan([]byte("key3"), []byte("key1"), func(key []byte, _ string) bool {
+		keys = append(keys, string(key))
+		return true
+	}))
+	assert.Equal(t, []string{"key3", "key29", "key28", "key27", "key26", "key24", "key23", "key22", "key21", "key2", "key19", "key18", "key17", "key16", "key14", "key13", "key12", "key11"}, keys)
+}
+
+// TestSSTStorage_BackgroundWork ensures that no flush is
+// run while background work is paused, that the data is
+// served from the immutable memtable meanwhile and that
+// the storage can't be used once it's closed.
+func TestSSTStorage_BackgroundWork(t *testing.T) {
+	opts := Options{Dir: t.TempDir(), MemtableSize: 256, CompactionRateLimit: 1 << 20}
+	s, err := NewSSTStorage(context.Background(), _map.NewMapIndexerGenerator(), opts)
+	assert.Nil(t, err)
+
+	s.PauseBackgroundWork()
+	for i := 0; s.imm == nil; i++ {
+		key := "key" + strconv.Itoa(i)
+		assert.Nil(t, s.Append([]byte(key), record(t, key, "value")))
+	}
+	assert.Empty(t, s.Stats().Segments)
+
+	data, err := s.Query([]byte("key0"))
+	assert.Nil(t, err)
+	assert.Equal(t, string(record(t, "key0", "value")), data)
+
+	s.ResumeBackgroundWork()
+	s.scheduler.Wait()
+	assert.NotEmpty(t, s.Stats().Segments)
+
+	assert.Nil(t, s.Close())
+	assert.Nil(t, s.Close())
+	assert.Equal(t, ErrStorageClosed, s.Append([]byte("key"), record(t, "key", "value")))
+	_, err = s.Query([]byte("key0"))
+	assert.Equal(t, ErrStorageClosed, err)
+}
+
+// TestSSTStorage_WriteStall ensures that writes are slowed
+// down and then blocked as level 0 tables pile up or while
+// the memtable can't be flushed, that they carry on once
+// the background work catches up and that closing the
+// storage releases them.
+func TestSSTStorage_WriteStall(t *testing.T) {
+	st := compaction.NewSizeTiered()
+	st.MinThreshold = 1000
+	opts := Options{
+		Dir:                t.TempDir(),
+		MemtableSize:       256,
+		CompactionStrategy: st,
+		SoftSegmentLimit:   2,
+		HardSegmentLimit:   3,
+	}
+	s, err := NewSSTStorage(context.Background(), _map.NewMapIndexerGenerator(), opts)
+	assert.Nil(t, err)
+
+	appendAsync := func(key string) chan error {
+		done := make(chan error, 1)
+		go func() {
+			done <- s.Append([]byte(key), record(t, key, "value"))
+		}()
+		return done
+	}
+
+	// The memtable fills up while the flush of the
+	// previous one is paused.
+	s.PauseBackgroundWork()
+	for i := 0; s.Stats().WriteStall != WriteStallStop; i++ {
+		key := "key" + strconv.Itoa(i)
+		assert.Nil(t, s.Append([]byte(key), record(t, key, "value")))
+	}
+
+	done := appendAsync("blocked")
+	select {
+	case <-done:
+		t.Fatal("write went through while the memtable was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.ResumeBackgroundWork()
+	assert.Nil(t, <-done)
+	s.scheduler.Wait()
+
+	// The level 0 tables aren't ever compacted.
+	for i := 0; len(s.Stats().Segments) < opts.HardSegmentLimit; i++ {
+		key := "other" + strconv.Itoa(i)
+		assert.Nil(t, s.Append([]byte(key), record(t, key, "value")))
+		s.scheduler.Wait()
+	}
+
+	stats := s.Stats()
+	assert.Equal(t, WriteStallStop, stats.WriteStall)
+	assert.NotZero(t, stats.StalledWrites)
+	assert.NotZero(t, stats.StallDuration)
+
+	done = appendAsync("blocked")
+	select {
+	case <-done:
+		t.Fatal("write went through past the hard segment limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.Nil(t, s.Close())
+	assert.Equal(t, ErrStorageClosed, <-done)
+}
+
+// TestSSTStorage_DefaultStrategy ensures that storages
+// created with the same default options don't share the
+// state of their compaction strategy.
+func TestSSTStorage_DefaultStrategy(t *testing.T) {
+	opts := DefaultOptions()
+	assert.Nil(t, opts.CompactionStrategy)
+
+	opts.Dir = t.TempDir()
+	first, err := NewSSTStorage(context.Background(), _map.NewMapIndexerGenerator(), opts)
+	assert.Nil(t, err)
+	defer first.Close()
+
+	opts.Dir = t.TempDir()
+	second, err := NewSSTStorage(context.Background(), _map.NewMapIndexerGenerator(), opts)
+	assert.Nil(t, err)
+	defer second.Close()
+
+	assert.Equal(t, "leveled", first.strategy.Name())
+	assert.True(t, first.strategy != second.strategy)
+}
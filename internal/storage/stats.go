@@ -0,0 +1,56 @@
+package storage
+
+import "time"
+
+// Stats describes the state of a storage.
+type Stats struct {
+	// Segments describe the segments of the storage,
+	// oldest first. The tables of an SSTStorage are
+	// described level by level, in the order kept in
+	// each level.
+	Segments []SegmentStats
+	// PendingCompactionBytes is the number of bytes
+	// waiting to be compacted.
+	PendingCompactionBytes int64
+	// ValueLogSize is the size of the value log the large
+	// records of the storage are separated into.
+	ValueLogSize int64
+	// WriteStall is how writes are currently held back.
+	WriteStall WriteStall
+	// StalledWrites is the number of writes which were
+	// delayed or blocked since the storage was created.
+	StalledWrites int64
+	// StallDuration is the total time writes were held
+	// back for since the storage was created.
+	StallDuration time.Duration
+	// Evictions is the number of keys a MemoryStorage
+	// evicted to stay within its capacity.
+	Evictions int64
+}
+
+// SegmentStats describes the space used by a single
+// segment of the storage.
+type SegmentStats struct {
+	// ID is the id of the segment.
+	ID int64
+	// Level is the level of the table in an SSTStorage
+	// and always zero for the segments of a StorageV1.
+	Level int
+	// Size is the size of the data file of the segment.
+	Size int64
+	// LiveBytes is the number of bytes taken by records
+	// which are the most recent records of their keys.
+	LiveBytes int64
+	// DeadBytes is the number of bytes taken by records
+	// shadowed by later writes or deletes of their keys.
+	DeadBytes int64
+	// GarbageRatio is the fraction of the segment taken
+	// by dead bytes.
+	GarbageRatio float64
+	// IndexMemoryUsage is the approximate number of bytes
+	// taken in memory by the index of the segment.
+	IndexMemoryUsage int64
+	// Active signifies whether the segment is the one
+	// being written to.
+	Active bool
+}
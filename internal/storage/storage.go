@@ -24,4 +24,39 @@ type Storage interface {
 	// back the data that was stored from the
 	// provided key value as argument.
 	Query([]byte) (string, error)
+	// Delete allows the key-value store to remove
+	// the data stored with the provided key, such
+	// that querying it doesn't find any data.
+	Delete([]byte) error
+	// Sync commits everything written to the storage
+	// so far to disk, so that it survives a crash of
+	// the machine. Writes are only known to be durable
+	// once a Sync after them returns.
+	Sync() error
+	// Stats describes the state of the storage.
+	Stats() Stats
+	// PauseBackgroundWork stops the storage from
+	// starting any more flushes or compactions in
+	// the background until ResumeBackgroundWork is
+	// called.
+	PauseBackgroundWork()
+	// ResumeBackgroundWork lets the storage start
+	// background work again.
+	ResumeBackgroundWork()
+	// Close stops the background work of the storage
+	// and releases its resources. The storage can't
+	// be used after it's closed.
+	Close() error
+}
+
+// Scanner is implemented by the storages which can scan
+// their keys in order, which are all of the storages of
+// this package.
+type Scanner interface {
+	// Scan calls fn with the keys from start up to but
+	// not including end and their data, in the order of
+	// the comparator of the storage, until fn returns
+	// false. A nil start scans from the first key and a
+	// nil end up to the last one.
+	Scan(start, end []byte, fn func(key []byte, data string) bool) error
 }
@@ -6,7 +6,10 @@ import (
 	"sync"
 
 	"github.com/SystemBuilders/KeyValueStore/internal/indexer"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/comparator"
 	"github.com/SystemBuilders/KeyValueStore/internal/storage/linkedlist"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/mergecompaction"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/scheduler"
 	"github.com/SystemBuilders/KeyValueStore/internal/storage/segment"
 )
 
@@ -14,8 +17,15 @@ import (
 //
 // StorageV1 is a linked-list of "segment" objects,
 // where each segment has an associated indexer.
+//
+// StorageV1 is safe for concurrent use. Writes are
+// serialised and queries run alongside them and the
+// merges, reading the segments through the version of
+// the storage they pinned as they started.
 type StorageV1 struct {
 	ctx context.Context
+	// opts are the options the storage was created with.
+	opts Options
 	// fs describes the file segments.
 	//
 	// fs is maintained as a doubly-linked-list.
@@ -31,6 +41,9 @@ type StorageV1 struct {
 	// be used to pass on new indexers when creating
 	// fresh segments.
 	idxrGntr indexer.IndexerGenerator
+	// ids hands out the ids of the segments the storage
+	// creates.
+	ids *segment.IDs
 	// numSegments holds the number of segments
 	// currently operational with all valid keys in
 	// the KV store. This will be updated by various
@@ -47,64 +60,468 @@ type StorageV1 struct {
 	// factors.
 	// This will be set to false by default.
 	MergeNeeded bool
-	// l is the lock needed to synchronise some critical
-	// variables StorageV1.
-	l sync.Mutex
+	// wl is the write lock, serialising the writes and
+	// the installing of merges. It guards the segment list
+	// and the fields below which aren't otherwise guarded,
+	// along with the garbage accounting of the segments.
+	wl sync.Mutex
+	// l guards the current version and closed. Queries
+	// hold it for reading while they pin the version. It's
+	// only held for writing, along with wl, while a new
+	// version is installed.
+	l sync.RWMutex
+	// versions hold the current version of the segment
+	// list, which queries look through.
+	versions versionSet
+	// scheduler runs the merges of the storage in the
+	// background.
+	scheduler *scheduler.Scheduler
+	// limiter limits the rate at which merges write.
+	limiter *scheduler.RateLimiter
+	// values is the value log the records past the value
+	// threshold are separated into, or nil.
+	values *valueLog
+	// wc holds back writes while merges fall behind.
+	wc *writeController
+	// bgErr is the error the first failed merge returned.
+	bgErr error
+	// closed is set once the storage is closed.
+	closed bool
 }
 
-var _ (Storage) = (*StorageV1)(nil)
-
 var (
-	// mergingLimit is the limit of the number of files
-	// tolerable by the system and the threshold where
-	// compaction and merging must occur.
-	//
-	// Currently an arbitrarily set number, this can be
-	// based on speed, RAM size and factors like if there's
-	// actually a lot of unmergeable data in the storage.
-	//
-	// TODO: This can be async'ly updated by a different
-	// monitoring thread.
-	mergingLimit int64 = 3
+	_ (Storage) = (*StorageV1)(nil)
+	_ (Scanner) = (*StorageV1)(nil)
 )
 
 // NewStorageV1 creates a new instance of StorageV1.
 //
-// This function creates a new segment, asserts
-// it as the head Node of the fs linked-list and
-// also creates a watch-set with the function that
-// needs to be triggered during a merge and then
-// returns the StorageV1 object.
+// This function loads the segments already present
+// in the directory of the storage, oldest first, and
+// then creates a new active segment after them. The
+// segments are loaded from their index snapshots, or
+// indexed from their hint files, wherever a valid one
+// exists.
+//
+// ErrComparatorMismatch is returned if the storage was
+// created with a comparator other than the one of the
+// options.
 func NewStorageV1(ctx context.Context,
 	idxrGntr indexer.IndexerGenerator,
+	opts Options,
 ) (*StorageV1, error) {
-	segment, err := segment.NewSegment(idxrGntr.Generate())
+	if opts.Dir != "" {
+		err := opts.fs().MkdirAll(opts.Dir, 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := segment.RemoveIncompleteMerges(opts.fs(), opts.Dir)
 	if err != nil {
 		return nil, err
 	}
 
-	segmentNode := linkedlist.NewDLLNode(segment)
-	return &StorageV1{
+	ids, err := segment.ListSegmentIDs(opts.fs(), opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// The segments aren't sorted, but the storage is scanned
+	// in the order of its comparator, so it's recorded in a
+	// manifest like the one of an SSTStorage. Segments
+	// written before it was recorded are scanned bytewise.
+	m, err := readManifest(opts.fs(), opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	recorded := m.Comparator != ""
+	if !recorded && len(ids) > 0 {
+		m.Comparator = comparator.Bytewise.Name()
+	}
+	if m.Comparator != "" && m.Comparator != opts.comparator().Name() {
+		return nil, ErrComparatorMismatch
+	}
+	if !recorded {
+		err = writeManifest(opts.fs(), opts.Dir, manifest{Comparator: opts.comparator().Name()})
+		if err != nil {
+			return nil, err
+		}
+	}
+	idxrGntr = opts.indexerGenerator(idxrGntr)
+
+	s := &StorageV1{
 		ctx:         ctx,
-		fs:          segmentNode,
-		currSegment: segmentNode,
+		opts:        opts,
 		idxrGntr:    idxrGntr,
-		numSegments: 1,
+		ids:         segment.NewIDs(opts.clock()),
 		MergeNeeded: false,
-		l:           sync.Mutex{},
-	}, nil
+	}
+	s.wc = newWriteController(&s.wl, opts)
+	for _, id := range ids {
+		s.ids.Observe(id)
+	}
+
+	// The value log is opened first so that the records of
+	// the segments can be checked against it.
+	s.values, err = openValueLog(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var seq uint64
+	for i, id := range ids {
+		sg, err := segment.OpenSegment(opts.fs(), opts.Dir, id, seq, idxrGntr.Generate())
+		if err != nil {
+			return nil, err
+		}
+
+		// The active segment of a previous run may hold
+		// records whose values didn't survive the crash
+		// the run ended with.
+		if i == len(ids)-1 {
+			sg, err = s.recoverSegment(sg)
+			if err != nil {
+				return nil, err
+			}
+			if sg == nil {
+				continue
+			}
+		}
+		seq = sg.Sequence()
+
+		// The active segment of a previous run may not
+		// have been written to at all.
+		if sg.Size() == 0 {
+			err = sg.Remove()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		err = s.accountShadowed(sg)
+		if err != nil {
+			return nil, err
+		}
+		err = s.pushSegment(sg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	segment, err := segment.CreateSegment(opts.fs(), opts.Dir, s.ids, seq, idxrGntr.Generate())
+	if err != nil {
+		return nil, err
+	}
+	err = s.pushSegment(segment)
+	if err != nil {
+		return nil, err
+	}
+
+	// The segments loaded may already have enough garbage
+	// in them to be merged, and so may the value log.
+	s.scheduler = opts.newScheduler(ctx)
+	s.wc.scheduler = s.scheduler
+	s.limiter = opts.compactionRateLimiter()
+	err = s.scheduleMerge()
+	if err == nil && s.values.sealed() {
+		err = s.scheduleValueLogGC()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// recoverSegment drops the records of the active segment
+// of a previous run from the first one whose value didn't
+// survive the crash the run ended with. The value log is
+// committed before the segment, so neither that record nor
+// the ones after it were committed. The records pointing
+// into files of the value log which were collected are
+// dropped on their own, as they were replaced by later
+// records. The segment is written again without them and
+// installed in its place, or removed if no record is left,
+// in which case nil is returned.
+func (s *StorageV1) recoverSegment(sg *segment.Segment) (*segment.Segment, error) {
+	entries, err := sg.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		kept    []segment.Entry
+		records []string
+	)
+	for _, e := range entries {
+		data, err := sg.ReadEntry(e)
+		if err != nil {
+			return nil, err
+		}
+		ok, replaced, err := s.values.recovered(data)
+		if err != nil {
+			return nil, err
+		}
+		if replaced {
+			continue
+		}
+		if !ok {
+			break
+		}
+		kept = append(kept, e)
+		records = append(records, data)
+	}
+
+	switch len(records) {
+	case len(entries):
+		return sg, nil
+	case 0:
+		return nil, sg.Remove()
+	}
+
+	recovered, err := segment.NewMergeSegment(s.opts.fs(), s.opts.Dir, sg.ID(), s.idxrGntr.Generate())
+	if err != nil {
+		return nil, err
+	}
+	for i, data := range records {
+		err = recovered.AppendRecord(kept[i], data)
+		if err != nil {
+			recovered.Remove()
+			return nil, err
+		}
+	}
+	return recovered, recovered.Replace(sg)
 }
 
 // Append is responsible for ensuring the data is durably
 // stored inside the backing-store and can be queried
 // in the future using the passed "key" argument which
 // will return the "data" argument.
+//
+// Data past the value threshold is written to the value
+// log, and the segment holds a record pointing at it.
 func (s *StorageV1) Append(key, data []byte) error {
-	return s.append(string(key), string(data))
+	s.wl.Lock()
+	defer s.wl.Unlock()
+
+	err := s.checkWritable()
+	if err == nil {
+		err = s.wc.wait(s.writeStall, s.checkWritable)
+	}
+	if err != nil {
+		return err
+	}
+
+	record, rotated, err := s.values.separate(string(key), string(data))
+	if err != nil {
+		return err
+	}
+	err = s.append(string(key), record)
+	if err == nil && rotated {
+		err = s.scheduleValueLogGC()
+	}
+	return err
 }
 
+// Query returns the most recent data stored for the key,
+// reading it from the value log if the segment holding it
+// only points at it.
 func (s *StorageV1) Query(key []byte) (string, error) {
-	return s.query(string(key))
+	return s.values.query(func() (string, error) {
+		return s.get(string(key))
+	})
+}
+
+// get returns the most recent record of the key.
+func (s *StorageV1) get(key string) (string, error) {
+	s.l.RLock()
+	if s.closed {
+		s.l.RUnlock()
+		return "", ErrStorageClosed
+	}
+	v := s.versions.pin()
+	s.l.RUnlock()
+
+	data, err := s.query(v, key)
+	unpinErr := s.versions.unpin(v)
+	if err == nil {
+		err = unpinErr
+	}
+	return data, err
+}
+
+// Scan calls fn with the keys from start up to but not
+// including end and their most recent data, in the order
+// of the comparator of the storage, until fn returns false.
+//
+// The segments are read through the version pinned by the
+// scan, from the active segment to the oldest one, and the
+// most recent record of every key is the one scanned. Keys
+// whose most recent record is a tombstone are left out.
+func (s *StorageV1) Scan(start, end []byte, fn func(key []byte, data string) bool) error {
+	s.l.RLock()
+	if s.closed {
+		s.l.RUnlock()
+		return ErrStorageClosed
+	}
+	v := s.versions.pin()
+	s.l.RUnlock()
+
+	err := s.scan(v, start, end, fn)
+	unpinErr := s.versions.unpin(v)
+	if err == nil {
+		err = unpinErr
+	}
+	return err
+}
+
+// scan merges the segments of the version for Scan.
+func (s *StorageV1) scan(v *version, start, end []byte, fn func(key []byte, data string) bool) error {
+	m := newScanMerge(s.opts.comparator(), start, end)
+	for _, sg := range v.levels[0] {
+		err := m.addSegment(sg)
+		if err != nil {
+			return err
+		}
+	}
+	return m.run(s.values, s.Query, fn)
+}
+
+// Delete removes the key from the storage by appending
+// a tombstone for it, which shadows all of its records.
+func (s *StorageV1) Delete(key []byte) error {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+
+	err := s.checkWritable()
+	if err == nil {
+		err = s.wc.wait(s.writeStall, s.checkWritable)
+	}
+	if err != nil {
+		return err
+	}
+	return s.delete(string(key))
+}
+
+// Sync commits the records appended to the active segment
+// to disk, after the values they point at in the value
+// log. The sealed segments were committed as they were
+// sealed.
+func (s *StorageV1) Sync() error {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+
+	err := s.checkWritable()
+	if err != nil {
+		return err
+	}
+
+	return s.sync()
+}
+
+// sync commits the active segment to disk, after the value
+// log, and must be called with wl held.
+func (s *StorageV1) sync() error {
+	err := s.values.sync()
+	if err != nil {
+		return err
+	}
+	return (s.currSegment.Value).(*segment.Segment).Sync()
+}
+
+// PauseBackgroundWork stops any more merges from being
+// started until ResumeBackgroundWork is called.
+func (s *StorageV1) PauseBackgroundWork() {
+	s.scheduler.Pause()
+}
+
+// ResumeBackgroundWork lets merges be started again.
+func (s *StorageV1) ResumeBackgroundWork() {
+	s.scheduler.Resume()
+}
+
+// ValueLogGC collects the files of the value log with
+// enough garbage in them right away, rather than once the
+// value log moves on to a new file. It does nothing if the
+// storage has no value log.
+func (s *StorageV1) ValueLogGC() error {
+	s.wl.Lock()
+	err := s.checkWritable()
+	s.wl.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.collectValueLog(s.ctx)
+}
+
+// Close stops the merges of the storage, waiting for a
+// running merge to be abandoned, and closes the segments
+// and the value log.
+// It returns the error a merge failed with, if any.
+func (s *StorageV1) Close() error {
+	s.wl.Lock()
+	if s.closed {
+		s.wl.Unlock()
+		return nil
+	}
+	s.l.Lock()
+	s.closed = true
+	s.l.Unlock()
+	s.wl.Unlock()
+	s.wc.signal()
+
+	// The scheduler is closed without holding the locks
+	// as the running merge needs them to finish. The
+	// queries still reading the segments are waited for
+	// before the segments are closed.
+	bgErr := s.scheduler.Close()
+	s.versions.wait()
+
+	s.wl.Lock()
+	defer s.wl.Unlock()
+	s.l.Lock()
+	defer s.l.Unlock()
+	for node := s.fs; node != nil; node = node.Right {
+		err := (node.Value).(*segment.Segment).Close()
+		if err != nil {
+			return err
+		}
+	}
+	err := s.values.close()
+	if err != nil {
+		return err
+	}
+	return bgErr
+}
+
+// Stats returns the sizes and garbage ratios of the
+// segments of the storage.
+func (s *StorageV1) Stats() Stats {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+
+	var stats Stats
+	for node := s.fs; node != nil; node = node.Right {
+		sg := (node.Value).(*segment.Segment)
+		stats.Segments = append(stats.Segments, SegmentStats{
+			ID:               sg.ID(),
+			Size:             sg.Size(),
+			LiveBytes:        sg.Size() - sg.DeadBytes(),
+			DeadBytes:        sg.DeadBytes(),
+			GarbageRatio:     sg.GarbageRatio(),
+			IndexMemoryUsage: sg.IndexMemoryUsage(),
+			Active:           node == s.currSegment,
+		})
+	}
+
+	_, stats.PendingCompactionBytes = s.pendingMerges()
+	stats.ValueLogSize = s.values.size()
+	stats.WriteStall = s.writeStall()
+	stats.StalledWrites = s.wc.stalledWrites
+	stats.StallDuration = s.wc.stallDuration
+	return stats
 }
 
 // append passes on the task of appending the data to the
@@ -120,85 +537,203 @@ func (s *StorageV1) Query(key []byte) (string, error) {
 // because the access to the segment-linked-list is available
 // only at this level based on the scope.
 func (s *StorageV1) append(key string, data string) error {
+	curSeg, err := s.activeSegment()
+	if err != nil {
+		return err
+	}
+
+	prevSeg, prevLoc, shadows := s.locate(key)
+	err = curSeg.Append(key, data)
+	if err != nil {
+		return err
+	}
+
+	// The record being shadowed in an older segment is
+	// now garbage. Shadowing within the active segment
+	// is accounted for by the segment itself.
+	if shadows && prevSeg != curSeg {
+		prevSeg.MarkDead(prevLoc.Size)
+	}
+	return nil
+}
+
+// delete appends a tombstone for the key to the active
+// segment if the key exists in the storage.
+//
+// The tombstone shadows the most recent record of the
+// key, which is accounted as garbage like an overwrite.
+func (s *StorageV1) delete(key string) error {
+	curSeg, err := s.activeSegment()
+	if err != nil {
+		return err
+	}
+
+	prevSeg, prevLoc, ok := s.locate(key)
+	if !ok || prevLoc.Tombstone {
+		return nil
+	}
+
+	err = curSeg.Delete(key)
+	if err != nil {
+		return err
+	}
+
+	if prevSeg != curSeg {
+		prevSeg.MarkDead(prevLoc.Size)
+	}
+	return nil
+}
+
+// activeSegment returns the segment where the data
+// must be written to.
+//
+// This function will also check whether the current
+// is full and create new segments for future use. This is
+// located at this level rather than the segment level methods
+// because the access to the segment-linked-list is available
+// only at this level based on the scope.
+func (s *StorageV1) activeSegment() (*segment.Segment, error) {
 
 	curSeg := (s.currSegment.Value).(*segment.Segment)
 
 	// Monitor the currSegment, move to a new segment if necessary.
-	if curSeg.IsFull {
-		segment, err := segment.NewSegment(s.idxrGntr.Generate())
+	// The full segment is sealed first, which writes out its
+	// hint file, once the values it points at are committed.
+	if curSeg.Full() {
+		err := s.values.sync()
+		if err == nil {
+			err = curSeg.Seal()
+		}
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		segmentNode := linkedlist.NewDLLNode(segment)
+		segment, err := segment.CreateSegment(s.opts.fs(), s.opts.Dir, s.ids, curSeg.Sequence(), s.idxrGntr.Generate())
+		if err != nil {
+			return nil, err
+		}
+		err = s.pushSegment(segment)
+		if err != nil {
+			return nil, err
+		}
+
+		// Sealing a segment is when the merging of
+		// sealed segments with enough garbage in them
+		// is considered.
+		err = s.scheduleMerge()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return (s.currSegment.Value).(*segment.Segment), nil
+}
+
+// pushSegment adds the segment to the right end of the
+// segment list and makes it the current segment.
+func (s *StorageV1) pushSegment(sg *segment.Segment) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	segmentNode := linkedlist.NewDLLNode(sg)
+	if s.currSegment == nil {
+		s.fs = segmentNode
+	} else {
 		s.currSegment.AppendToRight(segmentNode)
-		s.currSegment = segmentNode
-
-		s.l.Lock()
-		s.numSegments++
-		// If the merging limit is breached, start a
-		// goroutine to handle that and move on with
-		// the normal operations of the Key-Value store.
-		if s.numSegments > mergingLimit {
-			s.l.Unlock()
-			// TODO: We might be calling this on
-			// non-redundant nodes, we need to build a
-			// heuristic to know if we are since it can
-			// be a useless merge/compact operation.
-			// Something like if the segments didn't reduce
-			// post operation is a good starting point
-			// to work on.
-			// go s.mergeCompaction()
-		} else {
-			s.l.Unlock()
+	}
+	s.currSegment = segmentNode
+	s.numSegments++
+	return s.installVersion()
+}
+
+// installVersion makes a version of the segment list
+// current and must be called with both locks held. The
+// segments of the version are ordered from the active
+// segment to the oldest one.
+func (s *StorageV1) installVersion() error {
+	var segments []*segment.Segment
+	for node := s.currSegment; node != nil; node = node.Left {
+		segments = append(segments, (node.Value).(*segment.Segment))
+	}
+	return s.versions.install([][]*segment.Segment{segments})
+}
+
+// locate returns the segment holding the most recent
+// record of the key and the location of that record,
+// which may be a tombstone, and whether it exists.
+func (s *StorageV1) locate(key string) (*segment.Segment, indexer.ObjectLocation, bool) {
+	for node := s.currSegment; node != nil; node = node.Left {
+		sg := (node.Value).(*segment.Segment)
+		if objLoc, ok := sg.Locate(key); ok {
+			return sg, objLoc, true
 		}
 	}
+	return nil, indexer.ObjectLocation{}, false
+}
 
-	curSeg = (s.currSegment.Value).(*segment.Segment)
-	return curSeg.Append(key, data)
+// accountShadowed marks the records in the segments of
+// the storage that are shadowed by the records of the
+// given segment as dead. It is used to rebuild the garbage
+// accounting while loading segments, before the segment
+// is added to the list.
+func (s *StorageV1) accountShadowed(sg *segment.Segment) error {
+	entries, err := sg.Entries()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		// Only the most recent record of the key in the
+		// segment shadows older segments, the rest are
+		// shadowed themselves.
+		if objLoc, _ := sg.Locate(e.Key); objLoc.Offset != e.Offset {
+			continue
+		}
+
+		if prevSeg, prevLoc, ok := s.locate(e.Key); ok {
+			prevSeg.MarkDead(prevLoc.Size)
+		}
+	}
+	return nil
 }
 
-// query is resposible for querying the storage in the
-// reverse order of the active segment.
+// isLive reports whether the record described by the
+// entry of the segment is the most recent record of its
+// key in the storage.
+func (s *StorageV1) isLive(sg *segment.Segment, e segment.Entry) bool {
+	owner, objLoc, ok := s.locate(e.Key)
+	return ok && owner == sg && objLoc.Offset == e.Offset
+}
+
+// query is resposible for querying the segments of the
+// version in the reverse order of the active segment.
 //
 // If the active segment doesnt have the data, the query
 // moves on to the next latest segment until the data is found.
 //
-// TODO: There has to be some thought around the compaction
-// and merging and till where the query part continues and
-// also to check whether it can go into invalid segments
-// if such a thing even exists. What we can do is, have a
-// new parameter called limiter or something in the segment node.
-// If this is hit, it means that the merging operation is
-// taken over the nodes until here.
-//     Now, we should prioritise the query over the merging
-// and stop the merging/compaction operation in a stable state
-// and release this new variable so that the query can finish
-// its job.
-func (s *StorageV1) query(key string) (string, error) {
-	activeSegment := s.currSegment
-
-	var queryData string
-	for {
-		data, err := (activeSegment.Value).(*segment.Segment).Query(key)
+// The version is pinned by the query, so the segments it
+// holds stay readable even if a merge installs a newer
+// version and makes them obsolete meanwhile.
+func (s *StorageV1) query(v *version, key string) (string, error) {
+	for _, sg := range v.levels[0] {
+		data, err := sg.Query(key)
 		// If we see that the data doesn't exist according to the
 		// segment, we move on to the previous segment if it exists.
-		if err == segment.ErrDataDoesntExistInSegment {
-			// If this is the last segment, data doesn't exist
-			// in the storage.
-			if activeSegment.Left == nil {
-				return "", ErrDataNotFound
-			}
-			activeSegment = activeSegment.Left
+		// A deleted key doesn't exist regardless of any older
+		// segments holding it.
+		if err == segment.ErrDataDeletedInSegment {
+			return "", ErrDataNotFound
+		} else if err == segment.ErrDataDoesntExistInSegment {
+			continue
 		} else if err != nil {
 			return "", err
-		} else {
-			queryData = data
-			break
 		}
+		return data, nil
 	}
 
-	return queryData, nil
+	// None of the segments, down to the oldest one, has
+	// the data.
+	return "", ErrDataNotFound
 }
 
 // print prints the chain of segments by calling
@@ -213,46 +748,333 @@ func (s *StorageV1) print() {
 	fmt.Println("")
 }
 
+// checkWritable returns the error the storage can't be
+// written to with, if any.
+//
+// A failed merge leaves the storage as it was before the
+// merge, but the failure is reported on the following
+// writes so that it isn't silently ignored.
+func (s *StorageV1) checkWritable() error {
+	if s.closed {
+		return ErrStorageClosed
+	}
+	return s.bgErr
+}
+
+// scheduleMerge schedules a merge of the segments in
+// the background, unless one is already pending.
+func (s *StorageV1) scheduleMerge() error {
+	_, err := s.scheduler.Schedule("merge", s.mergeJob)
+	return err
+}
+
+// mergeJob is the background job merging the segments.
+//
+// The write lock of the storage is only held while the
+// segments to merge are picked and while the merged
+// segments are installed, so writes carry on while the
+// records are merged. Queries carry on throughout, as the
+// merged segments are only removed once the queries
+// reading them are done.
+func (s *StorageV1) mergeJob(ctx context.Context) error {
+	s.wl.Lock()
+	if s.closed {
+		s.wl.Unlock()
+		return nil
+	}
+	runs := s.pickMergeRuns()
+	if len(runs) == 0 {
+		s.wl.Unlock()
+		return nil
+	}
+	snap, err := s.mergeSnapshot()
+	s.wl.Unlock()
+	if err != nil {
+		return s.failBackgroundJob(ctx, err)
+	}
+
+	err = s.mergeCompaction(ctx, snap, runs)
+	unpinErr := s.versions.unpin(snap.v)
+	if err == nil {
+		err = unpinErr
+	}
+	if err != nil {
+		return s.failBackgroundJob(ctx, err)
+	}
+	return nil
+}
+
+// failBackgroundJob records the error a merge or value log
+// collection failed with, which is then returned by the
+// following writes, and wakes the writers held back by the
+// storage. The error of a job abandoned as the storage is
+// closed isn't recorded.
+func (s *StorageV1) failBackgroundJob(ctx context.Context, err error) error {
+	s.wl.Lock()
+	if ctx.Err() == nil && s.bgErr == nil {
+		s.bgErr = err
+	}
+	s.wl.Unlock()
+
+	s.wc.signal()
+	return err
+}
+
+// scheduleValueLogGC schedules a collection of the value
+// log in the background, unless one is already pending.
+func (s *StorageV1) scheduleValueLogGC() error {
+	_, err := s.scheduler.Schedule("valuelog-gc", s.valueLogGCJob)
+	return err
+}
+
+// valueLogGCJob is the background job collecting the
+// value log. Like a merge, it only holds the write lock of
+// the storage to rewrite the values it moves and to sync.
+func (s *StorageV1) valueLogGCJob(ctx context.Context) error {
+	err := s.collectValueLog(ctx)
+	if err == ErrStorageClosed {
+		return nil
+	}
+	if err != nil {
+		return s.failBackgroundJob(ctx, err)
+	}
+	return nil
+}
+
+// collectValueLog collects the value log, appending the
+// records pointing at the values it moves to the active
+// segment. It takes wl as it needs it.
+func (s *StorageV1) collectValueLog(ctx context.Context) error {
+	return s.values.collect(ctx, &s.wl, s.checkWritable, s.get, s.append, s.sync)
+}
+
+// pendingMerges returns the number of sealed segments past
+// the garbage ratio threshold, which are waiting to be
+// merged, and their total size.
+func (s *StorageV1) pendingMerges() (int, int64) {
+	var (
+		count     int
+		size      int64
+		threshold = s.opts.garbageRatioThreshold()
+	)
+	for node := s.fs; node != s.currSegment; node = node.Right {
+		sg := (node.Value).(*segment.Segment)
+		if sg.GarbageRatio() > threshold {
+			count++
+			size += sg.Size()
+		}
+	}
+	return count, size
+}
+
+// writeStall returns how writes are to be held back given
+// the segments waiting to be merged.
+func (s *StorageV1) writeStall() WriteStall {
+	return s.wc.state(s.pendingMerges())
+}
+
 // mergeCompaction enables the segments of the storage
 // layer to merge and compact into non-redundant entities.
 //
-// This function assumes that there are atleast three nodes
-// in the segment list because it ignores the current node
-// and needs two more nodes atleast to perform merging
-// and compaction.
+// Only the sealed segments whose garbage ratio exceeds
+// the threshold of the storage are merged, since merging
+// any other segment would reclaim too little to be worth
+// rewriting it. Adjacent segments picked this way are
+// merged together into a single segment.
+//
+// The runs are picked and the snapshot is taken together,
+// with wl held, but the runs are merged without it.
+func (s *StorageV1) mergeCompaction(ctx context.Context, snap mergeSnapshot, runs [][]*linkedlist.DLLNode) error {
+	for _, run := range runs {
+		err := s.merge(ctx, snap, run)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeSnapshot is the state of the storage which the
+// records of a merge are checked against, taken as the
+// merge starts.
+type mergeSnapshot struct {
+	// v is the version pinned for the merge, which must
+	// be released once the merge is done.
+	v *version
+	// synced is the size of the active segment of the
+	// version once it was synced. The records it took since
+	// may not survive a crash, so they can't be relied on
+	// to shadow the records merged.
+	synced int64
+	// oldest is the oldest segment of the storage.
+	oldest *linkedlist.DLLNode
+}
+
+// mergeSnapshot takes a snapshot of the storage for a
+// merge, and must be called with wl held.
+//
+// The records shadowing those the merge drops may only be
+// in the active segment, and are committed first so that
+// a crash can't lose them along with the records they
+// shadow.
+func (s *StorageV1) mergeSnapshot() (mergeSnapshot, error) {
+	err := s.sync()
+	if err != nil {
+		return mergeSnapshot{}, err
+	}
+
+	s.l.RLock()
+	v := s.versions.pin()
+	s.l.RUnlock()
+	return mergeSnapshot{
+		v:      v,
+		synced: (s.currSegment.Value).(*segment.Segment).Size(),
+		oldest: s.fs,
+	}, nil
+}
+
+// isLive reports whether the record described by the
+// entry of the segment is the most recent record of its
+// key in the snapshot.
+//
+// A record is only reported as shadowed if the record
+// shadowing it was committed when the snapshot was taken.
+// Writes made since then shadow it at most, in which case
+// it's merged and accounted as garbage once installed.
+func (snap mergeSnapshot) isLive(sg *segment.Segment, e segment.Entry) bool {
+	for i, other := range snap.v.levels[0] {
+		objLoc, ok := other.Locate(e.Key)
+		if !ok || (i == 0 && objLoc.Offset >= snap.synced) {
+			continue
+		}
+		return other == sg && objLoc.Offset == e.Offset
+	}
+	return false
+}
+
+// pickMergeRuns returns the runs of adjacent sealed
+// segments, oldest first, whose garbage ratio exceeds
+// the threshold.
 //
-// This function has no way to know if the segments its
-// merging are already non-redundant and thus it is the
-// responsibility of the user to ensure that, since this
-// can be a significant user of CPU cycles.
-// TODO: Figure out how?
-func (s *StorageV1) mergeCompaction() {
-	segmentSnapshot, currActiveSegment := s.getSegmentSnapshot()
-
-	// TODO: Actual merging operation which should be
-	// dependent on the indexer. Well sort of.
-
-	mergedSegment := s.merge(segmentSnapshot)
-	mergedSegment.Right = currActiveSegment
-	currActiveSegment.Left = mergedSegment
-}
-
-// getSegmentSnapshot is responsible to provide a
-// copy of the existing linkedlist of segments (except
-// the active segment) without depending on the
-// original list - this is because since they are
-// all pointers, variable assignment won't work and
-// we need to re-create the entire list.
-func (s *StorageV1) getSegmentSnapshot() (
-	*linkedlist.DLLNode,
-	*linkedlist.DLLNode) {
-	return nil, nil
-}
-
-// merge is supposed to do the actual merging of all these
-// segments it has got.
-func (s *StorageV1) merge(
-	unmergedSegments *linkedlist.DLLNode,
-) *linkedlist.DLLNode {
+// Only adjacent segments can be merged together since
+// the merged segment takes their place in the list, and
+// a segment in between would otherwise end up ordered
+// before records older than its own.
+func (s *StorageV1) pickMergeRuns() [][]*linkedlist.DLLNode {
+	var (
+		runs      [][]*linkedlist.DLLNode
+		run       []*linkedlist.DLLNode
+		threshold = s.opts.garbageRatioThreshold()
+	)
+	for node := s.fs; node != s.currSegment; node = node.Right {
+		if (node.Value).(*segment.Segment).GarbageRatio() > threshold {
+			run = append(run, node)
+			continue
+		}
+
+		if len(run) > 0 {
+			runs = append(runs, run)
+			run = nil
+		}
+	}
+
+	if len(run) > 0 {
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+// merge does the actual merging of the given run of
+// segments and puts the merged segment in their place
+// in the list. Only the installing takes wl.
+//
+// Only the records which are still the most recent of
+// their key in the snapshot are kept. Tombstones are only
+// dropped if the run starts at the oldest segment, as
+// they could be shadowing records in older segments
+// otherwise. The merged segment is indexed by a fresh
+// indexer and is installed on disk in place of the
+// segments it was merged from, which are removed once
+// no pinned version holds them.
+func (s *StorageV1) merge(ctx context.Context, snap mergeSnapshot, run []*linkedlist.DLLNode) error {
+	var segments []*segment.Segment
+	for _, node := range run {
+		segments = append(segments, (node.Value).(*segment.Segment))
+	}
+
+	merged, err := mergecompaction.Merge(
+		ctx,
+		s.opts.Dir,
+		segments,
+		s.idxrGntr.Generate(),
+		mergecompaction.Options{
+			IsLive:         snap.isLive,
+			DropTombstones: run[0] == snap.oldest,
+			Filter:         s.opts.CompactionFilter,
+			Resolve:        s.values.resolveForFilter,
+			Limiter:        s.limiter,
+			FS:             s.opts.fs(),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	s.wl.Lock()
+	defer s.wl.Unlock()
+	defer s.wc.signal()
+	err = s.installMerge(run, merged)
+	if err != nil || merged == nil {
+		return err
+	}
+	return s.accountMerged(merged)
+}
+
+// installMerge puts the merged segment, if any, in place
+// of the run of segments it was merged from, and must be
+// called with wl held.
+func (s *StorageV1) installMerge(run []*linkedlist.DLLNode, merged *segment.Segment) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	// The active segment is never merged, so there's
+	// always a segment to the right of the run.
+	left, right := run[0].Left, run[len(run)-1].Right
+	mergedCount := int64(0)
+	if merged != nil {
+		mergedNode := linkedlist.NewDLLNode(merged)
+		mergedNode.Right = right
+		right.Left = mergedNode
+		right = mergedNode
+		mergedCount = 1
+	}
+
+	right.Left = left
+	if left == nil {
+		s.fs = right
+	} else {
+		left.Right = right
+	}
+
+	s.numSegments -= int64(len(run)) - mergedCount
+	return s.installVersion()
+}
+
+// accountMerged marks the records of the merged segment
+// shadowed by the writes made during the merge as dead.
+// The writes marked them dead in the segments merged,
+// which the merged segment doesn't carry over. It must be
+// called with wl held, once the segment is installed.
+func (s *StorageV1) accountMerged(merged *segment.Segment) error {
+	entries, err := merged.Entries()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if !s.isLive(merged, e) {
+			merged.MarkDead(e.Size)
+		}
+	}
 	return nil
 }
@@ -1 +1,407 @@
 package storage
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/clock"
+	"github.com/SystemBuilders/KeyValueStore/internal/dataobject"
+	"github.com/SystemBuilders/KeyValueStore/internal/indexer"
+	_map "github.com/SystemBuilders/KeyValueStore/internal/indexer/map"
+	"github.com/SystemBuilders/KeyValueStore/internal/indexer/sst"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/comparator"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/linkedlist"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/mergecompaction"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/scheduler"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/segment"
+	"github.com/SystemBuilders/KeyValueStore/internal/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+// segmentDelimiter is the delimiter the segments write
+// after every record.
+const segmentDelimiter = "\\o/"
+
+// record returns the marshalled data object for the
+// key and value, as the key-value store would append it.
+func record(t *testing.T, key, value string) []byte {
+	data, err := json.Marshal(dataobject.NewObject([]byte(key), value))
+	assert.Nil(t, err)
+	return data
+}
+
+// TestStorageV1_Reopen ensures that a storage created on
+// a directory with existing segments serves their data,
+// whether the segments were sealed or not.
+func TestStorageV1_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{Dir: dir}
+
+	s, err := NewStorageV1(context.Background(), _map.NewMapIndexerGenerator(), opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 20; i++ {
+		key := "key" + strconv.Itoa(i%7)
+		assert.Nil(t, s.Append([]byte(key), record(t, key, "value"+strconv.Itoa(i))))
+	}
+	lastSeq := s.currSegment.Value.(*segment.Segment).Sequence()
+	assert.Equal(t, uint64(20), lastSeq)
+	assert.Nil(t, s.Close())
+
+	reopened, err := NewStorageV1(context.Background(), _map.NewMapIndexerGenerator(), opts)
+	assert.Nil(t, err)
+	defer reopened.Close()
+	assert.Equal(t, lastSeq, reopened.currSegment.Value.(*segment.Segment).Sequence())
+
+	for i := 13; i < 20; i++ {
+		key := "key" + strconv.Itoa(i%7)
+		data, err := reopened.Query([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, string(record(t, key, "value"+strconv.Itoa(i))), data)
+	}
+
+	_, err = reopened.Query([]byte("key7"))
+	assert.Equal(t, ErrDataNotFound, err)
+}
+
+// TestStorageV1_Delete ensures that a deleted key is not
+// found anymore, even though older segments hold it.
+func TestStorageV1_Delete(t *testing.T) {
+	s, err := NewStorageV1(context.Background(), _map.NewMapIndexerGenerator(), Options{Dir: t.TempDir()})
+	assert.Nil(t, err)
+	defer s.Close()
+
+	assert.Nil(t, s.Append([]byte("key"), record(t, "key", "value")))
+	for i := 0; i < 5; i++ {
+		other := "other" + strconv.Itoa(i)
+		assert.Nil(t, s.Append([]byte(other), record(t, other, "value")))
+	}
+
+	assert.Nil(t, s.Delete([]byte("key")))
+	_, err = s.Query([]byte("key"))
+	assert.Equal(t, ErrDataNotFound, err)
+
+	assert.Nil(t, s.Delete([]byte("missing")))
+	_, err = s.Query([]byte("missing"))
+	assert.Equal(t, ErrDataNotFound, err)
+
+	assert.Nil(t, s.Append([]byte("key"), record(t, "key", "again")))
+	data, err := s.Query([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, string(record(t, "key", "again")), data)
+}
+
+// TestStorageV1_Scan ensures that a scan finds the most
+// recent data of every key across the segments, in order,
+// leaving out the deleted keys and reading the values
+// kept in the value log.
+func TestStorageV1_Scan(t *testing.T) {
+	opts := Options{Dir: t.TempDir(), ValueThreshold: 32}
+	s, err := NewStorageV1(context.Background(), _map.NewMapIndexerGenerator(), opts)
+	assert.Nil(t, err)
+
+	latest := make(map[string]string)
+	for i := 0; i < 40; i++ {
+		key := "key" + strconv.Itoa(i*3%10)
+		data := record(t, key, "value"+strconv.Itoa(i))
+		assert.Nil(t, s.Append([]byte(key), data))
+		latest[key] = string(data)
+	}
+	for _, key := range []string{"key2", "key7"} {
+		assert.Nil(t, s.Delete([]byte(key)))
+		delete(latest, key)
+	}
+	assert.True(t, len(s.Stats().Segments) > 1)
+
+	var keys []string
+	assert.Nil(t, s.Scan(nil, nil, func(key []byte, data string) bool {
+		keys = append(keys, string(key))
+		assert.Equal(t, latest[string(key)], data)
+		return true
+	}))
+	assert.Equal(t, []string{"key0", "key1", "key3", "key4", "key5", "key6", "key8", "key9"}, keys)
+
+	keys = nil
+	assert.Nil(t, s.Scan([]byte("key2"), []byte("key6"), func(key []byte, _ string) bool {
+		keys = append(keys, string(key))
+		return true
+	}))
+	assert.Equal(t, []string{"key3", "key4", "key5"}, keys)
+
+	keys = nil
+	assert.Nil(t, s.Scan(nil, nil, func(key []byte, _ string) bool {
+		keys = append(keys, string(key))
+		return false
+	}))
+	assert.Equal(t, []string{"key0"}, keys)
+
+	assert.Nil(t, s.Close())
+	assert.Equal(t, ErrStorageClosed, s.Scan(nil, nil, func([]byte, string) bool { return true }))
+}
+
+// TestStorageV1_Comparator ensures that a storage is
+// scanned in the order of its comparator, which is
+// recorded so that the storage can't be opened again with
+// another one.
+func TestStorageV1_Comparator(t *testing.T) {
+	opts := Options{Dir: t.TempDir(), Comparator: comparator.Reverse(comparator.Bytewise)}
+	s, err := NewStorageV1(context.Background(), sst.NewSSTableIndexerGenerator(), opts)
+	assert.Nil(t, err)
+	for _, key := range []string{"b", "a", "c"} {
+		assert.Nil(t, s.Append([]byte(key), record(t, key, "value")))
+	}
+
+	var keys []string
+	assert.Nil(t, s.Scan(nil, nil, func(key []byte, _ string) bool {
+		keys = append(keys, string(key))
+		return true
+	}))
+	assert.Equal(t, []string{"c", "b", "a"}, keys)
+
+	// The segments are indexed in the order of the
+	// comparator too.
+	idxr := s.idxrGntr.Generate().(indexer.OrderedIndexer)
+	idxr.Store("a", indexer.ObjectLocation{})
+	idxr.Store("b", indexer.ObjectLocation{})
+	key, _, err := idxr.QueryWith(indexer.QueryLeast, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "b", key)
+	assert.Nil(t, s.Close())
+
+	m, err := readManifest(opts.fs(), opts.Dir)
+	assert.Nil(t, err)
+	assert.Equal(t, "reverse(bytewise)", m.Comparator)
+
+	_, err = NewStorageV1(context.Background(), _map.NewMapIndexerGenerator(), Options{Dir: opts.Dir})
+	assert.Equal(t, ErrComparatorMismatch, err)
+
+	reopened, err := NewStorageV1(context.Background(), _map.NewMapIndexerGenerator(), opts)
+	assert.Nil(t, err)
+	assert.Nil(t, reopened.Close())
+}
+
+// TestStorageV1_GarbageAccounting ensures that shadowed
+// records are accounted as dead bytes in their segments,
+// that segments past the garbage ratio threshold are
+// merged and that the accounting survives a reopen.
+func TestStorageV1_GarbageAccounting(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{Dir: dir, GarbageRatioThreshold: 1}
+
+	s, err := NewStorageV1(context.Background(), _map.NewMapIndexerGenerator(), opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 10; i++ {
+		key := "key" + strconv.Itoa(i)
+		assert.Nil(t, s.Append([]byte(key), record(t, key, "value")))
+	}
+	for i := 0; i < 5; i++ {
+		key := "key" + strconv.Itoa(i)
+		assert.Nil(t, s.Append([]byte(key), record(t, key, "newvalue")))
+	}
+
+	stats := s.Stats()
+	var size, dead int64
+	for _, sgStats := range stats.Segments {
+		assert.Equal(t, sgStats.Size, sgStats.LiveBytes+sgStats.DeadBytes)
+		if sgStats.Size > 0 {
+			assert.NotZero(t, sgStats.IndexMemoryUsage)
+		}
+		size += sgStats.Size
+		dead += sgStats.DeadBytes
+	}
+	assert.Equal(t, int64(5*len(record(t, "key0", "value"))+5*len(segmentDelimiter)), dead)
+	assert.True(t, stats.Segments[len(stats.Segments)-1].Active)
+	assert.Nil(t, s.Close())
+
+	reopened, err := NewStorageV1(context.Background(), _map.NewMapIndexerGenerator(), opts)
+	assert.Nil(t, err)
+
+	var reopenedDead int64
+	for _, sgStats := range reopened.Stats().Segments {
+		reopenedDead += sgStats.DeadBytes
+	}
+	assert.Equal(t, dead, reopenedDead)
+	assert.Nil(t, reopened.Close())
+
+	// With the default threshold, the segments past it
+	// are merged in the background after the next seal.
+	// Writing new keys seals a segment without shadowing
+	// anything.
+	opts.GarbageRatioThreshold = 0
+	reopened, err = NewStorageV1(context.Background(), _map.NewMapIndexerGenerator(), opts)
+	assert.Nil(t, err)
+	defer reopened.Close()
+	for i := 0; i < 5; i++ {
+		key := "new" + strconv.Itoa(i)
+		assert.Nil(t, reopened.Append([]byte(key), record(t, key, "value")))
+	}
+
+	reopened.scheduler.Wait()
+	stats = reopened.Stats()
+	for _, sgStats := range stats.Segments {
+		assert.LessOrEqual(t, sgStats.GarbageRatio, defaultGarbageRatioThreshold)
+	}
+
+	for i := 0; i < 5; i++ {
+		key := "key" + strconv.Itoa(i)
+		assert.Nil(t, reopened.Delete([]byte(key)))
+	}
+	for i := 0; i < 10; i++ {
+		key := "key" + strconv.Itoa(i)
+		data, err := reopened.Query([]byte(key))
+		if i < 5 {
+			assert.Equal(t, ErrDataNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, string(record(t, key, "value")), data)
+	}
+}
+
+// TestStorageV1_WriteDuringMerge ensures that writes carry
+// on while segments are merged, and that the records of
+// the merged segment they shadow are accounted as garbage.
+func TestStorageV1_WriteDuringMerge(t *testing.T) {
+	var (
+		s       *StorageV1
+		once    sync.Once
+		written = make(chan error, 1)
+	)
+	// The write is made while the first record is merged.
+	filter := mergecompaction.FilterFunc(func(key []byte, value interface{}) (mergecompaction.Decision, interface{}) {
+		once.Do(func() {
+			go func() {
+				written <- s.Append([]byte("key5"), record(t, "key5", "during"))
+			}()
+			select {
+			case err := <-written:
+				assert.Nil(t, err)
+			case <-time.After(time.Second):
+				t.Error("write held back by the merge")
+			}
+		})
+		return mergecompaction.Keep, nil
+	})
+
+	// No segment is ever past the threshold, so the
+	// segments are only merged here.
+	s, err := NewStorageV1(context.Background(), _map.NewMapIndexerGenerator(), Options{
+		Dir:                   t.TempDir(),
+		GarbageRatioThreshold: 1,
+		CompactionFilter:      filter,
+	})
+	assert.Nil(t, err)
+	defer s.Close()
+
+	for i := 0; i < 10; i++ {
+		key := "key" + strconv.Itoa(i)
+		assert.Nil(t, s.Append([]byte(key), record(t, key, "value")))
+	}
+
+	s.wl.Lock()
+	var run []*linkedlist.DLLNode
+	for node := s.fs; node != s.currSegment; node = node.Right {
+		run = append(run, node)
+	}
+	snap, err := s.mergeSnapshot()
+	s.wl.Unlock()
+	assert.Nil(t, err)
+	assert.Nil(t, s.merge(context.Background(), snap, run))
+	assert.Nil(t, s.versions.unpin(snap.v))
+
+	var dead int64
+	for _, sgStats := range s.Stats().Segments {
+		dead += sgStats.DeadBytes
+	}
+	assert.Equal(t, int64(len(record(t, "key5", "value"))+len(segmentDelimiter)), dead)
+
+	data, err := s.Query([]byte("key5"))
+	assert.Nil(t, err)
+	assert.Equal(t, string(record(t, "key5", "during")), data)
+}
+
+// TestStorageV1_WriteStall ensures that writes are blocked
+// once enough segments are waiting to be merged and carry
+// on after they're merged.
+func TestStorageV1_WriteStall(t *testing.T) {
+	opts := Options{
+		Dir:                   t.TempDir(),
+		GarbageRatioThreshold: 0.4,
+		SoftSegmentLimit:      2,
+		HardSegmentLimit:      3,
+	}
+	s, err := NewStorageV1(context.Background(), _map.NewMapIndexerGenerator(), opts)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	// Overwriting the same key leaves every sealed segment
+	// past the threshold.
+	s.PauseBackgroundWork()
+	for i := 0; s.Stats().WriteStall != WriteStallStop; i++ {
+		assert.Nil(t, s.Append([]byte("key"), record(t, "key", "value"+strconv.Itoa(i))))
+	}
+	stats := s.Stats()
+	assert.NotZero(t, stats.PendingCompactionBytes)
+	assert.NotZero(t, stats.StalledWrites)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Append([]byte("key"), record(t, "key", "last"))
+	}()
+	select {
+	case <-done:
+		t.Fatal("write went through past the hard segment limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.ResumeBackgroundWork()
+	assert.Nil(t, <-done)
+
+	data, err := s.Query([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, string(record(t, "key", "last")), data)
+}
+
+// TestStorageV1_Simulated ensures that a storage with a
+// simulated clock and a manual scheduler holds back writes
+// in the time of the clock, and that a write past the hard
+// segment limit runs the queued merge itself rather than
+// blocking.
+func TestStorageV1_Simulated(t *testing.T) {
+	c := clock.NewSim(time.Unix(0, 0))
+	var sched *scheduler.Scheduler
+	opts := Options{
+		FS:                    vfs.NewMemFSWithClock(c),
+		GarbageRatioThreshold: 0.4,
+		SoftSegmentLimit:      2,
+		HardSegmentLimit:      3,
+		Clock:                 c,
+		NewScheduler: func(ctx context.Context, _ int) *scheduler.Scheduler {
+			sched = scheduler.NewManualScheduler(ctx)
+			return sched
+		},
+	}
+	s, err := NewStorageV1(context.Background(), _map.NewMapIndexerGenerator(), opts)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	for i := 0; s.Stats().WriteStall != WriteStallStop; i++ {
+		assert.Nil(t, s.Append([]byte("key"), record(t, "key", "value"+strconv.Itoa(i))))
+	}
+	stats := s.Stats()
+	assert.Equal(t, []string{"merge"}, sched.Queued())
+	assert.Equal(t, time.Duration(stats.StalledWrites)*writeSlowdownDelay, stats.StallDuration)
+	assert.Equal(t, time.Unix(0, 0).Add(stats.StallDuration), c.Now())
+
+	assert.Nil(t, s.Append([]byte("key"), record(t, "key", "last")))
+	assert.NotEqual(t, WriteStallStop, s.Stats().WriteStall)
+
+	data, err := s.Query([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, string(record(t, "key", "last")), data)
+}
@@ -0,0 +1,347 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/dataobject"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/vlog"
+)
+
+// valueLogDirName is the name of the directory holding the
+// value log of a storage.
+const valueLogDirName = "vlog"
+
+// valueLog separates the records of a storage past the
+// value threshold into a value log, leaving the storage to
+// hold records pointing at them instead.
+//
+// Raw objects are always separated, whatever their size,
+// as the segments and tables can only hold the records
+// of marshalled Objects.
+type valueLog struct {
+	log       *vlog.Log
+	threshold int
+	gcRatio   float64
+	// collecting serialises the collections of the value
+	// log, which don't hold the write lock of the storage
+	// throughout.
+	collecting sync.Mutex
+}
+
+// openValueLog opens the value log in the directory of the
+// storage, creating it if there is none yet.
+func openValueLog(opts Options) (*valueLog, error) {
+	dir := filepath.Join(opts.Dir, valueLogDirName)
+
+	log, err := vlog.Open(dir, vlog.Options{
+		FileSize: opts.ValueLogFileSize,
+		FS:       opts.fs(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &valueLog{
+		log:       log,
+		threshold: opts.ValueThreshold,
+		gcRatio:   opts.valueLogGCRatio(),
+	}, nil
+}
+
+// separate returns the record to store for the data of the
+// key, which is a pointer to the data in the value log if
+// the data is past the threshold or is a raw object, and
+// the data itself otherwise. It also reports whether the
+// value log moved on to a new file, leaving a file to be
+// collected.
+func (vl *valueLog) separate(key, data string) (string, bool, error) {
+	raw := strings.HasPrefix(data, dataobject.RawMarker)
+	if !raw && (vl.threshold == 0 || len(data) <= vl.threshold) {
+		return data, false, nil
+	}
+	return vl.write(key, data)
+}
+
+// write appends the data of the key to the value log and
+// returns the record pointing at it, along with whether the
+// value log moved on to a new file.
+func (vl *valueLog) write(key, data string) (string, bool, error) {
+	p, err := vl.log.Append(key, []byte(data))
+	if err != nil {
+		return "", false, err
+	}
+
+	record, err := json.Marshal(dataobject.NewPointer([]byte(key), p))
+	if err != nil {
+		return "", false, err
+	}
+	return string(record), p.Offset == 0, nil
+}
+
+// resolve returns the data the record points at, or the
+// record itself if it holds its data.
+func (vl *valueLog) resolve(record string) (string, error) {
+	p, err := pointerOf(record)
+	if err != nil || p == nil {
+		return record, err
+	}
+
+	data, err := vl.log.Read(*p)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// recovered reports whether the value the record points
+// at, if any, survived the crash the storage recovers from.
+// The value log is committed before the records pointing
+// into it, so a record whose value was lost or torn was
+// never committed and is dropped like the writes after the
+// last commit which didn't survive.
+//
+// It also reports whether the record points into a file
+// which was collected. Such a record was replaced by a
+// later one, which the collection committed before the
+// file was removed, and is dropped on its own.
+func (vl *valueLog) recovered(record string) (ok, replaced bool, err error) {
+	_, err = vl.resolve(record)
+	switch err {
+	case nil:
+		return true, false, nil
+	case vlog.ErrCorruptEntry:
+		return false, false, nil
+	case vlog.ErrFileRemoved:
+		return false, true, nil
+	}
+	return false, false, err
+}
+
+// resolveForFilter resolves the records passed to the
+// compaction filter of the storage. A record pointing into
+// a file which was collected meanwhile is kept as it is,
+// since it has been replaced by a more recent record.
+func (vl *valueLog) resolveForFilter(record string) (string, bool, error) {
+	data, err := vl.resolve(record)
+	if err == vlog.ErrFileRemoved {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return data, true, nil
+}
+
+// query resolves the record returned by q, the lookup of a
+// query.
+//
+// The file of the value log a record points into may be
+// collected after the record was found, as a query doesn't
+// hold back collections. q is run again in that case, which
+// finds the record written in its place. A query which
+// finds its record just as the storage is closed sees
+// ErrStorageClosed.
+func (vl *valueLog) query(q func() (string, error)) (string, error) {
+	for {
+		record, err := q()
+		if err != nil {
+			return "", err
+		}
+
+		data, err := vl.resolve(record)
+		switch err {
+		case vlog.ErrFileRemoved:
+			continue
+		case vlog.ErrLogClosed:
+			return "", ErrStorageClosed
+		}
+		return data, err
+	}
+}
+
+// liveValue is a value in a file of the value log which
+// the storage still points at.
+type liveValue struct {
+	key string
+	p   dataobject.ValuePointer
+}
+
+// collect removes the files the value log moved on from
+// whose share of values which were overwritten or deleted
+// reaches the garbage collection ratio.
+//
+// current returns the record the storage holds for a key,
+// which tells whether a value is still live. The live
+// values of a file are appended again to the value log and
+// the records pointing at them are stored through rewrite.
+// sync commits the records of the storage to disk, which
+// is done before the file is removed.
+//
+// The files are read without holding wl, the write lock
+// of the storage, which is only taken to rewrite a value
+// and to sync. Whether the value is still live is checked
+// again with wl held, as a write may have replaced it
+// meanwhile. check tells whether the storage can still
+// be written to, once wl is taken.
+func (vl *valueLog) collect(
+	ctx context.Context,
+	wl sync.Locker,
+	check func() error,
+	current func(key string) (string, error),
+	rewrite func(key, record string) error,
+	sync func() error,
+) error {
+	vl.collecting.Lock()
+	defer vl.collecting.Unlock()
+
+	for _, id := range vl.log.SealedFiles() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var (
+			live      []liveValue
+			liveBytes int64
+			liveErr   error
+		)
+		err := vl.log.Iterate(id, func(key string, p dataobject.ValuePointer) bool {
+			var ok bool
+			ok, liveErr = isLiveValue(key, p, current)
+			if ok {
+				live = append(live, liveValue{key, p})
+				liveBytes += p.Size
+			}
+			return liveErr == nil
+		})
+		if err == nil {
+			err = liveErr
+		}
+		if err != nil {
+			return err
+		}
+
+		size := vl.log.FileSize(id)
+		if size > 0 && float64(size-liveBytes)/float64(size) < vl.gcRatio {
+			continue
+		}
+
+		for _, v := range live {
+			data, err := vl.log.Read(v.p)
+			if err != nil {
+				return err
+			}
+			err = vl.rewrite(wl, check, v, string(data), current, rewrite)
+			if err != nil {
+				return err
+			}
+		}
+
+		// The records which replaced the values the file holds
+		// are committed even if none was rewritten, or a crash
+		// could bring back the ones pointing into it.
+		wl.Lock()
+		err = check()
+		if err == nil {
+			err = vl.log.Sync()
+		}
+		if err == nil {
+			err = sync()
+		}
+		wl.Unlock()
+		if err != nil {
+			return err
+		}
+
+		err = vl.log.Remove(id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewrite appends the data of the live value to the value
+// log again and stores the record pointing at it through
+// rewrite, with wl held, unless the value was replaced
+// since it was found live.
+func (vl *valueLog) rewrite(
+	wl sync.Locker,
+	check func() error,
+	v liveValue,
+	data string,
+	current func(key string) (string, error),
+	rewrite func(key, record string) error,
+) error {
+	wl.Lock()
+	defer wl.Unlock()
+
+	err := check()
+	if err != nil {
+		return err
+	}
+	ok, err := isLiveValue(v.key, v.p, current)
+	if err != nil || !ok {
+		return err
+	}
+
+	record, _, err := vl.write(v.key, data)
+	if err != nil {
+		return err
+	}
+	return rewrite(v.key, record)
+}
+
+// isLiveValue reports whether the storage still points at
+// the value of the key.
+func isLiveValue(key string, p dataobject.ValuePointer, current func(key string) (string, error)) (bool, error) {
+	record, err := current(key)
+	if err == ErrDataNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	curr, err := pointerOf(record)
+	if err != nil {
+		return false, err
+	}
+	return curr != nil && *curr == p, nil
+}
+
+// sync commits the value log to disk. It's done before the
+// records pointing into the value log are committed, so
+// that a committed pointer never points at a value lost in
+// a crash.
+func (vl *valueLog) sync() error {
+	return vl.log.Sync()
+}
+
+// sealed reports whether the value log moved on from any
+// of its files, which a collection may remove.
+func (vl *valueLog) sealed() bool {
+	return len(vl.log.SealedFiles()) > 0
+}
+
+// size returns the size of the value log.
+func (vl *valueLog) size() int64 {
+	return vl.log.Size()
+}
+
+// close closes the value log.
+func (vl *valueLog) close() error {
+	return vl.log.Close()
+}
+
+// pointerOf returns the value pointer of the record, or nil
+// if it holds its data. Records which can't be pointers
+// are told apart without being parsed.
+func pointerOf(record string) (*dataobject.ValuePointer, error) {
+	if !strings.Contains(record, `"Pointer":`) {
+		return nil, nil
+	}
+	return dataobject.PointerOf([]byte(record))
+}
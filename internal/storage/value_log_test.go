@@ -0,0 +1,434 @@
+package storage
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/dataobject"
+	_map "github.com/SystemBuilders/KeyValueStore/internal/indexer/map"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/linkedlist"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/mergecompaction"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/segment"
+	"github.com/SystemBuilders/KeyValueStore/internal/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+// valueLogStorage is a storage which can separate its
+// records into a value log.
+type valueLogStorage interface {
+	Storage
+	ValueLogGC() error
+}
+
+// valueLogStorages create the storages which can separate
+// their records into a value log.
+var valueLogStorages = map[string]func(opts Options) (valueLogStorage, error){
+	"v1": func(opts Options) (valueLogStorage, error) {
+		return NewStorageV1(context.Background(), _map.NewMapIndexerGenerator(), opts)
+	},
+	"sst": func(opts Options) (valueLogStorage, error) {
+		return NewSSTStorage(context.Background(), _map.NewMapIndexerGenerator(), opts)
+	},
+}
+
+// waitForBackgroundWork waits for the background work
+// scheduled by the storage to be done.
+func waitForBackgroundWork(s Storage) {
+	switch s := s.(type) {
+	case *StorageV1:
+		s.scheduler.Wait()
+	case *SSTStorage:
+		s.scheduler.Wait()
+	}
+}
+
+// TestValueLog_Separation ensures that records past the
+// value threshold are kept in the value log and served
+// from it, including after the storage is created again.
+func TestValueLog_Separation(t *testing.T) {
+	for name, newStorage := range valueLogStorages {
+		t.Run(name, func(t *testing.T) {
+			opts := Options{Dir: t.TempDir(), ValueThreshold: 100}
+			s, err := newStorage(opts)
+			assert.Nil(t, err)
+
+			big := record(t, "big", strings.Repeat("v", 500))
+			small := record(t, "small", "value")
+			assert.Nil(t, s.Append([]byte("big"), big))
+			assert.Nil(t, s.Append([]byte("small"), small))
+			assert.Nil(t, s.Append([]byte("deleted"), big))
+			assert.Nil(t, s.Delete([]byte("deleted")))
+
+			size := s.Stats().ValueLogSize
+			assert.Greater(t, size, int64(2*len(big)))
+			assert.Less(t, size, int64(3*len(big)))
+
+			check := func(s Storage) {
+				data, err := s.Query([]byte("big"))
+				assert.Nil(t, err)
+				assert.Equal(t, string(big), data)
+				data, err = s.Query([]byte("small"))
+				assert.Nil(t, err)
+				assert.Equal(t, string(small), data)
+				_, err = s.Query([]byte("deleted"))
+				assert.Equal(t, ErrDataNotFound, err)
+			}
+
+			check(s)
+			reopened := reopen(t, s, newStorage, opts)
+			defer reopened.Close()
+			check(reopened)
+		})
+	}
+}
+
+// TestValueLog_RawObjects ensures that raw objects are kept
+// in the value log even without a value threshold, so the
+// segments holding pointers to them can be scanned again
+// whatever bytes the objects hold.
+func TestValueLog_RawObjects(t *testing.T) {
+	for name, newStorage := range valueLogStorages {
+		t.Run(name, func(t *testing.T) {
+			opts := Options{Dir: t.TempDir()}
+			s, err := newStorage(opts)
+			assert.Nil(t, err)
+
+			raw := dataobject.NewRaw([]byte("\x00{" + segmentDelimiter + "\xff"))
+			assert.Nil(t, s.Append([]byte("raw"), raw))
+			small := record(t, "small", "value")
+			assert.Nil(t, s.Append([]byte("small"), small))
+			size := s.Stats().ValueLogSize
+			assert.Greater(t, size, int64(len(raw)))
+			assert.Less(t, size, int64(len(raw)+len(small)))
+
+			check := func(s Storage) {
+				data, err := s.Query([]byte("raw"))
+				assert.Nil(t, err)
+				assert.Equal(t, string(raw), data)
+				data, err = s.Query([]byte("small"))
+				assert.Nil(t, err)
+				assert.Equal(t, string(small), data)
+			}
+
+			check(s)
+			reopened := reopen(t, s, newStorage, opts)
+			defer reopened.Close()
+			check(reopened)
+		})
+	}
+}
+
+// TestValueLog_GC ensures that collecting the value log
+// reclaims the space of overwritten and deleted values and
+// keeps the live ones readable.
+func TestValueLog_GC(t *testing.T) {
+	for name, newStorage := range valueLogStorages {
+		t.Run(name, func(t *testing.T) {
+			opts := Options{
+				Dir:              t.TempDir(),
+				ValueThreshold:   64,
+				ValueLogFileSize: 4096,
+			}
+			s, err := newStorage(opts)
+			assert.Nil(t, err)
+
+			value := func(key string, version int) []byte {
+				return record(t, key, strconv.Itoa(version)+strings.Repeat("v", 300))
+			}
+			for v := 0; v < 20; v++ {
+				for k := 0; k < 10; k++ {
+					key := "key" + strconv.Itoa(k)
+					assert.Nil(t, s.Append([]byte(key), value(key, v)))
+				}
+			}
+			for k := 0; k < 5; k++ {
+				assert.Nil(t, s.Delete([]byte("key"+strconv.Itoa(k))))
+			}
+
+			waitForBackgroundWork(s)
+			assert.Nil(t, s.ValueLogGC())
+			waitForBackgroundWork(s)
+
+			// Only the live values and the head of the value
+			// log are left.
+			assert.Less(t, s.Stats().ValueLogSize, int64(3*opts.ValueLogFileSize))
+
+			check := func(s Storage) {
+				for k := 0; k < 10; k++ {
+					key := "key" + strconv.Itoa(k)
+					data, err := s.Query([]byte(key))
+					if k < 5 {
+						assert.Equal(t, ErrDataNotFound, err)
+						continue
+					}
+					assert.Nil(t, err)
+					assert.Equal(t, string(value(key, 19)), data)
+				}
+			}
+
+			check(s)
+			reopened := reopen(t, s, newStorage, opts)
+			defer reopened.Close()
+			check(reopened)
+		})
+	}
+}
+
+// TestValueLog_CompactionFilter ensures that the compaction
+// filter is passed the values kept in the value log rather
+// than the records pointing at them.
+func TestValueLog_CompactionFilter(t *testing.T) {
+	for name, newStorage := range valueLogStorages {
+		t.Run(name, func(t *testing.T) {
+			var (
+				mu       sync.Mutex
+				filtered []interface{}
+			)
+			filter := mergecompaction.FilterFunc(func(key []byte, value interface{}) (mergecompaction.Decision, interface{}) {
+				mu.Lock()
+				defer mu.Unlock()
+				filtered = append(filtered, value)
+				return mergecompaction.Keep, nil
+			})
+
+			s, err := newStorage(Options{
+				Dir:              t.TempDir(),
+				MemtableSize:     512,
+				ValueThreshold:   64,
+				CompactionFilter: filter,
+			})
+			assert.Nil(t, err)
+			defer s.Close()
+
+			// Raw objects are merged along with the records
+			// but aren't passed to the filter.
+			value := strings.Repeat("v", 300)
+			raw := dataobject.NewRaw([]byte(value))
+			for v := 0; v < 50; v++ {
+				for k := 0; k < 10; k++ {
+					key := "key" + strconv.Itoa(k)
+					assert.Nil(t, s.Append([]byte(key), record(t, key, value)))
+				}
+				assert.Nil(t, s.Append([]byte("raw"), raw))
+			}
+			waitForBackgroundWork(s)
+
+			// Every pointer record fills a segment of a
+			// StorageV1 by itself, so its segments are either
+			// all garbage or not garbage at all and only the
+			// former are merged. The rest are merged here.
+			if s, ok := s.(*StorageV1); ok {
+				s.wl.Lock()
+				var run []*linkedlist.DLLNode
+				for node := s.fs; node != s.currSegment; node = node.Right {
+					run = append(run, node)
+				}
+				snap, err := s.mergeSnapshot()
+				s.wl.Unlock()
+				assert.Nil(t, err)
+				assert.Nil(t, s.merge(context.Background(), snap, run))
+				assert.Nil(t, s.versions.unpin(snap.v))
+			}
+
+			data, err := s.Query([]byte("raw"))
+			assert.Nil(t, err)
+			assert.Equal(t, string(raw), data)
+
+			mu.Lock()
+			defer mu.Unlock()
+			assert.NotEmpty(t, filtered)
+			for _, v := range filtered {
+				assert.Equal(t, value, v)
+			}
+		})
+	}
+}
+
+// TestValueLog_ConcurrentAccess ensures that the storages
+// can be written to and queried at once while they collect
+// their value logs, which is meant to be run with -race.
+func TestValueLog_ConcurrentAccess(t *testing.T) {
+	for name, newStorage := range valueLogStorages {
+		t.Run(name, func(t *testing.T) {
+			s, err := newStorage(Options{
+				Dir:              t.TempDir(),
+				MemtableSize:     512,
+				ValueThreshold:   32,
+				ValueLogFileSize: 1024,
+			})
+			assert.Nil(t, err)
+			defer s.Close()
+
+			testConcurrentAccess(t, s)
+			waitForBackgroundWork(s)
+			assert.Nil(t, s.ValueLogGC())
+		})
+	}
+}
+
+// reopen closes the storage and creates it again.
+func reopen(
+	t *testing.T,
+	s Storage,
+	newStorage func(opts Options) (valueLogStorage, error),
+	opts Options,
+) Storage {
+	assert.Nil(t, s.Close())
+	reopened, err := newStorage(opts)
+	assert.Nil(t, err)
+	return reopened
+}
+
+// hookLocker is a mutex which runs a hook whenever it's
+// locked, and tells whether it's held.
+type hookLocker struct {
+	sync.Mutex
+	held   bool
+	onLock func()
+}
+
+func (l *hookLocker) Lock() {
+	l.Mutex.Lock()
+	l.held = true
+	if l.onLock != nil {
+		l.onLock()
+	}
+}
+
+func (l *hookLocker) Unlock() {
+	l.held = false
+	l.Mutex.Unlock()
+}
+
+// TestValueLog_CollectLocking ensures that a collection only
+// holds the write lock of the storage to rewrite the values
+// it moves and to sync, and leaves out a value replaced by
+// a write made while it didn't hold it.
+func TestValueLog_CollectLocking(t *testing.T) {
+	vl, err := openValueLog(Options{
+		Dir:              t.TempDir(),
+		ValueThreshold:   1,
+		ValueLogFileSize: 256,
+		ValueLogGCRatio:  0.1,
+	})
+	assert.Nil(t, err)
+	defer vl.close()
+
+	// Every other key is deleted, leaving garbage in every
+	// file.
+	records := make(map[string]string)
+	for i := 0; i < 8; i++ {
+		key := "key" + strconv.Itoa(i)
+		record, _, err := vl.write(key, strings.Repeat("v", 100))
+		assert.Nil(t, err)
+		if i%2 == 0 {
+			records[key] = record
+		}
+	}
+
+	var live []string
+	sealed := vl.log.SealedFiles()
+	for _, id := range sealed {
+		assert.Nil(t, vl.log.Iterate(id, func(key string, p dataobject.ValuePointer) bool {
+			if _, ok := records[key]; ok && key != "key0" {
+				live = append(live, key)
+			}
+			return true
+		}))
+	}
+	assert.NotEmpty(t, live)
+
+	var (
+		wl            = &hookLocker{}
+		unlockedReads int
+		rewritten     []string
+	)
+	// key0 is overwritten as soon as the lock is taken to
+	// rewrite its value.
+	wl.onLock = func() {
+		records["key0"] = string(record(t, "key0", "small"))
+		wl.onLock = nil
+	}
+	current := func(key string) (string, error) {
+		if !wl.held {
+			unlockedReads++
+		}
+		data, ok := records[key]
+		if !ok {
+			return "", ErrDataNotFound
+		}
+		return data, nil
+	}
+	rewrite := func(key, record string) error {
+		assert.True(t, wl.held)
+		rewritten = append(rewritten, key)
+		records[key] = record
+		return nil
+	}
+	sync := func() error {
+		assert.True(t, wl.held)
+		return nil
+	}
+
+	check := func() error { return nil }
+	assert.Nil(t, vl.collect(context.Background(), wl, check, current, rewrite, sync))
+	assert.Equal(t, live, rewritten)
+	assert.GreaterOrEqual(t, unlockedReads, 2*len(live))
+	for _, id := range vl.log.SealedFiles() {
+		assert.NotContains(t, sealed, id)
+	}
+	assert.Equal(t, string(record(t, "key0", "small")), records["key0"])
+}
+
+// TestValueLog_CrashAfterGC ensures that a StorageV1 which
+// crashed after collecting its value log recovers a record
+// the collection wrote to the active segment behind the
+// record it replaced, which points into the removed file.
+func TestValueLog_CrashAfterGC(t *testing.T) {
+	fs := vfs.NewFaultFS(vfs.FaultOptions{})
+	opts := Options{
+		Dir:              "store",
+		FS:               fs,
+		ValueThreshold:   64,
+		ValueLogFileSize: 200,
+	}
+	s, err := NewStorageV1(context.Background(), _map.NewMapIndexerGenerator(), opts)
+	assert.Nil(t, err)
+
+	value := record(t, "key", strings.Repeat("v", 100))
+	assert.Nil(t, s.Append([]byte("key"), value))
+
+	// Values whose records never made it to the storage,
+	// as after a crash, leave garbage in the file of the
+	// value and move the value log on to a new file, while
+	// the active segment holds the record of the key alone.
+	for _, key := range []string{"lost0", "lost1"} {
+		_, err = s.values.log.Append(key, record(t, key, strings.Repeat("v", 100)))
+		assert.Nil(t, err)
+	}
+	assert.Len(t, s.values.log.SealedFiles(), 1)
+
+	// The collection moves the value of the key, writing
+	// the record pointing at it to the active segment next
+	// to the one pointing into the file it removes.
+	active := (s.currSegment.Value).(*segment.Segment)
+	assert.Nil(t, s.ValueLogGC())
+	assert.Empty(t, s.values.log.SealedFiles())
+	entries, err := active.Entries()
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+
+	fs.Crash()
+	s.Close()
+	fs.Restart()
+
+	s, err = NewStorageV1(context.Background(), _map.NewMapIndexerGenerator(), opts)
+	assert.Nil(t, err)
+	defer s.Close()
+	data, err := s.Query([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, string(value), data)
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/segment"
+)
+
+// version is an immutable set of the segments which made
+// up a storage at some point.
+//
+// Queries pin the current version of the storage and read
+// the segments through it, so a merge or compaction can
+// install a new version meanwhile without pulling the
+// segments out from under them. A version holds a
+// reference on each of its segments, so the segments
+// merged away are only removed once no version holding
+// them is pinned any more.
+type version struct {
+	// levels hold the segments of the version, in the
+	// order the storage looks through them.
+	levels [][]*segment.Segment
+	// refs counts the references held on the version, one
+	// of which is held by the storage while the version is
+	// current.
+	refs int32
+}
+
+// newVersion returns a version holding the segments of
+// the levels, with the reference of the storage taken on
+// it.
+func newVersion(levels [][]*segment.Segment) *version {
+	v := &version{
+		levels: make([][]*segment.Segment, len(levels)),
+		refs:   1,
+	}
+	for level, segments := range levels {
+		v.levels[level] = append([]*segment.Segment{}, segments...)
+		for _, sg := range segments {
+			sg.Ref()
+		}
+	}
+	return v
+}
+
+// ref takes a reference on the version.
+func (v *version) ref() {
+	atomic.AddInt32(&v.refs, 1)
+}
+
+// unref releases a reference on the version. Releasing
+// the last one releases the segments of the version, which
+// removes the ones made obsolete meanwhile.
+func (v *version) unref() error {
+	if atomic.AddInt32(&v.refs, -1) > 0 {
+		return nil
+	}
+
+	var firstErr error
+	for _, segments := range v.levels {
+		for _, sg := range segments {
+			err := sg.Unref()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// versionSet holds the current version of a storage and
+// keeps track of the queries pinning its versions.
+//
+// The versionSet doesn't lock anything itself. The storage
+// must hold its lock for reading to pin a version and for
+// writing to install one.
+type versionSet struct {
+	current *version
+	// readers counts the queries which pinned a version and
+	// haven't released it yet.
+	readers sync.WaitGroup
+}
+
+// install makes a new version of the segments of the
+// levels current, releasing the reference of the storage
+// on the previous one.
+func (vs *versionSet) install(levels [][]*segment.Segment) error {
+	prev := vs.current
+	vs.current = newVersion(levels)
+	if prev == nil {
+		return nil
+	}
+	return prev.unref()
+}
+
+// pin takes a reference on the current version for a
+// query, which must release it with unpin.
+func (vs *versionSet) pin() *version {
+	vs.readers.Add(1)
+	vs.current.ref()
+	return vs.current
+}
+
+// unpin releases the reference a query took with pin.
+func (vs *versionSet) unpin(v *version) error {
+	defer vs.readers.Done()
+	return v.unref()
+}
+
+// wait blocks until every pinned version is released. It
+// must only be called once nothing pins a version any more.
+func (vs *versionSet) wait() {
+	vs.readers.Wait()
+}
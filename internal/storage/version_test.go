@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/clock"
+	_map "github.com/SystemBuilders/KeyValueStore/internal/indexer/map"
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/segment"
+	"github.com/SystemBuilders/KeyValueStore/internal/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestVersionSet_PinnedSegments ensures that a segment made
+// obsolete while a pinned version holds it stays readable
+// and is only removed once the version is released.
+func TestVersionSet_PinnedSegments(t *testing.T) {
+	dir := t.TempDir()
+	sg, err := segment.CreateSegment(vfs.OS, dir, segment.NewIDs(clock.Real), 0, _map.NewMapIndexer())
+	assert.Nil(t, err)
+	assert.Nil(t, sg.Append("key", string(record(t, "key", "value"))))
+	assert.Nil(t, sg.Seal())
+
+	var vs versionSet
+	assert.Nil(t, vs.install([][]*segment.Segment{{sg}}))
+	v := vs.pin()
+
+	// The segment is merged away while the version is
+	// pinned.
+	assert.Nil(t, vs.install([][]*segment.Segment{{}}))
+	assert.Nil(t, sg.Obsolete())
+
+	data, err := sg.Query("key")
+	assert.Nil(t, err)
+	assert.Equal(t, string(record(t, "key", "value")), data)
+
+	ids, err := segment.ListSegmentIDs(vfs.OS, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{sg.ID()}, ids)
+
+	assert.Nil(t, vs.unpin(v))
+	vs.wait()
+
+	ids, err = segment.ListSegmentIDs(vfs.OS, dir)
+	assert.Nil(t, err)
+	assert.Empty(t, ids)
+}
+
+// TestStorageV1_QueryDuringMerge ensures that a query which
+// pinned a version before a merge keeps reading the merged
+// segments, which are removed once the query is done.
+func TestStorageV1_QueryDuringMerge(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStorageV1(context.Background(), _map.NewMapIndexerGenerator(), Options{Dir: dir})
+	assert.Nil(t, err)
+	defer s.Close()
+	s.PauseBackgroundWork()
+
+	for i := 0; i < 6; i++ {
+		assert.Nil(t, s.Append([]byte("key"), record(t, "key", "value")))
+	}
+
+	s.l.RLock()
+	v := s.versions.pin()
+	s.l.RUnlock()
+	pinned := v.levels[0][len(v.levels[0])-1]
+
+	s.ResumeBackgroundWork()
+	s.scheduler.Wait()
+	assert.Nil(t, s.scheduler.Err())
+	assert.Less(t, len(s.Stats().Segments), len(v.levels[0]))
+
+	data, err := s.query(v, "key")
+	assert.Nil(t, err)
+	assert.Equal(t, string(record(t, "key", "value")), data)
+	ids, err := segment.ListSegmentIDs(vfs.OS, dir)
+	assert.Nil(t, err)
+	assert.Contains(t, ids, pinned.ID())
+
+	assert.Nil(t, s.versions.unpin(v))
+	ids, err = segment.ListSegmentIDs(vfs.OS, dir)
+	assert.Nil(t, err)
+	assert.NotContains(t, ids, pinned.ID())
+}
@@ -0,0 +1,21 @@
+package vlog
+
+// Error is a helper type for creating constant errors.
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+const (
+	// ErrFileRemoved indicates that a value was read from a file
+	// which was removed, after its live values were moved out of it.
+	ErrFileRemoved Error = "the value log file was removed"
+	// ErrCorruptEntry indicates that an entry of the value log failed
+	// its checksum or doesn't match the pointer it was read with.
+	ErrCorruptEntry Error = "the value log entry is corrupt"
+	// ErrHeadFile indicates an attempt to remove the file the value
+	// log is appending to.
+	ErrHeadFile Error = "the file being appended to can't be removed"
+	// ErrLogClosed indicates that the value log was used after it
+	// was closed.
+	ErrLogClosed Error = "the value log is closed"
+)
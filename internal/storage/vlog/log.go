@@ -0,0 +1,482 @@
+package vlog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/dataobject"
+	"github.com/SystemBuilders/KeyValueStore/internal/vfs"
+)
+
+const (
+	// fileExt is the extension of the files of a value
+	// log.
+	fileExt = ".vlog"
+	// DefaultFileSize is the size of the files of a value
+	// log if none is set.
+	DefaultFileSize = 64 << 20
+)
+
+// Options holds the settings of a value log.
+type Options struct {
+	// FileSize is the size past which the file being
+	// appended to is left for a new one.
+	//
+	// A zero value means DefaultFileSize.
+	FileSize int64
+	// FS is the filesystem holding the directory of the
+	// log.
+	//
+	// A nil value means vfs.OS.
+	FS vfs.FS
+}
+
+// fileSize returns the file size of the options, applying
+// the default.
+func (opts Options) fileSize() int64 {
+	if opts.FileSize == 0 {
+		return DefaultFileSize
+	}
+	return opts.FileSize
+}
+
+// fs returns the filesystem of the options, applying the
+// default.
+func (opts Options) fs() vfs.FS {
+	if opts.FS == nil {
+		return vfs.OS
+	}
+	return opts.FS
+}
+
+// Log is a value log, which holds values apart from the
+// segments of a storage so that merges and compactions
+// only rewrite small pointers to them rather than the
+// values themselves.
+//
+// The values are appended to the head file of the log,
+// each as an entry laid out as,
+//
+//	crc32 | key length | data length | key | data
+//
+// where the lengths are uvarints and the checksum covers
+// everything after it. Once the head file is full, a new
+// head file is started. The files before it are never
+// appended to again, and are removed once the values in
+// them which are still live were appended again to the
+// head file.
+//
+// A new head file is started every time the log is opened,
+// unless the last file is empty, so an entry torn by a
+// crash is always the last one of its file.
+//
+// Log is safe for concurrent use.
+type Log struct {
+	dir  string
+	opts Options
+	fs   vfs.FS
+	// mu guards the fields below it.
+	mu sync.RWMutex
+	// files hold every file of the log by id.
+	files map[int64]vfs.File
+	// sizes hold the size of every file of the log.
+	sizes map[int64]int64
+	// head is the id of the file being appended to.
+	head   int64
+	closed bool
+}
+
+// Open opens the value log in the directory, creating the
+// directory if it doesn't exist, and starts a new head
+// file.
+func Open(dir string, opts Options) (*Log, error) {
+	fs := opts.fs()
+	err := fs.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := listFileIDs(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{
+		dir:   dir,
+		opts:  opts,
+		fs:    fs,
+		files: make(map[int64]vfs.File),
+		sizes: make(map[int64]int64),
+	}
+	for _, id := range ids {
+		f, err := vfs.Open(fs, l.path(id))
+		if err == nil {
+			var info os.FileInfo
+			info, err = f.Stat()
+			if err == nil {
+				l.files[id], l.sizes[id] = f, info.Size()
+			}
+		}
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l.head = id
+	}
+
+	// A last file which was never written to holds no torn
+	// entry, so it's started over as the head file rather
+	// than left behind empty.
+	if len(ids) > 0 && l.sizes[l.head] == 0 {
+		l.files[l.head].Close()
+		delete(l.files, l.head)
+		delete(l.sizes, l.head)
+		l.head--
+	}
+
+	err = l.startHead()
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Append appends the data of the key to the head file and
+// returns the pointer to it.
+//
+// This is a race-safe method.
+func (l *Log) Append(key string, data []byte) (dataobject.ValuePointer, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return dataobject.ValuePointer{}, ErrLogClosed
+	}
+	if l.sizes[l.head] >= l.opts.fileSize() {
+		err := l.files[l.head].Sync()
+		if err == nil {
+			err = l.startHead()
+		}
+		if err != nil {
+			return dataobject.ValuePointer{}, err
+		}
+	}
+
+	entry := encodeEntry(key, data)
+	p := dataobject.ValuePointer{
+		File:   l.head,
+		Offset: l.sizes[l.head],
+		Size:   int64(len(entry)),
+	}
+	_, err := l.files[l.head].WriteAt(entry, p.Offset)
+	if err != nil {
+		return dataobject.ValuePointer{}, err
+	}
+
+	l.sizes[l.head] += p.Size
+	return p, nil
+}
+
+// Read returns the data the pointer points at.
+// ErrFileRemoved is returned if the file it points into
+// was removed.
+//
+// This is a race-safe method.
+func (l *Log) Read(p dataobject.ValuePointer) ([]byte, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return nil, ErrLogClosed
+	}
+	f, ok := l.files[p.File]
+	if !ok {
+		return nil, ErrFileRemoved
+	}
+
+	buf := make([]byte, p.Size)
+	_, err := f.ReadAt(buf, p.Offset)
+	if err == io.EOF {
+		return nil, ErrCorruptEntry
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, data, err := decodeEntry(buf)
+	return data, err
+}
+
+// Iterate calls fn with the key of every entry of the file
+// and the pointer to it, in the order they were appended,
+// until fn returns false. An entry torn by a crash at the
+// end of the file ends the iteration.
+//
+// This is a race-safe method.
+func (l *Log) Iterate(id int64, fn func(key string, p dataobject.ValuePointer) bool) error {
+	l.mu.RLock()
+	f, ok := l.files[id]
+	size := l.sizes[id]
+	l.mu.RUnlock()
+
+	if !ok {
+		return ErrFileRemoved
+	}
+
+	var (
+		r      = bufio.NewReader(io.NewSectionReader(f, 0, size))
+		offset int64
+	)
+	for offset < size {
+		n, key, err := readEntry(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == ErrCorruptEntry {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if !fn(key, dataobject.ValuePointer{File: id, Offset: offset, Size: n}) {
+			return nil
+		}
+		offset += n
+	}
+	return nil
+}
+
+// Sync commits the head file to disk. The files before it
+// were committed as they were left.
+//
+// This is a race-safe method.
+func (l *Log) Sync() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return ErrLogClosed
+	}
+	return l.files[l.head].Sync()
+}
+
+// SealedFiles returns the ids of the files before the head
+// file, oldest first.
+//
+// This is a race-safe method.
+func (l *Log) SealedFiles() []int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var ids []int64
+	for id := range l.files {
+		if id != l.head {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// FileSize returns the size of the file.
+//
+// This is a race-safe method.
+func (l *Log) FileSize(id int64) int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.sizes[id]
+}
+
+// Size returns the total size of the files of the log.
+//
+// This is a race-safe method.
+func (l *Log) Size() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var size int64
+	for _, fileSize := range l.sizes {
+		size += fileSize
+	}
+	return size
+}
+
+// Remove removes the file, which must not be the head
+// file. The values in it can't be read anymore.
+//
+// This is a race-safe method.
+func (l *Log) Remove(id int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrLogClosed
+	}
+	if id == l.head {
+		return ErrHeadFile
+	}
+
+	f, ok := l.files[id]
+	if !ok {
+		return nil
+	}
+	delete(l.files, id)
+	delete(l.sizes, id)
+
+	err := f.Close()
+	if err != nil {
+		return err
+	}
+	return l.fs.Remove(l.path(id))
+}
+
+// Close commits the head file to disk and closes the
+// files of the log.
+//
+// This is a race-safe method.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+
+	var err error
+	if f, ok := l.files[l.head]; ok {
+		err = f.Sync()
+	}
+	for _, f := range l.files {
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// startHead creates a new head file after the last one and
+// must be called with mu held.
+func (l *Log) startHead() error {
+	id := l.head + 1
+	f, err := l.fs.OpenFile(l.path(id), os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+
+	l.files[id], l.sizes[id] = f, 0
+	l.head = id
+	return nil
+}
+
+// path returns the path of the file.
+func (l *Log) path(id int64) string {
+	return filepath.Join(l.dir, strconv.FormatInt(id, 10)+fileExt)
+}
+
+// listFileIDs returns the ids of the value log files in
+// the directory of the filesystem in increasing order.
+func listFileIDs(fs vfs.FS, dir string) ([]int64, error) {
+	infos, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int64
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, fileExt) {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(name, fileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// encodeEntry returns the entry holding the data of the
+// key.
+func encodeEntry(key string, data []byte) []byte {
+	buf := make([]byte, 4+2*binary.MaxVarintLen64+len(key)+len(data))
+	n := 4
+	n += binary.PutUvarint(buf[n:], uint64(len(key)))
+	n += binary.PutUvarint(buf[n:], uint64(len(data)))
+	n += copy(buf[n:], key)
+	n += copy(buf[n:], data)
+
+	binary.BigEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[4:n]))
+	return buf[:n]
+}
+
+// decodeEntry returns the key and data of the entry, which
+// must be the whole of buf.
+func decodeEntry(buf []byte) (string, []byte, error) {
+	if len(buf) < 4 || binary.BigEndian.Uint32(buf) != crc32.ChecksumIEEE(buf[4:]) {
+		return "", nil, ErrCorruptEntry
+	}
+
+	p := buf[4:]
+	keyLen, n := binary.Uvarint(p)
+	if n <= 0 {
+		return "", nil, ErrCorruptEntry
+	}
+	p = p[n:]
+	dataLen, n := binary.Uvarint(p)
+	if n <= 0 || uint64(len(p)-n) != keyLen+dataLen {
+		return "", nil, ErrCorruptEntry
+	}
+	p = p[n:]
+
+	return string(p[:keyLen]), p[keyLen:], nil
+}
+
+// readEntry reads the next entry and returns its size
+// and key.
+func readEntry(r *bufio.Reader) (int64, string, error) {
+	header := make([]byte, 4)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, "", err
+	}
+
+	keyLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, "", err
+	}
+	dataLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, "", err
+	}
+
+	var lens [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lens[:], keyLen)
+	n += binary.PutUvarint(lens[n:], dataLen)
+
+	body := make([]byte, keyLen+dataLen)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return 0, "", err
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write(lens[:n])
+	crc.Write(body)
+	if crc.Sum32() != binary.BigEndian.Uint32(header) {
+		return 0, "", ErrCorruptEntry
+	}
+
+	return int64(4 + n + len(body)), string(body[:keyLen]), nil
+}
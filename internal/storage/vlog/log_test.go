@@ -0,0 +1,126 @@
+package vlog
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/dataobject"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLog_AppendAndRead(t *testing.T) {
+	l, err := Open(t.TempDir(), Options{})
+	assert.Nil(t, err)
+	defer l.Close()
+
+	p1, err := l.Append("a", []byte("first value"))
+	assert.Nil(t, err)
+	p2, err := l.Append("b", []byte("second value"))
+	assert.Nil(t, err)
+	assert.Equal(t, p1.File, p2.File)
+	assert.Equal(t, p1.Offset+p1.Size, p2.Offset)
+
+	data, err := l.Read(p1)
+	assert.Nil(t, err)
+	assert.Equal(t, "first value", string(data))
+	data, err = l.Read(p2)
+	assert.Nil(t, err)
+	assert.Equal(t, "second value", string(data))
+
+	_, err = l.Read(dataobject.ValuePointer{File: p1.File, Offset: p1.Offset + 1, Size: p1.Size})
+	assert.Equal(t, ErrCorruptEntry, err)
+	assert.Equal(t, p1.Size+p2.Size, l.Size())
+}
+
+func TestLog_RotatesAndRemovesFiles(t *testing.T) {
+	l, err := Open(t.TempDir(), Options{FileSize: 64})
+	assert.Nil(t, err)
+	defer l.Close()
+
+	value := bytes.Repeat([]byte("v"), 40)
+	var pointers []dataobject.ValuePointer
+	for _, key := range []string{"a", "b", "c", "d"} {
+		p, err := l.Append(key, value)
+		assert.Nil(t, err)
+		pointers = append(pointers, p)
+	}
+
+	sealed := l.SealedFiles()
+	assert.Equal(t, pointers[0].File, pointers[1].File)
+	assert.Equal(t, pointers[0].File+1, pointers[2].File)
+	assert.Equal(t, []int64{pointers[0].File}, sealed)
+
+	var keys []string
+	err = l.Iterate(sealed[0], func(key string, p dataobject.ValuePointer) bool {
+		keys = append(keys, key)
+		assert.Contains(t, pointers, p)
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, keys)
+
+	assert.Nil(t, l.Remove(sealed[0]))
+	_, err = l.Read(pointers[0])
+	assert.Equal(t, ErrFileRemoved, err)
+	assert.Equal(t, ErrFileRemoved, l.Iterate(sealed[0], nil))
+	assert.Equal(t, ErrHeadFile, l.Remove(pointers[3].File))
+
+	data, err := l.Read(pointers[3])
+	assert.Nil(t, err)
+	assert.Equal(t, value, data)
+}
+
+func TestLog_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, Options{})
+	assert.Nil(t, err)
+	p1, err := l.Append("a", []byte("kept"))
+	assert.Nil(t, err)
+	p2, err := l.Append("b", []byte("torn"))
+	assert.Nil(t, err)
+	assert.Nil(t, l.Close())
+
+	// Tear the last entry as a crash while writing it would.
+	path := filepath.Join(dir, "1"+fileExt)
+	assert.Nil(t, os.Truncate(path, p2.Offset+p2.Size-1))
+
+	l, err = Open(dir, Options{})
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{p1.File}, l.SealedFiles())
+
+	data, err := l.Read(p1)
+	assert.Nil(t, err)
+	assert.Equal(t, "kept", string(data))
+
+	var keys []string
+	err = l.Iterate(p1.File, func(key string, _ dataobject.ValuePointer) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a"}, keys)
+
+	p, err := l.Append("c", []byte("new"))
+	assert.Nil(t, err)
+	assert.Equal(t, p1.File+1, p.File)
+
+	assert.Nil(t, l.Close())
+
+	// The head file left empty is started over on the
+	// next open.
+	for i := 0; i < 2; i++ {
+		l, err = Open(dir, Options{})
+		assert.Nil(t, err)
+		assert.Equal(t, []int64{p1.File, p.File}, l.SealedFiles())
+		assert.Nil(t, l.Close())
+	}
+
+	l, err = Open(dir, Options{})
+	assert.Nil(t, err)
+	defer l.Close()
+	p, err = l.Append("d", []byte("newer"))
+	assert.Nil(t, err)
+	assert.Equal(t, p1.File+2, p.File)
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/storage/scheduler"
+)
+
+// WriteStall describes how writes to a storage are held
+// back while its background work catches up.
+type WriteStall int
+
+const (
+	// WriteStallNone means writes go through as they come.
+	WriteStallNone WriteStall = iota
+	// WriteStallSlowdown means every write is delayed.
+	WriteStallSlowdown
+	// WriteStallStop means writes are blocked until the
+	// background work catches up.
+	WriteStallStop
+)
+
+// String returns the name of the write stall state.
+func (ws WriteStall) String() string {
+	switch ws {
+	case WriteStallSlowdown:
+		return "slowdown"
+	case WriteStallStop:
+		return "stop"
+	default:
+		return "none"
+	}
+}
+
+// writeSlowdownDelay is how long every write is delayed
+// while writes are slowed down.
+const writeSlowdownDelay = time.Millisecond
+
+// writeController holds back the writes to a storage
+// once the segments waiting to be compacted, or the
+// bytes they hold, pass the limits of the options.
+type writeController struct {
+	opts Options
+	// cond is signalled whenever background work finishes,
+	// waking the writers blocked on it. Its lock is the
+	// lock of the storage.
+	cond *sync.Cond
+	// scheduler runs the background work of the storage.
+	// Writers blocked on a manual scheduler run its jobs
+	// themselves, as nothing else would.
+	scheduler *scheduler.Scheduler
+	// stalledWrites is the number of writes which were
+	// delayed or blocked.
+	stalledWrites int64
+	// stallDuration is the total time writes were held
+	// back for.
+	stallDuration time.Duration
+}
+
+// newWriteController returns a write controller for a
+// storage guarded by the given lock.
+func newWriteController(l sync.Locker, opts Options) *writeController {
+	return &writeController{
+		opts: opts,
+		cond: sync.NewCond(l),
+	}
+}
+
+// state returns how writes are to be held back given the
+// number of segments waiting to be compacted and the bytes
+// waiting to be compacted.
+func (wc *writeController) state(segments int, pendingBytes int64) WriteStall {
+	hardBytes, softBytes := wc.opts.HardPendingCompactionBytes, wc.opts.SoftPendingCompactionBytes
+	switch {
+	case segments >= wc.opts.hardSegmentLimit(),
+		hardBytes > 0 && pendingBytes >= hardBytes:
+		return WriteStallStop
+	case segments >= wc.opts.softSegmentLimit(),
+		softBytes > 0 && pendingBytes >= softBytes:
+		return WriteStallSlowdown
+	default:
+		return WriteStallNone
+	}
+}
+
+// wait holds back a write according to the state returned
+// by stall, and must be called with the lock of the storage
+// held. The lock is released while the write is held back.
+//
+// A write which is blocked is let through once stall no
+// longer returns WriteStallStop, or fails with the error
+// returned by check, which tells whether the storage can
+// still be written to.
+func (wc *writeController) wait(stall func() WriteStall, check func() error) error {
+	state := stall()
+	if state == WriteStallNone {
+		return nil
+	}
+
+	clock := wc.opts.clock()
+	start := clock.Now()
+	defer func() {
+		wc.stalledWrites++
+		wc.stallDuration += clock.Now().Sub(start)
+	}()
+
+	if state == WriteStallSlowdown {
+		wc.cond.L.Unlock()
+		clock.Sleep(writeSlowdownDelay)
+		wc.cond.L.Lock()
+		return check()
+	}
+
+	for state == WriteStallStop {
+		if !wc.runQueued() {
+			wc.cond.Wait()
+		}
+		err := check()
+		if err != nil {
+			return err
+		}
+		state = stall()
+	}
+	return nil
+}
+
+// runQueued runs the first job queued on a manual
+// scheduler, releasing the lock of the storage meanwhile,
+// and reports whether it did.
+func (wc *writeController) runQueued() bool {
+	if wc.scheduler == nil || !wc.scheduler.Manual() {
+		return false
+	}
+	queued := wc.scheduler.Queued()
+	if len(queued) == 0 {
+		return false
+	}
+
+	wc.cond.L.Unlock()
+	defer wc.cond.L.Lock()
+	return wc.scheduler.Run(queued[0])
+}
+
+// signal wakes the writers blocked on the background work,
+// to check whether they can carry on.
+func (wc *writeController) signal() {
+	wc.cond.Broadcast()
+}
@@ -0,0 +1,28 @@
+package vfs
+
+// Error is a helper type for creating constant errors.
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+const (
+	// ErrIsDir indicates that a directory was opened or
+	// renamed as a file.
+	ErrIsDir Error = "is a directory"
+	// ErrNotDir indicates that a file was used as a
+	// directory.
+	ErrNotDir Error = "not a directory"
+	// ErrDirNotEmpty indicates an attempt to remove a
+	// directory which isn't empty.
+	ErrDirNotEmpty Error = "directory not empty"
+	// ErrBadMode indicates a read from a file opened only
+	// for writing, or a write to a file opened only for
+	// reading.
+	ErrBadMode Error = "the file wasn't opened for this access"
+	// ErrAppendWriteAt indicates a WriteAt to a file opened
+	// with os.O_APPEND, which os.File refuses too.
+	ErrAppendWriteAt Error = "WriteAt on a file opened with O_APPEND"
+	// ErrCrashed indicates an operation on a FaultFS which
+	// crashed, or on a file opened before it crashed.
+	ErrCrashed Error = "the filesystem crashed"
+)
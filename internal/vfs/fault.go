@@ -0,0 +1,480 @@
+package vfs
+
+import (
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/clock"
+)
+
+// Op is an operation of a FaultFS or of its files, which
+// faults can be injected into.
+type Op int
+
+// The operations are named after the methods of FS and
+// File. Reads and writes at an offset are OpRead and
+// OpWrite too.
+const (
+	OpOpen Op = iota
+	OpRead
+	OpWrite
+	OpSync
+	OpClose
+	OpStat
+	OpRemove
+	OpRename
+	OpMkdir
+	OpReadDir
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpOpen:
+		return "open"
+	case OpRead:
+		return "read"
+	case OpWrite:
+		return "write"
+	case OpSync:
+		return "sync"
+	case OpClose:
+		return "close"
+	case OpStat:
+		return "stat"
+	case OpRemove:
+		return "remove"
+	case OpRename:
+		return "rename"
+	case OpMkdir:
+		return "mkdir"
+	case OpReadDir:
+		return "readdir"
+	}
+	return "unknown"
+}
+
+// FaultOptions holds the settings of a FaultFS.
+type FaultOptions struct {
+	// Seed seeds the choices of a FaultFS, such as where
+	// the writes are torn, so that a failing run can be
+	// repeated.
+	Seed int64
+	// TearWrites keeps a random part of what was written
+	// to each file since it was last synced when the FS
+	// crashes, rather than dropping all of it. Whatever
+	// lies before the point a file is torn at is kept and
+	// whatever lies after it is lost, which may cut a
+	// write in the middle.
+	TearWrites bool
+	// Clock is the clock the files are stamped with the
+	// time of.
+	//
+	// A nil value means clock.Real.
+	Clock clock.Clock
+}
+
+// FaultFS implements FS.
+//
+// FaultFS keeps its files in memory like a MemFS, and
+// keeps track of what was synced to each of them, so that
+// it can simulate a crash of the machine with Crash. The
+// data a crash doesn't lose, like the data of a MemFS, is
+// only lost once the FaultFS is dropped, so a store can be
+// opened on it again to check what it recovers.
+//
+// Creating, renaming and removing files are taken to be
+// durable as soon as they return, as though the directories
+// were synced along with them.
+//
+// Any operation can be made to fail with Inject, and the
+// FS can be made to crash at a chosen operation with
+// CrashAfter.
+//
+// FaultFS is safe for concurrent use. Its operations are
+// serialised, so that a crash happens between two of them.
+type FaultFS struct {
+	mem  *MemFS
+	opts FaultOptions
+	// mu guards the fields below it, and is held through
+	// every operation.
+	mu   sync.Mutex
+	rand *rand.Rand
+	// synced hold what was synced to every file which was
+	// synced since it was created, or since the last crash.
+	synced map[*memNode][]byte
+	// epoch is the number of crashes so far. The files
+	// opened before the last crash can't be used anymore.
+	epoch int
+	// crashed is set from a crash until the FS is
+	// restarted.
+	crashed bool
+	// ops is the number of operations so far.
+	ops int64
+	// crashAt is the operation the FS crashes at, or zero.
+	crashAt int64
+	// fault decides whether each operation fails.
+	fault func(op Op, path string) error
+}
+
+var _ (FS) = (*FaultFS)(nil)
+
+// NewFaultFS creates a new, empty instance of FaultFS.
+func NewFaultFS(opts FaultOptions) *FaultFS {
+	return &FaultFS{
+		mem:    NewMemFSWithClock(opts.clock()),
+		opts:   opts,
+		rand:   rand.New(rand.NewSource(opts.Seed)),
+		synced: make(map[*memNode][]byte),
+	}
+}
+
+// clock returns the clock of the options, applying the
+// default.
+func (opts FaultOptions) clock() clock.Clock {
+	if opts.Clock == nil {
+		return clock.Real
+	}
+	return opts.Clock
+}
+
+// Clock returns the clock of the FS.
+func (fs *FaultFS) Clock() clock.Clock {
+	return fs.mem.Clock()
+}
+
+// Inject sets the function deciding whether each
+// operation fails. The operation fails without being
+// done with the error the function returns for it, if
+// any. A nil function stops injecting faults.
+func (fs *FaultFS) Inject(fault func(op Op, path string) error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.fault = fault
+}
+
+// CrashAfter makes the FS crash once n more operations
+// are done, so that the operation after them fails with
+// ErrCrashed. A write which is due to crash the FS is done
+// in part first, if TearWrites is set. A zero n stops the
+// FS from crashing.
+func (fs *FaultFS) CrashAfter(n int64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.crashAt = 0
+	if n > 0 {
+		fs.crashAt = fs.ops + n + 1
+	}
+}
+
+// Crash simulates a crash of the machine. The data written
+// to each file since it was last synced is lost, or torn
+// if TearWrites is set. Every operation then fails with
+// ErrCrashed until the FS is restarted.
+func (fs *FaultFS) Crash() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.crash()
+}
+
+// Crashed reports whether the FS crashed and wasn't
+// restarted since.
+func (fs *FaultFS) Crashed() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.crashed
+}
+
+// Restart lets operations through again after a crash,
+// other than those on files opened before it.
+func (fs *FaultFS) Restart() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.crashed = false
+}
+
+// Ops returns the number of operations done so far.
+func (fs *FaultFS) Ops() int64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.ops
+}
+
+// OpenFile opens the named file. The directory of the file
+// must exist.
+func (fs *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	err := fs.begin(OpOpen, name, fs.epoch)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := fs.mem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{
+		fs:    fs,
+		f:     f.(*memFile),
+		epoch: fs.epoch,
+	}, nil
+}
+
+// Stat describes the named file or directory.
+func (fs *FaultFS) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	err := fs.begin(OpStat, name, fs.epoch)
+	if err != nil {
+		return nil, err
+	}
+	return fs.mem.Stat(name)
+}
+
+// Remove removes the named file or empty directory.
+func (fs *FaultFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	err := fs.begin(OpRemove, name, fs.epoch)
+	if err != nil {
+		return err
+	}
+	return fs.mem.Remove(name)
+}
+
+// Rename moves the file oldpath to newpath, replacing any
+// file at newpath.
+func (fs *FaultFS) Rename(oldpath, newpath string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	err := fs.begin(OpRename, oldpath, fs.epoch)
+	if err != nil {
+		return err
+	}
+	return fs.mem.Rename(oldpath, newpath)
+}
+
+// MkdirAll creates the directory along with any of its
+// parents which don't exist.
+func (fs *FaultFS) MkdirAll(path string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	err := fs.begin(OpMkdir, path, fs.epoch)
+	if err != nil {
+		return err
+	}
+	return fs.mem.MkdirAll(path, perm)
+}
+
+// ReadDir describes the files and directories in the
+// directory, sorted by name.
+func (fs *FaultFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	err := fs.begin(OpReadDir, dirname, fs.epoch)
+	if err != nil {
+		return nil, err
+	}
+	return fs.mem.ReadDir(dirname)
+}
+
+// begin counts an operation on the path by a file opened
+// in the epoch, or by the FS itself, and returns the error
+// it's to fail with, if any. It crashes the FS if the
+// operation is the one to crash at. It must be called with
+// mu held.
+func (fs *FaultFS) begin(op Op, path string, epoch int) error {
+	if fs.crashed || epoch != fs.epoch {
+		return &os.PathError{Op: op.String(), Path: path, Err: ErrCrashed}
+	}
+
+	fs.ops++
+	if fs.ops == fs.crashAt {
+		fs.crash()
+		return &os.PathError{Op: op.String(), Path: path, Err: ErrCrashed}
+	}
+
+	if fs.fault != nil {
+		return fs.fault(op, path)
+	}
+	return nil
+}
+
+// crash crashes the FS and must be called with mu held.
+func (fs *FaultFS) crash() {
+	fs.mem.mu.Lock()
+	defer fs.mem.mu.Unlock()
+
+	// The files are torn in the order of their paths, so
+	// that the same seed tears them the same way.
+	paths := make([]string, 0, len(fs.mem.nodes))
+	for path := range fs.mem.nodes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		node := fs.mem.nodes[path]
+		node.mu.Lock()
+		node.data = fs.survivor(node.data, fs.synced[node])
+		node.mu.Unlock()
+	}
+
+	// Whatever survived is on disk now, and the files
+	// which were removed are gone for good.
+	fs.synced = make(map[*memNode][]byte)
+	for _, node := range fs.mem.nodes {
+		fs.synced[node] = append([]byte(nil), node.data...)
+	}
+
+	fs.crashAt = 0
+	fs.crashed = true
+	fs.epoch++
+}
+
+// survivor returns what's left of a file holding the data
+// after a crash, given what was last synced to it. It must
+// be called with mu held.
+func (fs *FaultFS) survivor(data, synced []byte) []byte {
+	if !fs.opts.TearWrites {
+		return append([]byte(nil), synced...)
+	}
+
+	// The file is torn at a random point, keeping the data
+	// before it and what was synced after it.
+	n := fs.rand.Intn(len(data) + 1)
+	survivor := append([]byte(nil), data[:n]...)
+	if n < len(synced) {
+		survivor = append(survivor, synced[n:]...)
+	}
+	return survivor
+}
+
+// sync records the data of the node as synced and must be
+// called with mu held.
+func (fs *FaultFS) sync(node *memNode) {
+	node.mu.RLock()
+	defer node.mu.RUnlock()
+	fs.synced[node] = append(fs.synced[node][:0], node.data...)
+}
+
+// faultFile is a handle to a file of a FaultFS.
+type faultFile struct {
+	fs *FaultFS
+	f  *memFile
+	// epoch is the epoch of the FS the file was opened in.
+	epoch int
+}
+
+var _ (File) = (*faultFile)(nil)
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	err := f.fs.begin(OpRead, f.f.name, f.epoch)
+	if err != nil {
+		return 0, err
+	}
+	return f.f.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	err := f.fs.begin(OpRead, f.f.name, f.epoch)
+	if err != nil {
+		return 0, err
+	}
+	return f.f.ReadAt(p, off)
+}
+
+// Write writes the data, or a part of it if it's due to
+// crash the FS and TearWrites is set.
+func (f *faultFile) Write(p []byte) (int, error) {
+	return f.write(p, func(p []byte) (int, error) { return f.f.Write(p) })
+}
+
+func (f *faultFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+// WriteAt writes the data at the offset, or a part of it
+// if it's due to crash the FS and TearWrites is set.
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.write(p, func(p []byte) (int, error) { return f.f.WriteAt(p, off) })
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	err := f.fs.begin(OpStat, f.f.name, f.epoch)
+	if err != nil {
+		return nil, err
+	}
+	return f.f.Stat()
+}
+
+// Sync records what was written to the file as synced,
+// so that a crash doesn't lose it.
+func (f *faultFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	err := f.fs.begin(OpSync, f.f.name, f.epoch)
+	if err != nil {
+		return err
+	}
+
+	err = f.f.Sync()
+	if err != nil {
+		return err
+	}
+	f.fs.sync(f.f.node)
+	return nil
+}
+
+// Close closes the handle. A handle opened before a crash
+// is closed without an error, so that what was opened can
+// always be released.
+func (f *faultFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.epoch == f.fs.epoch {
+		err := f.fs.begin(OpClose, f.f.name, f.epoch)
+		if err != nil {
+			return err
+		}
+	}
+	return f.f.Close()
+}
+
+// write writes the data with the write function, doing
+// only a part of it if the write is due to crash the FS
+// and TearWrites is set.
+func (f *faultFile) write(p []byte, write func(p []byte) (int, error)) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	crashing := !f.fs.crashed && f.epoch == f.fs.epoch && f.fs.ops+1 == f.fs.crashAt
+	if crashing && f.fs.opts.TearWrites {
+		write(p[:f.fs.rand.Intn(len(p)+1)])
+	}
+
+	err := f.fs.begin(OpWrite, f.f.name, f.epoch)
+	if err != nil {
+		return 0, err
+	}
+	return write(p)
+}
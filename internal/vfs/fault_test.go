@@ -0,0 +1,153 @@
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeFile creates the file on the FS with the data,
+// syncing the first synced bytes of it.
+func writeFile(t *testing.T, fs FS, name string, data []byte, synced int) File {
+	f, err := fs.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = f.Write(data[:synced])
+	assert.Nil(t, err)
+	assert.Nil(t, f.Sync())
+	_, err = f.Write(data[synced:])
+	assert.Nil(t, err)
+	return f
+}
+
+func TestFaultFS_Crash(t *testing.T) {
+	fs := NewFaultFS(FaultOptions{})
+	f := writeFile(t, fs, "file", []byte("synced, lost"), 6)
+	writeFile(t, fs, "renamed", []byte("synced"), 6)
+	assert.Nil(t, fs.Rename("renamed", "target"))
+	g, err := fs.OpenFile("unsynced", os.O_CREATE|os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = g.Write([]byte("lost"))
+	assert.Nil(t, err)
+
+	fs.Crash()
+	assert.True(t, fs.Crashed())
+	_, err = fs.Stat("file")
+	assert.True(t, errors.Is(err, ErrCrashed))
+
+	fs.Restart()
+	assert.False(t, fs.Crashed())
+	_, err = f.Write([]byte("x"))
+	assert.True(t, errors.Is(err, ErrCrashed))
+	assert.Nil(t, f.Close())
+
+	for name, want := range map[string]string{
+		"file":     "synced",
+		"target":   "synced",
+		"unsynced": "",
+	} {
+		data, err := ReadFile(fs, name)
+		assert.Nil(t, err)
+		assert.Equal(t, want, string(data))
+	}
+}
+
+func TestFaultFS_TearWrites(t *testing.T) {
+	data := []byte("synced, then torn")
+
+	torn := 0
+	for seed := int64(0); seed < 20; seed++ {
+		fs := NewFaultFS(FaultOptions{Seed: seed, TearWrites: true})
+		writeFile(t, fs, "file", data, 6)
+		fs.Crash()
+		fs.Restart()
+
+		survivor, err := ReadFile(fs, "file")
+		assert.Nil(t, err)
+		assert.True(t, bytes.HasPrefix(data, survivor))
+		assert.GreaterOrEqual(t, len(survivor), 6)
+		if len(survivor) > 6 && len(survivor) < len(data) {
+			torn++
+		}
+
+		// A crash keeps what survived the last one.
+		fs.Crash()
+		fs.Restart()
+		again, err := ReadFile(fs, "file")
+		assert.Nil(t, err)
+		assert.Equal(t, survivor, again)
+	}
+	assert.Greater(t, torn, 0)
+}
+
+func TestFaultFS_TearWritesInPlace(t *testing.T) {
+	fs := NewFaultFS(FaultOptions{Seed: 1, TearWrites: true})
+	f, err := fs.OpenFile("file", os.O_CREATE|os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte("aaaaaaaa"), 0)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Sync())
+	_, err = f.WriteAt([]byte("bbbbbbbb"), 0)
+	assert.Nil(t, err)
+
+	fs.Crash()
+	fs.Restart()
+
+	// The file is torn at a point, before which the new
+	// data survived and after which the old one did.
+	data, err := ReadFile(fs, "file")
+	assert.Nil(t, err)
+	n := bytes.IndexByte(append(data, 'a'), 'a')
+	assert.Equal(t, bytes.Repeat([]byte("b"), n), data[:n])
+	assert.Equal(t, bytes.Repeat([]byte("a"), 8-n), data[n:])
+}
+
+func TestFaultFS_CrashAfter(t *testing.T) {
+	fs := NewFaultFS(FaultOptions{})
+	f := writeFile(t, fs, "file", []byte("synced"), 6)
+
+	// The two writes are done and the sync after them
+	// crashes the FS.
+	fs.CrashAfter(2)
+	_, err := f.Write([]byte(" one"))
+	assert.Nil(t, err)
+	_, err = f.Write([]byte(" two"))
+	assert.Nil(t, err)
+	assert.True(t, errors.Is(f.Sync(), ErrCrashed))
+	assert.True(t, fs.Crashed())
+
+	ops := fs.Ops()
+	_, err = f.Write([]byte(" three"))
+	assert.True(t, errors.Is(err, ErrCrashed))
+	assert.Equal(t, ops, fs.Ops())
+
+	fs.Restart()
+	data, err := ReadFile(fs, "file")
+	assert.Nil(t, err)
+	assert.Equal(t, "synced", string(data))
+}
+
+func TestFaultFS_Inject(t *testing.T) {
+	fs := NewFaultFS(FaultOptions{})
+	f := writeFile(t, fs, "file", []byte("synced"), 6)
+
+	errSync := errors.New("sync failed")
+	fs.Inject(func(op Op, path string) error {
+		if op == OpSync && path == "file" {
+			return errSync
+		}
+		return nil
+	})
+	_, err := f.Write([]byte(" lost"))
+	assert.Nil(t, err)
+	assert.Equal(t, errSync, f.Sync())
+
+	fs.Inject(nil)
+	fs.Crash()
+	fs.Restart()
+	data, err := ReadFile(fs, "file")
+	assert.Nil(t, err)
+	assert.Equal(t, "synced", string(data))
+}
@@ -0,0 +1,465 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/clock"
+)
+
+// MemFS implements FS.
+//
+// MemFS keeps its files and directories in memory, so a
+// store on it never touches the disk and its data is gone
+// once the MemFS is dropped. The root directory, and the
+// working directory relative paths start from, always
+// exist.
+//
+// Like on a POSIX filesystem, a file which was opened stays
+// readable and writable through its handle once it's
+// removed or renamed over. Sync does nothing, as there is
+// nothing to commit the data to.
+//
+// The files and directories are stamped with the time of
+// the clock of the MemFS.
+//
+// MemFS is safe for concurrent use.
+type MemFS struct {
+	clock clock.Clock
+	// mu guards nodes and dirs, but not the contents of
+	// the files.
+	mu sync.Mutex
+	// nodes hold the files by their cleaned paths.
+	nodes map[string]*memNode
+	// dirs hold the directories by their cleaned paths,
+	// along with when they were created.
+	dirs map[string]time.Time
+}
+
+var _ (FS) = (*MemFS)(nil)
+
+// NewMemFS creates a new, empty instance of MemFS.
+func NewMemFS() *MemFS {
+	return NewMemFSWithClock(clock.Real)
+}
+
+// NewMemFSWithClock creates a new, empty instance of MemFS
+// whose time is the one of the given clock.
+func NewMemFSWithClock(c clock.Clock) *MemFS {
+	return &MemFS{
+		clock: c,
+		nodes: make(map[string]*memNode),
+		dirs:  make(map[string]time.Time),
+	}
+}
+
+// Clock returns the clock of the MemFS.
+func (fs *MemFS) Clock() clock.Clock {
+	return fs.clock
+}
+
+// memNode is the contents of a file of a MemFS, shared by
+// all the handles to it.
+type memNode struct {
+	mu      sync.RWMutex
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// OpenFile opens the named file. The directory of the file
+// must exist.
+func (fs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	path := filepath.Clean(name)
+	if fs.isDir(path) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: ErrIsDir}
+	}
+
+	node, ok := fs.nodes[path]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !ok:
+		err := fs.checkParent(path)
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		node = &memNode{mode: perm, modTime: fs.clock.Now()}
+		fs.nodes[path] = node
+	}
+
+	f := &memFile{
+		name:  name,
+		node:  node,
+		flag:  flag,
+		clock: fs.clock,
+	}
+	if flag&os.O_TRUNC != 0 && f.writable() {
+		node.mu.Lock()
+		node.data = nil
+		node.modTime = fs.clock.Now()
+		node.mu.Unlock()
+	}
+	return f, nil
+}
+
+// Stat describes the named file or directory.
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	path := filepath.Clean(name)
+	if fs.isDir(path) {
+		return memDirInfo(path, fs.dirs[path]), nil
+	}
+
+	node, ok := fs.nodes[path]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return node.info(filepath.Base(path)), nil
+}
+
+// Remove removes the named file or empty directory.
+func (fs *MemFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	path := filepath.Clean(name)
+	if _, ok := fs.nodes[path]; ok {
+		delete(fs.nodes, path)
+		return nil
+	}
+
+	if _, ok := fs.dirs[path]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if len(fs.children(path)) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: ErrDirNotEmpty}
+	}
+	delete(fs.dirs, path)
+	return nil
+}
+
+// Rename moves the file oldpath to newpath, replacing any
+// file at newpath. Directories can't be renamed.
+func (fs *MemFS) Rename(oldpath, newpath string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	from, to := filepath.Clean(oldpath), filepath.Clean(newpath)
+	node, ok := fs.nodes[from]
+	if !ok {
+		err := error(os.ErrNotExist)
+		if fs.isDir(from) {
+			err = ErrIsDir
+		}
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+
+	if fs.isDir(to) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: ErrIsDir}
+	}
+	err := fs.checkParent(to)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+
+	delete(fs.nodes, from)
+	fs.nodes[to] = node
+	return nil
+}
+
+// MkdirAll creates the directory along with any of its
+// parents which don't exist.
+func (fs *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir := filepath.Clean(path)
+	var missing []string
+	for !fs.isDir(dir) {
+		if _, ok := fs.nodes[dir]; ok {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: ErrNotDir}
+		}
+		missing = append(missing, dir)
+		dir = filepath.Dir(dir)
+	}
+
+	now := fs.clock.Now()
+	for _, dir := range missing {
+		fs.dirs[dir] = now
+	}
+	return nil
+}
+
+// ReadDir describes the files and directories in the
+// directory, sorted by name.
+func (fs *MemFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir := filepath.Clean(dirname)
+	if !fs.isDir(dir) {
+		err := error(os.ErrNotExist)
+		if _, ok := fs.nodes[dir]; ok {
+			err = ErrNotDir
+		}
+		return nil, &os.PathError{Op: "open", Path: dirname, Err: err}
+	}
+
+	infos := fs.children(dir)
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// isDir reports whether the cleaned path is a directory
+// and must be called with mu held.
+func (fs *MemFS) isDir(path string) bool {
+	if isRoot(path) {
+		return true
+	}
+	_, ok := fs.dirs[path]
+	return ok
+}
+
+// checkParent returns an error unless the directory of the
+// cleaned path exists. It must be called with mu held.
+func (fs *MemFS) checkParent(path string) error {
+	dir := filepath.Dir(path)
+	if fs.isDir(dir) {
+		return nil
+	}
+	if _, ok := fs.nodes[dir]; ok {
+		return ErrNotDir
+	}
+	return os.ErrNotExist
+}
+
+// children describes the files and directories right in
+// the cleaned directory and must be called with mu held.
+func (fs *MemFS) children(dir string) []os.FileInfo {
+	var infos []os.FileInfo
+	for path, node := range fs.nodes {
+		if filepath.Dir(path) == dir && !isRoot(path) {
+			infos = append(infos, node.info(filepath.Base(path)))
+		}
+	}
+	for path, created := range fs.dirs {
+		if filepath.Dir(path) == dir && !isRoot(path) {
+			infos = append(infos, memDirInfo(path, created))
+		}
+	}
+	return infos
+}
+
+// isRoot reports whether the cleaned path is the root or
+// the working directory, which always exist.
+func isRoot(path string) bool {
+	return path == "." || filepath.Dir(path) == path
+}
+
+// info describes the node as the file of the name.
+func (n *memNode) info(name string) os.FileInfo {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	return &memFileInfo{
+		name:    name,
+		size:    int64(len(n.data)),
+		mode:    n.mode,
+		modTime: n.modTime,
+	}
+}
+
+// memDirInfo describes the directory of the cleaned path.
+func memDirInfo(path string, created time.Time) os.FileInfo {
+	return &memFileInfo{
+		name:    filepath.Base(path),
+		mode:    os.ModeDir | 0755,
+		modTime: created,
+	}
+}
+
+// memFile is a handle to a file of a MemFS.
+type memFile struct {
+	name  string
+	node  *memNode
+	flag  int
+	clock clock.Clock
+	// mu guards the fields below it.
+	mu sync.Mutex
+	// offset is where the next Read or Write of the
+	// handle starts.
+	offset int64
+	closed bool
+}
+
+var _ (File) = (*memFile)(nil)
+
+// Read reads from the offset of the handle.
+func (f *memFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.readAt("read", p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// ReadAt reads from the offset, returning io.EOF if it
+// reads less than len(p) bytes.
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.readAt("read", p, off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Write writes at the offset of the handle, or at the end
+// of the file if it was opened with os.O_APPEND.
+func (f *memFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	off := f.offset
+	if f.flag&os.O_APPEND != 0 {
+		f.node.mu.RLock()
+		off = int64(len(f.node.data))
+		f.node.mu.RUnlock()
+	}
+
+	n, err := f.writeAt("write", p, off)
+	f.offset = off + int64(n)
+	return n, err
+}
+
+// WriteString writes the string like Write does.
+func (f *memFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+// WriteAt writes at the offset, filling any gap past the
+// end of the file with zeroes.
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.flag&os.O_APPEND != 0 {
+		return 0, &os.PathError{Op: "writeat", Path: f.name, Err: ErrAppendWriteAt}
+	}
+	return f.writeAt("writeat", p, off)
+}
+
+// Stat describes the file.
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil, &os.PathError{Op: "stat", Path: f.name, Err: os.ErrClosed}
+	}
+	return f.node.info(filepath.Base(f.name)), nil
+}
+
+// Sync does nothing but check that the handle is open.
+func (f *memFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return &os.PathError{Op: "sync", Path: f.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+// Close closes the handle.
+func (f *memFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+// readAt reads from the offset and must be called with mu
+// held. It returns io.EOF only if it reads nothing.
+func (f *memFile) readAt(op string, p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == os.O_WRONLY {
+		return 0, &os.PathError{Op: op, Path: f.name, Err: ErrBadMode}
+	}
+
+	f.node.mu.RLock()
+	defer f.node.mu.RUnlock()
+
+	if off >= int64(len(f.node.data)) {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	return copy(p, f.node.data[off:]), nil
+}
+
+// writeAt writes at the offset and must be called with mu
+// held.
+func (f *memFile) writeAt(op string, p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	if !f.writable() {
+		return 0, &os.PathError{Op: op, Path: f.name, Err: ErrBadMode}
+	}
+
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	if end := off + int64(len(p)); end > int64(len(f.node.data)) {
+		data := make([]byte, end, end+end/4)
+		copy(data, f.node.data)
+		f.node.data = data
+	}
+	copy(f.node.data[off:], p)
+	f.node.modTime = f.clock.Now()
+	return len(p), nil
+}
+
+// writable reports whether the handle was opened for
+// writing.
+func (f *memFile) writable() bool {
+	return f.flag&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+// memFileInfo describes a file or directory of a MemFS.
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,81 @@
+package vfs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/SystemBuilders/KeyValueStore/internal/clock"
+)
+
+// FS is a filesystem which the storage engines do all their
+// file I/O through, so that they can run on disk, in memory
+// or on a filesystem which injects faults.
+//
+// The methods behave like the functions of package os of
+// the same names, and errors about paths are returned as
+// *os.PathError, so os.IsNotExist and os.IsExist can be
+// used with any FS.
+type FS interface {
+	// OpenFile opens the named file with the flags of
+	// os.OpenFile, creating it with the permissions if
+	// os.O_CREATE is set.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	// Stat describes the named file or directory.
+	Stat(name string) (os.FileInfo, error)
+	// Remove removes the named file or empty directory.
+	Remove(name string) error
+	// Rename moves the file oldpath to newpath, replacing
+	// any file at newpath.
+	Rename(oldpath, newpath string) error
+	// MkdirAll creates the directory along with any of its
+	// parents which don't exist.
+	MkdirAll(path string, perm os.FileMode) error
+	// ReadDir describes the files and directories in the
+	// directory, sorted by name.
+	ReadDir(dirname string) ([]os.FileInfo, error)
+}
+
+// File is a file opened on an FS.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.StringWriter
+	io.Closer
+	// Stat describes the file.
+	Stat() (os.FileInfo, error)
+	// Sync commits what was written to the file to the
+	// storage backing the FS.
+	Sync() error
+}
+
+// ClockOf returns the clock of the filesystem, which it
+// stamps its files with the time of: the one it was given
+// for a MemFS or a FaultFS and clock.Real otherwise.
+//
+// Whatever is named after the time it's created at on the
+// filesystem takes the time from its clock, so that it's
+// named the same way in every run of a simulation.
+func ClockOf(fs FS) clock.Clock {
+	if fs, ok := fs.(interface{ Clock() clock.Clock }); ok {
+		return fs.Clock()
+	}
+	return clock.Real
+}
+
+// Open opens the named file for reading.
+func Open(fs FS, name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// ReadFile returns the contents of the named file.
+func ReadFile(fs FS, name string) ([]byte, error) {
+	f, err := Open(fs, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
@@ -0,0 +1,191 @@
+package vfs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// forEachFS runs the test on the OS, in a temporary
+// directory, and on a MemFS, so that MemFS is checked to
+// behave like the OS.
+func forEachFS(t *testing.T, test func(t *testing.T, fs FS, dir string)) {
+	t.Run("os", func(t *testing.T) { test(t, OS, t.TempDir()) })
+	t.Run("mem", func(t *testing.T) {
+		fs := NewMemFS()
+		assert.Nil(t, fs.MkdirAll("/data", 0755))
+		test(t, fs, "/data")
+	})
+}
+
+// names returns the names of the files described.
+func names(infos []os.FileInfo) []string {
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names
+}
+
+func TestFS_ReadAndWrite(t *testing.T) {
+	forEachFS(t, func(t *testing.T, fs FS, dir string) {
+		path := filepath.Join(dir, "file")
+		_, err := Open(fs, path)
+		assert.True(t, os.IsNotExist(err))
+
+		f, err := fs.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+		assert.Nil(t, err)
+		_, err = f.WriteString("hello world")
+		assert.Nil(t, err)
+		_, err = f.WriteAt([]byte("W"), 6)
+		assert.Nil(t, err)
+
+		b := make([]byte, 5)
+		n, err := f.ReadAt(b, 6)
+		assert.Nil(t, err)
+		assert.Equal(t, "World", string(b[:n]))
+		n, err = f.ReadAt(b, 8)
+		assert.Equal(t, io.EOF, err)
+		assert.Equal(t, "rld", string(b[:n]))
+
+		info, err := f.Stat()
+		assert.Nil(t, err)
+		assert.Equal(t, int64(11), info.Size())
+		assert.Equal(t, "file", info.Name())
+		assert.Nil(t, f.Sync())
+		assert.Nil(t, f.Close())
+		_, err = f.Write([]byte("x"))
+		assert.NotNil(t, err)
+
+		// Appends always go to the end of the file.
+		f, err = fs.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+		assert.Nil(t, err)
+		_, err = f.Write([]byte("!"))
+		assert.Nil(t, err)
+		_, err = f.WriteAt([]byte("!"), 0)
+		assert.NotNil(t, err)
+		_, err = f.Read(b)
+		assert.NotNil(t, err)
+		assert.Nil(t, f.Close())
+
+		data, err := ReadFile(fs, path)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello World!", string(data))
+
+		f, err = fs.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		assert.True(t, os.IsExist(err))
+
+		f, err = fs.OpenFile(path, os.O_TRUNC|os.O_WRONLY, 0644)
+		assert.Nil(t, err)
+		_, err = f.WriteAt([]byte("abc"), 2)
+		assert.Nil(t, err)
+		assert.Nil(t, f.Close())
+
+		data, err = ReadFile(fs, path)
+		assert.Nil(t, err)
+		assert.Equal(t, "\x00\x00abc", string(data))
+	})
+}
+
+func TestFS_Directories(t *testing.T) {
+	forEachFS(t, func(t *testing.T, fs FS, dir string) {
+		sub := filepath.Join(dir, "a", "b")
+		_, err := fs.OpenFile(filepath.Join(sub, "file"), os.O_CREATE|os.O_RDWR, 0644)
+		assert.True(t, os.IsNotExist(err))
+
+		assert.Nil(t, fs.MkdirAll(sub, 0755))
+		assert.Nil(t, fs.MkdirAll(sub, 0755))
+		for _, name := range []string{"2", "1"} {
+			f, err := fs.OpenFile(filepath.Join(sub, name), os.O_CREATE|os.O_RDWR, 0644)
+			assert.Nil(t, err)
+			assert.Nil(t, f.Close())
+		}
+
+		infos, err := fs.ReadDir(sub)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"1", "2"}, names(infos))
+		infos, err = fs.ReadDir(dir)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"a"}, names(infos))
+		assert.True(t, infos[0].IsDir())
+
+		info, err := fs.Stat(sub)
+		assert.Nil(t, err)
+		assert.True(t, info.IsDir())
+		_, err = fs.OpenFile(sub, os.O_RDWR, 0644)
+		assert.NotNil(t, err)
+		_, err = fs.ReadDir(filepath.Join(sub, "1"))
+		assert.NotNil(t, err)
+		assert.NotNil(t, fs.MkdirAll(filepath.Join(sub, "1", "c"), 0755))
+
+		assert.NotNil(t, fs.Remove(sub))
+		assert.Nil(t, fs.Remove(filepath.Join(sub, "1")))
+		assert.Nil(t, fs.Remove(filepath.Join(sub, "2")))
+		assert.Nil(t, fs.Remove(sub))
+		assert.True(t, os.IsNotExist(fs.Remove(sub)))
+		_, err = fs.Stat(sub)
+		assert.True(t, os.IsNotExist(err))
+	})
+}
+
+func TestFS_RenameAndRemoveOpenFiles(t *testing.T) {
+	forEachFS(t, func(t *testing.T, fs FS, dir string) {
+		oldPath, newPath := filepath.Join(dir, "old"), filepath.Join(dir, "new")
+		old, err := fs.OpenFile(oldPath, os.O_CREATE|os.O_RDWR, 0644)
+		assert.Nil(t, err)
+		defer old.Close()
+		_, err = old.WriteString("old")
+		assert.Nil(t, err)
+
+		f, err := fs.OpenFile(newPath, os.O_CREATE|os.O_RDWR, 0644)
+		assert.Nil(t, err)
+		_, err = f.WriteString("new")
+		assert.Nil(t, err)
+		assert.Nil(t, f.Close())
+
+		// The file renamed over stays readable through its
+		// handle, and so does a removed one.
+		assert.Nil(t, fs.Rename(newPath, oldPath))
+		_, err = fs.Stat(newPath)
+		assert.True(t, os.IsNotExist(err))
+		data, err := ReadFile(fs, oldPath)
+		assert.Nil(t, err)
+		assert.Equal(t, "new", string(data))
+
+		data, err = ioutil.ReadAll(io.NewSectionReader(old, 0, 3))
+		assert.Nil(t, err)
+		assert.Equal(t, "old", string(data))
+
+		assert.Nil(t, fs.Remove(oldPath))
+		_, err = old.WriteAt([]byte("O"), 0)
+		assert.Nil(t, err)
+		data, err = ioutil.ReadAll(io.NewSectionReader(old, 0, 3))
+		assert.Nil(t, err)
+		assert.Equal(t, "Old", string(data))
+
+		assert.True(t, os.IsNotExist(fs.Rename(oldPath, newPath)))
+		assert.True(t, os.IsNotExist(fs.Remove(oldPath)))
+	})
+}
+
+func TestMemFS_WorkingDirectory(t *testing.T) {
+	fs := NewMemFS()
+
+	f, err := fs.OpenFile("file", os.O_CREATE|os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	assert.Nil(t, fs.MkdirAll("dir", 0755))
+
+	infos, err := fs.ReadDir("")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"dir", "file"}, names(infos))
+
+	// The working directory is apart from the root.
+	infos, err = fs.ReadDir("/")
+	assert.Nil(t, err)
+	assert.Empty(t, infos)
+}